@@ -1,81 +1,621 @@
 /*
- * Detect scanned PDF files by looking through the object types and determining whether it is likely to be a scanned file.
+ * Detect scanned PDF files and find the pages that need OCR.
  *
- * Run as: go run pdf_detect_scanned.go input.pdf
+ * Each page is classified by combining the text that the extractor finds with what is drawn on it:
+ *  - text:      The page has visible text that extracts to readable characters.
+ *  - ocr-layer: The page's only text is invisible (rendering mode 3 or 7). This is typically the text
+ *               layer that an OCR tool added over a scanned image.
+ *  - garbage:   The page has visible text that doesn't extract to readable characters, e.g. it uses
+ *               fonts that have no ToUnicode map or it extracts to private use codepoints.
+ *  - image:     The page is mostly covered by images and has only a little visible text, e.g. a scan
+ *               with a page number or Bates stamp added. In files with fewer than two font objects
+ *               (the document-level check that this example originally made) any amount of visible
+ *               text is allowed, as the only font is likely to be the stamp's.
+ *  - none:      The page has no text.
+ * Pages that are garbage or image, or that are none and have images, need OCR.
+ *
+ * A file is reported as scanned if every page that isn't blank needs OCR or has an OCR layer, or if
+ * it has fewer than two font objects.
+ *
+ * Run as: go run pdf_detect_scanned.go [-json] [-l] input1.pdf input2.pdf ...
  */
 
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
 	"os"
+	"strings"
+	"unicode"
 
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/contentstream"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/extractor"
 	pdf "github.com/unidoc/unipdf/v3/model"
 )
 
+const usage = `Usage: go run pdf_detect_scanned.go [-json] [-l] input1.pdf input2.pdf ...
+
+Classifies the pages of the input files by whether they have extractable text and reports the pages that
+need OCR. With -l only the pages that need OCR are listed.
+`
+
+// Page classes.
+const (
+	classText     = "text"
+	classOCRLayer = "ocr-layer"
+	classGarbage  = "garbage"
+	classImage    = "image"
+	classNone     = "none"
+)
+
+// Classification thresholds.
+const (
+	// visibleFraction is the fraction of glyphs that must be visible for a page to have visible text.
+	visibleFraction = 0.05
+	// maxBadFraction is the largest fraction of unreadable characters in readable text.
+	maxBadFraction = 0.3
+	// maxUnmappedFraction is the largest fraction of visible glyphs in fonts that can't be mapped to
+	// Unicode in readable text.
+	maxUnmappedFraction = 0.5
+	// minImageCoverage is the fraction of a page that images must cover for the page to be an image
+	// with a little text on it.
+	minImageCoverage = 0.5
+	// maxStampGlyphs is the largest number of visible glyphs on such a page, enough for stamps like
+	// page numbers and Bates numbers.
+	maxStampGlyphs = 100
+	// minFontObjects is the number of font objects below which a file is scanned.
+	minFontObjects = 2
+)
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("Syntax: go run pdf_detect_scanned.go input1.pdf input2.pdf ...\n")
+	var asJSON, listOnly, debug bool
+	flag.BoolVar(&asJSON, "json", false, "Output the report as JSON.")
+	flag.BoolVar(&listOnly, "l", false, "Only list the pages that need OCR.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
 	// Enable debug-level logging.
-	//unicommon.SetLogger(unicommon.NewConsoleLogger(unicommon.LogLevelDebug))
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	}
+
+	var reports []fileReport
+	for _, inputPath := range args {
+		report, err := detectScanned(inputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", inputPath, err)
+			continue
+		}
+		reports = append(reports, report)
+	}
 
-	for _, inputPath := range os.Args[1:] {
-		err := detectScanned(inputPath)
+	if asJSON {
+		b, err := json.MarshalIndent(reports, "", "  ")
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	for _, report := range reports {
+		if listOnly {
+			fmt.Printf("%s: %s\n", report.File, pageList(report.OCRPages))
+			continue
 		}
+		printReport(report)
 	}
 }
 
-func detectScanned(inputPath string) error {
+// fileReport is the OCR report for a PDF file.
+type fileReport struct {
+	File     string       `json:"file"`
+	NumPages int          `json:"num_pages"`
+	Scanned  bool         `json:"scanned"`      // See the description of scanned files above.
+	Fonts    int          `json:"font_objects"` // Number of font objects in the file.
+	OCRPages []int        `json:"ocr_pages"`    // Pages that need OCR.
+	Pages    []pageReport `json:"pages"`
+}
+
+// pageReport is the OCR report for a page.
+type pageReport struct {
+	Page            int     `json:"page"`
+	Class           string  `json:"class"`
+	NeedsOCR        bool    `json:"needs_ocr"`
+	Reason          string  `json:"reason"`
+	VisibleGlyphs   int     `json:"visible_glyphs"`
+	InvisibleGlyphs int     `json:"invisible_glyphs"`
+	UnmappedGlyphs  int     `json:"unmapped_glyphs"` // Visible glyphs in fonts that can't be mapped to Unicode.
+	BadChars        float64 `json:"bad_chars"`       // Fraction of extracted characters that are unreadable.
+	Images          int     `json:"images"`
+	ImageCoverage   float64 `json:"image_coverage"` // Fraction of the page covered by images.
+}
+
+// printReport prints `report` as text.
+func printReport(report fileReport) {
+	status := "not scanned (has text)"
+	if report.Scanned {
+		status = "SCANNED!"
+	}
+	fmt.Printf("%s (%d pages, %d fonts) - %s\n", report.File, report.NumPages, report.Fonts, status)
+	for _, p := range report.Pages {
+		ocr := ""
+		if p.NeedsOCR {
+			ocr = " OCR"
+		}
+		fmt.Printf("  Page %d: %-9s%-4s glyphs=%d invisible=%d unmapped=%d bad=%.2f images=%d coverage=%.2f - %s\n",
+			p.Page, p.Class, ocr, p.VisibleGlyphs, p.InvisibleGlyphs, p.UnmappedGlyphs, p.BadChars, p.Images,
+			p.ImageCoverage, p.Reason)
+	}
+	if len(report.OCRPages) == 0 {
+		fmt.Printf("  No pages need OCR.\n")
+	} else {
+		fmt.Printf("  OCR needed on pages %s (%d of %d).\n", pageList(report.OCRPages), len(report.OCRPages),
+			report.NumPages)
+	}
+}
+
+func detectScanned(inputPath string) (fileReport, error) {
+	report := fileReport{File: inputPath, OCRPages: []int{}}
 	f, err := os.Open(inputPath)
 	if err != nil {
-		return err
+		return report, err
 	}
 
 	defer f.Close()
 
 	pdfReader, err := pdf.NewPdfReader(f)
 	if err != nil {
-		return err
+		return report, err
 	}
 
 	isEncrypted, err := pdfReader.IsEncrypted()
 	if err != nil {
-		return err
+		return report, err
 	}
 
 	if isEncrypted {
 		// Decrypt if needed.  Put your password in the empty string below.
 		auth, err := pdfReader.Decrypt([]byte(""))
 		if err != nil {
-			return err
+			return report, err
 		}
 		if !auth {
-			fmt.Printf("%s - Unable to access (encrypted)\n", inputPath)
-			return nil
+			return report, errors.New("unable to access (encrypted)")
 		}
 	}
 
 	numPages, err := pdfReader.GetNumPages()
 	if err != nil {
-		return err
+		return report, err
 	}
-	fmt.Printf("%s (%d pages) - ", inputPath, numPages)
+	report.NumPages = numPages
+
 	objTypes, err := pdfReader.Inspect()
+	if err != nil {
+		return report, err
+	}
+	report.Fonts = objTypes["Font"]
+
+	scanned, blank := true, 0
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return report, err
+		}
+		pr, err := classifyPage(page, report.Fonts < minFontObjects)
+		if err != nil {
+			return report, fmt.Errorf("classifyPage failed. pageNum=%d err=%v", pageNum, err)
+		}
+		pr.Page = pageNum
+		report.Pages = append(report.Pages, pr)
+		if pr.NeedsOCR {
+			report.OCRPages = append(report.OCRPages, pageNum)
+		}
+		switch {
+		case pr.Class == classNone && pr.Images == 0:
+			blank++
+		case pr.Class == classText:
+			scanned = false
+		}
+	}
+	report.Scanned = (scanned && blank < numPages) || report.Fonts < minFontObjects
+	return report, nil
+}
+
+// classifyPage returns the OCR report for `page`. `fewFonts` is true if the file has fewer than
+// minFontObjects font objects.
+func classifyPage(page *pdf.PdfPage, fewFonts bool) (pageReport, error) {
+	var pr pageReport
+
+	mbox, err := page.GetMediaBox()
+	if err != nil {
+		return pr, err
+	}
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return pr, err
+	}
+	pw := pageWalker{fonts: map[core.PdfObject]fontInfo{}}
+	if err := pw.walk(contents, page.Resources, identityMatrix(), 0); err != nil {
+		return pr, err
+	}
+	pr.VisibleGlyphs = pw.visible
+	pr.InvisibleGlyphs = pw.invisible
+	pr.UnmappedGlyphs = pw.unmapped
+	pr.Images = len(pw.images)
+	pr.ImageCoverage = math.Round(imageCoverage(pw.images, *mbox)*100) / 100
+
+	ex, err := extractor.New(page)
+	if err != nil {
+		return pr, err
+	}
+	text, err := ex.ExtractText()
+	if err != nil {
+		return pr, err
+	}
+	pr.BadChars = math.Round(badFraction(text)*100) / 100
+
+	total := pw.visible + pw.invisible
+	unmapped := 0.0
+	if pw.visible > 0 {
+		unmapped = float64(pw.unmapped) / float64(pw.visible)
+	}
+	switch {
+	case total == 0:
+		pr.Class = classNone
+		pr.NeedsOCR = pr.Images > 0
+		if pr.NeedsOCR {
+			pr.Reason = "images and no text"
+		} else {
+			pr.Reason = "blank page"
+		}
+	case float64(pw.visible) < visibleFraction*float64(total):
+		pr.Class = classOCRLayer
+		pr.Reason = "only invisible text"
+	case unmapped > maxUnmappedFraction:
+		pr.Class = classGarbage
+		pr.NeedsOCR = true
+		pr.Reason = "fonts without ToUnicode maps"
+	case pr.BadChars > maxBadFraction:
+		pr.Class = classGarbage
+		pr.NeedsOCR = true
+		pr.Reason = "unreadable extracted characters"
+	case pr.ImageCoverage > minImageCoverage && (pw.visible <= maxStampGlyphs || fewFonts):
+		pr.Class = classImage
+		pr.NeedsOCR = true
+		pr.Reason = "mostly images with little text"
+	default:
+		pr.Class = classText
+		pr.Reason = "extractable text"
+	}
+	return pr, nil
+}
+
+// badFraction returns the fraction of the characters in `text`, ignoring whitespace, that are
+// unreadable: private use codepoints, replacement characters, control characters and unassigned
+// codepoints.
+func badFraction(text string) float64 {
+	total, bad := 0, 0
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		total++
+		switch {
+		case r == unicode.ReplacementChar,
+			unicode.Is(unicode.Co, r),
+			unicode.IsControl(r),
+			!unicode.IsPrint(r) && !unicode.Is(unicode.Cf, r):
+			bad++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total)
+}
+
+// imageCoverage returns the fraction of `mbox` that is covered by images with bounding boxes `images`.
+// Overlapping images are counted once by measuring coverage on a grid.
+func imageCoverage(images []pdf.PdfRectangle, mbox pdf.PdfRectangle) float64 {
+	const n = 50
+	w, h := mbox.Urx-mbox.Llx, mbox.Ury-mbox.Lly
+	if len(images) == 0 || w <= 0 || h <= 0 {
+		return 0
+	}
+	covered := 0
+	for i := 0; i < n; i++ {
+		x := mbox.Llx + (float64(i)+0.5)*w/n
+		for j := 0; j < n; j++ {
+			y := mbox.Lly + (float64(j)+0.5)*h/n
+			for _, r := range images {
+				if r.Llx <= x && x <= r.Urx && r.Lly <= y && y <= r.Ury {
+					covered++
+					break
+				}
+			}
+		}
+	}
+	return float64(covered) / float64(n*n)
+}
+
+// fontInfo describes a font used on a page.
+type fontInfo struct {
+	font     *pdf.PdfFont
+	unmapped bool // True if the font's character codes can't be mapped to Unicode.
+}
+
+// pageWalker counts the glyphs and images drawn by content streams.
+type pageWalker struct {
+	fonts     map[core.PdfObject]fontInfo
+	visible   int
+	invisible int
+	unmapped  int
+	images    []pdf.PdfRectangle
+}
+
+// maxFormDepth is the maximum depth of form XObjects that pageWalker descends into.
+const maxFormDepth = 10
+
+// walk counts the glyphs and images in content stream `contents` with resources `resources`.
+// `ctm` transforms the content stream's coordinates to page coordinates.
+func (pw *pageWalker) walk(contents string, resources *pdf.PdfPageResources, ctm matrix, level int) error {
+	ops, err := contentstream.NewContentStreamParser(contents).Parse()
 	if err != nil {
 		return err
 	}
 
-	fontObjs, ok := objTypes["Font"]
-	if !ok || fontObjs < 2 {
-		fmt.Printf("SCANNED!\n")
+	// The rendering mode and font are part of the graphics state so they are saved by q and restored
+	// by Q.
+	type textState struct {
+		font       fontInfo
+		renderMode int
+	}
+	var ts textState
+	var stack []textState
+
+	processor := contentstream.NewContentStreamProcessor(*ops)
+	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
+		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState,
+			resources *pdf.PdfPageResources) error {
+			switch op.Operand {
+			case "q":
+				stack = append(stack, ts)
+			case "Q":
+				if len(stack) > 0 {
+					ts = stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+				}
+			case "Tf":
+				if len(op.Params) == 2 {
+					name, _ := core.GetNameVal(op.Params[0])
+					ts.font = pw.getFont(resources, name)
+				}
+			case "Tr":
+				if len(op.Params) == 1 {
+					if mode, err := core.GetNumberAsFloat(op.Params[0]); err == nil {
+						ts.renderMode = int(mode)
+					}
+				}
+			case "Tj", "TJ", "'", `"`:
+				if len(op.Params) == 0 {
+					return nil
+				}
+				n := countGlyphs(ts.font.font, op.Params[len(op.Params)-1])
+				if ts.renderMode == 3 || ts.renderMode == 7 {
+					pw.invisible += n
+				} else {
+					pw.visible += n
+					if ts.font.unmapped {
+						pw.unmapped += n
+					}
+				}
+			case "BI":
+				pw.addImage(gsMatrix(gs).mult(ctm))
+			case "Do":
+				if len(op.Params) != 1 || resources == nil {
+					return nil
+				}
+				name, ok := core.GetName(op.Params[0])
+				if !ok {
+					return nil
+				}
+				_, xtype := resources.GetXObjectByName(*name)
+				switch xtype {
+				case pdf.XObjectTypeImage:
+					pw.addImage(gsMatrix(gs).mult(ctm))
+				case pdf.XObjectTypeForm:
+					if level >= maxFormDepth {
+						return nil
+					}
+					xform, err := resources.GetXObjectFormByName(*name)
+					if err != nil {
+						return err
+					}
+					content, err := xform.GetContentStream()
+					if err != nil {
+						return err
+					}
+					formCtm := gsMatrix(gs).mult(ctm)
+					if arr, ok := core.GetArray(xform.Matrix); ok {
+						if vals, err := arr.ToFloat64Array(); err == nil && len(vals) == 6 {
+							formCtm = newMatrix(vals).mult(formCtm)
+						}
+					}
+					formResources := xform.Resources
+					if formResources == nil {
+						formResources = resources
+					}
+					return pw.walk(string(content), formResources, formCtm, level+1)
+				}
+			}
+			return nil
+		})
+	return processor.Process(resources)
+}
+
+// addImage records an image drawn with transformation matrix `m`. Images are drawn in the unit square.
+func (pw *pageWalker) addImage(m matrix) {
+	r := pdf.PdfRectangle{Llx: math.Inf(1), Lly: math.Inf(1), Urx: math.Inf(-1), Ury: math.Inf(-1)}
+	for _, corner := range [][2]float64{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		x, y := m.transform(corner[0], corner[1])
+		r.Llx, r.Lly = math.Min(r.Llx, x), math.Min(r.Lly, y)
+		r.Urx, r.Ury = math.Max(r.Urx, x), math.Max(r.Ury, y)
+	}
+	pw.images = append(pw.images, r)
+}
+
+// getFont returns the font named `name` in `resources`.
+func (pw *pageWalker) getFont(resources *pdf.PdfPageResources, name string) fontInfo {
+	if resources == nil {
+		return fontInfo{}
+	}
+	obj, ok := resources.GetFontByName(core.PdfObjectName(name))
+	if !ok {
+		return fontInfo{}
+	}
+	if info, ok := pw.fonts[obj]; ok {
+		return info
+	}
+	info := fontInfo{unmapped: isUnmappedFont(obj)}
+	if font, err := pdf.NewPdfFontFromPdfObject(obj); err == nil {
+		info.font = font
+	} else {
+		common.Log.Debug("NewPdfFontFromPdfObject failed. name=%q err=%v", name, err)
+	}
+	pw.fonts[obj] = info
+	return info
+}
+
+// isUnmappedFont returns true if the character codes of font dictionary `obj` can't be mapped to
+// Unicode. These are fonts without a ToUnicode map that are composite, Type3, or symbolic TrueType
+// fonts without an encoding.
+func isUnmappedFont(obj core.PdfObject) bool {
+	dict, ok := core.GetDict(obj)
+	if !ok {
+		return false
+	}
+	if dict.Get("ToUnicode") != nil {
+		return false
+	}
+	subtype, _ := core.GetNameVal(dict.Get("Subtype"))
+	switch subtype {
+	case "Type0", "Type3":
+		return true
+	case "TrueType":
+		if dict.Get("Encoding") != nil {
+			return false
+		}
+		descriptor, ok := core.GetDict(dict.Get("FontDescriptor"))
+		if !ok {
+			return false
+		}
+		flags, _ := core.GetNumberAsInt64(descriptor.Get("Flags"))
+		const symbolic = 1 << 2
+		return flags&symbolic != 0
+	}
+	return false
+}
+
+// countGlyphs returns the number of glyphs in `shown`, the operand of a text showing operator, in
+// `font`.
+func countGlyphs(font *pdf.PdfFont, shown core.PdfObject) int {
+	var elements []core.PdfObject
+	if arr, ok := core.GetArray(shown); ok {
+		elements = arr.Elements()
 	} else {
-		fmt.Printf("not scanned (has text objects)\n")
+		elements = []core.PdfObject{shown}
+	}
+	n := 0
+	for _, el := range elements {
+		strobj, ok := core.GetString(el)
+		if !ok {
+			continue
+		}
+		if font == nil {
+			n += len(strobj.Bytes())
+		} else {
+			n += len(font.BytesToCharcodes(strobj.Bytes()))
+		}
+	}
+	return n
+}
+
+// pageList returns `pages` as a list of page ranges e.g. "1-3,5".
+func pageList(pages []int) string {
+	var parts []string
+	for i := 0; i < len(pages); {
+		j := i
+		for j+1 < len(pages) && pages[j+1] == pages[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", pages[i], pages[j]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d", pages[i]))
+		}
+		i = j + 1
 	}
+	return strings.Join(parts, ",")
+}
+
+// gsMatrix returns the current transformation matrix of `gs`, which maps the image's unit square
+// to the page.
+func gsMatrix(gs contentstream.GraphicsState) matrix {
+	ctm := gs.CTM
+	return matrix{ctm[0], ctm[1], ctm[3], ctm[4], ctm[6], ctm[7]}
+}
 
-	return nil
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+// identityMatrix returns the identity matrix.
+func identityMatrix() matrix {
+	return matrix{1, 0, 0, 1, 0, 0}
+}
+
+// newMatrix returns the matrix with elements `vals`.
+func newMatrix(vals []float64) matrix {
+	var m matrix
+	copy(m[:], vals)
+	return m
+}
+
+// mult returns `m` × `o`, the transform that applies `m` then `o`.
+func (m matrix) mult(o matrix) matrix {
+	return matrix{
+		m[0]*o[0] + m[1]*o[2],
+		m[0]*o[1] + m[1]*o[3],
+		m[2]*o[0] + m[3]*o[2],
+		m[2]*o[1] + m[3]*o[3],
+		m[4]*o[0] + m[5]*o[2] + o[4],
+		m[4]*o[1] + m[5]*o[3] + o[5],
+	}
+}
+
+// transform returns point (`x`, `y`) transformed by `m`.
+func (m matrix) transform(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
 }
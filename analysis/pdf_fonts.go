@@ -0,0 +1,496 @@
+/*
+ * List the fonts in PDF files and check that they are embedded.
+ *
+ * The font resources of every page are walked, including the resources of nested form XObjects,
+ * tiling patterns, Type3 fonts and annotation appearance streams. For each font the base name,
+ * subtype, whether it is embedded, the subset prefix, the encoding, whether it has a ToUnicode map
+ * and the pages it is used on are listed.
+ *
+ * Fonts that are not embedded and fonts without a ToUnicode map are flagged. The exit status is 2 if
+ * any of the files has a font that is not embedded, so the command can be used to check files in bulk.
+ *
+ * Run as: go run pdf_fonts.go [-json] [-flagged] input1.pdf input2.pdf ...
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/core"
+	pdf "github.com/unidoc/unipdf/v3/model"
+)
+
+const usage = `Usage: go run pdf_fonts.go [-json] [-flagged] input1.pdf input2.pdf ...
+
+Lists the fonts in the input files and flags fonts that are not embedded or have no ToUnicode map.
+Exits with status 2 if any font is not embedded.
+`
+
+// Font flags.
+const (
+	flagNotEmbedded = "not embedded"
+	flagNoToUnicode = "no ToUnicode"
+)
+
+// subsetRegex matches the tag that starts the names of subset fonts e.g. "ABCDEF+".
+var subsetRegex = regexp.MustCompile(`^([A-Z]{6})\+`)
+
+func main() {
+	var asJSON, flaggedOnly, debug bool
+	flag.BoolVar(&asJSON, "json", false, "Output the report as JSON.")
+	flag.BoolVar(&flaggedOnly, "flagged", false, "Only list fonts that are flagged.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Enable debug-level logging.
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	}
+
+	var reports []fileReport
+	failed, notEmbedded := false, false
+	for _, inputPath := range args {
+		report, err := listFonts(inputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", inputPath, err)
+			failed = true
+			continue
+		}
+		if report.NotEmbedded > 0 {
+			notEmbedded = true
+		}
+		if flaggedOnly {
+			var fonts []fontReport
+			for _, font := range report.Fonts {
+				if len(font.Flags) > 0 {
+					fonts = append(fonts, font)
+				}
+			}
+			report.Fonts = fonts
+		}
+		reports = append(reports, report)
+	}
+
+	if asJSON {
+		b, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(b))
+	} else {
+		for _, report := range reports {
+			printReport(report)
+		}
+	}
+
+	if notEmbedded {
+		os.Exit(2)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// fileReport is the font report for a PDF file.
+type fileReport struct {
+	File        string       `json:"file"`
+	NumPages    int          `json:"num_pages"`
+	NotEmbedded int          `json:"not_embedded"`  // Number of fonts that are not embedded.
+	NoToUnicode int          `json:"no_to_unicode"` // Number of fonts without a ToUnicode map.
+	Fonts       []fontReport `json:"fonts"`
+}
+
+// fontReport describes a font in a PDF file.
+type fontReport struct {
+	Objects   []int64  `json:"objects"`   // Object numbers of the font dictionaries.
+	BaseFont  string   `json:"base_font"` // Base font name without the subset prefix.
+	Subtype   string   `json:"subtype"`   // Type1, TrueType, Type0, Type3 etc.
+	CIDType   string   `json:"cid_type,omitempty"`
+	Embedded  bool     `json:"embedded"`
+	FontFile  string   `json:"font_file,omitempty"` // FontFile, FontFile2 or FontFile3/<Subtype>.
+	Subset    string   `json:"subset,omitempty"`    // Subset prefix e.g. ABCDEF.
+	Encoding  string   `json:"encoding"`
+	ToUnicode bool     `json:"to_unicode"`
+	Pages     []int    `json:"pages"`
+	UsedIn    []string `json:"used_in"` // Where the font is used: page, form, pattern, type3, annotation.
+	Flags     []string `json:"flags,omitempty"`
+}
+
+// printReport prints `report` as text.
+func printReport(report fileReport) {
+	fmt.Printf("%s (%d pages) - %d fonts, %d not embedded, %d without ToUnicode\n", report.File,
+		report.NumPages, len(report.Fonts), report.NotEmbedded, report.NoToUnicode)
+	if len(report.Fonts) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  Font\tType\tEmbedded\tSubset\tEncoding\tToUnicode\tPages\tUsed in\tFlags")
+	for _, font := range report.Fonts {
+		subtype := font.Subtype
+		if font.CIDType != "" {
+			subtype += "/" + font.CIDType
+		}
+		embedded := "no"
+		if font.Embedded {
+			embedded = "yes"
+			if font.FontFile != "" {
+				embedded += " (" + font.FontFile + ")"
+			}
+		}
+		toUnicode := "no"
+		if font.ToUnicode {
+			toUnicode = "yes"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", font.BaseFont, subtype, embedded,
+			font.Subset, font.Encoding, toUnicode, pageList(font.Pages), strings.Join(font.UsedIn, ","),
+			strings.ToUpper(strings.Join(font.Flags, ", ")))
+	}
+	w.Flush()
+}
+
+// listFonts returns the font report for PDF file `inputPath`.
+func listFonts(inputPath string) (fileReport, error) {
+	report := fileReport{File: inputPath, Fonts: []fontReport{}}
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return report, err
+	}
+
+	defer f.Close()
+
+	pdfReader, err := pdf.NewPdfReader(f)
+	if err != nil {
+		return report, err
+	}
+
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return report, err
+	}
+
+	if isEncrypted {
+		// Decrypt if needed.  Put your password in the empty string below.
+		auth, err := pdfReader.Decrypt([]byte(""))
+		if err != nil {
+			return report, err
+		}
+		if !auth {
+			return report, errors.New("unable to access (encrypted)")
+		}
+	}
+
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return report, err
+	}
+	report.NumPages = numPages
+
+	fw := fontWalker{fonts: map[core.PdfObject]*fontReport{}}
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return report, err
+		}
+		fw.pageNum = pageNum
+		fw.visited = map[core.PdfObject]bool{}
+		if page.Resources != nil {
+			fw.walkResources(page.Resources.ToPdfObject(), "page")
+		}
+		annotations, err := page.GetAnnotations()
+		if err != nil {
+			return report, fmt.Errorf("GetAnnotations failed. pageNum=%d err=%v", pageNum, err)
+		}
+		for _, annotation := range annotations {
+			fw.walkAppearances(annotation.AP)
+		}
+	}
+
+	for _, font := range mergeFonts(fw.order) {
+		if !font.Embedded {
+			font.Flags = append(font.Flags, flagNotEmbedded)
+			report.NotEmbedded++
+		}
+		if !font.ToUnicode {
+			font.Flags = append(font.Flags, flagNoToUnicode)
+			report.NoToUnicode++
+		}
+		sort.Strings(font.UsedIn)
+		report.Fonts = append(report.Fonts, *font)
+	}
+	return report, nil
+}
+
+// fontWalker finds the fonts in the resources of the pages of a PDF file.
+type fontWalker struct {
+	pageNum int                            // (1-offset) Number of the page being walked.
+	visited map[core.PdfObject]bool        // Resources and streams visited on the current page.
+	fonts   map[core.PdfObject]*fontReport // Fonts found, keyed by font object.
+	order   []*fontReport                  // Fonts in the order they were found.
+}
+
+// walkResources records the fonts in resource dictionary `resObj` and the resources it refers to.
+// `usedIn` describes where the resources are used.
+func (fw *fontWalker) walkResources(resObj core.PdfObject, usedIn string) {
+	resources, ok := core.GetDict(resObj)
+	if !ok || fw.visited[resources] {
+		return
+	}
+	fw.visited[resources] = true
+
+	if fonts, ok := core.GetDict(resources.Get("Font")); ok {
+		for _, name := range fonts.Keys() {
+			fw.addFont(fonts.Get(name), usedIn)
+		}
+	}
+	if xobjects, ok := core.GetDict(resources.Get("XObject")); ok {
+		for _, name := range xobjects.Keys() {
+			stream, ok := core.GetStream(xobjects.Get(name))
+			if !ok {
+				continue
+			}
+			if subtype, _ := core.GetNameVal(stream.Get("Subtype")); subtype == "Form" {
+				fw.walkStream(stream, "form")
+			}
+		}
+	}
+	if patterns, ok := core.GetDict(resources.Get("Pattern")); ok {
+		for _, name := range patterns.Keys() {
+			// Tiling patterns are streams with their own resources.
+			if stream, ok := core.GetStream(patterns.Get(name)); ok {
+				fw.walkStream(stream, "pattern")
+			}
+		}
+	}
+}
+
+// walkStream records the fonts in the resources of content stream `stream`. `usedIn` describes where
+// the stream is used.
+func (fw *fontWalker) walkStream(stream *core.PdfObjectStream, usedIn string) {
+	if fw.visited[stream] {
+		return
+	}
+	fw.visited[stream] = true
+	fw.walkResources(stream.Get("Resources"), usedIn)
+}
+
+// walkAppearances records the fonts in annotation appearance dictionary `ap`. Each appearance (N, R
+// and D) is either a stream or a dictionary of streams for the annotation's appearance states.
+func (fw *fontWalker) walkAppearances(ap core.PdfObject) {
+	apDict, ok := core.GetDict(ap)
+	if !ok {
+		return
+	}
+	for _, key := range []core.PdfObjectName{"N", "R", "D"} {
+		obj := apDict.Get(key)
+		if stream, ok := core.GetStream(obj); ok {
+			fw.walkStream(stream, "annotation")
+			continue
+		}
+		if states, ok := core.GetDict(obj); ok {
+			for _, state := range states.Keys() {
+				if stream, ok := core.GetStream(states.Get(state)); ok {
+					fw.walkStream(stream, "annotation")
+				}
+			}
+		}
+	}
+}
+
+// addFont records that font `fontObj` is used on the current page in `usedIn`.
+func (fw *fontWalker) addFont(fontObj core.PdfObject, usedIn string) {
+	dict, ok := core.GetDict(fontObj)
+	if !ok {
+		return
+	}
+	font, ok := fw.fonts[dict]
+	if !ok {
+		font = describeFont(dict)
+		font.Objects = []int64{}
+		if ind, ok := fontObj.(*core.PdfIndirectObject); ok {
+			font.Objects = append(font.Objects, ind.ObjectNumber)
+		}
+		fw.fonts[dict] = font
+		fw.order = append(fw.order, font)
+	}
+	if n := len(font.Pages); n == 0 || font.Pages[n-1] != fw.pageNum {
+		font.Pages = append(font.Pages, fw.pageNum)
+	}
+	if !containsString(font.UsedIn, usedIn) {
+		font.UsedIn = append(font.UsedIn, usedIn)
+	}
+
+	// Type3 glyph procedures can use fonts too.
+	if font.Subtype == "Type3" {
+		fw.walkResources(dict.Get("Resources"), "type3")
+	}
+}
+
+// mergeFonts returns `fonts` with the fonts that have the same description merged. PDF writers often
+// write a separate copy of a font dictionary for each page.
+func mergeFonts(fonts []*fontReport) []*fontReport {
+	var merged []*fontReport
+	byKey := map[string]*fontReport{}
+	for _, font := range fonts {
+		key := fmt.Sprintf("%s|%s|%s|%s|%t|%s|%s|%t", font.BaseFont, font.Subset, font.Subtype,
+			font.CIDType, font.Embedded, font.FontFile, font.Encoding, font.ToUnicode)
+		m, ok := byKey[key]
+		if !ok {
+			byKey[key] = font
+			merged = append(merged, font)
+			continue
+		}
+		m.Objects = append(m.Objects, font.Objects...)
+		for _, pageNum := range font.Pages {
+			if !containsInt(m.Pages, pageNum) {
+				m.Pages = append(m.Pages, pageNum)
+			}
+		}
+		sort.Ints(m.Pages)
+		for _, usedIn := range font.UsedIn {
+			if !containsString(m.UsedIn, usedIn) {
+				m.UsedIn = append(m.UsedIn, usedIn)
+			}
+		}
+	}
+	return merged
+}
+
+// describeFont returns a fontReport describing font dictionary `dict`.
+func describeFont(dict *core.PdfObjectDictionary) *fontReport {
+	font := &fontReport{}
+	font.Subtype, _ = core.GetNameVal(dict.Get("Subtype"))
+	baseFont, _ := core.GetNameVal(dict.Get("BaseFont"))
+	if m := subsetRegex.FindStringSubmatch(baseFont); m != nil {
+		font.Subset = m[1]
+		baseFont = baseFont[len(m[0]):]
+	}
+	font.BaseFont = baseFont
+	font.ToUnicode = dict.Get("ToUnicode") != nil
+	font.Encoding = describeEncoding(dict.Get("Encoding"))
+
+	// The font program of a composite font is in its descendant CIDFont.
+	descriptorHolder := dict
+	if font.Subtype == "Type0" {
+		if descendants, ok := core.GetArray(dict.Get("DescendantFonts")); ok && descendants.Len() > 0 {
+			if cidFont, ok := core.GetDict(descendants.Get(0)); ok {
+				font.CIDType, _ = core.GetNameVal(cidFont.Get("Subtype"))
+				descriptorHolder = cidFont
+			}
+		}
+	}
+
+	switch font.Subtype {
+	case "Type3":
+		// Type3 glyphs are defined by content streams in the font dictionary.
+		font.Embedded = true
+		if font.BaseFont == "" {
+			font.BaseFont = "(Type3)"
+		}
+	default:
+		if descriptor, ok := core.GetDict(descriptorHolder.Get("FontDescriptor")); ok {
+			for _, key := range []core.PdfObjectName{"FontFile", "FontFile2", "FontFile3"} {
+				stream, ok := core.GetStream(descriptor.Get(key))
+				if !ok {
+					continue
+				}
+				font.Embedded = true
+				font.FontFile = string(key)
+				if subtype, ok := core.GetNameVal(stream.Get("Subtype")); ok {
+					font.FontFile += "/" + subtype
+				}
+				break
+			}
+		}
+	}
+	return font
+}
+
+// describeEncoding returns a description of font encoding object `obj`.
+func describeEncoding(obj core.PdfObject) string {
+	obj = core.TraceToDirectObject(obj)
+	switch t := obj.(type) {
+	case nil, *core.PdfObjectNull:
+		return "(built-in)"
+	case *core.PdfObjectName:
+		return string(*t)
+	case *core.PdfObjectStream:
+		if name, ok := core.GetNameVal(t.Get("CMapName")); ok {
+			return name + " (embedded CMap)"
+		}
+		return "(embedded CMap)"
+	case *core.PdfObjectDictionary:
+		desc := "(built-in)"
+		if base, ok := core.GetNameVal(t.Get("BaseEncoding")); ok {
+			desc = base
+		}
+		if t.Get("Differences") != nil {
+			desc += " + Differences"
+		}
+		return desc
+	}
+	return fmt.Sprintf("%T", obj)
+}
+
+// containsString returns true if `list` contains `s`.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsInt returns true if `list` contains `n`.
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// pageList returns `pages` as a list of page ranges e.g. "1-3,5".
+func pageList(pages []int) string {
+	var parts []string
+	for i := 0; i < len(pages); {
+		j := i
+		for j+1 < len(pages) && pages[j+1] == pages[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", pages[i], pages[j]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d", pages[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
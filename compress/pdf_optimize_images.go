@@ -0,0 +1,1069 @@
+/*
+ * Optimize the images in a PDF file with a policy that chooses what to do with each image.
+ *
+ * pdf_optimize.go applies the same JPEG quality and resolution limit to every image. This example
+ * reads a policy file of rules instead, so that scans, photos and line art in the same file can be
+ * treated differently. Each rule is a line of conditions, a colon and actions. The first rule whose
+ * conditions all match an image decides what is done with it. Images that match no rule are kept.
+ *
+ *     # Bilevel scans: CCITT G4 at up to 300 PPI.
+ *     bpc=1                              : downsample=300 ccitt
+ *     # Color scans of black and white pages.
+ *     cs=DeviceRGB|ICCBased gray ppi>200 : downsample=200 gray jpeg=70
+ *     # Photos.
+ *     filter=DCTDecode !mask ppi>150     : downsample=150 jpeg=75
+ *     *                                  : keep
+ *
+ * Conditions:
+ *     cs=DeviceRGB|DeviceCMYK|...  Color space family. cs!=... for the opposite.
+ *     filter=DCTDecode|FlateDecode|none|...  Any of the image's filters.
+ *     ppi, bpc, width, height, bytes compared with =, !=, <, <=, > or >= e.g. ppi>=300.
+ *         ppi is the effective resolution: the lowest of the image's placements on the pages.
+ *     mask, !mask  The image has (or doesn't have) a SMask or Mask.
+ *     gray, !gray  All the image's pixels are (or aren't) close to gray.
+ *     *            Matches every image.
+ * Actions:
+ *     keep           Don't change the image.
+ *     downsample=N   Downsample to N PPI if the effective resolution is higher.
+ *     jpeg[=Q]       Encode as JPEG with quality Q (default 80).
+ *     flate          Encode losslessly with Flate.
+ *     gray           Convert to DeviceGray.
+ *     ccitt          Convert to bilevel and encode as CCITT G4.
+ *     flate1         Convert to 1 bit per pixel and encode with Flate.
+ *     threshold=N    Gray level (0-255) below which pixels are black in bilevel images (default 128).
+ *
+ * An image is only replaced if the result is smaller. Images with a /Mask (stencil or color key) and
+ * image masks are kept as a lossy or resized copy would no longer match them. The size of each image
+ * before and after is reported.
+ *
+ * Run as: go run pdf_optimize_images.go -policy policy.txt input.pdf output.pdf
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	goimage "image"
+	"image/color"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/contentstream"
+	"github.com/unidoc/unipdf/v3/core"
+	pdf "github.com/unidoc/unipdf/v3/model"
+	"github.com/unidoc/unipdf/v3/model/optimize"
+	"golang.org/x/image/draw"
+)
+
+const usage = `Usage: go run pdf_optimize_images.go -policy policy.txt [-n] input.pdf [output.pdf]
+
+Downsamples and recompresses each image in input.pdf as chosen by the rules in the policy file and
+reports the size of each image before and after.
+`
+
+func main() {
+	var policyPath string
+	var dryRun, debug bool
+	flag.StringVar(&policyPath, "policy", "", "Policy file.")
+	flag.BoolVar(&dryRun, "n", false, "Only report what would be done. Don't write an output file.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if policyPath == "" || len(args) < 1 || (len(args) < 2 && !dryRun) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	}
+
+	policy, err := readPolicy(policyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	outputPath := ""
+	if !dryRun {
+		outputPath = args[1]
+	}
+	if err := optimizeImages(args[0], outputPath, policy); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// condition is a test of one property of an image.
+type condition struct {
+	key    string   // cs, filter, ppi, bpc, width, height, bytes, mask, gray or *.
+	op     string   // =, !=, <, <=, >, >=. "!" for !mask and !gray.
+	values []string // Alternatives for cs and filter.
+	number float64  // Value that numeric properties are compared with.
+}
+
+// action describes what is done with an image.
+type action struct {
+	keep      bool
+	ppi       float64 // Downsample to this PPI. 0 for no downsampling.
+	encoding  string  // jpeg, flate, ccitt, flate1 or "" to keep the image's kind of encoding.
+	quality   int     // JPEG quality.
+	gray      bool    // Convert to DeviceGray.
+	threshold int     // Gray level below which pixels are black in bilevel images.
+}
+
+// rule is a line of a policy file.
+type rule struct {
+	line       int    // (1-offset) Line number in the policy file.
+	text       string // The line.
+	conditions []condition
+	action     action
+}
+
+// numericKeys are the image properties that are compared with numbers.
+var numericKeys = map[string]bool{"ppi": true, "bpc": true, "width": true, "height": true, "bytes": true}
+
+// readPolicy returns the rules in policy file `policyPath`.
+func readPolicy(policyPath string) ([]rule, error) {
+	f, err := os.Open(policyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var policy []rule
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", policyPath, lineNum, err)
+		}
+		r.line = lineNum
+		policy = append(policy, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(policy) == 0 {
+		return nil, fmt.Errorf("%s has no rules", policyPath)
+	}
+	return policy, nil
+}
+
+// parseRule returns the rule described by policy file line `line`.
+func parseRule(line string) (rule, error) {
+	r := rule{text: line}
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("no colon between conditions and actions in %q", line)
+	}
+	for _, field := range strings.Fields(parts[0]) {
+		c, err := parseCondition(field)
+		if err != nil {
+			return r, err
+		}
+		r.conditions = append(r.conditions, c)
+	}
+	act, err := parseAction(strings.Fields(parts[1]))
+	if err != nil {
+		return r, err
+	}
+	r.action = act
+	return r, nil
+}
+
+// parseCondition returns the condition described by policy file condition `field`.
+func parseCondition(field string) (condition, error) {
+	switch field {
+	case "*", "mask", "gray":
+		return condition{key: field}, nil
+	case "!mask", "!gray":
+		return condition{key: field[1:], op: "!"}, nil
+	}
+	// Find the operator. Two character operators are tried first so that "<=" isn't read as "<".
+	var c condition
+	var value string
+	for _, op := range []string{"!=", "<=", ">=", "=", "<", ">"} {
+		if i := strings.Index(field, op); i > 0 {
+			c.key, c.op, value = field[:i], op, field[i+len(op):]
+			break
+		}
+	}
+	switch {
+	case c.key == "":
+		return c, fmt.Errorf("bad condition %q", field)
+	case c.key == "cs" || c.key == "filter":
+		if c.op != "=" && c.op != "!=" {
+			return c, fmt.Errorf("%s can only be compared with = or != in %q", c.key, field)
+		}
+		c.values = strings.Split(value, "|")
+	case numericKeys[c.key]:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return c, fmt.Errorf("bad number in %q", field)
+		}
+		c.number = number
+	default:
+		return c, fmt.Errorf("unknown condition %q", field)
+	}
+	return c, nil
+}
+
+// parseAction returns the action described by policy file actions `fields`.
+func parseAction(fields []string) (action, error) {
+	act := action{quality: 80, threshold: 128}
+	if len(fields) == 0 {
+		return act, fmt.Errorf("no actions")
+	}
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		name, value := parts[0], ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		number := 0
+		if value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return act, fmt.Errorf("bad value in action %q", field)
+			}
+			number = n
+		}
+		switch name {
+		case "keep":
+			act.keep = true
+		case "downsample":
+			if number == 0 {
+				return act, fmt.Errorf("no PPI in action %q", field)
+			}
+			act.ppi = float64(number)
+		case "jpeg", "flate", "ccitt", "flate1":
+			if act.encoding != "" {
+				return act, fmt.Errorf("more than one encoding in %q", strings.Join(fields, " "))
+			}
+			act.encoding = name
+			if name == "jpeg" && number > 0 {
+				if number > 100 {
+					return act, fmt.Errorf("JPEG quality must be 1-100 in action %q", field)
+				}
+				act.quality = number
+			}
+		case "gray":
+			act.gray = true
+		case "threshold":
+			if number == 0 || number > 255 {
+				return act, fmt.Errorf("threshold must be 1-255 in action %q", field)
+			}
+			act.threshold = number
+		default:
+			return act, fmt.Errorf("unknown action %q", field)
+		}
+	}
+	if act.keep && len(fields) > 1 {
+		return act, fmt.Errorf("keep can't be combined with other actions")
+	}
+	return act, nil
+}
+
+// imageEntry is an image XObject in a PDF file.
+type imageEntry struct {
+	stream  *core.PdfObjectStream
+	objNum  int64
+	pages   []int
+	ppi     float64 // Lowest effective resolution of the image's placements. 0 if it isn't drawn.
+	width   int
+	height  int
+	bpc     int
+	cs      string
+	filters []string
+	mask    bool
+	before  int   // Size in bytes of the image and its soft mask.
+	gray    *bool // Cached result of isGray.
+
+	rule   *rule  // The rule that matched the image. nil if no rule matched.
+	after  int    // Size in bytes of the optimized image and its soft mask.
+	result string // What was done.
+}
+
+// optimizeImages applies the image optimization `policy` to the images in PDF file `inputPath` and
+// writes the result to `outputPath`. Nothing is written if `outputPath` is empty.
+func optimizeImages(inputPath, outputPath string, policy []rule) error {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pdfReader, err := pdf.NewPdfReader(f)
+	if err != nil {
+		return err
+	}
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return err
+	}
+	if isEncrypted {
+		// Try decrypting with an empty one.
+		auth, err := pdfReader.Decrypt([]byte(""))
+		if err != nil || !auth {
+			return fmt.Errorf("unable to access (encrypted). err=%v", err)
+		}
+	}
+
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return err
+	}
+	iw := imageWalker{images: map[*core.PdfObjectStream]*imageEntry{}}
+	var pages []*pdf.PdfPage
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return err
+		}
+		pages = append(pages, page)
+		contents, err := page.GetAllContentStreams()
+		if err != nil {
+			return err
+		}
+		iw.pageNum = pageNum
+		if err := iw.walk(contents, page.Resources, identityMatrix(), 0); err != nil {
+			return fmt.Errorf("page %d: %v", pageNum, err)
+		}
+	}
+
+	for _, entry := range iw.order {
+		entry.rule = matchRule(policy, entry)
+		if entry.rule == nil {
+			entry.after, entry.result = entry.before, "keep (no rule)"
+			continue
+		}
+		entry.result = optimizeImage(entry, entry.rule.action)
+	}
+	printReport(iw.order)
+
+	if outputPath == "" {
+		return nil
+	}
+	writer := pdf.NewPdfWriter()
+	for _, page := range pages {
+		if err := writer.AddPage(page); err != nil {
+			return err
+		}
+	}
+	if pdfReader.AcroForm != nil {
+		writer.SetForms(pdfReader.AcroForm)
+	}
+	// The images have been optimized, so the optimizer only compresses and combines objects.
+	writer.SetOptimizer(optimize.New(optimize.Options{
+		CombineDuplicateDirectObjects:   true,
+		CombineIdenticalIndirectObjects: true,
+		CombineDuplicateStreams:         true,
+		CompressStreams:                 true,
+		UseObjectStreams:                true,
+	}))
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	if err := writer.Write(outputFile); err != nil {
+		return err
+	}
+
+	inputInfo, err := os.Stat(inputPath)
+	if err != nil {
+		return err
+	}
+	outputInfo, err := os.Stat(outputPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d bytes -> %s: %d bytes\n", inputPath, inputInfo.Size(), outputPath, outputInfo.Size())
+	return nil
+}
+
+// printReport prints the images in `images` with their sizes before and after optimization.
+func printReport(images []*imageEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Obj\tPages\tSize\tColorSpace\tFilter\tBPC\tPPI\tRule\tBefore\tAfter\tResult")
+	before, after := 0, 0
+	for _, entry := range images {
+		ruleLine := "-"
+		if entry.rule != nil {
+			ruleLine = strconv.Itoa(entry.rule.line)
+		}
+		filter := strings.Join(entry.filters, "+")
+		if filter == "" {
+			filter = "none"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%dx%d\t%s\t%s\t%d\t%.0f\t%s\t%d\t%d\t%s\n", entry.objNum,
+			pageList(entry.pages), entry.width, entry.height, entry.cs, filter, entry.bpc, entry.ppi,
+			ruleLine, entry.before, entry.after, entry.result)
+		before += entry.before
+		after += entry.after
+	}
+	w.Flush()
+	saved := 0.0
+	if before > 0 {
+		saved = 100 * float64(before-after) / float64(before)
+	}
+	fmt.Printf("%d images: %d bytes -> %d bytes (%.1f%% saved)\n", len(images), before, after, saved)
+}
+
+// matchRule returns the first rule in `policy` whose conditions match `entry` or nil if none do.
+func matchRule(policy []rule, entry *imageEntry) *rule {
+	for i, r := range policy {
+		matched := true
+		for _, c := range r.conditions {
+			if !c.matches(entry) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return &policy[i]
+		}
+	}
+	return nil
+}
+
+// matches returns true if `entry` satisfies condition `c`.
+func (c condition) matches(entry *imageEntry) bool {
+	switch c.key {
+	case "*":
+		return true
+	case "mask":
+		return entry.mask != (c.op == "!")
+	case "gray":
+		return entry.isGray() != (c.op == "!")
+	case "cs":
+		return containsString(c.values, entry.cs) == (c.op == "=")
+	case "filter":
+		found := false
+		for _, filter := range entry.filters {
+			found = found || containsString(c.values, filter)
+		}
+		if len(entry.filters) == 0 {
+			found = containsString(c.values, "none")
+		}
+		return found == (c.op == "=")
+	}
+	var v float64
+	switch c.key {
+	case "ppi":
+		v = entry.ppi
+	case "bpc":
+		v = float64(entry.bpc)
+	case "width":
+		v = float64(entry.width)
+	case "height":
+		v = float64(entry.height)
+	case "bytes":
+		v = float64(entry.before)
+	}
+	switch c.op {
+	case "=":
+		return v == c.number
+	case "!=":
+		return v != c.number
+	case "<":
+		return v < c.number
+	case "<=":
+		return v <= c.number
+	case ">":
+		return v > c.number
+	case ">=":
+		return v >= c.number
+	}
+	return false
+}
+
+// isGray returns true if all the pixels in `entry` are close to gray.
+func (entry *imageEntry) isGray() bool {
+	if entry.gray != nil {
+		return *entry.gray
+	}
+	gray := false
+	switch {
+	case entry.cs == "DeviceGray" || entry.cs == "CalGray":
+		gray = true
+	default:
+		if img, _, err := decodeImage(entry.stream, true); err == nil {
+			gray = isGrayImage(img)
+		}
+	}
+	entry.gray = &gray
+	return gray
+}
+
+// isGrayImage returns true if the color components of each pixel in `img` differ by no more than
+// a small tolerance.
+func isGrayImage(img goimage.Image) bool {
+	const tolerance = 12
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			lo := minInt(int(c.R), minInt(int(c.G), int(c.B)))
+			hi := maxInt(int(c.R), maxInt(int(c.G), int(c.B)))
+			if hi-lo > tolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// optimizeImage applies action `act` to `entry`. The image stream is replaced in place if the result
+// is smaller. Returns a description of what was done.
+func optimizeImage(entry *imageEntry, act action) string {
+	entry.after = entry.before
+	stream := entry.stream
+	if act.keep {
+		return "keep"
+	}
+	if isImageMask, _ := core.GetBoolVal(stream.Get("ImageMask")); isImageMask {
+		return "kept: image mask"
+	}
+	if stream.Get("Mask") != nil {
+		return "kept: has /Mask"
+	}
+
+	// The color space and number of color components of the new image.
+	bilevel := act.encoding == "ccitt" || act.encoding == "flate1"
+	colorspace, components := targetColorspace(stream.Get("ColorSpace"))
+	if act.gray || bilevel {
+		colorspace, components = core.MakeName("DeviceGray"), 1
+	}
+
+	width, height := entry.width, entry.height
+	resize := act.ppi > 0 && entry.ppi > act.ppi
+	if resize {
+		scale := act.ppi / entry.ppi
+		width = maxInt(1, int(math.Round(float64(width)*scale)))
+		height = maxInt(1, int(math.Round(float64(height)*scale)))
+	}
+	encoding := act.encoding
+	if encoding == "" {
+		encoding = "flate"
+		if containsString(entry.filters, "DCTDecode") {
+			encoding = "jpeg"
+		}
+	}
+	var notes []string
+	if encoding == "jpeg" && components == 4 {
+		// The Go JPEG encoder can't write CMYK images.
+		encoding = "flate"
+		notes = append(notes, "CMYK encoded with flate")
+	}
+	if !resize && !act.gray && act.encoding == "" {
+		if act.ppi > 0 && entry.ppi > 0 {
+			return fmt.Sprintf("keep (%.0f PPI)", entry.ppi)
+		}
+		return "keep"
+	}
+
+	// Decode the image. The original samples are used if the number of color components doesn't
+	// change so that the color space and any /Decode array still apply.
+	img, raw, err := decodeImage(stream, components != entryComponents(stream))
+	if err != nil {
+		return fmt.Sprintf("kept: can't decode (%v)", err)
+	}
+	if resize {
+		img = scaleImage(img, width, height)
+	}
+
+	var data []byte
+	var encoder core.StreamEncoder
+	bpc := 8
+	switch encoding {
+	case "jpeg":
+		enc := core.NewDCTEncoder()
+		enc.ColorComponents = components
+		enc.BitsPerComponent = 8
+		enc.Width = width
+		enc.Height = height
+		enc.Quality = act.quality
+		encoder = enc
+		data, err = enc.EncodeBytes(imageSamples(img, components))
+	case "flate":
+		encoder = core.NewFlateEncoder()
+		data, err = encoder.EncodeBytes(imageSamples(img, components))
+	case "ccitt":
+		enc := core.NewCCITTFaxEncoder()
+		enc.K = -1
+		enc.Columns = width
+		enc.Rows = height
+		enc.EndOfBlock = true
+		encoder = enc
+		bpc = 1
+		data, err = enc.EncodeBytes(bilevelSamples(img, act.threshold))
+	case "flate1":
+		encoder = core.NewFlateEncoder()
+		bpc = 1
+		data, err = encoder.EncodeBytes(packBits(bilevelSamples(img, act.threshold), width))
+	}
+	if err != nil {
+		return fmt.Sprintf("kept: %s encoding failed (%v)", encoding, err)
+	}
+
+	dict := encoder.MakeStreamDict()
+	dict.Set("Type", core.MakeName("XObject"))
+	dict.Set("Subtype", core.MakeName("Image"))
+	dict.Set("Width", core.MakeInteger(int64(width)))
+	dict.Set("Height", core.MakeInteger(int64(height)))
+	dict.Set("ColorSpace", colorspace)
+	dict.Set("BitsPerComponent", core.MakeInteger(int64(bpc)))
+	for _, key := range []core.PdfObjectName{"Intent", "Interpolate"} {
+		if obj := stream.Get(key); obj != nil {
+			dict.Set(key, obj)
+		}
+	}
+	if raw {
+		if obj := stream.Get("Decode"); obj != nil {
+			dict.Set("Decode", obj)
+		}
+	}
+	after := len(data)
+
+	// The soft mask must have the same size as the image.
+	if smaskObj := stream.Get("SMask"); smaskObj != nil {
+		smask, ok := core.GetStream(smaskObj)
+		if resize && ok {
+			smask, err = scaleSoftMask(smask, width, height)
+			if err != nil {
+				return fmt.Sprintf("kept: can't resize soft mask (%v)", err)
+			}
+			dict.Set("SMask", smask)
+		} else {
+			dict.Set("SMask", smaskObj)
+		}
+		if ok {
+			after += len(smask.Stream)
+		}
+	}
+
+	if after >= entry.before {
+		return fmt.Sprintf("kept: %s result was %d bytes", describeAction(act, resize, width, height),
+			after)
+	}
+	dict.Set("Length", core.MakeInteger(int64(len(data))))
+	stream.PdfObjectDictionary = dict
+	stream.Stream = data
+	entry.after = after
+	notes = append([]string{describeAction(act, resize, width, height)}, notes...)
+	return strings.Join(notes, ", ")
+}
+
+// describeAction returns a description of action `act`. `resize` is true if the image was resized to
+// `width` x `height`.
+func describeAction(act action, resize bool, width, height int) string {
+	var parts []string
+	if resize {
+		parts = append(parts, fmt.Sprintf("%dx%d", width, height))
+	}
+	if act.gray {
+		parts = append(parts, "gray")
+	}
+	switch act.encoding {
+	case "jpeg":
+		parts = append(parts, fmt.Sprintf("jpeg q%d", act.quality))
+	case "":
+	default:
+		parts = append(parts, act.encoding)
+	}
+	if len(parts) == 0 {
+		return "recompressed"
+	}
+	return strings.Join(parts, " ")
+}
+
+// entryComponents returns the number of color components in image stream `stream`. 0 if it is not
+// known.
+func entryComponents(stream *core.PdfObjectStream) int {
+	ximg, err := pdf.NewXObjectImageFromStream(stream)
+	if err != nil || ximg.ColorSpace == nil {
+		return 0
+	}
+	return ximg.ColorSpace.GetNumComponents()
+}
+
+// decodeImage returns the decoded image in image stream `stream`. If `toRGB` is true the image is
+// converted to RGB. Otherwise it is converted to RGB only if it can't be represented by a Go image in
+// its own color space. The second return value is true if the image has its original samples.
+func decodeImage(stream *core.PdfObjectStream, toRGB bool) (goimage.Image, bool, error) {
+	ximg, err := pdf.NewXObjectImageFromStream(stream)
+	if err != nil {
+		return nil, false, err
+	}
+	img, err := ximg.ToImage()
+	if err != nil {
+		return nil, false, err
+	}
+	if !toRGB {
+		switch ximg.ColorSpace.(type) {
+		case *pdf.PdfColorspaceDeviceGray, *pdf.PdfColorspaceDeviceRGB, *pdf.PdfColorspaceDeviceCMYK,
+			*pdf.PdfColorspaceCalGray, *pdf.PdfColorspaceCalRGB, *pdf.PdfColorspaceICCBased:
+			goImg, err := img.ToGoImage()
+			return goImg, true, err
+		}
+	}
+	if ximg.ColorSpace == nil {
+		return nil, false, fmt.Errorf("no color space")
+	}
+	rgb, err := ximg.ColorSpace.ImageToRGB(*img)
+	if err != nil {
+		return nil, false, err
+	}
+	goImg, err := rgb.ToGoImage()
+	return goImg, false, err
+}
+
+// scaleImage returns `img` scaled to `width` x `height`.
+func scaleImage(img goimage.Image, width, height int) goimage.Image {
+	r := goimage.Rect(0, 0, width, height)
+	var dst draw.Image
+	switch img.(type) {
+	case *goimage.Gray, *goimage.Gray16:
+		dst = goimage.NewGray(r)
+	case *goimage.CMYK:
+		dst = goimage.NewCMYK(r)
+	default:
+		dst = goimage.NewRGBA(r)
+	}
+	draw.CatmullRom.Scale(dst, r, img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// scaleSoftMask returns a copy of soft mask image `smask` scaled to `width` x `height`.
+func scaleSoftMask(smask *core.PdfObjectStream, width, height int) (*core.PdfObjectStream, error) {
+	img, _, err := decodeImage(smask, false)
+	if err != nil {
+		return nil, err
+	}
+	img = scaleImage(img, width, height)
+	encoder := core.NewFlateEncoder()
+	data, err := encoder.EncodeBytes(imageSamples(img, 1))
+	if err != nil {
+		return nil, err
+	}
+	dict := encoder.MakeStreamDict()
+	dict.Set("Type", core.MakeName("XObject"))
+	dict.Set("Subtype", core.MakeName("Image"))
+	dict.Set("Width", core.MakeInteger(int64(width)))
+	dict.Set("Height", core.MakeInteger(int64(height)))
+	dict.Set("ColorSpace", core.MakeName("DeviceGray"))
+	dict.Set("BitsPerComponent", core.MakeInteger(8))
+	if obj := smask.Get("Matte"); obj != nil {
+		dict.Set("Matte", obj)
+	}
+	dict.Set("Length", core.MakeInteger(int64(len(data))))
+	return &core.PdfObjectStream{PdfObjectDictionary: dict, Stream: data}, nil
+}
+
+// targetColorspace returns the color space that a replacement for an image in color space `cs` is
+// encoded in and its number of components. Device, ICCBased and calibrated color spaces are kept.
+// Other color spaces are replaced with DeviceRGB.
+func targetColorspace(cs core.PdfObject) (core.PdfObject, int) {
+	switch t := core.TraceToDirectObject(cs).(type) {
+	case *core.PdfObjectName:
+		switch *t {
+		case "DeviceGray":
+			return cs, 1
+		case "DeviceRGB":
+			return cs, 3
+		case "DeviceCMYK":
+			return cs, 4
+		}
+	case *core.PdfObjectArray:
+		family, _ := core.GetNameVal(t.Get(0))
+		switch family {
+		case "CalGray":
+			return cs, 1
+		case "CalRGB":
+			return cs, 3
+		case "ICCBased":
+			if icc, ok := core.GetStream(t.Get(1)); ok {
+				if n, err := core.GetNumberAsInt64(icc.Get("N")); err == nil && (n == 1 || n == 3 || n == 4) {
+					return cs, int(n)
+				}
+			}
+		}
+	}
+	return core.MakeName("DeviceRGB"), 3
+}
+
+// colorspaceName returns the family name of color space `cs`.
+func colorspaceName(cs core.PdfObject) string {
+	switch t := core.TraceToDirectObject(cs).(type) {
+	case *core.PdfObjectName:
+		return string(*t)
+	case *core.PdfObjectArray:
+		family, _ := core.GetNameVal(t.Get(0))
+		return family
+	}
+	return "none"
+}
+
+// imageSamples returns the 8 bit samples of `img` with `components` color components per pixel
+// (1: gray, 3: RGB, 4: CMYK).
+func imageSamples(img goimage.Image, components int) []byte {
+	b := img.Bounds()
+	samples := make([]byte, 0, b.Dx()*b.Dy()*components)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			switch components {
+			case 1:
+				samples = append(samples, color.GrayModel.Convert(c).(color.Gray).Y)
+			case 4:
+				k := color.CMYKModel.Convert(c).(color.CMYK)
+				samples = append(samples, k.C, k.M, k.Y, k.K)
+			default:
+				rgba := color.RGBAModel.Convert(c).(color.RGBA)
+				samples = append(samples, rgba.R, rgba.G, rgba.B)
+			}
+		}
+	}
+	return samples
+}
+
+// bilevelSamples returns the pixels of `img` as one byte per pixel: 0 for black and 255 for white.
+// Pixels with gray levels below `threshold` are black.
+func bilevelSamples(img goimage.Image, threshold int) []byte {
+	samples := imageSamples(img, 1)
+	for i, v := range samples {
+		if int(v) < threshold {
+			samples[i] = 0
+		} else {
+			samples[i] = 255
+		}
+	}
+	return samples
+}
+
+// packBits returns the bilevel samples `samples` of an image `width` pixels wide packed 8 pixels to a
+// byte. Each row starts on a byte boundary.
+func packBits(samples []byte, width int) []byte {
+	rowBytes := (width + 7) / 8
+	height := len(samples) / width
+	packed := make([]byte, rowBytes*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if samples[y*width+x] != 0 {
+				packed[y*rowBytes+x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	return packed
+}
+
+// imageWalker finds the image XObjects drawn by content streams and their effective resolutions.
+type imageWalker struct {
+	pageNum int                                   // (1-offset) Number of the page being walked.
+	images  map[*core.PdfObjectStream]*imageEntry // Images found, keyed by image stream.
+	order   []*imageEntry                         // Images in the order they were found.
+}
+
+// maxFormDepth is the maximum depth of form XObjects that imageWalker descends into.
+const maxFormDepth = 10
+
+// walk records the images drawn in content stream `contents` with resources `resources`. `ctm`
+// transforms the content stream's coordinates to page coordinates.
+func (iw *imageWalker) walk(contents string, resources *pdf.PdfPageResources, ctm matrix, level int) error {
+	ops, err := contentstream.NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return err
+	}
+	processor := contentstream.NewContentStreamProcessor(*ops)
+	processor.AddHandler(contentstream.HandlerConditionEnumOperand, "Do",
+		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState,
+			resources *pdf.PdfPageResources) error {
+			if len(op.Params) != 1 || resources == nil {
+				return nil
+			}
+			name, ok := core.GetName(op.Params[0])
+			if !ok {
+				return nil
+			}
+			stream, xtype := resources.GetXObjectByName(*name)
+			switch xtype {
+			case pdf.XObjectTypeImage:
+				iw.addImage(stream, gsMatrix(gs).mult(ctm))
+			case pdf.XObjectTypeForm:
+				if level >= maxFormDepth {
+					return nil
+				}
+				xform, err := resources.GetXObjectFormByName(*name)
+				if err != nil {
+					return err
+				}
+				content, err := xform.GetContentStream()
+				if err != nil {
+					return err
+				}
+				formCtm := gsMatrix(gs).mult(ctm)
+				if arr, ok := core.GetArray(xform.Matrix); ok {
+					if vals, err := arr.ToFloat64Array(); err == nil && len(vals) == 6 {
+						formCtm = newMatrix(vals).mult(formCtm)
+					}
+				}
+				formResources := xform.Resources
+				if formResources == nil {
+					formResources = resources
+				}
+				return iw.walk(string(content), formResources, formCtm, level+1)
+			}
+			return nil
+		})
+	return processor.Process(resources)
+}
+
+// addImage records that image `stream` is drawn with transformation matrix `m` on the current page.
+// Images are drawn in the unit square, so the lengths of the transformed unit vectors are the
+// image's width and height in points.
+func (iw *imageWalker) addImage(stream *core.PdfObjectStream, m matrix) {
+	entry, ok := iw.images[stream]
+	if !ok {
+		entry = newImageEntry(stream)
+		iw.images[stream] = entry
+		iw.order = append(iw.order, entry)
+	}
+	if n := len(entry.pages); n == 0 || entry.pages[n-1] != iw.pageNum {
+		entry.pages = append(entry.pages, iw.pageNum)
+	}
+	w, h := math.Hypot(m[0], m[1]), math.Hypot(m[2], m[3])
+	if w <= 0 || h <= 0 {
+		return
+	}
+	ppi := math.Min(float64(entry.width)*72/w, float64(entry.height)*72/h)
+	if entry.ppi == 0 || ppi < entry.ppi {
+		entry.ppi = ppi
+	}
+}
+
+// newImageEntry returns an imageEntry describing image stream `stream`.
+func newImageEntry(stream *core.PdfObjectStream) *imageEntry {
+	entry := &imageEntry{stream: stream, objNum: stream.ObjectNumber, before: len(stream.Stream)}
+	width, _ := core.GetNumberAsInt64(stream.Get("Width"))
+	height, _ := core.GetNumberAsInt64(stream.Get("Height"))
+	bpc, _ := core.GetNumberAsInt64(stream.Get("BitsPerComponent"))
+	entry.width, entry.height, entry.bpc = int(width), int(height), int(bpc)
+	entry.cs = colorspaceName(stream.Get("ColorSpace"))
+	switch t := core.TraceToDirectObject(stream.Get("Filter")).(type) {
+	case *core.PdfObjectName:
+		entry.filters = []string{string(*t)}
+	case *core.PdfObjectArray:
+		for _, obj := range t.Elements() {
+			if name, ok := core.GetNameVal(obj); ok {
+				entry.filters = append(entry.filters, name)
+			}
+		}
+	}
+	entry.mask = stream.Get("SMask") != nil || stream.Get("Mask") != nil
+	if smask, ok := core.GetStream(stream.Get("SMask")); ok {
+		entry.before += len(smask.Stream)
+	}
+	return entry
+}
+
+// gsMatrix returns the current transformation matrix of `gs`.
+func gsMatrix(gs contentstream.GraphicsState) matrix {
+	ctm := gs.CTM
+	return matrix{ctm[0], ctm[1], ctm[3], ctm[4], ctm[6], ctm[7]}
+}
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+// identityMatrix returns the identity matrix.
+func identityMatrix() matrix {
+	return matrix{1, 0, 0, 1, 0, 0}
+}
+
+// newMatrix returns the matrix with elements `vals`.
+func newMatrix(vals []float64) matrix {
+	var m matrix
+	copy(m[:], vals)
+	return m
+}
+
+// mult returns `m` × `o`, the transform that applies `m` then `o`.
+func (m matrix) mult(o matrix) matrix {
+	return matrix{
+		m[0]*o[0] + m[1]*o[2],
+		m[0]*o[1] + m[1]*o[3],
+		m[2]*o[0] + m[3]*o[2],
+		m[2]*o[1] + m[3]*o[3],
+		m[4]*o[0] + m[5]*o[2] + o[4],
+		m[4]*o[1] + m[5]*o[3] + o[5],
+	}
+}
+
+// containsString returns true if `list` contains `s`.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pageList returns `pages` as a list of page ranges e.g. "1-3,5".
+func pageList(pages []int) string {
+	sort.Ints(pages)
+	var parts []string
+	for i := 0; i < len(pages); {
+		j := i
+		for j+1 < len(pages) && pages[j+1] == pages[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", pages[i], pages[j]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d", pages[i]))
+		}
+		i = j + 1
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, ",")
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
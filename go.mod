@@ -11,5 +11,6 @@ require (
 	github.com/wcharczuk/go-chart v2.0.1+incompatible
 	github.com/youtube/vitess v2.1.1+incompatible // indirect
 	golang.org/x/crypto v0.0.0-20190605123033-f99c8df09eb5
-	golang.org/x/image v0.0.0-20190703141733-d6a02ce849c9 // indirect
+	golang.org/x/image v0.0.0-20190703141733-d6a02ce849c9
+	golang.org/x/text v0.3.2
 )
@@ -0,0 +1,473 @@
+/*
+ * Report the effective resolution of every image placement in PDF files.
+ *
+ * pdf_list_images.go lists the pixel dimensions of images but not the resolution they are printed
+ * at. That depends on the size an image is drawn at, which is set by the current transformation matrix
+ * (CTM) when the image is drawn. An image can be drawn several times at different sizes so each
+ * placement is reported separately.
+ *
+ * The CTM is tracked through nested form XObjects, including their /Matrix entries. The horizontal and
+ * vertical PPI are measured along the image's own axes, so they are correct for rotated and skewed
+ * images. Clipping is ignored.
+ *
+ * Placements below -min PPI are flagged as low resolution and placements above -max PPI as over
+ * resolved. Bilevel (1 bit per pixel) images such as scanned text and line art need more pixels to
+ * print well, so they are checked against -linemin and -linemax instead. The exit status is 2 if any
+ * placement is low resolution, so the command can be used in prepress checks.
+ *
+ * Run as: go run pdf_image_resolution.go [-min 150] [-max 600] [-o report.csv] input1.pdf input2.pdf ...
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/contentstream"
+	"github.com/unidoc/unipdf/v3/core"
+	pdf "github.com/unidoc/unipdf/v3/model"
+)
+
+const usage = `Usage: go run pdf_image_resolution.go [options] input1.pdf input2.pdf ...
+
+Lists the effective horizontal and vertical resolution (PPI) of every image placement and flags
+placements that are low resolution or over resolved. With -o the placements are also saved to a CSV
+file or, if the file has a .json extension, a JSON file.
+Exits with status 2 if any placement is low resolution.
+`
+
+// Placement flags.
+const (
+	flagLow  = "low"  // Below the minimum resolution.
+	flagHigh = "high" // Above the maximum resolution.
+)
+
+// thresholds are the resolution limits that placements are checked against.
+type thresholds struct {
+	min, max         float64 // Continuous tone images.
+	lineMin, lineMax float64 // Bilevel images.
+}
+
+func main() {
+	var t thresholds
+	var reportPath string
+	var flaggedOnly, debug bool
+	flag.Float64Var(&t.min, "min", 150, "Flag continuous tone images below this PPI.")
+	flag.Float64Var(&t.max, "max", 600, "Flag continuous tone images above this PPI. 0 for no limit.")
+	flag.Float64Var(&t.lineMin, "linemin", 600, "Flag bilevel images below this PPI.")
+	flag.Float64Var(&t.lineMax, "linemax", 2400, "Flag bilevel images above this PPI. 0 for no limit.")
+	flag.StringVar(&reportPath, "o", "", "Save the placements to this CSV or JSON file.")
+	flag.BoolVar(&flaggedOnly, "flagged", false, "Only list placements that are flagged.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	}
+
+	var placements []placement
+	failed := false
+	for _, inputPath := range args {
+		filePlacements, err := imagePlacements(inputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", inputPath, err)
+			failed = true
+			continue
+		}
+		placements = append(placements, filePlacements...)
+	}
+
+	low := 0
+	var shown []placement
+	for _, p := range placements {
+		p.Flag = t.check(p)
+		if p.Flag == flagLow {
+			low++
+		}
+		if !flaggedOnly || p.Flag != "" {
+			shown = append(shown, p)
+		}
+	}
+	printPlacements(shown, t)
+	if reportPath != "" {
+		if err := writeReport(reportPath, shown); err != nil {
+			fmt.Fprintf(os.Stderr, "writeReport failed. reportPath=%q err=%v\n", reportPath, err)
+			os.Exit(1)
+		}
+	}
+
+	if low > 0 {
+		os.Exit(2)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// placement is an image drawn on a page.
+type placement struct {
+	File        string  `json:"file"`
+	Page        int     `json:"page"`
+	Index       int     `json:"index"`          // (1-offset) Number of the placement on the page.
+	Inline      bool    `json:"inline"`         // Inline image (BI ... EI) rather than an XObject.
+	Name        string  `json:"name,omitempty"` // XObject name.
+	Object      int64   `json:"object,omitempty"`
+	PixelWidth  int     `json:"pixel_width"`
+	PixelHeight int     `json:"pixel_height"`
+	ColorSpace  string  `json:"colorspace"`
+	BPC         int     `json:"bpc"`
+	Width       float64 `json:"width"`  // Width in points that the image is drawn at.
+	Height      float64 `json:"height"` // Height in points that the image is drawn at.
+	X           float64 `json:"x"`      // Position of the image's lower left corner in points.
+	Y           float64 `json:"y"`
+	Angle       float64 `json:"angle"` // Rotation in degrees.
+	PPIX        float64 `json:"ppi_x"` // Resolution along the image's horizontal axis.
+	PPIY        float64 `json:"ppi_y"` // Resolution along the image's vertical axis.
+	Flag        string  `json:"flag,omitempty"`
+}
+
+// bilevel returns true if `p` has 1 bit per pixel.
+func (p placement) bilevel() bool {
+	return p.BPC == 1 && (p.ColorSpace == "DeviceGray" || p.ColorSpace == "ImageMask")
+}
+
+// check returns flagLow if `p` is below the minimum resolution in `t`, flagHigh if it is above the
+// maximum and "" otherwise. The lower of the horizontal and vertical resolutions is checked against
+// the minimum and the higher against the maximum.
+func (t thresholds) check(p placement) string {
+	min, max := t.min, t.max
+	if p.bilevel() {
+		min, max = t.lineMin, t.lineMax
+	}
+	switch {
+	case math.Min(p.PPIX, p.PPIY) < min:
+		return flagLow
+	case max > 0 && math.Max(p.PPIX, p.PPIY) > max:
+		return flagHigh
+	}
+	return ""
+}
+
+// printPlacements prints `placements` and a summary of how many were flagged with `t`.
+func printPlacements(placements []placement, t thresholds) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "File\tPage\tImage\tPixels\tColorSpace\tBPC\tSize (pt)\tAngle\tPPI x\tPPI y\tFlag")
+	low, high := 0, 0
+	for _, p := range placements {
+		image := fmt.Sprintf("%d %s", p.Index, p.Name)
+		if p.Inline {
+			image = fmt.Sprintf("%d (inline)", p.Index)
+		} else if p.Object > 0 {
+			image += fmt.Sprintf(" (%d)", p.Object)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%dx%d\t%s\t%d\t%.1fx%.1f\t%.0f\t%.0f\t%.0f\t%s\n",
+			filepath.Base(p.File), p.Page, image, p.PixelWidth, p.PixelHeight, p.ColorSpace, p.BPC,
+			p.Width, p.Height, p.Angle, p.PPIX, p.PPIY, strings.ToUpper(p.Flag))
+		switch p.Flag {
+		case flagLow:
+			low++
+		case flagHigh:
+			high++
+		}
+	}
+	w.Flush()
+	fmt.Printf("%d placements: %d below %.0f PPI (bilevel %.0f), %d above %.0f PPI (bilevel %.0f)\n",
+		len(placements), low, t.min, t.lineMin, high, t.max, t.lineMax)
+}
+
+// writeReport writes `placements` to `reportPath` as JSON if it has a .json extension and as CSV
+// otherwise.
+func writeReport(reportPath string, placements []placement) error {
+	if placements == nil {
+		placements = []placement{}
+	}
+	if strings.ToLower(filepath.Ext(reportPath)) == ".json" {
+		b, err := json.MarshalIndent(placements, "", "\t")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(reportPath, b, 0666)
+	}
+
+	f, err := os.Create(reportPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"file", "page", "index", "inline", "name", "object", "pixel_width", "pixel_height",
+		"colorspace", "bpc", "width", "height", "x", "y", "angle", "ppi_x", "ppi_y", "flag"})
+	for _, p := range placements {
+		w.Write([]string{
+			p.File,
+			strconv.Itoa(p.Page),
+			strconv.Itoa(p.Index),
+			strconv.FormatBool(p.Inline),
+			p.Name,
+			strconv.FormatInt(p.Object, 10),
+			strconv.Itoa(p.PixelWidth),
+			strconv.Itoa(p.PixelHeight),
+			p.ColorSpace,
+			strconv.Itoa(p.BPC),
+			fmt.Sprintf("%.2f", p.Width),
+			fmt.Sprintf("%.2f", p.Height),
+			fmt.Sprintf("%.2f", p.X),
+			fmt.Sprintf("%.2f", p.Y),
+			fmt.Sprintf("%.1f", p.Angle),
+			fmt.Sprintf("%.1f", p.PPIX),
+			fmt.Sprintf("%.1f", p.PPIY),
+			p.Flag,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// imagePlacements returns the image placements in PDF file `inputPath`.
+func imagePlacements(inputPath string) ([]placement, error) {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pdfReader, err := pdf.NewPdfReader(f)
+	if err != nil {
+		return nil, err
+	}
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return nil, err
+	}
+	if isEncrypted {
+		// Try decrypting with an empty one.
+		auth, err := pdfReader.Decrypt([]byte(""))
+		if err != nil {
+			return nil, err
+		}
+		if !auth {
+			return nil, errors.New("unable to access (encrypted)")
+		}
+	}
+
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, err
+	}
+	var placements []placement
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := page.GetAllContentStreams()
+		if err != nil {
+			return nil, err
+		}
+		pw := placementWalker{file: inputPath, pageNum: pageNum}
+		if err := pw.walk(contents, page.Resources, identityMatrix(), 0); err != nil {
+			return nil, fmt.Errorf("page %d: %v", pageNum, err)
+		}
+		placements = append(placements, pw.placements...)
+	}
+	return placements, nil
+}
+
+// placementWalker finds the image placements in the content streams of a page.
+type placementWalker struct {
+	file       string
+	pageNum    int
+	placements []placement
+}
+
+// maxFormDepth is the maximum depth of form XObjects that placementWalker descends into.
+const maxFormDepth = 10
+
+// walk records the images drawn in content stream `contents` with resources `resources`. `ctm`
+// transforms the content stream's coordinates to page coordinates.
+func (pw *placementWalker) walk(contents string, resources *pdf.PdfPageResources, ctm matrix,
+	level int) error {
+	ops, err := contentstream.NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return err
+	}
+	processor := contentstream.NewContentStreamProcessor(*ops)
+	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
+		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState,
+			resources *pdf.PdfPageResources) error {
+			switch op.Operand {
+			case "BI":
+				if len(op.Params) != 1 {
+					return nil
+				}
+				iimg, ok := op.Params[0].(*contentstream.ContentStreamInlineImage)
+				if !ok {
+					return nil
+				}
+				p := placement{Inline: true}
+				p.PixelWidth = intValue(iimg.Width)
+				p.PixelHeight = intValue(iimg.Height)
+				p.BPC = intValue(iimg.BitsPerComponent)
+				if isMask, _ := core.GetBoolVal(iimg.ImageMask); isMask {
+					p.ColorSpace, p.BPC = "ImageMask", 1
+				} else if cs, err := iimg.GetColorSpace(resources); err == nil && cs != nil {
+					p.ColorSpace = cs.String()
+				}
+				pw.addPlacement(p, gsMatrix(gs).mult(ctm))
+			case "Do":
+				if len(op.Params) != 1 || resources == nil {
+					return nil
+				}
+				name, ok := core.GetName(op.Params[0])
+				if !ok {
+					return nil
+				}
+				stream, xtype := resources.GetXObjectByName(*name)
+				switch xtype {
+				case pdf.XObjectTypeImage:
+					p := placement{Name: string(*name), Object: stream.ObjectNumber}
+					p.PixelWidth = intValue(stream.Get("Width"))
+					p.PixelHeight = intValue(stream.Get("Height"))
+					p.BPC = intValue(stream.Get("BitsPerComponent"))
+					p.ColorSpace = colorspaceName(stream.Get("ColorSpace"))
+					if isMask, _ := core.GetBoolVal(stream.Get("ImageMask")); isMask {
+						p.ColorSpace, p.BPC = "ImageMask", 1
+					}
+					pw.addPlacement(p, gsMatrix(gs).mult(ctm))
+				case pdf.XObjectTypeForm:
+					if level >= maxFormDepth {
+						return nil
+					}
+					xform, err := resources.GetXObjectFormByName(*name)
+					if err != nil {
+						return err
+					}
+					content, err := xform.GetContentStream()
+					if err != nil {
+						return err
+					}
+					formCtm := gsMatrix(gs).mult(ctm)
+					if arr, ok := core.GetArray(xform.Matrix); ok {
+						if vals, err := arr.ToFloat64Array(); err == nil && len(vals) == 6 {
+							formCtm = newMatrix(vals).mult(formCtm)
+						}
+					}
+					formResources := xform.Resources
+					if formResources == nil {
+						formResources = resources
+					}
+					return pw.walk(string(content), formResources, formCtm, level+1)
+				}
+			}
+			return nil
+		})
+	return processor.Process(resources)
+}
+
+// addPlacement records image placement `p` drawn with transformation matrix `m`. Images are drawn in
+// the unit square, so the lengths of the transformed unit vectors are the width and height of the
+// image in points.
+func (pw *placementWalker) addPlacement(p placement, m matrix) {
+	p.File = pw.file
+	p.Page = pw.pageNum
+	p.Index = len(pw.placements) + 1
+	p.Width, p.Height = math.Hypot(m[0], m[1]), math.Hypot(m[2], m[3])
+	p.Angle = math.Atan2(m[1], m[0]) * 180 / math.Pi
+	p.X, p.Y = math.Inf(1), math.Inf(1)
+	for _, corner := range [][2]float64{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		x, y := m.transform(corner[0], corner[1])
+		p.X, p.Y = math.Min(p.X, x), math.Min(p.Y, y)
+	}
+	if p.Width > 0 {
+		p.PPIX = float64(p.PixelWidth) * 72 / p.Width
+	}
+	if p.Height > 0 {
+		p.PPIY = float64(p.PixelHeight) * 72 / p.Height
+	}
+	pw.placements = append(pw.placements, p)
+}
+
+// intValue returns the integer value of `obj` or 0 if it isn't a number.
+func intValue(obj core.PdfObject) int {
+	v, err := core.GetNumberAsInt64(obj)
+	if err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+// colorspaceName returns the family name of color space `cs`.
+func colorspaceName(cs core.PdfObject) string {
+	switch t := core.TraceToDirectObject(cs).(type) {
+	case *core.PdfObjectName:
+		return string(*t)
+	case *core.PdfObjectArray:
+		family, _ := core.GetNameVal(t.Get(0))
+		return family
+	}
+	return "none"
+}
+
+// gsMatrix returns the current transformation matrix of `gs` as a matrix.
+func gsMatrix(gs contentstream.GraphicsState) matrix {
+	ctm := gs.CTM
+	return matrix{ctm[0], ctm[1], ctm[3], ctm[4], ctm[6], ctm[7]}
+}
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+// identityMatrix returns the identity matrix.
+func identityMatrix() matrix {
+	return matrix{1, 0, 0, 1, 0, 0}
+}
+
+// newMatrix returns the matrix with elements `vals`.
+func newMatrix(vals []float64) matrix {
+	var m matrix
+	copy(m[:], vals)
+	return m
+}
+
+// mult returns `m` × `o`, the transform that applies `m` then `o`.
+func (m matrix) mult(o matrix) matrix {
+	return matrix{
+		m[0]*o[0] + m[1]*o[2],
+		m[0]*o[1] + m[1]*o[3],
+		m[2]*o[0] + m[3]*o[2],
+		m[2]*o[1] + m[3]*o[3],
+		m[4]*o[0] + m[5]*o[2] + o[4],
+		m[4]*o[1] + m[5]*o[3] + o[5],
+	}
+}
+
+// transform returns point (`x`, `y`) transformed by `m`.
+func (m matrix) transform(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
@@ -1,29 +1,107 @@
 /*
  * Add images to a PDF file, one image per page.
  *
+ * By default each page is 612 points (8.5") wide and as high as the image's aspect ratio requires.
+ * With -page a4, letter etc. each image is centered on a standard size page, inside -margin points,
+ * with the page turned to match the image's orientation unless -orient is given. Images are drawn at
+ * the size given by their resolution: the DPI stored in the file (JFIF density, PNG pHYs chunk or
+ * TIFF XResolution/YResolution) or -dpi if the file doesn't store one. Images that are larger than
+ * the page are scaled down to fit, and with -fit smaller images are scaled up. -page image makes each
+ * page the size of its image.
+ *
+ * JPEG data is copied into the PDF without being decoded and re-encoded so there is no loss of
+ * quality. Each page of a multi-page TIFF becomes a PDF page, and CCITT G3 and G4 compressed bilevel
+ * TIFF pages are copied without being re-encoded too. Other images are compressed losslessly.
+ *
  * Run as: go run pdf_images_to_pdf.go output.pdf img1.jpg img2.jpg img3.png ...
+ *     or: go run pdf_images_to_pdf.go -page a4 -margin 36 output.pdf scan1.tif scan2.jpg ...
  */
 
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	goimage "image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"math"
 	"os"
+	"strings"
 
 	unicommon "github.com/unidoc/unipdf/v3/common"
-	"github.com/unidoc/unipdf/v3/creator"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/model"
+	"golang.org/x/image/tiff"
 )
 
+const usage = `Usage: go run pdf_images_to_pdf.go [options] output.pdf img1.jpg img2.tif img3.png ...
+
+Puts each image, and each page of multi-page TIFFs, on its own PDF page.
+`
+
+// pageSizes are the standard page sizes in points (portrait).
+var pageSizes = map[string][2]float64{
+	"a3":     {841.89, 1190.55},
+	"a4":     {595.28, 841.89},
+	"a5":     {419.53, 595.28},
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+}
+
+// layoutOptions describes how images are placed on pages.
+type layoutOptions struct {
+	page   string  // "" for 612 point wide pages, "image" or a key of `pageSizes`.
+	margin float64 // Margin in points around images on standard size pages.
+	orient string  // auto, portrait or landscape.
+	dpi    float64 // Resolution of images that don't store one.
+	fit    bool    // Scale images up to fill standard size pages.
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Printf("Usage: go run pdf_add_images.go output.pdf img1.jpg img2.jpg ...\n")
+	var opt layoutOptions
+	var debug bool
+	flag.StringVar(&opt.page, "page", "",
+		"Page size: a3, a4, a5, letter, legal or image. Default is 612 points wide.")
+	flag.Float64Var(&opt.margin, "margin", 0, "Margin in points for standard page sizes.")
+	flag.StringVar(&opt.orient, "orient", "auto", "Orientation of standard size pages: auto, portrait or landscape.")
+	flag.Float64Var(&opt.dpi, "dpi", 72, "Resolution of images that don't store one.")
+	flag.BoolVar(&opt.fit, "fit", false, "Scale small images up to fill standard size pages.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if debug {
+		unicommon.SetLogger(unicommon.NewConsoleLogger(unicommon.LogLevelDebug))
+	}
+	opt.page = strings.ToLower(opt.page)
+	if _, ok := pageSizes[opt.page]; !ok && opt.page != "" && opt.page != "image" {
+		fmt.Fprintf(os.Stderr, "Unknown page size %q\n", opt.page)
+		os.Exit(1)
+	}
+	if opt.orient != "auto" && opt.orient != "portrait" && opt.orient != "landscape" {
+		fmt.Fprintf(os.Stderr, "Unknown orientation %q\n", opt.orient)
+		os.Exit(1)
+	}
+	if opt.dpi <= 0 {
+		fmt.Fprintf(os.Stderr, "-dpi must be positive\n")
 		os.Exit(1)
 	}
 
-	outputPath := os.Args[1]
-	inputPaths := os.Args[2:len(os.Args)]
+	outputPath := args[0]
+	inputPaths := args[1:]
 
-	err := imagesToPdf(inputPaths, outputPath)
+	err := imagesToPdf(inputPaths, outputPath, opt)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
@@ -32,29 +110,623 @@ func main() {
 	fmt.Printf("Complete, see output file: %s\n", outputPath)
 }
 
+// pageImage is an image to be drawn on a page. It is stored as one or more image XObjects, each
+// holding a horizontal strip of the image.
+type pageImage struct {
+	width, height int     // Size in pixels.
+	dpiX, dpiY    float64 // Resolution stored in the image file. 0 if there is none.
+	strips        []imageStrip
+	desc          string // Description of how the image was stored.
+}
+
+// imageStrip is an image XObject holding the rows of a pageImage from `y` to `y+height`.
+type imageStrip struct {
+	y, height int
+	stream    *core.PdfObjectStream
+}
+
 // Images to PDF.
-func imagesToPdf(inputPaths []string, outputPath string) error {
-	c := creator.New()
+func imagesToPdf(inputPaths []string, outputPath string, opt layoutOptions) error {
+	writer := model.NewPdfWriter()
 
 	for _, imgPath := range inputPaths {
 		unicommon.Log.Debug("Image: %s", imgPath)
 
-		img, err := c.NewImageFromFile(imgPath)
+		images, err := loadImages(imgPath)
 		if err != nil {
 			unicommon.Log.Debug("Error loading image: %v", err)
-			return err
+			return fmt.Errorf("%s: %v", imgPath, err)
+		}
+		for i, img := range images {
+			page := makePage(img, opt)
+			if err := writer.AddPage(page); err != nil {
+				return err
+			}
+			mbox := page.MediaBox
+			fmt.Printf("%s page %d: %dx%d pixels, %s -> %.0fx%.0f point page\n", imgPath, i+1, img.width,
+				img.height, img.desc, mbox.Urx, mbox.Ury)
 		}
-		img.ScaleToWidth(612.0)
+	}
+
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writer.Write(f)
+}
+
+// makePage returns a page with `img` drawn on it as described by `opt`.
+func makePage(img *pageImage, opt layoutOptions) *model.PdfPage {
+	// The size of the image in points at its resolution.
+	dpiX, dpiY := img.dpiX, img.dpiY
+	if dpiX <= 0 || dpiY <= 0 {
+		dpiX, dpiY = opt.dpi, opt.dpi
+	}
+	w := float64(img.width) * 72 / dpiX
+	h := float64(img.height) * 72 / dpiY
 
+	var pageW, pageH, x, y float64
+	switch opt.page {
+	case "":
 		// Use page width of 612 points, and calculate the height proportionally based on the image.
 		// Standard PPI is 72 points per inch, thus a width of 8.5"
-		height := 612.0 * img.Height() / img.Width()
-		c.SetPageSize(creator.PageSize{612, height})
-		c.NewPage()
-		img.SetPos(0, 0)
-		_ = c.Draw(img)
+		pageW, pageH = 612, 612*h/w
+		w, h = pageW, pageH
+	case "image":
+		pageW, pageH = w, h
+	default:
+		size := pageSizes[opt.page]
+		pageW, pageH = size[0], size[1]
+		if opt.orient == "landscape" || (opt.orient == "auto" && w > h) {
+			pageW, pageH = pageH, pageW
+		}
+		boxW, boxH := pageW-2*opt.margin, pageH-2*opt.margin
+		scale := math.Min(boxW/w, boxH/h)
+		if scale < 1 || opt.fit {
+			w, h = w*scale, h*scale
+		}
+		x, y = (pageW-w)/2, (pageH-h)/2
+	}
+
+	page := model.NewPdfPage()
+	page.MediaBox = &model.PdfRectangle{Urx: pageW, Ury: pageH}
+	page.Resources = model.NewPdfPageResources()
+	var content bytes.Buffer
+	for i, strip := range img.strips {
+		name := core.PdfObjectName(fmt.Sprintf("Im%d", i))
+		page.Resources.SetXObjectByName(name, strip.stream)
+		// Strips are stored top to bottom and PDF y coordinates increase upwards.
+		stripH := h * float64(strip.height) / float64(img.height)
+		stripY := y + h*float64(img.height-strip.y-strip.height)/float64(img.height)
+		fmt.Fprintf(&content, "q %.4f 0 0 %.4f %.4f %.4f cm /%s Do Q\n", w, stripH, x, stripY, name)
+	}
+	page.SetContentStreams([]string{content.String()}, core.NewFlateEncoder())
+	return page
+}
+
+// loadImages returns the images in image file `imgPath`. TIFF files can hold several images.
+func loadImages(imgPath string) ([]*pageImage, error) {
+	data, err := ioutil.ReadFile(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		img, err := jpegImage(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*pageImage{img}, nil
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		return tiffImages(data)
+	}
+	img, _, err := goimage.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	pimg, err := decodedImage(img, false)
+	if err != nil {
+		return nil, err
+	}
+	pimg.dpiX, pimg.dpiY = pngDPI(data)
+	return []*pageImage{pimg}, nil
+}
+
+// jpegImage returns a pageImage that holds JPEG file contents `data` without re-encoding it.
+func jpegImage(data []byte) (*pageImage, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	colorspace, components := "DeviceRGB", 3
+	switch cfg.ColorModel {
+	case color.GrayModel:
+		colorspace, components = "DeviceGray", 1
+	case color.CMYKModel:
+		colorspace, components = "DeviceCMYK", 4
+	}
+	encoder := core.NewDCTEncoder()
+	dict := encoder.MakeStreamDict()
+	dict.Set("Type", core.MakeName("XObject"))
+	dict.Set("Subtype", core.MakeName("Image"))
+	dict.Set("Width", core.MakeInteger(int64(cfg.Width)))
+	dict.Set("Height", core.MakeInteger(int64(cfg.Height)))
+	dict.Set("ColorSpace", core.MakeName(colorspace))
+	dict.Set("BitsPerComponent", core.MakeInteger(8))
+	dpiX, dpiY, adobe := jpegMarkers(data)
+	if components == 4 && adobe {
+		// Adobe applications write CMYK JPEGs with inverted values.
+		dict.Set("Decode", core.MakeArrayFromIntegers([]int{1, 0, 1, 0, 1, 0, 1, 0}))
+	}
+	dict.Set("Length", core.MakeInteger(int64(len(data))))
+	stream := &core.PdfObjectStream{PdfObjectDictionary: dict, Stream: data}
+	return &pageImage{
+		width:  cfg.Width,
+		height: cfg.Height,
+		dpiX:   dpiX,
+		dpiY:   dpiY,
+		strips: []imageStrip{{y: 0, height: cfg.Height, stream: stream}},
+		desc:   fmt.Sprintf("%s JPEG copied", colorspace),
+	}, nil
+}
+
+// jpegMarkers returns the resolution in the JFIF APP0 segment of JPEG file contents `data` (0 if
+// there is none) and whether the file has an Adobe APP14 segment.
+func jpegMarkers(data []byte) (float64, float64, bool) {
+	var dpiX, dpiY float64
+	adobe := false
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte.
+			i++
+			continue
+		}
+		if marker == 0xda {
+			// Start of scan. The headers are over.
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if n < 2 {
+			// The length includes the length field, so the file is corrupt.
+			break
+		}
+		segment := data[i+4 : minInt(len(data), i+2+n)]
+		switch {
+		case marker == 0xe0 && len(segment) >= 12 && bytes.HasPrefix(segment, []byte("JFIF\x00")):
+			units := segment[7]
+			x := float64(binary.BigEndian.Uint16(segment[8:10]))
+			y := float64(binary.BigEndian.Uint16(segment[10:12]))
+			switch units {
+			case 1: // Dots per inch.
+				dpiX, dpiY = x, y
+			case 2: // Dots per cm.
+				dpiX, dpiY = x*2.54, y*2.54
+			}
+		case marker == 0xee && bytes.HasPrefix(segment, []byte("Adobe")):
+			adobe = true
+		}
+		i += 2 + n
+	}
+	return dpiX, dpiY, adobe
+}
+
+// pngDPI returns the resolution in the pHYs chunk of PNG file contents `data`. 0 if there is none.
+func pngDPI(data []byte) (float64, float64) {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return 0, 0
+	}
+	for i := 8; i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i : i+4]))
+		chunk := string(data[i+4 : i+8])
+		if chunk == "IDAT" || i+8+n > len(data) {
+			break
+		}
+		if chunk == "pHYs" && n >= 9 {
+			body := data[i+8 : i+8+n]
+			if body[8] == 1 { // Pixels per meter.
+				x := float64(binary.BigEndian.Uint32(body[0:4]))
+				y := float64(binary.BigEndian.Uint32(body[4:8]))
+				return x * 0.0254, y * 0.0254
+			}
+			break
+		}
+		i += 12 + n // Length, type, data and CRC.
+	}
+	return 0, 0
+}
+
+// decodedImage returns a pageImage that holds `img` compressed with Flate. If `bilevel` is true the
+// image is stored with 1 bit per pixel.
+func decodedImage(img goimage.Image, bilevel bool) (*pageImage, error) {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	colorspace, components := "DeviceRGB", 3
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		colorspace, components = "DeviceGray", 1
+	case color.CMYKModel:
+		colorspace, components = "DeviceCMYK", 4
+	}
+	bpc := 8
+	samples := imageSamples(img, components)
+	if bilevel {
+		colorspace, components, bpc = "DeviceGray", 1, 1
+		samples = packBits(imageSamples(img, 1), width)
+	}
+
+	encoder := core.NewFlateEncoder()
+	data, err := encoder.EncodeBytes(samples)
+	if err != nil {
+		return nil, err
+	}
+	dict := encoder.MakeStreamDict()
+	dict.Set("Type", core.MakeName("XObject"))
+	dict.Set("Subtype", core.MakeName("Image"))
+	dict.Set("Width", core.MakeInteger(int64(width)))
+	dict.Set("Height", core.MakeInteger(int64(height)))
+	dict.Set("ColorSpace", core.MakeName(colorspace))
+	dict.Set("BitsPerComponent", core.MakeInteger(int64(bpc)))
+	desc := fmt.Sprintf("%s %d bit Flate", colorspace, bpc)
+	if !isOpaque(img) {
+		smask, err := makeSoftMask(img)
+		if err != nil {
+			return nil, err
+		}
+		dict.Set("SMask", smask)
+		desc += " with soft mask"
+	}
+	dict.Set("Length", core.MakeInteger(int64(len(data))))
+	stream := &core.PdfObjectStream{PdfObjectDictionary: dict, Stream: data}
+	return &pageImage{
+		width:  width,
+		height: height,
+		strips: []imageStrip{{y: 0, height: height, stream: stream}},
+		desc:   desc,
+	}, nil
+}
+
+// TIFF tags.
+const (
+	tImageWidth      = 256
+	tImageLength     = 257
+	tBitsPerSample   = 258
+	tCompression     = 259
+	tPhotometric     = 262
+	tFillOrder       = 266
+	tStripOffsets    = 273
+	tSamplesPerPixel = 277
+	tRowsPerStrip    = 278
+	tStripByteCounts = 279
+	tXResolution     = 282
+	tYResolution     = 283
+	tT4Options       = 292
+	tResolutionUnit  = 296
+	tTileWidth       = 322
+)
+
+// tiffIFD is an image file directory: the tags of one image in a TIFF file.
+type tiffIFD struct {
+	offset uint32             // Offset of the IFD in the file.
+	tags   map[int][]uint32   // Integer tag values.
+	rats   map[int][2]float64 // Rational tag values.
+}
+
+// val returns the first value of tag `tag` in `ifd` or `def` if the tag is missing.
+func (ifd tiffIFD) val(tag int, def uint32) uint32 {
+	if v := ifd.tags[tag]; len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+// tiffImages returns the images in TIFF file contents `data`, one for each page.
+func tiffImages(data []byte) ([]*pageImage, error) {
+	ifds, order, err := readTiffIFDs(data)
+	if err != nil {
+		return nil, err
+	}
+	var images []*pageImage
+	for i, ifd := range ifds {
+		img, err := ccittImage(data, ifd)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %v", i+1, err)
+		}
+		if img == nil {
+			// The image can't be copied, so decode it. x/image/tiff decodes the first image in a file,
+			// so a copy of the file that starts with this page's IFD is decoded.
+			patched := append([]byte(nil), data...)
+			order.PutUint32(patched[4:8], ifd.offset)
+			goImg, err := tiff.Decode(bytes.NewReader(patched))
+			if err != nil {
+				return nil, fmt.Errorf("page %d: %v", i+1, err)
+			}
+			bilevel := ifd.val(tBitsPerSample, 1) == 1 && ifd.val(tSamplesPerPixel, 1) == 1
+			img, err = decodedImage(goImg, bilevel)
+			if err != nil {
+				return nil, fmt.Errorf("page %d: %v", i+1, err)
+			}
+		}
+		img.dpiX, img.dpiY = tiffDPI(ifd)
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// readTiffIFDs returns the IFDs in TIFF file contents `data` and the file's byte order.
+func readTiffIFDs(data []byte) ([]tiffIFD, binary.ByteOrder, error) {
+	if len(data) < 8 {
+		return nil, nil, errors.New("TIFF file too short")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	var ifds []tiffIFD
+	visited := map[uint32]bool{}
+	for offset := order.Uint32(data[4:8]); offset != 0; {
+		if visited[offset] || int(offset)+2 > len(data) {
+			return nil, nil, fmt.Errorf("bad IFD offset %d", offset)
+		}
+		visited[offset] = true
+		ifd := tiffIFD{offset: offset, tags: map[int][]uint32{}, rats: map[int][2]float64{}}
+		n := int(order.Uint16(data[offset : offset+2]))
+		end := int(offset) + 2 + 12*n
+		if end+4 > len(data) {
+			return nil, nil, fmt.Errorf("IFD at %d runs past the end of the file", offset)
+		}
+		for i := 0; i < n; i++ {
+			entry := data[int(offset)+2+12*i:]
+			tag := int(order.Uint16(entry[0:2]))
+			typ := order.Uint16(entry[2:4])
+			count := int(order.Uint32(entry[4:8]))
+			size := map[uint16]int{1: 1, 3: 2, 4: 4, 5: 8}[typ]
+			if size == 0 || count <= 0 || count > len(data) {
+				continue
+			}
+			// Values are stored in the entry if they fit in 4 bytes.
+			values := entry[8:12]
+			if size*count > 4 {
+				start := int(order.Uint32(entry[8:12]))
+				if start+size*count > len(data) {
+					continue
+				}
+				values = data[start : start+size*count]
+			}
+			switch typ {
+			case 1:
+				for j := 0; j < count; j++ {
+					ifd.tags[tag] = append(ifd.tags[tag], uint32(values[j]))
+				}
+			case 3:
+				for j := 0; j < count; j++ {
+					ifd.tags[tag] = append(ifd.tags[tag], uint32(order.Uint16(values[2*j:])))
+				}
+			case 4:
+				for j := 0; j < count; j++ {
+					ifd.tags[tag] = append(ifd.tags[tag], order.Uint32(values[4*j:]))
+				}
+			case 5:
+				ifd.rats[tag] = [2]float64{float64(order.Uint32(values[0:4])),
+					float64(order.Uint32(values[4:8]))}
+			}
+		}
+		ifds = append(ifds, ifd)
+		offset = order.Uint32(data[end : end+4])
+	}
+	if len(ifds) == 0 {
+		return nil, nil, errors.New("no images in TIFF file")
+	}
+	return ifds, order, nil
+}
+
+// tiffDPI returns the resolution of the image described by `ifd`. 0 if it isn't stored.
+func tiffDPI(ifd tiffIFD) (float64, float64) {
+	x, y := ifd.rats[tXResolution], ifd.rats[tYResolution]
+	if x[1] == 0 || y[1] == 0 {
+		return 0, 0
+	}
+	dpiX, dpiY := x[0]/x[1], y[0]/y[1]
+	switch ifd.val(tResolutionUnit, 2) {
+	case 2: // Inches.
+		return dpiX, dpiY
+	case 3: // Centimeters.
+		return dpiX * 2.54, dpiY * 2.54
+	}
+	return 0, 0
+}
+
+// ccittImage returns a pageImage that holds the CCITT compressed bilevel TIFF image described by
+// `ifd` in TIFF file contents `data` without re-encoding it. Each TIFF strip is coded separately so
+// each is stored as an image XObject. Returns nil if the image isn't CCITT compressed or can't be
+// copied.
+func ccittImage(data []byte, ifd tiffIFD) (*pageImage, error) {
+	compression := ifd.val(tCompression, 1)
+	if compression != 2 && compression != 3 && compression != 4 {
+		return nil, nil
+	}
+	if ifd.val(tBitsPerSample, 1) != 1 || ifd.val(tSamplesPerPixel, 1) != 1 || ifd.tags[tTileWidth] != nil {
+		return nil, nil
+	}
+	width, height := int(ifd.val(tImageWidth, 0)), int(ifd.val(tImageLength, 0))
+	offsets, counts := ifd.tags[tStripOffsets], ifd.tags[tStripByteCounts]
+	if width <= 0 || height <= 0 || len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, nil
+	}
+	rowsPerStrip := int(ifd.val(tRowsPerStrip, uint32(height)))
+	if rowsPerStrip <= 0 || rowsPerStrip > height {
+		rowsPerStrip = height
+	}
+
+	// PDF's CCITTFaxDecode parameters for the TIFF compression.
+	k, byteAlign := -1, false
+	kind := "G4"
+	switch compression {
+	case 2:
+		// Modified Huffman: 1-D coding with each row starting on a byte boundary.
+		k, byteAlign, kind = 0, true, "MH"
+	case 3:
+		t4 := ifd.val(tT4Options, 0)
+		k, byteAlign, kind = 0, t4&4 != 0, "G3"
+		if t4&1 != 0 {
+			k = 1
+		}
 	}
+	// TIFF CCITT images are normally WhiteIsZero. BlackIsZero images are inverted to look the same as
+	// in TIFF viewers.
+	invert := ifd.val(tPhotometric, 0) == 1
+	reverse := ifd.val(tFillOrder, 1) == 2
 
-	err := c.WriteToFile(outputPath)
-	return err
+	img := &pageImage{width: width, height: height, desc: "CCITT " + kind + " copied"}
+	for i, offset := range offsets {
+		y := i * rowsPerStrip
+		if y >= height {
+			break
+		}
+		rows := minInt(rowsPerStrip, height-y)
+		if int(offset)+int(counts[i]) > len(data) {
+			return nil, fmt.Errorf("strip %d runs past the end of the file", i)
+		}
+		strip := append([]byte(nil), data[offset:offset+counts[i]]...)
+		if reverse {
+			// The bits in each byte are stored least significant bit first.
+			for j, c := range strip {
+				strip[j] = reverseBits(c)
+			}
+		}
+
+		params := core.MakeDict()
+		params.Set("K", core.MakeInteger(int64(k)))
+		params.Set("Columns", core.MakeInteger(int64(width)))
+		params.Set("Rows", core.MakeInteger(int64(rows)))
+		if byteAlign {
+			params.Set("EncodedByteAlign", core.MakeBool(true))
+		}
+		dict := core.MakeDict()
+		dict.Set("Type", core.MakeName("XObject"))
+		dict.Set("Subtype", core.MakeName("Image"))
+		dict.Set("Width", core.MakeInteger(int64(width)))
+		dict.Set("Height", core.MakeInteger(int64(rows)))
+		dict.Set("ColorSpace", core.MakeName("DeviceGray"))
+		dict.Set("BitsPerComponent", core.MakeInteger(1))
+		dict.Set("Filter", core.MakeName("CCITTFaxDecode"))
+		dict.Set("DecodeParms", params)
+		if invert {
+			dict.Set("Decode", core.MakeArrayFromIntegers([]int{1, 0}))
+		}
+		dict.Set("Length", core.MakeInteger(int64(len(strip))))
+		stream := &core.PdfObjectStream{PdfObjectDictionary: dict, Stream: strip}
+		img.strips = append(img.strips, imageStrip{y: y, height: rows, stream: stream})
+	}
+	if len(img.strips) > 1 {
+		img.desc += fmt.Sprintf(" in %d strips", len(img.strips))
+	}
+	return img, nil
+}
+
+// reverseBits returns `c` with its bits in the reverse order.
+func reverseBits(c byte) byte {
+	var r byte
+	for i := 0; i < 8; i++ {
+		r = r<<1 | c&1
+		c >>= 1
+	}
+	return r
+}
+
+// isOpaque returns true if `img` has no transparent pixels.
+func isOpaque(img goimage.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// imageSamples returns the 8 bit samples of `img` with `components` color components per pixel
+// (1: gray, 3: RGB, 4: CMYK). Transparent pixels are unpremultiplied.
+func imageSamples(img goimage.Image, components int) []byte {
+	b := img.Bounds()
+	samples := make([]byte, 0, b.Dx()*b.Dy()*components)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			switch components {
+			case 1:
+				samples = append(samples, color.GrayModel.Convert(c).(color.Gray).Y)
+			case 4:
+				k := color.CMYKModel.Convert(c).(color.CMYK)
+				samples = append(samples, k.C, k.M, k.Y, k.K)
+			default:
+				n := color.NRGBAModel.Convert(c).(color.NRGBA)
+				samples = append(samples, n.R, n.G, n.B)
+			}
+		}
+	}
+	return samples
+}
+
+// packBits returns the gray samples `samples` of an image `width` pixels wide as 1 bit per pixel
+// samples. Each row starts on a byte boundary.
+func packBits(samples []byte, width int) []byte {
+	rowBytes := (width + 7) / 8
+	height := len(samples) / width
+	packed := make([]byte, rowBytes*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if samples[y*width+x] >= 0x80 {
+				packed[y*rowBytes+x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	return packed
+}
+
+// makeSoftMask returns a soft mask image XObject with the alpha channel of `img`.
+func makeSoftMask(img goimage.Image) (*core.PdfObjectStream, error) {
+	b := img.Bounds()
+	alpha := make([]byte, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			alpha = append(alpha, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA).A)
+		}
+	}
+	encoder := core.NewFlateEncoder()
+	data, err := encoder.EncodeBytes(alpha)
+	if err != nil {
+		return nil, err
+	}
+	dict := encoder.MakeStreamDict()
+	dict.Set("Type", core.MakeName("XObject"))
+	dict.Set("Subtype", core.MakeName("Image"))
+	dict.Set("Width", core.MakeInteger(int64(b.Dx())))
+	dict.Set("Height", core.MakeInteger(int64(b.Dy())))
+	dict.Set("ColorSpace", core.MakeName("DeviceGray"))
+	dict.Set("BitsPerComponent", core.MakeInteger(8))
+	dict.Set("Length", core.MakeInteger(int64(len(data))))
+	return &core.PdfObjectStream{PdfObjectDictionary: dict, Stream: data}, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
 }
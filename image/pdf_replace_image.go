@@ -0,0 +1,734 @@
+/*
+ * Replace images in a PDF file with a JPEG or PNG image.
+ *
+ * The images to replace are selected by page and image number (as numbered by
+ * pdf_extract_images_position.go, counting inline images and images in form XObjects in the order
+ * they are drawn), by XObject name or by the SHA-256 hash of their decoded pixel data. Use -list to
+ * see the numbers, names and hashes of the images in a file.
+ *
+ * The image XObject is replaced in place, so every placement of it keeps its transformation matrix
+ * and the new image is drawn where the old one was. With -fit contain the new image keeps its aspect
+ * ratio inside the area of the old one. Images used on several pages are replaced on all of them.
+ *
+ * The new image is converted to the color space of the old one when it is DeviceGray, DeviceRGB,
+ * DeviceCMYK or an equivalent ICCBased or calibrated color space, and to DeviceRGB otherwise. The
+ * transparency of PNG images is kept in a soft mask. If the new image is opaque, the old image's mask
+ * is dropped so the whole new image is shown. With -keepmask the old soft mask or stencil mask is kept
+ * if the new image has the same dimensions as the old one. Color key masks are always dropped as they
+ * would make arbitrary colors of the new image transparent.
+ *
+ * JPEG files are copied into the PDF without re-encoding when the DCT filter is used and no color
+ * conversion is needed.
+ *
+ * Inline images and image masks are not replaced.
+ *
+ * Run as: go run pdf_replace_image.go -list input.pdf
+ *     or: go run pdf_replace_image.go (-p page -i n | -name Im1 | -hash abc123) input.pdf logo.png output.pdf
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	goimage "image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/contentstream"
+	"github.com/unidoc/unipdf/v3/core"
+	pdf "github.com/unidoc/unipdf/v3/model"
+)
+
+const usage = `Usage: go run pdf_replace_image.go -list input.pdf
+   or: go run pdf_replace_image.go [options] input.pdf replacement.jpg|png output.pdf
+
+The images to replace are selected with -p and -i, -name or -hash. If more than one is given, images must
+match all of them.
+`
+
+func main() {
+	// Make sure to enter a valid license key.
+	// Otherwise text is truncated and a watermark added to the text.
+	// License keys are available via: https://unidoc.io
+	/*
+			license.SetLicenseKey(`
+		-----BEGIN UNIDOC LICENSE KEY-----
+		...key contents...
+		-----END UNIDOC LICENSE KEY-----
+		`)
+	*/
+	var sel imageSelector
+	var opt replaceOptions
+	var list, debug bool
+	flag.BoolVar(&list, "list", false, "List the images in input.pdf.")
+	flag.IntVar(&sel.page, "p", 0, "Replace images on this page number (1-offset).")
+	flag.IntVar(&sel.index, "i", 0, "Replace the image with this image number (1-offset) on the page given by -p.")
+	flag.StringVar(&sel.name, "name", "", "Replace images with this XObject name.")
+	flag.StringVar(&sel.hash, "hash", "", "Replace images whose SHA-256 hash starts with this (at least 8 hex digits).")
+	flag.StringVar(&opt.filter, "filter", "auto", "Encoding of the new image: auto, dct or flate. auto is dct for JPEGs.")
+	flag.IntVar(&opt.quality, "q", 90, "JPEG quality when encoding with dct.")
+	flag.StringVar(&opt.fit, "fit", "stretch", "stretch: fill the old image's area. contain: keep the new image's aspect ratio.")
+	flag.BoolVar(&opt.keepMask, "keepmask", false, "Keep the old image's mask if the new image is opaque and the same size.")
+	flag.BoolVar(&debug, "d", false, "Print debugging information.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	} else {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelInfo))
+	}
+
+	if list {
+		if len(args) < 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := listImages(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "listImages failed. inputPath=%q err=%v\n", args[0], err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(args) < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err := sel.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	switch opt.filter {
+	case "auto", "dct", "flate":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown filter %q\n", opt.filter)
+		os.Exit(1)
+	}
+	switch opt.fit {
+	case "stretch", "contain":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown fit %q\n", opt.fit)
+		os.Exit(1)
+	}
+
+	inputPath, imagePath, outputPath := args[0], args[1], args[2]
+	err := replaceImages(inputPath, imagePath, outputPath, sel, opt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replaceImages failed. inputPath=%q imagePath=%q err=%v\n",
+			inputPath, imagePath, err)
+		os.Exit(1)
+	}
+}
+
+// imageSelector selects the images to replace.
+type imageSelector struct {
+	page  int    // (1-offset) Page number. 0 for all pages.
+	index int    // (1-offset) Image number on `page`. 0 for all images.
+	name  string // XObject name. "" for any name.
+	hash  string // Prefix of the SHA-256 hash of the image data. "" for any hash.
+}
+
+// validate returns an error if `sel` doesn't select specific images.
+func (sel *imageSelector) validate() error {
+	sel.hash = strings.ToLower(sel.hash)
+	if sel.index > 0 && sel.page <= 0 {
+		return fmt.Errorf("-i requires -p")
+	}
+	if sel.hash != "" && len(sel.hash) < 8 {
+		return fmt.Errorf("-hash must have at least 8 hex digits")
+	}
+	if sel.index <= 0 && sel.name == "" && sel.hash == "" {
+		return fmt.Errorf("select the images to replace with -p and -i, -name or -hash")
+	}
+	return nil
+}
+
+// matches returns true if `img` is selected by `sel`.
+func (sel imageSelector) matches(img *imageRef) bool {
+	if sel.page > 0 && img.page != sel.page {
+		return false
+	}
+	if sel.index > 0 && img.index != sel.index {
+		return false
+	}
+	if sel.name != "" && img.name != sel.name {
+		return false
+	}
+	if sel.hash != "" && !strings.HasPrefix(img.hash(), sel.hash) {
+		return false
+	}
+	return true
+}
+
+// replaceOptions control how the replacement image is encoded and placed.
+type replaceOptions struct {
+	filter  string // auto, dct or flate.
+	quality int    // JPEG quality for dct.
+	fit     string // stretch or contain.
+	// keepMask keeps the old image's soft mask or stencil mask when the new image is opaque and has
+	// the same dimensions.
+	keepMask bool
+}
+
+// imageRef is a placement of an image on a page.
+type imageRef struct {
+	page   int                   // (1-offset) Page number.
+	index  int                   // (1-offset) Number of the image on the page.
+	name   string                // XObject name. "" for inline images.
+	stream *core.PdfObjectStream // The image XObject. nil for inline images.
+	sum    string                // Cached hash.
+}
+
+// hash returns the hex SHA-256 hash of the decoded data of the image XObject in `img`. The raw stream
+// data is hashed if it can't be decoded.
+func (img *imageRef) hash() string {
+	if img.stream == nil || img.sum != "" {
+		return img.sum
+	}
+	data, err := core.DecodeStream(img.stream)
+	if err != nil {
+		data = img.stream.Stream
+	}
+	sum := sha256.Sum256(data)
+	img.sum = hex.EncodeToString(sum[:])
+	return img.sum
+}
+
+// hashImages computes the hashes of `images`. Each XObject is only hashed once.
+func hashImages(images []*imageRef) {
+	hashes := map[*core.PdfObjectStream]string{}
+	for _, img := range images {
+		if img.stream == nil {
+			continue
+		}
+		if sum, ok := hashes[img.stream]; ok {
+			img.sum = sum
+			continue
+		}
+		hashes[img.stream] = img.hash()
+	}
+}
+
+// listImages prints the images in PDF file `inputPath`.
+func listImages(inputPath string) error {
+	pdfReader, f, err := openPdf(inputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	images, err := findImages(pdfReader)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d images\n", inputPath, len(images))
+	hashImages(images)
+	for _, img := range images {
+		if img.stream == nil {
+			fmt.Printf("  page %d image %d: inline\n", img.page, img.index)
+			continue
+		}
+		width, _ := core.GetNumberAsInt64(img.stream.Get("Width"))
+		height, _ := core.GetNumberAsInt64(img.stream.Get("Height"))
+		filter := "none"
+		if obj := img.stream.Get("Filter"); obj != nil {
+			filter = strings.Trim(core.TraceToDirectObject(obj).String(), "[]")
+		}
+		fmt.Printf("  page %d image %d: name=%s obj=%d %dx%d cs=%s filter=%s hash=%s\n", img.page,
+			img.index, img.name, img.stream.ObjectNumber, width, height,
+			colorspaceName(img.stream.Get("ColorSpace")), filter, img.hash()[:16])
+	}
+	return nil
+}
+
+// replaceImages replaces the images selected by `sel` in PDF file `inputPath` with the image in
+// `imagePath` as described by `opt` and saves the result to `outputPath`.
+func replaceImages(inputPath, imagePath, outputPath string, sel imageSelector, opt replaceOptions) error {
+	pdfReader, f, err := openPdf(inputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	newImage, err := loadImage(imagePath)
+	if err != nil {
+		return fmt.Errorf("loadImage failed. err=%v", err)
+	}
+
+	images, err := findImages(pdfReader)
+	if err != nil {
+		return err
+	}
+	if sel.hash != "" {
+		// The hashes must be computed before any images are replaced.
+		hashImages(images)
+	}
+
+	// Each selected XObject is replaced once, however many times it is drawn.
+	replaced := map[*core.PdfObjectStream]bool{}
+	placements := 0
+	for _, img := range images {
+		if !sel.matches(img) {
+			continue
+		}
+		if img.stream == nil {
+			fmt.Printf("Page %d image %d is an inline image. Skipping.\n", img.page, img.index)
+			continue
+		}
+		placements++
+		if replaced[img.stream] {
+			continue
+		}
+		if isMask, _ := core.GetBoolVal(img.stream.Get("ImageMask")); isMask {
+			fmt.Printf("Page %d image %d is an image mask. Skipping.\n", img.page, img.index)
+			continue
+		}
+		notes, err := replaceXObject(img.stream, newImage, opt)
+		if err != nil {
+			return fmt.Errorf("replaceXObject failed. page %d image %d err=%v", img.page, img.index, err)
+		}
+		replaced[img.stream] = true
+		fmt.Printf("Replaced page %d image %d (%s obj=%d). %s\n", img.page, img.index, img.name,
+			img.stream.ObjectNumber, strings.Join(notes, " "))
+	}
+	if len(replaced) == 0 {
+		return fmt.Errorf("no images matched")
+	}
+
+	pdfWriter := pdf.NewPdfWriter()
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return err
+	}
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return err
+		}
+		if err := pdfWriter.AddPage(page); err != nil {
+			return err
+		}
+	}
+	fOut, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer fOut.Close()
+	if err := pdfWriter.Write(fOut); err != nil {
+		return err
+	}
+	fmt.Printf("Replaced %d images (%d placements). Saved %q\n", len(replaced), placements, outputPath)
+	return nil
+}
+
+// openPdf opens PDF file `inputPath` and returns a reader for it and the open file.
+func openPdf(inputPath string) (*pdf.PdfReader, *os.File, error) {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	pdfReader, err := pdf.NewPdfReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	// Try decrypting with an empty one.
+	if isEncrypted {
+		auth, err := pdfReader.Decrypt([]byte(""))
+		if err != nil || !auth {
+			f.Close()
+			return nil, nil, fmt.Errorf("unable to access (encrypted). err=%v", err)
+		}
+	}
+	return pdfReader, f, nil
+}
+
+// findImages returns the image placements on the pages read by `pdfReader` in the order they are
+// drawn.
+func findImages(pdfReader *pdf.PdfReader) ([]*imageRef, error) {
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, err
+	}
+	var images []*imageRef
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := page.GetAllContentStreams()
+		if err != nil {
+			return nil, err
+		}
+		var resources core.PdfObject
+		if page.Resources != nil {
+			resources = page.Resources.ToPdfObject()
+		}
+		var pageImages []*imageRef
+		if err := walkContent(contents, resources, pageNum, &pageImages, 0); err != nil {
+			return nil, fmt.Errorf("page %d: %v", pageNum, err)
+		}
+		images = append(images, pageImages...)
+	}
+	return images, nil
+}
+
+// walkContent appends the image placements in content stream `contents` with resources `resources`
+// on page `pageNum` to `images`. Form XObjects are walked recursively. `level` is the form nesting
+// level.
+func walkContent(contents string, resources core.PdfObject, pageNum int, images *[]*imageRef,
+	level int) error {
+	if level > 10 {
+		return nil
+	}
+	operations, err := contentstream.NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return err
+	}
+	var xobjects *core.PdfObjectDictionary
+	if resDict, ok := core.GetDict(resources); ok {
+		xobjects, _ = core.GetDict(resDict.Get("XObject"))
+	}
+	for _, op := range *operations {
+		switch op.Operand {
+		case "BI":
+			*images = append(*images, &imageRef{page: pageNum, index: len(*images) + 1})
+		case "Do":
+			if len(op.Params) != 1 || xobjects == nil {
+				continue
+			}
+			name, ok := core.GetNameVal(op.Params[0])
+			if !ok {
+				continue
+			}
+			stream, ok := core.GetStream(xobjects.Get(core.PdfObjectName(name)))
+			if !ok {
+				continue
+			}
+			switch subtype, _ := core.GetNameVal(stream.Get("Subtype")); subtype {
+			case "Image":
+				*images = append(*images, &imageRef{page: pageNum, index: len(*images) + 1, name: name,
+					stream: stream})
+			case "Form":
+				formContents, err := core.DecodeStream(stream)
+				if err != nil {
+					return err
+				}
+				// Forms without resources use the resources of the content stream they are drawn in.
+				formResources := stream.Get("Resources")
+				if formResources == nil {
+					formResources = resources
+				}
+				if err := walkContent(string(formContents), formResources, pageNum, images,
+					level+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sourceImage is a replacement image.
+type sourceImage struct {
+	img  goimage.Image
+	jpeg []byte // The file contents if the image is a JPEG.
+	// jpegComponents is the number of color components in the JPEG.
+	jpegComponents int
+	opaque         bool
+}
+
+// loadImage returns the JPEG or PNG image in `imagePath`.
+func loadImage(imagePath string) (*sourceImage, error) {
+	data, err := ioutil.ReadFile(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	img, format, err := goimage.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	src := &sourceImage{img: img, opaque: isOpaque(img)}
+	if format == "jpeg" {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		src.jpeg = data
+		switch cfg.ColorModel {
+		case color.GrayModel:
+			src.jpegComponents = 1
+		case color.CMYKModel:
+			src.jpegComponents = 4
+		default:
+			src.jpegComponents = 3
+		}
+	}
+	return src, nil
+}
+
+// isOpaque returns true if `img` has no transparent pixels.
+func isOpaque(img goimage.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// replaceXObject replaces the contents of image XObject `stream` with `src` as described by `opt`.
+// It returns notes about how the image was replaced.
+func replaceXObject(stream *core.PdfObjectStream, src *sourceImage, opt replaceOptions) ([]string, error) {
+	var notes []string
+	oldWidth, _ := core.GetNumberAsInt64(stream.Get("Width"))
+	oldHeight, _ := core.GetNumberAsInt64(stream.Get("Height"))
+	b := src.img.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	// The color space of the new image.
+	colorspace, components := targetColorspace(stream.Get("ColorSpace"))
+	notes = append(notes, fmt.Sprintf("ColorSpace=%s.", colorspaceName(colorspace)))
+
+	filter := opt.filter
+	if filter == "auto" {
+		filter = "flate"
+		if src.jpeg != nil {
+			filter = "dct"
+		}
+	}
+	if filter == "dct" && components == 4 {
+		// The Go JPEG encoder can't write CMYK images.
+		filter = "flate"
+		notes = append(notes, "CMYK image encoded with flate.")
+	}
+
+	var data []byte
+	var encoder core.StreamEncoder
+	if filter == "dct" && src.jpeg != nil && src.jpegComponents == components {
+		// Copy the JPEG data without re-encoding it.
+		data = src.jpeg
+		encoder = core.NewDCTEncoder()
+		notes = append(notes, "JPEG copied.")
+	} else {
+		samples := imageSamples(src.img, components)
+		if filter == "dct" {
+			enc := core.NewDCTEncoder()
+			enc.ColorComponents = components
+			enc.BitsPerComponent = 8
+			enc.Width = width
+			enc.Height = height
+			enc.Quality = opt.quality
+			encoder = enc
+		} else {
+			encoder = core.NewFlateEncoder()
+		}
+		var err error
+		data, err = encoder.EncodeBytes(samples)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dict := encoder.MakeStreamDict()
+	dict.Set("Type", core.MakeName("XObject"))
+	dict.Set("Subtype", core.MakeName("Image"))
+	dict.Set("Width", core.MakeInteger(int64(width)))
+	dict.Set("Height", core.MakeInteger(int64(height)))
+	dict.Set("ColorSpace", colorspace)
+	dict.Set("BitsPerComponent", core.MakeInteger(8))
+	for _, key := range []core.PdfObjectName{"Intent", "Interpolate"} {
+		if obj := stream.Get(key); obj != nil {
+			dict.Set(key, obj)
+		}
+	}
+
+	// Transparency.
+	switch {
+	case !src.opaque:
+		smask, err := makeSoftMask(src.img)
+		if err != nil {
+			return nil, err
+		}
+		dict.Set("SMask", smask)
+		notes = append(notes, "Alpha kept in SMask.")
+	case stream.Get("SMask") != nil || stream.Get("Mask") != nil:
+		// A /Mask array is a color key mask, which would make pixels of the new image transparent
+		// depending on their colors, so only soft masks and stencil mask streams can be kept.
+		var masks []core.PdfObjectName
+		if stream.Get("SMask") != nil {
+			masks = append(masks, "SMask")
+		}
+		if _, ok := core.GetStream(stream.Get("Mask")); ok {
+			masks = append(masks, "Mask")
+		}
+		switch {
+		case !opt.keepMask:
+			notes = append(notes, "Old mask dropped as the new image is opaque.")
+		case len(masks) == 0:
+			notes = append(notes, "Old color key mask dropped.")
+		case int64(width) != oldWidth || int64(height) != oldHeight:
+			notes = append(notes, "Old mask dropped as the image size changed.")
+		default:
+			for _, key := range masks {
+				dict.Set(key, stream.Get(key))
+			}
+			notes = append(notes, "Old mask kept.")
+		}
+	}
+
+	if opt.fit == "contain" && oldWidth > 0 && oldHeight > 0 {
+		// Draw the new image in a form XObject that fills the unit square that the old image was
+		// drawn in, with the new image centered in it at its own aspect ratio.
+		dict.Set("Length", core.MakeInteger(int64(len(data))))
+		image := &core.PdfObjectStream{PdfObjectDictionary: dict, Stream: data}
+		oldAspect := float64(oldWidth) / float64(oldHeight)
+		newAspect := float64(width) / float64(height)
+		w, h := 1.0, 1.0
+		if newAspect > oldAspect {
+			h = oldAspect / newAspect
+		} else {
+			w = newAspect / oldAspect
+		}
+		content := fmt.Sprintf("q %.6f 0 0 %.6f %.6f %.6f cm /Im0 Do Q", w, h, (1-w)/2, (1-h)/2)
+		xobjects := core.MakeDict()
+		xobjects.Set("Im0", image)
+		resources := core.MakeDict()
+		resources.Set("XObject", xobjects)
+		dict = core.MakeDict()
+		dict.Set("Type", core.MakeName("XObject"))
+		dict.Set("Subtype", core.MakeName("Form"))
+		dict.Set("BBox", core.MakeArrayFromIntegers([]int{0, 0, 1, 1}))
+		dict.Set("Resources", resources)
+		data = []byte(content)
+		notes = append(notes, "Aspect ratio kept.")
+	}
+
+	dict.Set("Length", core.MakeInteger(int64(len(data))))
+	stream.PdfObjectDictionary = dict
+	stream.Stream = data
+	return notes, nil
+}
+
+// targetColorspace returns the color space that a replacement for an image in color space `cs` is
+// encoded in and its number of components. Device, ICCBased and calibrated color spaces are kept.
+// Other color spaces are replaced with DeviceRGB.
+func targetColorspace(cs core.PdfObject) (core.PdfObject, int) {
+	switch t := core.TraceToDirectObject(cs).(type) {
+	case *core.PdfObjectName:
+		switch *t {
+		case "DeviceGray":
+			return cs, 1
+		case "DeviceRGB":
+			return cs, 3
+		case "DeviceCMYK":
+			return cs, 4
+		}
+	case *core.PdfObjectArray:
+		family, _ := core.GetNameVal(t.Get(0))
+		switch family {
+		case "CalGray":
+			return cs, 1
+		case "CalRGB":
+			return cs, 3
+		case "ICCBased":
+			if icc, ok := core.GetStream(t.Get(1)); ok {
+				if n, err := core.GetNumberAsInt64(icc.Get("N")); err == nil && (n == 1 || n == 3 || n == 4) {
+					return cs, int(n)
+				}
+			}
+		}
+	}
+	return core.MakeName("DeviceRGB"), 3
+}
+
+// colorspaceName returns a short description of color space `cs`.
+func colorspaceName(cs core.PdfObject) string {
+	switch t := core.TraceToDirectObject(cs).(type) {
+	case *core.PdfObjectName:
+		return string(*t)
+	case *core.PdfObjectArray:
+		family, _ := core.GetNameVal(t.Get(0))
+		return family
+	}
+	return "none"
+}
+
+// imageSamples returns the 8 bit samples of `img` with `components` color components per pixel
+// (1: gray, 3: RGB, 4: CMYK). Transparent pixels are unpremultiplied.
+func imageSamples(img goimage.Image, components int) []byte {
+	b := img.Bounds()
+	samples := make([]byte, 0, b.Dx()*b.Dy()*components)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			switch components {
+			case 1:
+				g := color.GrayModel.Convert(color.RGBA{c.R, c.G, c.B, 0xff}).(color.Gray)
+				samples = append(samples, g.Y)
+			case 4:
+				k := color.CMYKModel.Convert(color.RGBA{c.R, c.G, c.B, 0xff}).(color.CMYK)
+				samples = append(samples, k.C, k.M, k.Y, k.K)
+			default:
+				samples = append(samples, c.R, c.G, c.B)
+			}
+		}
+	}
+	return samples
+}
+
+// makeSoftMask returns a soft mask image XObject with the alpha channel of `img`.
+func makeSoftMask(img goimage.Image) (*core.PdfObjectStream, error) {
+	b := img.Bounds()
+	alpha := make([]byte, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			alpha = append(alpha, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA).A)
+		}
+	}
+	encoder := core.NewFlateEncoder()
+	data, err := encoder.EncodeBytes(alpha)
+	if err != nil {
+		return nil, err
+	}
+	dict := encoder.MakeStreamDict()
+	dict.Set("Type", core.MakeName("XObject"))
+	dict.Set("Subtype", core.MakeName("Image"))
+	dict.Set("Width", core.MakeInteger(int64(b.Dx())))
+	dict.Set("Height", core.MakeInteger(int64(b.Dy())))
+	dict.Set("ColorSpace", core.MakeName("DeviceGray"))
+	dict.Set("BitsPerComponent", core.MakeInteger(8))
+	dict.Set("Length", core.MakeInteger(int64(len(data))))
+	return &core.PdfObjectStream{PdfObjectDictionary: dict, Stream: data}, nil
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
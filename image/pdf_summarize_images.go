@@ -4,15 +4,26 @@
  * handles images referred within XObject Form content streams.
  * Outputs a summary of the images found.
  *
+ * With -dup, duplicate images are also reported. Images whose streams are byte for byte the same are
+ * exact duplicates and the bytes used by all but one copy are wasted. Images whose decoded pixels
+ * have dHash and pHash perceptual hashes within -dist bits of each other are reported as similar,
+ * e.g. the same logo saved at another resolution or the same scanned signature.
+ *
  * Run as: go run pdf_summarize_images.go ~/testdata/*.pdf
+ *     or: go run pdf_summarize_images.go -dup -dups duplicates.csv ~/testdata/*.pdf
  */
 
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	goimage "image"
+	"math"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"sort"
@@ -27,6 +38,9 @@ import (
 
 const usage = "Usage: go run pdf_summarize_images.go testdata/*.pdf\n"
 
+// findDups is true if images are hashed to find duplicates.
+var findDups bool
+
 func main() {
 	var debug, trace bool
 	flag.BoolVar(&debug, "d", false, "Print debugging information.")
@@ -37,6 +51,11 @@ func main() {
 	flag.StringVar(&csvPath, "o", "results.csv", "CSV results file.")
 	flag.BoolVar(&byDoc, "p", false, "No page numbers specified in CSV file rows.")
 	flag.BoolVar(&noDims, "w", false, "No widths and heights specified in CSV file rows.")
+	var maxDist int
+	var dupsPath string
+	flag.BoolVar(&findDups, "dup", false, "Report duplicate and similar images.")
+	flag.IntVar(&maxDist, "dist", 6, "Maximum perceptual hash distance (bits) of similar images.")
+	flag.StringVar(&dupsPath, "dups", "", "CSV file of duplicate and similar images.")
 	makeUsage(usage)
 
 	flag.Parse()
@@ -84,6 +103,13 @@ func main() {
 
 	showSummary(corpus, corpusInfo)
 	saveAsCsv(csvPath, corpus, corpusInfo, doSort, byDoc, noDims)
+	if findDups {
+		clusters := findDuplicates(corpus, corpusInfo, maxDist)
+		showDuplicates(clusters, maxDist)
+		if dupsPath != "" {
+			saveDuplicatesCsv(dupsPath, clusters)
+		}
+	}
 }
 
 // fileImages returns a list of imageInfo entries for the images in the PDF file `inputPath`.
@@ -213,6 +239,14 @@ func contentStreamImages(contents string, resources *pdf.PdfPageResources) ([]im
 				colorspace: colorspace,
 				bpc:        bpc,
 			}
+			if findDups {
+				data := []byte(iimg.WriteString())
+				info.size = len(data)
+				info.hash = streamHash(data)
+				if img != nil && cs != nil {
+					info.dhash, info.phash, info.hasPHash = perceptualHashes(img, cs)
+				}
+			}
 
 			infoList = append(infoList, info)
 
@@ -226,7 +260,7 @@ func contentStreamImages(contents string, resources *pdf.PdfPageResources) ([]im
 			}
 			processedXObjects[string(*name)] = true
 
-			_, xtype := resources.GetXObjectByName(*name)
+			stream, xtype := resources.GetXObjectByName(*name)
 			if xtype == pdf.XObjectTypeImage {
 
 				ximg, err := resources.GetXObjectImageByName(*name)
@@ -260,6 +294,14 @@ func contentStreamImages(contents string, resources *pdf.PdfPageResources) ([]im
 					colorspace: ximg.ColorSpace.String(),
 					bpc:        bpc,
 				}
+				if findDups {
+					info.objNum = stream.ObjectNumber
+					info.size = len(stream.Stream)
+					info.hash = streamHash(stream.Stream)
+					if img != nil {
+						info.dhash, info.phash, info.hasPHash = perceptualHashes(img, ximg.ColorSpace)
+					}
+				}
 				infoList = append(infoList, info)
 
 			} else if xtype == pdf.XObjectTypeForm {
@@ -304,6 +346,14 @@ type imageInfo struct {
 	colorspace string
 	bpc        int
 	count      int
+
+	// Set with -dup.
+	objNum   int64  // Object number of XObject images.
+	size     int    // Size of the encoded image data in bytes.
+	hash     string // SHA-256 hash of the encoded image data.
+	dhash    uint64 // Difference hash of the decoded image.
+	phash    uint64 // DCT perceptual hash of the decoded image.
+	hasPHash bool   // The image could be decoded, so `dhash` and `phash` are set.
 }
 
 func (info imageInfo) String() string {
@@ -610,6 +660,343 @@ func stringCounts(corpusInfo map[string][]imageInfo, selector func(imageInfo) st
 	return byImage, byFile
 }
 
+// streamHash returns the hex SHA-256 hash of `data`.
+func streamHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// perceptualHashes returns the dHash and pHash of image `img` in color space `cs`. The last return
+// value is false if the image can't be converted to RGB.
+func perceptualHashes(img *pdf.Image, cs pdf.PdfColorspace) (uint64, uint64, bool) {
+	rgb, err := cs.ImageToRGB(*img)
+	if err != nil {
+		return 0, 0, false
+	}
+	gimg, err := rgb.ToGoImage()
+	if err != nil {
+		return 0, 0, false
+	}
+	small, tiny := grayThumbnails(gimg)
+	return differenceHash(tiny), dctHash(small), true
+}
+
+// grayThumbnails returns 32x32 and 9x8 (width x height) grayscale thumbnails of `img`. Each
+// thumbnail pixel is the mean luminance of the image pixels it covers.
+func grayThumbnails(img goimage.Image) ([32][32]float64, [8][9]float64) {
+	var small [32][32]float64
+	var tiny [8][9]float64
+	var smallN [32][32]int
+	var tinyN [8][9]int
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			lum := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+			sy, sx := y*32/h, x*32/w
+			small[sy][sx] += lum
+			smallN[sy][sx]++
+			ty, tx := y*8/h, x*9/w
+			tiny[ty][tx] += lum
+			tinyN[ty][tx]++
+		}
+	}
+	// Cells that no pixel falls in (for images smaller than the thumbnails) take the value of the
+	// cell before them.
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if smallN[y][x] > 0 {
+				small[y][x] /= float64(smallN[y][x])
+			} else if x > 0 {
+				small[y][x] = small[y][x-1]
+			} else if y > 0 {
+				small[y][x] = small[y-1][x]
+			}
+		}
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			if tinyN[y][x] > 0 {
+				tiny[y][x] /= float64(tinyN[y][x])
+			} else if x > 0 {
+				tiny[y][x] = tiny[y][x-1]
+			} else if y > 0 {
+				tiny[y][x] = tiny[y-1][x]
+			}
+		}
+	}
+	return small, tiny
+}
+
+// differenceHash returns the dHash of 9x8 thumbnail `tiny`: one bit for each pair of horizontally
+// adjacent pixels that is set if the left pixel is darker.
+func differenceHash(tiny [8][9]float64) uint64 {
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if tiny[y][x] < tiny[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// dctHash returns the pHash of 32x32 thumbnail `small`: one bit for each of the 8x8 lowest frequency
+// DCT coefficients that is set if the coefficient is above the median (excluding the DC term).
+func dctHash(small [32][32]float64) uint64 {
+	var cosTable [8][32]float64
+	for u := 0; u < 8; u++ {
+		for x := 0; x < 32; x++ {
+			cosTable[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 64)
+		}
+	}
+	// The DCT is separable: transform the rows then the columns.
+	var rows [32][8]float64
+	for y := 0; y < 32; y++ {
+		for u := 0; u < 8; u++ {
+			for x := 0; x < 32; x++ {
+				rows[y][u] += cosTable[u][x] * small[y][x]
+			}
+		}
+	}
+	var coefs []float64
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			c := 0.0
+			for y := 0; y < 32; y++ {
+				c += cosTable[v][y] * rows[y][u]
+			}
+			coefs = append(coefs, c)
+		}
+	}
+	sorted := append([]float64(nil), coefs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for _, c := range coefs {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// imageCopy is a copy of an image stored in a PDF file. An XObject image drawn on several pages is
+// one copy. Each inline image is a copy.
+type imageCopy struct {
+	info  imageInfo
+	pages []int
+}
+
+// cluster is a group of duplicate or similar images.
+type cluster struct {
+	kind   string // "exact" or "similar".
+	copies []*imageCopy
+}
+
+// bytes returns the total size of the copies in `c`.
+func (c cluster) bytes() int {
+	n := 0
+	for _, cp := range c.copies {
+		n += cp.info.size
+	}
+	return n
+}
+
+// wasted returns the number of bytes that would be saved by storing only the largest copy in `c`.
+func (c cluster) wasted() int {
+	largest := 0
+	for _, cp := range c.copies {
+		if cp.info.size > largest {
+			largest = cp.info.size
+		}
+	}
+	return c.bytes() - largest
+}
+
+// findDuplicates returns the clusters of exact duplicate images and of similar images in the files
+// `corpus` with images `corpusInfo`. Images are similar if both their dHashes and pHashes differ by at
+// most `maxDist` bits. Exact duplicates are treated as one image when finding similar images.
+func findDuplicates(corpus []string, corpusInfo map[string][]imageInfo, maxDist int) []cluster {
+	// Find the stored copies of the images.
+	var copies []*imageCopy
+	for _, path := range corpus {
+		byObj := map[int64]*imageCopy{}
+		for _, info := range corpusInfo[path] {
+			if info.hash == "" {
+				continue
+			}
+			if cp, ok := byObj[info.objNum]; ok && !info.inline && info.objNum != 0 {
+				if cp.pages[len(cp.pages)-1] != info.page {
+					cp.pages = append(cp.pages, info.page)
+				}
+				continue
+			}
+			cp := &imageCopy{info: info, pages: []int{info.page}}
+			if !info.inline && info.objNum != 0 {
+				byObj[info.objNum] = cp
+			}
+			copies = append(copies, cp)
+		}
+	}
+
+	// Exact duplicates.
+	var clusters []cluster
+	var hashes []string
+	byHash := map[string][]*imageCopy{}
+	for _, cp := range copies {
+		if _, ok := byHash[cp.info.hash]; !ok {
+			hashes = append(hashes, cp.info.hash)
+		}
+		byHash[cp.info.hash] = append(byHash[cp.info.hash], cp)
+	}
+	for _, h := range hashes {
+		if len(byHash[h]) > 1 {
+			clusters = append(clusters, cluster{kind: "exact", copies: byHash[h]})
+		}
+	}
+
+	// Similar images. The unique images are grouped with union-find.
+	var reps []*imageCopy
+	for _, h := range hashes {
+		if cp := byHash[h][0]; cp.info.hasPHash {
+			reps = append(reps, cp)
+		}
+	}
+	parent := make([]int, len(reps))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := 0; i < len(reps); i++ {
+		for j := i + 1; j < len(reps); j++ {
+			a, b := reps[i].info, reps[j].info
+			if bits.OnesCount64(a.dhash^b.dhash) <= maxDist && bits.OnesCount64(a.phash^b.phash) <= maxDist {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+	groups := map[int][]*imageCopy{}
+	var roots []int
+	for i, cp := range reps {
+		r := find(i)
+		if _, ok := groups[r]; !ok {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], byHash[cp.info.hash]...)
+	}
+	for _, r := range roots {
+		if len(groups[r]) > len(byHash[reps[r].info.hash]) {
+			clusters = append(clusters, cluster{kind: "similar", copies: groups[r]})
+		}
+	}
+
+	sort.SliceStable(clusters, func(i, j int) bool {
+		if clusters[i].kind != clusters[j].kind {
+			return clusters[i].kind == "exact"
+		}
+		return clusters[i].wasted() > clusters[j].wasted()
+	})
+	return clusters
+}
+
+// showDuplicates prints `clusters`.
+func showDuplicates(clusters []cluster, maxDist int) {
+	numExact, numSimilar, copiesExact, wastedExact := 0, 0, 0, 0
+	for _, c := range clusters {
+		if c.kind == "exact" {
+			numExact++
+			copiesExact += len(c.copies)
+			wastedExact += c.wasted()
+		} else {
+			numSimilar++
+		}
+	}
+	fmt.Println("=================================================")
+	fmt.Printf("Exact duplicates: %d images stored %d times. %d bytes wasted\n", numExact, copiesExact,
+		wastedExact)
+	fmt.Printf("Similar images (dHash and pHash within %d bits): %d groups\n", maxDist, numSimilar)
+	for i, c := range clusters {
+		fmt.Println("-----------------------------------------")
+		fmt.Printf("%d: %s, %d copies, %d bytes, %d bytes wasted\n", i+1, c.kind, len(c.copies), c.bytes(),
+			c.wasted())
+		for _, cp := range c.copies {
+			fmt.Printf("\t%s\n", cp.describe())
+		}
+	}
+}
+
+// describe returns a one line description of `cp`.
+func (cp *imageCopy) describe() string {
+	pages := make([]string, len(cp.pages))
+	for i, p := range cp.pages {
+		pages[i] = fmt.Sprintf("%d", p)
+	}
+	where := "inline"
+	if !cp.info.inline {
+		where = fmt.Sprintf("obj %d", cp.info.objNum)
+	}
+	return fmt.Sprintf("%q pages %s %s %dx%d %d bytes hash=%s dhash=%016x phash=%016x",
+		filepath.Base(cp.info.path), strings.Join(pages, ","), where, cp.info.width, cp.info.height,
+		cp.info.size, cp.info.hash[:16], cp.info.dhash, cp.info.phash)
+}
+
+// saveDuplicatesCsv saves `clusters` as a CSV file.
+func saveDuplicatesCsv(csvPath string, clusters []cluster) error {
+	f, err := os.Create(csvPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't create %q. %v\n", csvPath, err)
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	defer w.Flush()
+
+	err = w.Write([]string{"Cluster", "Kind", "Path", "Pages", "Object", "Width", "Height", "Bytes",
+		"Hash", "dHash", "pHash"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't write header %q. %v\n", csvPath, err)
+		return err
+	}
+	for i, c := range clusters {
+		for _, cp := range c.copies {
+			pages := make([]string, len(cp.pages))
+			for j, p := range cp.pages {
+				pages[j] = fmt.Sprintf("%d", p)
+			}
+			err := w.Write([]string{
+				fmt.Sprintf("%d", i+1),
+				c.kind,
+				cp.info.path,
+				strings.Join(pages, " "),
+				fmt.Sprintf("%d", cp.info.objNum),
+				fmt.Sprintf("%d", cp.info.width),
+				fmt.Sprintf("%d", cp.info.height),
+				fmt.Sprintf("%d", cp.info.size),
+				cp.info.hash,
+				fmt.Sprintf("%016x", cp.info.dhash),
+				fmt.Sprintf("%016x", cp.info.phash),
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't write %q. %v\n", csvPath, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // showError prints an error message `format` for error `err` if `err` has not been reported before.
 // `errors` tracks errors seen so far. The caller can make `errors` per-page, per-file or global.
 func showError(errors map[error]bool, err error, format string, args ...interface{}) bool {
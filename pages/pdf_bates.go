@@ -0,0 +1,471 @@
+/*
+ * Apply Bates numbers to a set of PDF files.
+ *
+ * Each page of the input files is stamped with a sequential Bates number made of a prefix, a zero padded
+ * counter and a suffix, e.g. ABC000001. The counter continues from file to file in the order the files are
+ * given, so a document set is numbered as one production. The numbered files are written to an output
+ * directory, and a manifest CSV file records the first and last Bates numbers of each file.
+ *
+ * The number is placed relative to a corner or edge of the page as it is displayed, so pages with a
+ * /Rotate entry are numbered in the same place as other pages.
+ *
+ * Run as: go run pdf_bates.go [options] -o outdir input1.pdf input2.pdf ...
+ *     or: go run pdf_bates.go [options] -o outdir -l files.txt
+ * e.g. go run pdf_bates.go -prefix ABC -digits 6 -start 1 -pos bottom-right -o production a.pdf b.pdf
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/contentstream"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+const usage = `Usage: go run pdf_bates.go [options] -o outdir input1.pdf input2.pdf ...
+   or: go run pdf_bates.go [options] -o outdir -l files.txt
+
+Stamps sequential Bates numbers on the pages of the input files, in order, and writes the numbered files
+and a manifest CSV file to outdir. files.txt lists the input files, one per line.
+`
+
+// batesOptions describes the Bates numbers and how they are drawn.
+type batesOptions struct {
+	prefix   string  // Text before the counter.
+	suffix   string  // Text after the counter.
+	digits   int     // Counter is zero padded to this many digits.
+	start    int     // First counter value.
+	position string  // Page corner or edge the number is placed at.
+	marginX  float64 // Horizontal distance from the page edge (points).
+	marginY  float64 // Vertical distance from the page edge (points).
+	font     string  // Standard 14 font name or TrueType font file.
+	fontSize float64 // Font size (points).
+	color    string  // Text color #rrggbb.
+	bgColor  string  // Background color #rrggbb. "" for no background.
+}
+
+// batesFontName is the resource name of the Bates number font.
+const batesFontName = "FBates"
+
+func main() {
+	var (
+		opt          batesOptions
+		outDir       string
+		listPath     string
+		manifestPath string
+		naming       string
+		debug        bool
+	)
+	flag.StringVar(&opt.prefix, "prefix", "", "Bates number prefix.")
+	flag.StringVar(&opt.suffix, "suffix", "", "Bates number suffix.")
+	flag.IntVar(&opt.digits, "digits", 6, "Number of digits in the counter.")
+	flag.IntVar(&opt.start, "start", 1, "First counter value.")
+	flag.StringVar(&opt.position, "pos", "bottom-right",
+		"Position: top-left/top/top-right/bottom-left/bottom/bottom-right.")
+	flag.Float64Var(&opt.marginX, "x", 36, "Distance (points) from the left or right edge of the page.")
+	flag.Float64Var(&opt.marginY, "y", 24, "Distance (points) from the top or bottom edge of the page.")
+	flag.StringVar(&opt.font, "font", "Helvetica", "Standard 14 font name or TrueType font file.")
+	flag.Float64Var(&opt.fontSize, "size", 10, "Font size (points).")
+	flag.StringVar(&opt.color, "color", "#000000", "Text color (#rrggbb).")
+	flag.StringVar(&opt.bgColor, "bg", "", "Background color (#rrggbb) behind the number. Default: none.")
+	flag.StringVar(&outDir, "o", "", "Output directory. Required.")
+	flag.StringVar(&listPath, "l", "", "File listing the input files, one per line.")
+	flag.StringVar(&manifestPath, "manifest", "", "Manifest CSV file. Default: outdir/bates_manifest.csv")
+	flag.StringVar(&naming, "name", "original", "Output file names: original (input file name) or bates "+
+		"(first and last Bates numbers).")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	inputPaths := flag.Args()
+
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	} else {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelInfo))
+	}
+
+	if listPath != "" {
+		paths, err := readFileList(listPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		inputPaths = append(inputPaths, paths...)
+	}
+	if outDir == "" || len(inputPaths) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if naming != "original" && naming != "bates" {
+		fmt.Fprintf(os.Stderr, "Unknown -name %q\n", naming)
+		os.Exit(1)
+	}
+	if manifestPath == "" {
+		manifestPath = filepath.Join(outDir, "bates_manifest.csv")
+	}
+
+	entries, err := batesNumberFiles(inputPaths, outDir, naming, opt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeManifest(manifestPath, entries); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%s: %d pages %s - %s -> %s\n", e.inputPath, e.numPages, e.first, e.last, e.outputPath)
+	}
+	fmt.Printf("Complete, see manifest: %s\n", manifestPath)
+}
+
+// manifestEntry describes the Bates numbering of a file.
+type manifestEntry struct {
+	inputPath  string
+	outputPath string
+	numPages   int
+	first      string // Bates number of the first page.
+	last       string // Bates number of the last page.
+}
+
+// batesNumberFiles numbers the pages of the files `inputPaths`, in order, as described by `opt` and
+// writes the numbered files to `outDir`. The output files have the same names as the input files if
+// `naming` is "original" and are named by their first and last Bates numbers if it is "bates".
+func batesNumberFiles(inputPaths []string, outDir, naming string, opt batesOptions) ([]manifestEntry, error) {
+	if opt.digits < 1 {
+		return nil, fmt.Errorf("bad digits %d", opt.digits)
+	}
+	if opt.start < 0 {
+		return nil, fmt.Errorf("bad start %d", opt.start)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	used := map[string]string{}
+	var entries []manifestEntry
+	counter := opt.start
+	for _, inputPath := range inputPaths {
+		entry, err := batesNumberFile(inputPath, counter, opt, func(first, last string) (string, error) {
+			name := filepath.Base(inputPath)
+			if naming == "bates" {
+				name = first + "-" + last + ".pdf"
+			}
+			outputPath := filepath.Join(outDir, name)
+			if other, ok := used[outputPath]; ok {
+				return "", fmt.Errorf("%s has the same output file %s", other, outputPath)
+			}
+			used[outputPath] = inputPath
+			return outputPath, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", inputPath, err)
+		}
+		entries = append(entries, entry)
+		counter += entry.numPages
+	}
+	return entries, nil
+}
+
+// batesNumberFile numbers the pages of PDF file `inputPath` as described by `opt`, starting with
+// counter value `counter`, and writes the result to the path returned by `outputPath` for the first
+// and last Bates numbers.
+func batesNumberFile(inputPath string, counter int, opt batesOptions,
+	outputPath func(first, last string) (string, error)) (manifestEntry, error) {
+	entry := manifestEntry{inputPath: inputPath}
+
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	pdfReader, err := model.NewPdfReader(f)
+	if err != nil {
+		return entry, err
+	}
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return entry, err
+	}
+	if isEncrypted {
+		auth, err := pdfReader.Decrypt([]byte(""))
+		if err != nil {
+			return entry, err
+		}
+		if !auth {
+			return entry, errors.New("encrypted")
+		}
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return entry, err
+	}
+	if numPages == 0 {
+		return entry, errors.New("no pages")
+	}
+
+	font, err := loadFont(opt.font)
+	if err != nil {
+		return entry, err
+	}
+	fontObj := font.ToPdfObject()
+
+	pdfWriter := model.NewPdfWriter()
+	for i := 0; i < numPages; i++ {
+		page, err := pdfReader.GetPage(i + 1)
+		if err != nil {
+			return entry, err
+		}
+		number, err := batesNumber(counter+i, opt)
+		if err != nil {
+			return entry, err
+		}
+		if i == 0 {
+			entry.first = number
+		}
+		entry.last = number
+
+		if err := stampPage(page, number, font, fontObj, opt); err != nil {
+			return entry, fmt.Errorf("page %d: %v", i+1, err)
+		}
+		if err := pdfWriter.AddPage(page); err != nil {
+			return entry, err
+		}
+	}
+	entry.numPages = numPages
+	entry.outputPath, err = outputPath(entry.first, entry.last)
+	if err != nil {
+		return entry, err
+	}
+
+	if filepath.Clean(entry.outputPath) == filepath.Clean(inputPath) {
+		return entry, fmt.Errorf("output file %s would overwrite the input file", entry.outputPath)
+	}
+	fOut, err := os.Create(entry.outputPath)
+	if err != nil {
+		return entry, err
+	}
+	defer fOut.Close()
+	return entry, pdfWriter.Write(fOut)
+}
+
+// batesNumber returns the Bates number for counter value `n`.
+func batesNumber(n int, opt batesOptions) (string, error) {
+	digits := fmt.Sprintf("%0*d", opt.digits, n)
+	if len(digits) > opt.digits {
+		return "", fmt.Errorf("counter %d has more than %d digits", n, opt.digits)
+	}
+	return opt.prefix + digits + opt.suffix, nil
+}
+
+// stampPage draws Bates number `number` on `page` with font `font` (whose PDF object is `fontObj`)
+// as described by `opt`.
+func stampPage(page *model.PdfPage, number string, font *model.PdfFont, fontObj core.PdfObject,
+	opt batesOptions) error {
+	// The number is placed on the visible part of the page.
+	box, err := page.GetMediaBox()
+	if err != nil {
+		return err
+	}
+	if page.CropBox != nil {
+		box = page.CropBox
+	}
+	w, h := box.Urx-box.Llx, box.Ury-box.Lly
+	rotate := 0
+	if page.Rotate != nil {
+		rotate = int(*page.Rotate) % 360
+		if rotate < 0 {
+			rotate += 360
+		}
+	}
+	if rotate%90 != 0 {
+		return fmt.Errorf("bad page rotation %d", rotate)
+	}
+
+	// Displayed page width and height.
+	dispW, dispH := w, h
+	if rotate == 90 || rotate == 270 {
+		dispW, dispH = h, w
+	}
+
+	textWidth := 0.0
+	for _, r := range number {
+		metrics, ok := font.GetRuneMetrics(r)
+		if !ok {
+			return fmt.Errorf("font has no glyph for %q", r)
+		}
+		textWidth += metrics.Wx * opt.fontSize / 1000.0
+	}
+	// Approximate the ascent and descent as fractions of the font size.
+	ascent, descent := 0.75*opt.fontSize, 0.25*opt.fontSize
+
+	// Baseline origin of the text in displayed page coordinates.
+	var x, y float64
+	switch opt.position {
+	case "top-left", "bottom-left":
+		x = opt.marginX
+	case "top-right", "bottom-right":
+		x = dispW - opt.marginX - textWidth
+	case "top", "bottom":
+		x = (dispW - textWidth) / 2
+	default:
+		return fmt.Errorf("unknown position %q", opt.position)
+	}
+	if strings.HasPrefix(opt.position, "top") {
+		y = dispH - opt.marginY - ascent
+	} else {
+		y = opt.marginY + descent
+	}
+
+	// Matrix from displayed page coordinates to user space. /Rotate turns the page clockwise.
+	var a, b, c, d, e, ff float64
+	switch rotate {
+	case 0:
+		a, b, c, d, e, ff = 1, 0, 0, 1, 0, 0
+	case 90:
+		a, b, c, d, e, ff = 0, 1, -1, 0, w, 0
+	case 180:
+		a, b, c, d, e, ff = -1, 0, 0, -1, w, h
+	case 270:
+		a, b, c, d, e, ff = 0, -1, 1, 0, 0, h
+	}
+	e += box.Llx
+	ff += box.Lly
+
+	cc := contentstream.NewContentCreator()
+	cc.Add_q()
+	cc.Add_cm(a, b, c, d, e, ff)
+	if opt.bgColor != "" {
+		r, g, bl, err := parseColor(opt.bgColor)
+		if err != nil {
+			return err
+		}
+		const pad = 2.0
+		cc.Add_rg(r, g, bl)
+		cc.Add_re(x-pad, y-descent-pad, textWidth+2*pad, ascent+descent+2*pad)
+		cc.Add_f()
+	}
+	r, g, bl, err := parseColor(opt.color)
+	if err != nil {
+		return err
+	}
+	cc.Add_rg(r, g, bl)
+	cc.Add_BT()
+	cc.Add_Tf(batesFontName, opt.fontSize)
+	cc.Add_Td(x, y)
+	cc.Add_Tj(*core.MakeStringFromBytes(font.Encoder().Encode(number)))
+	cc.Add_ET()
+	cc.Add_Q()
+
+	if page.Resources == nil {
+		page.Resources = model.NewPdfPageResources()
+	}
+	if page.Resources.HasFontByName(batesFontName) {
+		return fmt.Errorf("page already has a font named %s", batesFontName)
+	}
+	if err := page.Resources.SetFontByName(batesFontName, fontObj); err != nil {
+		return err
+	}
+
+	// Wrap the existing contents in q/Q so that any graphics state changes they leave don't affect the
+	// Bates number.
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return err
+	}
+	ops, err := contentstream.NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return err
+	}
+	ops.WrapIfNeeded()
+	return page.SetContentStreams([]string{string(ops.Bytes()), cc.String()}, core.NewFlateEncoder())
+}
+
+// loadFont returns the font `name`, which is either a standard 14 font name or a TrueType font file.
+func loadFont(name string) (*model.PdfFont, error) {
+	if font, err := model.NewStandard14Font(model.StdFontName(name)); err == nil {
+		return font, nil
+	}
+	font, err := model.NewPdfFontFromTTFFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not load font %q. err=%v", name, err)
+	}
+	return font, nil
+}
+
+// parseColor returns the red, green and blue components in the range 0-1 of color `hex` (#rrggbb).
+func parseColor(hex string) (float64, float64, float64, error) {
+	s := strings.TrimPrefix(hex, "#")
+	if len(s) != 6 {
+		return 0, 0, 0, fmt.Errorf("bad color %q", hex)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("bad color %q", hex)
+	}
+	return float64(v>>16&0xff) / 255, float64(v>>8&0xff) / 255, float64(v&0xff) / 255, nil
+}
+
+// readFileList returns the file paths listed in `path`, one per line. Blank lines and lines starting
+// with # are skipped. Relative paths are relative to the directory of `path`.
+func readFileList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(path)
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		paths = append(paths, line)
+	}
+	return paths, scanner.Err()
+}
+
+// writeManifest writes a CSV file to `path` with a row for each of `entries`.
+func writeManifest(path string, entries []manifestEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"input", "output", "pages", "first", "last"})
+	for _, e := range entries {
+		w.Write([]string{e.inputPath, e.outputPath, strconv.Itoa(e.numPages), e.first, e.last})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
@@ -0,0 +1,479 @@
+/*
+ * Add a hidden text layer from OCR results to a scanned PDF file so that it can be searched and its
+ * text can be selected and extracted.
+ *
+ * The OCR results are hOCR or ALTO XML files that give the text of each word and its bounding box in
+ * the pixels of the page image that was OCRed. The OCR pages are matched to the PDF pages in order.
+ * The words are drawn with invisible text (rendering mode 3) over the largest image on each PDF page,
+ * found as in image/pdf_extract_images_position.go, by scaling the OCR page to the image's placement on
+ * the PDF page. If a PDF page has no images, the OCR page is scaled to the whole page.
+ *
+ * NOTE: The text is drawn in Helvetica so words that can't be represented in WinAnsiEncoding lose the
+ *       characters that can't be encoded.
+ *       Image placements are treated as scaling, rotation and translation. Skewed or flipped images are
+ *       not handled.
+ *
+ * Run as: go run pdf_add_text_layer.go [options] input.pdf output.pdf ocr1.hocr [ocr2.hocr ...]
+ * e.g. go run pdf_add_text_layer.go scan.pdf searchable.pdf scan.hocr
+ *      go run pdf_add_text_layer.go -first 3 -show scan.pdf check.pdf page3.xml page4.xml
+ */
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/contentstream"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/extractor"
+	pdf "github.com/unidoc/unipdf/v3/model"
+)
+
+const usage = `Usage: go run pdf_add_text_layer.go [options] input.pdf output.pdf ocr1.hocr [ocr2.hocr ...]
+
+Adds the words in hOCR or ALTO XML files as an invisible text layer over the scanned images in input.pdf
+and writes the result to output.pdf. The OCR pages in the files are matched to the PDF pages in order.
+`
+
+// ocrFontName is the resource name of the text layer font.
+const ocrFontName = "FOCR"
+
+func main() {
+	// Make sure to enter a valid license key.
+	// Otherwise text is truncated and a watermark added to the text.
+	// License keys are available via: https://unidoc.io
+	/*
+			license.SetLicenseKey(`
+		-----BEGIN UNIDOC LICENSE KEY-----
+		...key contents...
+		-----END UNIDOC LICENSE KEY-----
+		`)
+	*/
+	var firstPage int
+	var show, debug bool
+	flag.IntVar(&firstPage, "first", 1, "PDF page number that the first OCR page is added to.")
+	flag.BoolVar(&show, "show", false, "Draw the text layer in red instead of invisibly, to check alignment.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	} else {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelInfo))
+	}
+
+	inputPath, outputPath := args[0], args[1]
+	var ocrPages []ocrPage
+	for _, ocrPath := range args[2:] {
+		pages, err := readOCRFile(ocrPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		ocrPages = append(ocrPages, pages...)
+	}
+
+	err := addTextLayer(inputPath, outputPath, ocrPages, firstPage, show)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Complete, see output file: %s\n", outputPath)
+}
+
+// ocrPage is the OCR result for a page image.
+type ocrPage struct {
+	width, height float64 // Dimensions of the page image. 0 if unknown.
+	words         []ocrWord
+}
+
+// ocrWord is a word in an ocrPage. Coordinates are in the page image with the origin at the top left.
+type ocrWord struct {
+	text string
+	bbox [4]float64 // x0, y0, x1, y1 of the word.
+	line [4]float64 // x0, y0, x1, y1 of the word's line. The same as `bbox` if there is no line.
+}
+
+// addTextLayer adds the words in `ocrPages` as a text layer to the pages of PDF file `inputPath`,
+// starting at page `firstPage`, and writes the result to `outputPath`. If `show` is true the text is
+// drawn in red, otherwise it is invisible.
+func addTextLayer(inputPath, outputPath string, ocrPages []ocrPage, firstPage int, show bool) error {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pdfReader, err := pdf.NewPdfReader(f)
+	if err != nil {
+		return err
+	}
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return err
+	}
+	if isEncrypted {
+		auth, err := pdfReader.Decrypt([]byte(""))
+		if err != nil {
+			return err
+		}
+		if !auth {
+			return errors.New("encrypted")
+		}
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return err
+	}
+	if firstPage < 1 || firstPage > numPages {
+		return fmt.Errorf("first page %d out of range (1-%d)", firstPage, numPages)
+	}
+	if extra := firstPage - 1 + len(ocrPages) - numPages; extra > 0 {
+		fmt.Printf("WARNING: %d OCR pages are past the end of the PDF file and are ignored.\n", extra)
+	}
+
+	font, err := pdf.NewStandard14Font("Helvetica")
+	if err != nil {
+		return err
+	}
+	fontObj := font.ToPdfObject()
+
+	pdfWriter := pdf.NewPdfWriter()
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return err
+		}
+		if i := pageNum - firstPage; i >= 0 && i < len(ocrPages) {
+			desc, err := addPageTextLayer(page, ocrPages[i], font, fontObj, show)
+			if err != nil {
+				return fmt.Errorf("addPageTextLayer failed. pageNum=%d err=%v", pageNum, err)
+			}
+			fmt.Printf("Page %d: %s\n", pageNum, desc)
+		}
+		if err := pdfWriter.AddPage(page); err != nil {
+			return err
+		}
+	}
+
+	fOut, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer fOut.Close()
+	return pdfWriter.Write(fOut)
+}
+
+// addPageTextLayer adds the words in `op` as a text layer to `page` using `font`, whose PDF object is
+// `fontObj`, and returns a description of what was added.
+func addPageTextLayer(page *pdf.PdfPage, op ocrPage, font *pdf.PdfFont, fontObj core.PdfObject,
+	show bool) (string, error) {
+	mbox, err := page.GetMediaBox()
+	if err != nil {
+		return "", err
+	}
+
+	// The scanned image is the largest image on the page. Its placement maps the unit square to the page.
+	ex, err := extractor.New(page)
+	if err != nil {
+		return "", err
+	}
+	pageImages, err := ex.ExtractPageImages(nil)
+	if err != nil {
+		return "", err
+	}
+	var scan *extractor.ImageMark
+	for i, mark := range pageImages.Images {
+		if scan == nil || mark.Width*mark.Height > scan.Width*scan.Height {
+			scan = &pageImages.Images[i]
+		}
+	}
+	var placement matrix
+	var desc string
+	if scan != nil {
+		// ImageMark.Angle is measured clockwise.
+		theta := -scan.Angle * math.Pi / 180.0
+		// Round so that multiples of 90° give exact matrices.
+		cos, sin := math.Round(math.Cos(theta)*1e9)/1e9, math.Round(math.Sin(theta)*1e9)/1e9
+		placement = matrix{scan.Width * cos, scan.Width * sin, -scan.Height * sin, scan.Height * cos,
+			scan.X, scan.Y}
+		desc = fmt.Sprintf("%d words over %dx%d image at (%.1f,%.1f) %.1fx%.1f", len(op.words),
+			scan.Image.Width, scan.Image.Height, scan.X, scan.Y, scan.Width, scan.Height)
+		if op.width == 0 || op.height == 0 {
+			op.width, op.height = float64(scan.Image.Width), float64(scan.Image.Height)
+		}
+	} else {
+		placement = matrix{mbox.Urx - mbox.Llx, 0, 0, mbox.Ury - mbox.Lly, mbox.Llx, mbox.Lly}
+		desc = fmt.Sprintf("%d words over the whole page (no images)", len(op.words))
+	}
+	if op.width == 0 || op.height == 0 {
+		return "", errors.New("OCR page has no dimensions")
+	}
+
+	// The text is drawn in OCR image coordinates with the y axis flipped to point up.
+	ocrToPage := matrix{1 / op.width, 0, 0, 1 / op.height, 0, 0}.mult(placement)
+
+	cc := contentstream.NewContentCreator()
+	cc.Add_q()
+	cc.Add_cm(ocrToPage[0], ocrToPage[1], ocrToPage[2], ocrToPage[3], ocrToPage[4], ocrToPage[5])
+	cc.Add_BT()
+	if show {
+		cc.Add_rg(1, 0, 0)
+		cc.Add_Tr(0)
+	} else {
+		cc.Add_Tr(3)
+	}
+	for _, w := range op.words {
+		encoded := font.Encoder().Encode(w.text)
+		if len(encoded) == 0 {
+			continue
+		}
+		// The font size is the line height and the baseline is a fifth of the way up the line.
+		lineHeight := w.line[3] - w.line[1]
+		if lineHeight <= 0 {
+			lineHeight = w.bbox[3] - w.bbox[1]
+		}
+		if lineHeight <= 0 {
+			continue
+		}
+		size := lineHeight
+		baseline := op.height - w.line[3] + 0.2*lineHeight
+
+		// Scale the word horizontally to fill its bounding box.
+		textWidth := 0.0
+		for _, r := range w.text {
+			if m, ok := font.GetRuneMetrics(r); ok {
+				textWidth += m.Wx * size / 1000.0
+			}
+		}
+		scale := 100.0
+		if textWidth > 0 {
+			scale = 100.0 * (w.bbox[2] - w.bbox[0]) / textWidth
+		}
+
+		cc.Add_Tf(ocrFontName, size)
+		cc.Add_Tz(scale)
+		cc.Add_Tm(1, 0, 0, 1, w.bbox[0], baseline)
+		cc.Add_Tj(*core.MakeStringFromBytes(encoded))
+	}
+	cc.Add_ET()
+	cc.Add_Q()
+
+	if page.Resources == nil {
+		page.Resources = pdf.NewPdfPageResources()
+	}
+	if page.Resources.HasFontByName(ocrFontName) {
+		return "", fmt.Errorf("page already has a font named %s", ocrFontName)
+	}
+	if err := page.Resources.SetFontByName(ocrFontName, fontObj); err != nil {
+		return "", err
+	}
+
+	// Wrap the existing contents in q/Q so that any graphics state changes they leave don't affect the
+	// text layer.
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return "", err
+	}
+	ops, err := contentstream.NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return "", err
+	}
+	ops.WrapIfNeeded()
+	err = page.SetContentStreams([]string{string(ops.Bytes()), cc.String()}, core.NewFlateEncoder())
+	return desc, err
+}
+
+// readOCRFile returns the OCR pages in hOCR or ALTO XML file `path`.
+func readOCRFile(path string) ([]ocrPage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pages, err := parseOCR(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse OCR file %q. err=%v", path, err)
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no OCR pages in %q", path)
+	}
+	return pages, nil
+}
+
+// parseOCR returns the OCR pages in hOCR or ALTO XML read from `r`. The format is detected from the
+// elements: hOCR has elements with class ocr_page and ALTO has Page elements.
+//
+// hOCR: Pages are elements with class ocr_page, lines have class ocr_line (or another line class) and
+// words have class ocrx_word. Bounding boxes are in the title attributes, e.g. title="bbox 10 20 30 40".
+//
+// ALTO: Pages are Page elements with WIDTH and HEIGHT attributes, lines are TextLine elements and words
+// are String elements with CONTENT, HPOS, VPOS, WIDTH and HEIGHT attributes. As coordinates are scaled
+// by the page dimensions, the MeasurementUnit doesn't matter.
+func parseOCR(r io.Reader) ([]ocrPage, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var pages []ocrPage
+	var line [4]float64
+
+	// State of the hOCR word being read.
+	var word *ocrWord
+	wordDepth, depth := 0, 0
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			attrs := map[string]string{}
+			for _, a := range t.Attr {
+				attrs[a.Name.Local] = a.Value
+			}
+
+			// ALTO.
+			switch t.Name.Local {
+			case "Page":
+				pages = append(pages, ocrPage{width: parseFloat(attrs["WIDTH"]), height: parseFloat(attrs["HEIGHT"])})
+				continue
+			case "TextLine":
+				line = altoBBox(attrs)
+				continue
+			case "String":
+				if len(pages) > 0 && strings.TrimSpace(attrs["CONTENT"]) != "" {
+					p := &pages[len(pages)-1]
+					p.words = append(p.words, ocrWord{text: attrs["CONTENT"], bbox: altoBBox(attrs), line: line})
+				}
+				continue
+			}
+
+			// hOCR.
+			classes := strings.Fields(attrs["class"])
+			bbox, hasBBox := hocrBBox(attrs["title"])
+			for _, class := range classes {
+				switch class {
+				case "ocr_page":
+					pages = append(pages, ocrPage{width: bbox[2] - bbox[0], height: bbox[3] - bbox[1]})
+				case "ocr_line", "ocrx_line", "ocr_textfloat", "ocr_header", "ocr_caption":
+					if hasBBox {
+						line = bbox
+					}
+				case "ocrx_word":
+					if hasBBox && len(pages) > 0 {
+						word = &ocrWord{bbox: bbox, line: line}
+						wordDepth = depth
+					}
+				}
+			}
+		case xml.EndElement:
+			if word != nil && depth == wordDepth {
+				word.text = strings.TrimSpace(word.text)
+				if word.text != "" {
+					if word.line == [4]float64{} {
+						word.line = word.bbox
+					}
+					p := &pages[len(pages)-1]
+					p.words = append(p.words, *word)
+				}
+				word = nil
+			}
+			depth--
+		case xml.CharData:
+			if word != nil {
+				word.text += string(t)
+			}
+		}
+	}
+
+	// ALTO words without lines use their own bounding boxes.
+	for _, p := range pages {
+		for i, w := range p.words {
+			if w.line == [4]float64{} {
+				p.words[i].line = w.bbox
+			}
+		}
+	}
+	return pages, nil
+}
+
+// hocrBBox returns the bounding box in hOCR title attribute `title` e.g. "bbox 10 20 30 40; x_wconf 90".
+func hocrBBox(title string) ([4]float64, bool) {
+	var bbox [4]float64
+	for _, prop := range strings.Split(title, ";") {
+		fields := strings.Fields(prop)
+		if len(fields) != 5 || fields[0] != "bbox" {
+			continue
+		}
+		for i := range bbox {
+			v, err := strconv.ParseFloat(fields[i+1], 64)
+			if err != nil {
+				return bbox, false
+			}
+			bbox[i] = v
+		}
+		return bbox, true
+	}
+	return bbox, false
+}
+
+// altoBBox returns the bounding box x0, y0, x1, y1 of the ALTO element with attributes `attrs`.
+func altoBBox(attrs map[string]string) [4]float64 {
+	x, y := parseFloat(attrs["HPOS"]), parseFloat(attrs["VPOS"])
+	return [4]float64{x, y, x + parseFloat(attrs["WIDTH"]), y + parseFloat(attrs["HEIGHT"])}
+}
+
+// parseFloat returns `s` as a float64 or 0 if it isn't a number.
+func parseFloat(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+// mult returns `m` × `o`, the transform that applies `m` then `o`.
+func (m matrix) mult(o matrix) matrix {
+	return matrix{
+		m[0]*o[0] + m[1]*o[2],
+		m[0]*o[1] + m[1]*o[3],
+		m[2]*o[0] + m[3]*o[2],
+		m[2]*o[1] + m[3]*o[3],
+		m[4]*o[0] + m[5]*o[2] + o[4],
+		m[4]*o[1] + m[5]*o[3] + o[5],
+	}
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
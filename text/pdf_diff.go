@@ -0,0 +1,746 @@
+/*
+ * pdf_diff.go - Compare the text of two revisions of a PDF document.
+ *
+ * The words on each page of both PDFs are extracted with their positions and the two word
+ * sequences are compared with a word-level diff, so text that reflows onto another page is still
+ * matched. Each page of the new PDF is aligned with the page of the old PDF that it shares the most
+ * words with.
+ *
+ * The output PDF has the pages of both revisions with each old page placed before the new page it
+ * is aligned with. Deleted words are highlighted in red on the old pages and inserted words in green
+ * on the new pages. The highlights are annotations, so they can be hidden or deleted in PDF viewers.
+ * A unified diff of the words is written to stdout or to the file given with -report.
+ *
+ * Run as: go run pdf_diff.go [-i] [-context n] [-report diff.txt] old.pdf new.pdf output.pdf
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/extractor"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+const usage = `Usage: go run pdf_diff.go [options] old.pdf new.pdf output.pdf
+`
+
+// Highlight colors for deleted and inserted words.
+var (
+	deletedColor  = [3]float64{1, 0, 0}
+	insertedColor = [3]float64{0, 1, 0}
+)
+
+func main() {
+	// Make sure to enter a valid license key.
+	// Otherwise text is truncated and a watermark added to the text.
+	// License keys are available via: https://unidoc.io
+	/*
+			license.SetLicenseKey(`
+		-----BEGIN UNIDOC LICENSE KEY-----
+		...key contents...
+		-----END UNIDOC LICENSE KEY-----
+		`)
+	*/
+	var opt diffOptions
+	var reportPath string
+	var debug bool
+	flag.BoolVar(&opt.ignoreCase, "i", false, "Ignore case differences.")
+	flag.IntVar(&opt.context, "context", 5, "Number of words of context around changes in the report.")
+	flag.StringVar(&reportPath, "report", "", "Write the unified diff to this file instead of stdout.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	} else {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelInfo))
+	}
+	oldPath, newPath, outPath := args[0], args[1], args[2]
+
+	var report io.Writer = os.Stdout
+	if reportPath != "" {
+		f, err := os.Create(reportPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not create %q. err=%v\n", reportPath, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		report = f
+	}
+
+	stats, err := diffPdfs(oldPath, newPath, outPath, report, opt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diffPdfs failed. oldPath=%q newPath=%q err=%v\n", oldPath, newPath, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%d words deleted, %d words inserted in %d changes. Saved %q\n",
+		stats.deleted, stats.inserted, stats.changes, outPath)
+}
+
+// diffOptions control how the words of two PDFs are compared and reported.
+type diffOptions struct {
+	ignoreCase bool // Words that differ only in case are equal.
+	context    int  // Number of words of context around changes in the report.
+}
+
+// diffStats are the numbers of changes found by diffPdfs.
+type diffStats struct {
+	deleted  int // Number of words deleted.
+	inserted int // Number of words inserted.
+	changes  int // Number of runs of deleted and/or inserted words.
+}
+
+// word is a word extracted from a PDF page.
+type word struct {
+	text string             // The text of the word.
+	page int                // (1-offset) Number of the page the word is on.
+	bbox model.PdfRectangle // Bounding box of the word on the page.
+}
+
+// document is a PDF file and the words extracted from it.
+type document struct {
+	path      string
+	pdfReader *model.PdfReader
+	numPages  int
+	words     []word
+}
+
+// diffPdfs compares the words in PDF files `oldPath` and `newPath` as described by `opt`, saves a PDF
+// with the pages of both files and the changes highlighted to `outPath` and writes a unified diff of
+// the words to `report`.
+func diffPdfs(oldPath, newPath, outPath string, report io.Writer, opt diffOptions) (diffStats, error) {
+	var stats diffStats
+	oldFile, err := os.Open(oldPath)
+	if err != nil {
+		return stats, err
+	}
+	defer oldFile.Close()
+	newFile, err := os.Open(newPath)
+	if err != nil {
+		return stats, err
+	}
+	defer newFile.Close()
+
+	oldDoc, err := extractWords(oldPath, oldFile)
+	if err != nil {
+		return stats, err
+	}
+	newDoc, err := extractWords(newPath, newFile)
+	if err != nil {
+		return stats, err
+	}
+	common.Log.Debug("%q: %d pages %d words. %q: %d pages %d words", oldPath, oldDoc.numPages,
+		len(oldDoc.words), newPath, newDoc.numPages, len(newDoc.words))
+
+	key := func(w word) string {
+		if opt.ignoreCase {
+			return strings.ToLower(w.text)
+		}
+		return w.text
+	}
+	oldKeys := make([]string, len(oldDoc.words))
+	for i, w := range oldDoc.words {
+		oldKeys[i] = key(w)
+	}
+	newKeys := make([]string, len(newDoc.words))
+	for i, w := range newDoc.words {
+		newKeys[i] = key(w)
+	}
+	edits := diffWords(oldKeys, newKeys)
+	changes := findChanges(edits)
+	for _, c := range changes {
+		stats.deleted += len(c.deleted)
+		stats.inserted += len(c.inserted)
+	}
+	stats.changes = len(changes)
+
+	// Highlight the deleted words on the old pages and the inserted words on the new pages.
+	oldAnnots := map[int][]*model.PdfAnnotation{}
+	newAnnots := map[int][]*model.PdfAnnotation{}
+	for _, c := range changes {
+		deletedText := wordsText(oldDoc.words, c.deleted)
+		insertedText := wordsText(newDoc.words, c.inserted)
+		comment := "Deleted: " + deletedText
+		if len(c.inserted) > 0 {
+			comment += "\nReplaced by: " + insertedText
+		}
+		if err := addHighlights(oldAnnots, oldDoc.words, c.deleted, deletedColor, "Deleted",
+			comment); err != nil {
+			return stats, err
+		}
+		comment = "Inserted: " + insertedText
+		if len(c.deleted) > 0 {
+			comment += "\nReplaces: " + deletedText
+		}
+		if err := addHighlights(newAnnots, newDoc.words, c.inserted, insertedColor, "Inserted",
+			comment); err != nil {
+			return stats, err
+		}
+	}
+
+	if err := writeDiffPdf(outPath, oldDoc, newDoc, alignPages(oldDoc, newDoc, edits), oldAnnots,
+		newAnnots); err != nil {
+		return stats, err
+	}
+
+	if err := writeUnifiedDiff(report, oldDoc, newDoc, edits, opt.context); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// extractWords returns a document with the words in PDF file `f` with path `path`.
+func extractWords(path string, f *os.File) (*document, error) {
+	pdfReader, err := model.NewPdfReaderLazy(f)
+	if err != nil {
+		return nil, fmt.Errorf("NewPdfReaderLazy failed. %q err=%v", path, err)
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, fmt.Errorf("GetNumPages failed. %q err=%v", path, err)
+	}
+	doc := &document{path: path, pdfReader: pdfReader, numPages: numPages}
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return nil, fmt.Errorf("GetPage failed. %q pageNum=%d err=%v", path, pageNum, err)
+		}
+		ex, err := extractor.New(page)
+		if err != nil {
+			return nil, fmt.Errorf("extractor.New failed. %q pageNum=%d err=%v", path, pageNum, err)
+		}
+		pageText, _, _, err := ex.ExtractPageText()
+		if err != nil {
+			return nil, fmt.Errorf("ExtractPageText failed. %q pageNum=%d err=%v", path, pageNum, err)
+		}
+		text := pageText.Text()
+		// The marks are in offset order. The marks of each word are found by walking through them
+		// rather than with TextMarkArray.RangeOffset, which fails for the last word on a page.
+		marks := pageText.Marks().Elements()
+		m := 0
+		for i := 0; i < len(text); {
+			r, size := utf8.DecodeRuneInString(text[i:])
+			if unicode.IsSpace(r) {
+				i += size
+				continue
+			}
+			j := i
+			for j < len(text) {
+				r, size := utf8.DecodeRuneInString(text[j:])
+				if unicode.IsSpace(r) {
+					break
+				}
+				j += size
+			}
+			var bbox model.PdfRectangle
+			found := false
+			for ; m < len(marks) && marks[m].Offset < j; m++ {
+				mark := marks[m]
+				if mark.Offset < i || mark.Meta {
+					continue
+				}
+				if !found {
+					bbox, found = mark.BBox, true
+					continue
+				}
+				bbox.Llx, bbox.Lly = math.Min(bbox.Llx, mark.BBox.Llx), math.Min(bbox.Lly, mark.BBox.Lly)
+				bbox.Urx, bbox.Ury = math.Max(bbox.Urx, mark.BBox.Urx), math.Max(bbox.Ury, mark.BBox.Ury)
+			}
+			if found {
+				doc.words = append(doc.words, word{text: text[i:j], page: pageNum, bbox: bbox})
+			}
+			i = j
+		}
+	}
+	return doc, nil
+}
+
+// editOp is the type of an edit in a diff.
+type editOp int
+
+const (
+	opEqual editOp = iota
+	opDelete
+	opInsert
+)
+
+// edit is an element of a diff between old and new word lists. `oldIndex` and `newIndex` are the
+// indexes of the word in the old and new lists. For deletions `newIndex` is the index in the new list
+// where the word was deleted and for insertions `oldIndex` is the index in the old list where the word
+// was inserted.
+type edit struct {
+	op       editOp
+	oldIndex int
+	newIndex int
+}
+
+// diffWords returns the edits that transform `a` into `b` with the fewest deletions and insertions.
+func diffWords(a, b []string) []edit {
+	// Matching words at the start and end are common in document revisions, so trim them before
+	// running the O((N+M)D) diff.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	var edits []edit
+	for i := 0; i < pre; i++ {
+		edits = append(edits, edit{opEqual, i, i})
+	}
+	for _, e := range myersDiff(a[pre:len(a)-suf], b[pre:len(b)-suf]) {
+		e.oldIndex += pre
+		e.newIndex += pre
+		edits = append(edits, e)
+	}
+	for i := 0; i < suf; i++ {
+		edits = append(edits, edit{opEqual, len(a) - suf + i, len(b) - suf + i})
+	}
+	return edits
+}
+
+// myersDiff returns the edits that transform `a` into `b` using the linear space version of Myers'
+// O((N+M)D) algorithm, so comparing very different texts doesn't use a lot of memory.
+func myersDiff(a, b []string) []edit {
+	var edits []edit
+	diffRange(a, b, 0, 0, &edits)
+	return edits
+}
+
+// diffRange appends the edits that transform `a` into `b` to `edits`. `a` and `b` are slices of the
+// full word lists starting at indexes `aStart` and `bStart`.
+func diffRange(a, b []string, aStart, bStart int, edits *[]edit) {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		*edits = append(*edits, edit{opEqual, aStart + pre, bStart + pre})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	n, m := len(a)-pre-suf, len(b)-pre-suf
+	switch {
+	case n == 0:
+		for j := 0; j < m; j++ {
+			*edits = append(*edits, edit{opInsert, aStart + pre, bStart + pre + j})
+		}
+	case m == 0:
+		for i := 0; i < n; i++ {
+			*edits = append(*edits, edit{opDelete, aStart + pre + i, bStart + pre})
+		}
+	default:
+		x, y, ok := middleSnake(a[pre:pre+n], b[pre:pre+m])
+		if ok {
+			diffRange(a[pre:pre+x], b[pre:pre+y], aStart+pre, bStart+pre, edits)
+			diffRange(a[pre+x:pre+n], b[pre+y:pre+m], aStart+pre+x, bStart+pre+y, edits)
+		} else {
+			// `a` and `b` have no words in common.
+			for i := 0; i < n; i++ {
+				*edits = append(*edits, edit{opDelete, aStart + pre + i, bStart + pre})
+			}
+			for j := 0; j < m; j++ {
+				*edits = append(*edits, edit{opInsert, aStart + pre + n, bStart + pre + j})
+			}
+		}
+	}
+	for i := suf; i > 0; i-- {
+		*edits = append(*edits, edit{opEqual, aStart + len(a) - i, bStart + len(b) - i})
+	}
+}
+
+// middleSnake returns a point (`x`, `y`) on a shortest edit path from `a` to `b` where the path can be
+// split into two shorter paths, found by searching forwards from the start and backwards from the end
+// at the same time until the searches overlap. It returns false if `a` and `b` have no words in
+// common.
+func middleSnake(a, b []string) (int, int, bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	// vf[offset+k] is the furthest x reached on diagonal k searching forwards and vr[offset+k] is the
+	// furthest distance from the end reached on diagonal k searching backwards.
+	offset := maxD
+	vf := make([]int, 2*maxD+2)
+	vr := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vr[i] = -1, -1
+	}
+	vf[offset+1], vr[offset+1] = 0, 0
+	delta := n - m
+	// If delta is odd the searches overlap in a forward step, otherwise in a backward step.
+	front := delta%2 != 0
+	// Diagonals that have run off the edges of the edit graph are not searched again.
+	kfStart, kfEnd, krStart, krEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + kfStart; k <= d-kfEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+			switch {
+			case x > n:
+				kfEnd += 2
+			case y > m:
+				kfStart += 2
+			case front:
+				kr := offset + delta - k
+				if kr >= 0 && kr < len(vr) && vr[kr] != -1 && x >= n-vr[kr] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + krStart; k <= d-krEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vr[offset+k-1] < vr[offset+k+1]) {
+				x = vr[offset+k+1]
+			} else {
+				x = vr[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			vr[offset+k] = x
+			switch {
+			case x > n:
+				krEnd += 2
+			case y > m:
+				krStart += 2
+			case !front:
+				kf := offset + delta - k
+				if kf >= 0 && kf < len(vf) && vf[kf] != -1 {
+					xf := vf[kf]
+					if xf >= n-x {
+						return xf, offset + xf - kf, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// change is a run of deleted and/or inserted words. `deleted` are the indexes of the deleted words in
+// the old document and `inserted` are the indexes of the inserted words in the new document.
+type change struct {
+	deleted  []int
+	inserted []int
+}
+
+// findChanges returns the runs of deletions and insertions in `edits`.
+func findChanges(edits []edit) []change {
+	var changes []change
+	var c change
+	for _, e := range edits {
+		switch e.op {
+		case opEqual:
+			if len(c.deleted) > 0 || len(c.inserted) > 0 {
+				changes = append(changes, c)
+				c = change{}
+			}
+		case opDelete:
+			c.deleted = append(c.deleted, e.oldIndex)
+		case opInsert:
+			c.inserted = append(c.inserted, e.newIndex)
+		}
+	}
+	if len(c.deleted) > 0 || len(c.inserted) > 0 {
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// wordsText returns the text of the words in `words` with indexes `indexes` separated by spaces.
+func wordsText(words []word, indexes []int) string {
+	parts := make([]string, len(indexes))
+	for i, idx := range indexes {
+		parts[i] = words[idx].text
+	}
+	return strings.Join(parts, " ")
+}
+
+// alignPages returns a map from the page numbers of `newDoc` to the page numbers of the pages in
+// `oldDoc` that they share the most words with according to `edits`. New pages that share no words
+// with the old document are not in the map.
+func alignPages(oldDoc, newDoc *document, edits []edit) map[int]int {
+	shared := map[[2]int]int{}
+	for _, e := range edits {
+		if e.op == opEqual {
+			shared[[2]int{newDoc.words[e.newIndex].page, oldDoc.words[e.oldIndex].page}]++
+		}
+	}
+	align := map[int]int{}
+	for newPage := 1; newPage <= newDoc.numPages; newPage++ {
+		best := 0
+		for oldPage := 1; oldPage <= oldDoc.numPages; oldPage++ {
+			if n := shared[[2]int{newPage, oldPage}]; n > best {
+				best = n
+				align[newPage] = oldPage
+			}
+		}
+	}
+	return align
+}
+
+// addHighlights adds highlight annotations in color `color` over the words in `words` with indexes
+// `indexes` to `annots`, a map from page number to the annotations on the page. There is one
+// annotation per page with a quadrilateral for each line of words.
+func addHighlights(annots map[int][]*model.PdfAnnotation, words []word, indexes []int, color [3]float64,
+	subject, comment string) error {
+	var page int
+	var lines []model.PdfRectangle
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		annotation, err := makeHighlight(lines, color, subject, comment)
+		if err != nil {
+			return err
+		}
+		annots[page] = append(annots[page], annotation)
+		lines = nil
+		return nil
+	}
+	for _, idx := range indexes {
+		w := words[idx]
+		if w.page != page {
+			if err := flush(); err != nil {
+				return err
+			}
+			page = w.page
+		}
+		r := w.bbox
+		if len(lines) > 0 {
+			last := &lines[len(lines)-1]
+			tol := 0.5 * (r.Ury - r.Lly)
+			if math.Abs(r.Lly-last.Lly) <= tol && r.Llx >= last.Urx-tol {
+				last.Llx, last.Lly = math.Min(last.Llx, r.Llx), math.Min(last.Lly, r.Lly)
+				last.Urx, last.Ury = math.Max(last.Urx, r.Urx), math.Max(last.Ury, r.Ury)
+				continue
+			}
+		}
+		lines = append(lines, r)
+	}
+	return flush()
+}
+
+// makeHighlight returns a highlight annotation in color `color` over the rectangles `lines` with
+// subject `subject` and comment `comment`. The annotation has an appearance stream so that it is
+// shown the same way in all viewers.
+func makeHighlight(lines []model.PdfRectangle, color [3]float64, subject,
+	comment string) (*model.PdfAnnotation, error) {
+	var quads []float64
+	rect := lines[0]
+	ops := []string{"/GSHighlight gs", fmt.Sprintf("%.3f %.3f %.3f rg", color[0], color[1], color[2])}
+	for _, q := range lines {
+		// Upper left, upper right, lower left, lower right.
+		quads = append(quads, q.Llx, q.Ury, q.Urx, q.Ury, q.Llx, q.Lly, q.Urx, q.Lly)
+		rect.Llx, rect.Lly = math.Min(rect.Llx, q.Llx), math.Min(rect.Lly, q.Lly)
+		rect.Urx, rect.Ury = math.Max(rect.Urx, q.Urx), math.Max(rect.Ury, q.Ury)
+		ops = append(ops, fmt.Sprintf("%.2f %.2f %.2f %.2f re f", q.Llx, q.Lly, q.Urx-q.Llx, q.Ury-q.Lly))
+	}
+
+	// Multiply blending keeps the text under the highlight readable.
+	gs := core.MakeDict()
+	gs.Set("Type", core.MakeName("ExtGState"))
+	gs.Set("BM", core.MakeName("Multiply"))
+	resources := model.NewPdfPageResources()
+	if err := resources.AddExtGState("GSHighlight", gs); err != nil {
+		return nil, err
+	}
+	xform := model.NewXObjectForm()
+	xform.BBox = core.MakeArrayFromFloats([]float64{rect.Llx, rect.Lly, rect.Urx, rect.Ury})
+	xform.Resources = resources
+	if err := xform.SetContentStream([]byte(strings.Join(ops, "\n")), core.NewFlateEncoder()); err != nil {
+		return nil, err
+	}
+	ap := core.MakeDict()
+	ap.Set("N", xform.ToPdfObject())
+
+	highlight := model.NewPdfAnnotationHighlight()
+	highlight.QuadPoints = core.MakeArrayFromFloats(quads)
+	highlight.Rect = core.MakeArrayFromFloats([]float64{rect.Llx, rect.Lly, rect.Urx, rect.Ury})
+	highlight.C = core.MakeArrayFromFloats(color[:])
+	highlight.Contents = core.MakeString(comment)
+	highlight.F = core.MakeInteger(4) // Print.
+	highlight.AP = ap
+	now := time.Now().UTC().Format("D:20060102150405Z")
+	highlight.M = core.MakeString(now)
+	highlight.CreationDate = core.MakeString(now)
+	highlight.Subj = core.MakeString(subject)
+	return highlight.PdfAnnotation, nil
+}
+
+// writeDiffPdf saves a PDF with the pages of `oldDoc` and `newDoc` to `outPath`. Each old page is
+// placed before the new page that `align` aligns it with, and the pages are given the annotations
+// in `oldAnnots` and `newAnnots`.
+func writeDiffPdf(outPath string, oldDoc, newDoc *document, align map[int]int,
+	oldAnnots, newAnnots map[int][]*model.PdfAnnotation) error {
+	pdfWriter := model.NewPdfWriter()
+	addPage := func(doc *document, pageNum int, annots []*model.PdfAnnotation) error {
+		page, err := doc.pdfReader.GetPage(pageNum)
+		if err != nil {
+			return fmt.Errorf("GetPage failed. %q pageNum=%d err=%v", doc.path, pageNum, err)
+		}
+		if page.MediaBox == nil {
+			// Deal with MediaBox inherited from Parent.
+			mediaBox, err := page.GetMediaBox()
+			if err != nil {
+				return fmt.Errorf("GetMediaBox failed. %q pageNum=%d err=%v", doc.path, pageNum, err)
+			}
+			page.MediaBox = mediaBox
+		}
+		for _, annotation := range annots {
+			page.AddAnnotation(annotation)
+		}
+		return pdfWriter.AddPage(page)
+	}
+
+	nextOld := 1
+	for newPage := 1; newPage <= newDoc.numPages; newPage++ {
+		for ; nextOld <= align[newPage]; nextOld++ {
+			if err := addPage(oldDoc, nextOld, oldAnnots[nextOld]); err != nil {
+				return err
+			}
+		}
+		if err := addPage(newDoc, newPage, newAnnots[newPage]); err != nil {
+			return err
+		}
+	}
+	for ; nextOld <= oldDoc.numPages; nextOld++ {
+		if err := addPage(oldDoc, nextOld, oldAnnots[nextOld]); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pdfWriter.Write(f)
+}
+
+// writeUnifiedDiff writes the words in `oldDoc` and `newDoc` with the differences `edits` to `w` in
+// unified diff format with `context` words of context around each change. Runs of words are
+// written on one line. The @@ lines give the word positions and the page numbers.
+func writeUnifiedDiff(w io.Writer, oldDoc, newDoc *document, edits []edit, context int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- %s\n+++ %s\n", filepath.Base(oldDoc.path), filepath.Base(newDoc.path))
+
+	// Find the hunks: ranges of edits with changes and up to `context` equal edits around them.
+	// Changes separated by at most 2*`context` equal edits are in the same hunk.
+	var hunks [][2]int
+	for i := 0; i < len(edits); i++ {
+		if edits[i].op == opEqual {
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		if n := len(hunks); n > 0 && start <= hunks[n-1][1] {
+			start = hunks[n-1][0]
+			hunks = hunks[:n-1]
+		}
+		for i < len(edits) && edits[i].op != opEqual {
+			i++
+		}
+		end := i + context
+		if end > len(edits) {
+			end = len(edits)
+		}
+		hunks = append(hunks, [2]int{start, end})
+	}
+
+	for _, h := range hunks {
+		hunk := edits[h[0]:h[1]]
+		oldCount, newCount := 0, 0
+		for _, e := range hunk {
+			if e.op != opInsert {
+				oldCount++
+			}
+			if e.op != opDelete {
+				newCount++
+			}
+		}
+		fmt.Fprintf(bw, "@@ -%d,%d +%d,%d @@ page %d / page %d\n",
+			hunk[0].oldIndex+1, oldCount, hunk[0].newIndex+1, newCount,
+			pageOf(oldDoc, hunk[0].oldIndex), pageOf(newDoc, hunk[0].newIndex))
+		for i := 0; i < len(hunk); {
+			if hunk[i].op == opEqual {
+				var parts []string
+				for ; i < len(hunk) && hunk[i].op == opEqual; i++ {
+					parts = append(parts, newDoc.words[hunk[i].newIndex].text)
+				}
+				fmt.Fprintf(bw, " %s\n", strings.Join(parts, " "))
+				continue
+			}
+			var deleted, inserted []string
+			for ; i < len(hunk) && hunk[i].op != opEqual; i++ {
+				if hunk[i].op == opDelete {
+					deleted = append(deleted, oldDoc.words[hunk[i].oldIndex].text)
+				} else {
+					inserted = append(inserted, newDoc.words[hunk[i].newIndex].text)
+				}
+			}
+			if len(deleted) > 0 {
+				fmt.Fprintf(bw, "-%s\n", strings.Join(deleted, " "))
+			}
+			if len(inserted) > 0 {
+				fmt.Fprintf(bw, "+%s\n", strings.Join(inserted, " "))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// pageOf returns the number of the page in `doc` that word index `i` is on. Indexes past the last
+// word are on the last page.
+func pageOf(doc *document, i int) int {
+	if i < len(doc.words) {
+		return doc.words[i].page
+	}
+	if len(doc.words) > 0 {
+		return doc.words[len(doc.words)-1].page
+	}
+	return 1
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
@@ -1,25 +1,50 @@
 /*
  * PDF to text: Extract all text for each page of a pdf file.
  *
- * Run as: go run pdf_extract_text.go input.pdf
+ * With the -json option the text is written as JSON. Each page's text is grouped into lines and
+ * words, and each word into glyphs. Lines, words and glyphs have bounding boxes and words and
+ * glyphs have the font name, font size, fill color and text rendering mode they were drawn with.
+ * The rendering modes are the PDF Tr values: 0 = fill, 1 = stroke, 2 = fill and stroke,
+ * 3 = invisible (e.g. OCR text layers), 4-7 = modes 0-3 with clipping.
+ *
+ * With the -layout option the text is output in reading order. Each page is segmented into
+ * columns and blocks by recursive XY-cut: the words are split at the widest whitespace gap that
+ * crosses the whole region, either a vertical gap (between columns) or a horizontal gap (between
+ * blocks), until no gap is wide enough. The blocks are output top to bottom and columns left to
+ * right. With -blocks, each block is preceded by a line giving its number and bounding box.
+ * In JSON mode -layout adds the blocks to each page.
+ *
+ * With the -strip option, running heads, footers and page numbers are removed. These are blocks in
+ * the top or bottom margins of the page whose text is repeated at the same position on at least
+ * half the pages. Numbers, including roman numerals, are ignored when comparing the text so that
+ * "Confidential — Page 12 of 40" matches "Confidential — Page 13 of 40". The removed text is
+ * reported after the pages. -strip implies -layout.
+ *
+ * Run as: go run pdf_extract_text.go [-json] [-layout [-blocks]] [-strip] input.pdf
  */
 
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"math"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/contentstream"
+	"github.com/unidoc/unipdf/v3/core"
 	"github.com/unidoc/unipdf/v3/extractor"
 	pdf "github.com/unidoc/unipdf/v3/model"
 )
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: go run pdf_extract_text.go input.pdf\n")
-		os.Exit(1)
-	}
+const usage = "Usage: go run pdf_extract_text.go [-json] [-layout [-blocks]] [-strip] input.pdf\n"
 
+func main() {
 	// Make sure to enter a valid license key.
 	// Otherwise text is truncated and a watermark added to the text.
 	// License keys are available via: https://unidoc.io
@@ -34,17 +59,46 @@ func main() {
 	// For debugging.
 	// common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
 
-	inputPath := os.Args[1]
+	var asJSON bool
+	var opts layoutOptions
+	flag.BoolVar(&asJSON, "json", false, "Output text, bounding boxes, fonts and colors as JSON.")
+	flag.BoolVar(&opts.layout, "layout", false, "Output text in reading order of columns and blocks.")
+	flag.BoolVar(&opts.blocks, "blocks", false, "With -layout, show the block boundaries.")
+	flag.BoolVar(&opts.strip, "strip", false, "Remove running heads, footers and page numbers.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	inputPath := args[0]
+	if opts.strip {
+		opts.layout = true
+	}
 
-	err := outputPdfText(inputPath)
+	var err error
+	if asJSON {
+		err = outputPdfJSON(inputPath, opts)
+	} else {
+		err = outputPdfText(inputPath, opts)
+	}
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
+// layoutOptions control reading order text extraction.
+type layoutOptions struct {
+	layout bool // Output text in reading order.
+	blocks bool // Show block boundaries.
+	strip  bool // Remove repeated headers, footers and page numbers.
+}
+
 // outputPdfText prints out contents of PDF file to stdout.
-func outputPdfText(inputPath string) error {
+func outputPdfText(inputPath string, opts layoutOptions) error {
 	f, err := os.Open(inputPath)
 	if err != nil {
 		return err
@@ -62,12 +116,39 @@ func outputPdfText(inputPath string) error {
 		return err
 	}
 
+	// Headers and footers are found by comparing pages, so all the pages are read before any are
+	// output.
+	var pages []*pageBlocks
+	var removed []removedText
+	if opts.strip {
+		for pageNum := 1; pageNum <= numPages; pageNum++ {
+			page, err := pdfReader.GetPage(pageNum)
+			if err != nil {
+				return err
+			}
+			pb, err := readPageBlocks(page, pageNum)
+			if err != nil {
+				return err
+			}
+			pages = append(pages, pb)
+		}
+		removed = stripRepeatedBlocks(pages)
+	}
+
 	fmt.Printf("--------------------\n")
 	fmt.Printf("PDF to text extraction:\n")
 	fmt.Printf("--------------------\n")
 	for i := 0; i < numPages; i++ {
 		pageNum := i + 1
 
+		if opts.strip {
+			fmt.Println("------------------------------")
+			fmt.Printf("Page %d:\n", pageNum)
+			fmt.Printf("\"%s\"\n", layoutText(pages[i].blocks, opts.blocks))
+			fmt.Println("------------------------------")
+			continue
+		}
+
 		page, err := pdfReader.GetPage(pageNum)
 		if err != nil {
 			return err
@@ -78,9 +159,18 @@ func outputPdfText(inputPath string) error {
 			return err
 		}
 
-		text, err := ex.ExtractText()
-		if err != nil {
-			return err
+		var text string
+		if opts.layout {
+			pageText, _, _, err := ex.ExtractPageText()
+			if err != nil {
+				return err
+			}
+			text = layoutText(layoutBlocks(pageText), opts.blocks)
+		} else {
+			text, err = ex.ExtractText()
+			if err != nil {
+				return err
+			}
 		}
 
 		fmt.Println("------------------------------")
@@ -89,5 +179,989 @@ func outputPdfText(inputPath string) error {
 		fmt.Println("------------------------------")
 	}
 
+	if opts.strip {
+		fmt.Printf("Removed %d repeated headers and footers:\n", len(removed))
+		for _, r := range removed {
+			fmt.Printf("  %q on %d pages: %s\n", r.text, len(r.pages), pageList(r.pages))
+		}
+	}
+	return nil
+}
+
+// docLayout is the JSON representation of the text in a PDF file.
+type docLayout struct {
+	File  string       `json:"file"`
+	Pages []pageLayout `json:"pages"`
+}
+
+// pageLayout is the JSON representation of the text on a page.
+type pageLayout struct {
+	Page    int         `json:"page"`
+	Width   float64     `json:"width"`
+	Height  float64     `json:"height"`
+	Text    string      `json:"text"`
+	Lines   []textLine  `json:"lines"`
+	Blocks  []textBlock `json:"blocks,omitempty"`
+	Removed []textBlock `json:"removed,omitempty"` // Headers and footers removed by -strip.
+
+	blocks *pageBlocks
+}
+
+// textBlock is a block of text found by layout analysis. Blocks are in reading order.
+type textBlock struct {
+	Text string `json:"text"`
+	BBox bbox   `json:"bbox"`
+}
+
+// textLine is a line of text.
+type textLine struct {
+	Text  string     `json:"text"`
+	BBox  bbox       `json:"bbox"`
+	Words []textWord `json:"words"`
+}
+
+// textWord is a word of text. The font and color are those of the word's first glyph.
+type textWord struct {
+	Text       string      `json:"text"`
+	BBox       bbox        `json:"bbox"`
+	Font       string      `json:"font,omitempty"`
+	FontSize   float64     `json:"font_size"`
+	Color      string      `json:"color,omitempty"`
+	RenderMode *int        `json:"render_mode,omitempty"`
+	Glyphs     []textGlyph `json:"glyphs"`
+}
+
+// textGlyph is a glyph of text. `Offset` is the glyph's offset in the page text.
+type textGlyph struct {
+	Text       string  `json:"text"`
+	Original   string  `json:"original,omitempty"`
+	BBox       bbox    `json:"bbox"`
+	Font       string  `json:"font,omitempty"`
+	FontSize   float64 `json:"font_size"`
+	Color      string  `json:"color,omitempty"`
+	RenderMode *int    `json:"render_mode,omitempty"`
+	Offset     int     `json:"offset"`
+}
+
+// bbox is a bounding box [llx, lly, urx, ury] in device coordinates.
+type bbox [4]float64
+
+// outputPdfJSON prints out the text, text positions, fonts and colors of PDF file `inputPath` to
+// stdout as JSON.
+func outputPdfJSON(inputPath string, opts layoutOptions) error {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	pdfReader, err := pdf.NewPdfReader(f)
+	if err != nil {
+		return err
+	}
+
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return err
+	}
+
+	doc := docLayout{File: inputPath}
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return err
+		}
+		layout, err := extractPageLayout(page, opts)
+		if err != nil {
+			return fmt.Errorf("extractPageLayout failed. pageNum=%d err=%v", pageNum, err)
+		}
+		layout.Page = pageNum
+		if layout.blocks != nil {
+			layout.blocks.pageNum = pageNum
+		}
+		doc.Pages = append(doc.Pages, layout)
+	}
+
+	if opts.strip {
+		var pages []*pageBlocks
+		for _, layout := range doc.Pages {
+			pages = append(pages, layout.blocks)
+		}
+		stripRepeatedBlocks(pages)
+		for i := range doc.Pages {
+			doc.Pages[i].applyStrip()
+		}
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
 	return nil
 }
+
+// extractPageLayout returns the text on `page` grouped into lines, words and glyphs, and into
+// blocks if `opts.layout` is true.
+func extractPageLayout(page *pdf.PdfPage, opts layoutOptions) (pageLayout, error) {
+	var layout pageLayout
+	mbox, err := page.GetMediaBox()
+	if err != nil {
+		return layout, err
+	}
+	layout.Width = round(mbox.Urx - mbox.Llx)
+	layout.Height = round(mbox.Ury - mbox.Lly)
+
+	ex, err := extractor.New(page)
+	if err != nil {
+		return layout, err
+	}
+	pageText, _, _, err := ex.ExtractPageText()
+	if err != nil {
+		return layout, err
+	}
+	layout.Text = pageText.Text()
+	if opts.layout {
+		layout.blocks = &pageBlocks{mbox: *mbox, blocks: layoutBlocks(pageText)}
+		for _, b := range layout.blocks.blocks {
+			layout.Blocks = append(layout.Blocks, textBlock{Text: b.text(), BBox: makeBBox(b.bbox)})
+		}
+	}
+
+	styles, err := pageStyles(page)
+	if err != nil {
+		return layout, err
+	}
+
+	// The extractor inserts space and newline marks between words and lines. We use these to
+	// split the marks into words and lines.
+	var line []textWord
+	var word []textGlyph
+	endWord := func() {
+		if len(word) > 0 {
+			line = append(line, makeWord(word))
+			word = nil
+		}
+	}
+	endLine := func() {
+		endWord()
+		if len(line) > 0 {
+			layout.Lines = append(layout.Lines, makeLine(line))
+			line = nil
+		}
+	}
+	for _, tm := range pageText.Marks().Elements() {
+		switch {
+		case strings.Contains(tm.Text, "\n"):
+			endLine()
+			continue
+		case strings.TrimSpace(tm.Text) == "":
+			endWord()
+			continue
+		case tm.Meta:
+			continue
+		}
+		g := textGlyph{
+			Text:     tm.Text,
+			BBox:     makeBBox(tm.BBox),
+			FontSize: round(tm.FontSize),
+			Offset:   tm.Offset,
+		}
+		if tm.Original != tm.Text {
+			g.Original = tm.Original
+		}
+		if tm.Font != nil {
+			g.Font = tm.Font.BaseFont()
+		}
+		if style, ok := styles.find(tm.BBox.Llx, tm.BBox.Lly); ok {
+			g.Color = style.color
+			mode := style.renderMode
+			g.RenderMode = &mode
+		}
+		word = append(word, g)
+	}
+	endLine()
+	return layout, nil
+}
+
+// applyStrip removes the headers and footers found by stripRepeatedBlocks from `layout`. The text
+// is replaced by the reading order text of the remaining blocks.
+func (layout *pageLayout) applyStrip() {
+	pb := layout.blocks
+	layout.Text = layoutText(pb.blocks, false)
+	layout.Blocks = nil
+	for _, b := range pb.blocks {
+		layout.Blocks = append(layout.Blocks, textBlock{Text: b.text(), BBox: makeBBox(b.bbox)})
+	}
+	var lines []textLine
+	for _, line := range layout.Lines {
+		inRemoved := false
+		for _, b := range pb.removed {
+			if containsBBox(makeBBox(b.bbox), line.BBox) {
+				inRemoved = true
+				break
+			}
+		}
+		if !inRemoved {
+			lines = append(lines, line)
+		}
+	}
+	layout.Lines = lines
+	for _, b := range pb.removed {
+		layout.Removed = append(layout.Removed, textBlock{Text: b.text(), BBox: makeBBox(b.bbox)})
+	}
+}
+
+// containsBBox returns true if `outer` contains `inner`, allowing for rounding.
+func containsBBox(outer, inner bbox) bool {
+	const tol = 0.5
+	return outer[0]-tol <= inner[0] && outer[1]-tol <= inner[1] &&
+		inner[2] <= outer[2]+tol && inner[3] <= outer[3]+tol
+}
+
+// makeWord returns a word made from `glyphs`.
+func makeWord(glyphs []textGlyph) textWord {
+	var parts []string
+	box := glyphs[0].BBox
+	for _, g := range glyphs {
+		parts = append(parts, g.Text)
+		box = box.union(g.BBox)
+	}
+	return textWord{
+		Text:       strings.Join(parts, ""),
+		BBox:       box,
+		Font:       glyphs[0].Font,
+		FontSize:   glyphs[0].FontSize,
+		Color:      glyphs[0].Color,
+		RenderMode: glyphs[0].RenderMode,
+		Glyphs:     glyphs,
+	}
+}
+
+// makeLine returns a line made from `words`.
+func makeLine(words []textWord) textLine {
+	var parts []string
+	box := words[0].BBox
+	for _, w := range words {
+		parts = append(parts, w.Text)
+		box = box.union(w.BBox)
+	}
+	return textLine{Text: strings.Join(parts, " "), BBox: box, Words: words}
+}
+
+// makeBBox returns the normalized bounding box of `r`.
+func makeBBox(r pdf.PdfRectangle) bbox {
+	return bbox{
+		round(math.Min(r.Llx, r.Urx)),
+		round(math.Min(r.Lly, r.Ury)),
+		round(math.Max(r.Llx, r.Urx)),
+		round(math.Max(r.Lly, r.Ury)),
+	}
+}
+
+// union returns the smallest bounding box that contains `b` and `o`.
+func (b bbox) union(o bbox) bbox {
+	return bbox{math.Min(b[0], o[0]), math.Min(b[1], o[1]), math.Max(b[2], o[2]), math.Max(b[3], o[3])}
+}
+
+// round returns `x` rounded to 2 decimal places.
+func round(x float64) float64 {
+	return math.Round(x*100) / 100
+}
+
+// pageBlocks are the blocks of text on a page.
+type pageBlocks struct {
+	pageNum int
+	mbox    pdf.PdfRectangle
+	blocks  []layoutBlock
+	removed []layoutBlock // Headers and footers removed from `blocks`.
+}
+
+// removedText describes a header or footer removed from pages.
+type removedText struct {
+	text  string // The text on the first page it was removed from.
+	pages []int  // The pages it was removed from.
+}
+
+// Header and footer detection parameters.
+const (
+	// marginFraction is the fraction of the page height at the top and bottom of a page where
+	// headers and footers are looked for.
+	marginFraction = 0.2
+	// positionTol is the maximum difference (in points) in the vertical position of a header or
+	// footer on different pages.
+	positionTol = 4.0
+)
+
+// readPageBlocks returns the blocks of text on `page`, which is page number `pageNum`.
+func readPageBlocks(page *pdf.PdfPage, pageNum int) (*pageBlocks, error) {
+	mbox, err := page.GetMediaBox()
+	if err != nil {
+		return nil, err
+	}
+	ex, err := extractor.New(page)
+	if err != nil {
+		return nil, err
+	}
+	pageText, _, _, err := ex.ExtractPageText()
+	if err != nil {
+		return nil, err
+	}
+	return &pageBlocks{pageNum: pageNum, mbox: *mbox, blocks: layoutBlocks(pageText)}, nil
+}
+
+// stripRepeatedBlocks removes the headers and footers from `pages` and returns a description of
+// what was removed. Headers and footers are blocks in the page margins whose text, ignoring
+// numbers, is repeated at the same position on at least half the pages.
+func stripRepeatedBlocks(pages []*pageBlocks) []removedText {
+	minRepeats := (len(pages) + 1) / 2
+	if minRepeats < 2 {
+		minRepeats = 2
+	}
+
+	// isCandidate returns true if `b` is in the top or bottom margin of `pb`'s page.
+	isCandidate := func(pb *pageBlocks, b layoutBlock) bool {
+		height := pb.mbox.Ury - pb.mbox.Lly
+		return b.bbox.Lly-pb.mbox.Lly >= (1-marginFraction)*height ||
+			b.bbox.Ury-pb.mbox.Lly <= marginFraction*height
+	}
+	// samePosition returns true if `a` on page `pa` and `b` on page `pb` are at the same position.
+	samePosition := func(pa *pageBlocks, a layoutBlock, pb *pageBlocks, b layoutBlock) bool {
+		return math.Abs((a.bbox.Lly-pa.mbox.Lly)-(b.bbox.Lly-pb.mbox.Lly)) <= positionTol &&
+			math.Abs((a.bbox.Ury-pa.mbox.Lly)-(b.bbox.Ury-pb.mbox.Lly)) <= positionTol &&
+			a.bbox.Llx-pa.mbox.Llx <= b.bbox.Urx-pb.mbox.Llx &&
+			b.bbox.Llx-pb.mbox.Llx <= a.bbox.Urx-pa.mbox.Llx
+	}
+
+	type blockRef struct {
+		page  *pageBlocks
+		block layoutBlock
+	}
+	byKey := map[string][]blockRef{}
+	for _, pb := range pages {
+		for _, b := range pb.blocks {
+			if isCandidate(pb, b) {
+				key := blockKey(b)
+				byKey[key] = append(byKey[key], blockRef{pb, b})
+			}
+		}
+	}
+
+	var removed []removedText
+	removedIndex := map[string]int{}
+	for _, pb := range pages {
+		var kept []layoutBlock
+		for _, b := range pb.blocks {
+			repeatPages := map[int]bool{}
+			if isCandidate(pb, b) {
+				for _, ref := range byKey[blockKey(b)] {
+					if samePosition(pb, b, ref.page, ref.block) {
+						repeatPages[ref.page.pageNum] = true
+					}
+				}
+			}
+			if len(repeatPages) < minRepeats {
+				kept = append(kept, b)
+				continue
+			}
+			pb.removed = append(pb.removed, b)
+			key := blockKey(b)
+			i, ok := removedIndex[key]
+			if !ok {
+				i = len(removed)
+				removedIndex[key] = i
+				removed = append(removed, removedText{text: b.text()})
+			}
+			removed[i].pages = append(removed[i].pages, pb.pageNum)
+		}
+		pb.blocks = kept
+	}
+	return removed
+}
+
+// blockKey returns a key for comparing `b` with blocks on other pages. Numbers, including roman
+// numerals, are replaced by # and whitespace is normalized.
+func blockKey(b layoutBlock) string {
+	var tokens []string
+	for _, tok := range strings.Fields(b.text()) {
+		if reRoman.MatchString(tok) && strings.Trim(tok, ".)") != "" {
+			tok = "#"
+		}
+		tokens = append(tokens, reDigits.ReplaceAllString(tok, "#"))
+	}
+	return strings.Join(tokens, " ")
+}
+
+var (
+	reDigits = regexp.MustCompile(`\d+`)
+	reRoman  = regexp.MustCompile(`(?i)^(m{0,4}(cm|cd|d?c{0,3})(xc|xl|l?x{0,3})(ix|iv|v?i{0,3}))[.)]?$`)
+)
+
+// pageList returns a compact description of page numbers `pages`. e.g. 1-3,5
+func pageList(pages []int) string {
+	var parts []string
+	for i := 0; i < len(pages); {
+		j := i
+		for j+1 < len(pages) && pages[j+1] == pages[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", pages[i], pages[j]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d", pages[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// layoutWord is a word on a page.
+type layoutWord struct {
+	text string
+	bbox pdf.PdfRectangle
+}
+
+// layoutBlock is a block of lines of text that XY-cut doesn't split.
+type layoutBlock struct {
+	bbox  pdf.PdfRectangle
+	lines []string
+}
+
+// text returns the text of `b`.
+func (b layoutBlock) text() string {
+	return strings.Join(b.lines, "\n")
+}
+
+// Minimum gaps for XY-cut, as multiples of the median word height. Vertical gaps must be wider than
+// the spaces between words and horizontal gaps must be wider than the spaces between lines.
+const (
+	columnGapFactor = 1.0
+	blockGapFactor  = 0.7
+)
+
+// layoutText returns the text of `blocks` separated by blank lines. If `showBlocks` is true, each
+// block is preceded by its number and bounding box.
+func layoutText(blocks []layoutBlock, showBlocks bool) string {
+	var parts []string
+	for i, b := range blocks {
+		text := b.text()
+		if showBlocks {
+			text = fmt.Sprintf("[block %d: %.1f %.1f %.1f %.1f]\n%s", i+1,
+				b.bbox.Llx, b.bbox.Lly, b.bbox.Urx, b.bbox.Ury, text)
+		}
+		parts = append(parts, text)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// layoutBlocks returns the text in `pageText` segmented into blocks in reading order.
+func layoutBlocks(pageText *extractor.PageText) []layoutBlock {
+	words := layoutWords(pageText)
+	if len(words) == 0 {
+		return nil
+	}
+	var heights []float64
+	for _, w := range words {
+		heights = append(heights, w.bbox.Ury-w.bbox.Lly)
+	}
+	sort.Float64s(heights)
+	height := heights[len(heights)/2]
+	if height <= 0 {
+		height = 1
+	}
+	return xyCut(words, height)
+}
+
+// layoutWords returns the words in `pageText`. The extractor separates words with space and
+// newline marks.
+func layoutWords(pageText *extractor.PageText) []layoutWord {
+	var words []layoutWord
+	var text []string
+	var box pdf.PdfRectangle
+	endWord := func() {
+		if len(text) > 0 {
+			words = append(words, layoutWord{text: strings.Join(text, ""), bbox: box})
+			text = nil
+		}
+	}
+	for _, tm := range pageText.Marks().Elements() {
+		if strings.TrimSpace(tm.Text) == "" {
+			endWord()
+			continue
+		}
+		r := normalizeRect(tm.BBox)
+		if len(text) == 0 {
+			box = r
+		} else {
+			box = rectUnion(box, r)
+		}
+		text = append(text, tm.Text)
+	}
+	endWord()
+	return words
+}
+
+// xyCut recursively splits `words` at the widest vertical or horizontal whitespace gap that crosses
+// all of them and returns the resulting blocks in reading order. `height` is the median word height.
+func xyCut(words []layoutWord, height float64) []layoutBlock {
+	colGap, colAt := widestGap(words, true)
+	rowGap, rowAt := widestGap(words, false)
+	colScore := colGap / (columnGapFactor * height)
+	rowScore := rowGap / (blockGapFactor * height)
+	if colScore < 1 && rowScore < 1 {
+		return []layoutBlock{makeBlock(words)}
+	}
+
+	var first, second []layoutWord
+	for _, w := range words {
+		var isFirst bool
+		if colScore >= rowScore {
+			// Left column first.
+			isFirst = (w.bbox.Llx+w.bbox.Urx)/2 < colAt
+		} else {
+			// Top block first.
+			isFirst = (w.bbox.Lly+w.bbox.Ury)/2 > rowAt
+		}
+		if isFirst {
+			first = append(first, w)
+		} else {
+			second = append(second, w)
+		}
+	}
+	return append(xyCut(first, height), xyCut(second, height)...)
+}
+
+// widestGap returns the width and center of the widest gap between the projections of `words` on
+// the x axis if `vertical` is true, or the y axis if it is false.
+func widestGap(words []layoutWord, vertical bool) (float64, float64) {
+	type interval struct{ lo, hi float64 }
+	intervals := make([]interval, len(words))
+	for i, w := range words {
+		if vertical {
+			intervals[i] = interval{w.bbox.Llx, w.bbox.Urx}
+		} else {
+			intervals[i] = interval{w.bbox.Lly, w.bbox.Ury}
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].lo < intervals[j].lo })
+
+	gap, at := 0.0, 0.0
+	reach := intervals[0].hi
+	for _, iv := range intervals[1:] {
+		if iv.lo-reach > gap {
+			gap = iv.lo - reach
+			at = (iv.lo + reach) / 2
+		}
+		reach = math.Max(reach, iv.hi)
+	}
+	return gap, at
+}
+
+// makeBlock returns a block containing `words`. The words are grouped into lines by vertical
+// overlap, as in identifyLines in pdf_to_csv.go, and the lines are sorted top to bottom and the
+// words in each line left to right.
+func makeBlock(words []layoutWord) layoutBlock {
+	var lines [][]layoutWord
+	for _, w := range words {
+		match := false
+		for i, line := range lines {
+			if lineOverlap(w.bbox, line[0].bbox) < 0 {
+				lines[i] = append(lines[i], w)
+				match = true
+				break
+			}
+		}
+		if !match {
+			lines = append(lines, []layoutWord{w})
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i][0].bbox.Lly >= lines[j][0].bbox.Lly
+	})
+
+	block := layoutBlock{bbox: words[0].bbox}
+	for _, line := range lines {
+		sort.SliceStable(line, func(i, j int) bool { return line[i].bbox.Llx < line[j].bbox.Llx })
+		var parts []string
+		for _, w := range line {
+			parts = append(parts, w.text)
+			block.bbox = rectUnion(block.bbox, w.bbox)
+		}
+		block.lines = append(block.lines, strings.Join(parts, " "))
+	}
+	return block
+}
+
+// lineOverlap is a measure of the vertical overlap of `bbox1` and `bbox2`. It is 0 when they are
+// exactly on top of each other and negative when they overlap.
+func lineOverlap(bbox1, bbox2 pdf.PdfRectangle) float64 {
+	union := rectUnion(bbox1, bbox2)
+	a := math.Abs(union.Ury - union.Lly)
+	b := math.Abs(bbox1.Ury-bbox1.Lly) + math.Abs(bbox2.Ury-bbox2.Lly)
+	return (a - b) / (a + b)
+}
+
+// rectUnion returns the smallest rectangle that contains `b1` and `b2`.
+func rectUnion(b1, b2 pdf.PdfRectangle) pdf.PdfRectangle {
+	return pdf.PdfRectangle{
+		Llx: math.Min(b1.Llx, b2.Llx),
+		Lly: math.Min(b1.Lly, b2.Lly),
+		Urx: math.Max(b1.Urx, b2.Urx),
+		Ury: math.Max(b1.Ury, b2.Ury),
+	}
+}
+
+// normalizeRect returns `r` with its lower left corner below and to the left of its upper right
+// corner.
+func normalizeRect(r pdf.PdfRectangle) pdf.PdfRectangle {
+	return pdf.PdfRectangle{
+		Llx: math.Min(r.Llx, r.Urx),
+		Lly: math.Min(r.Lly, r.Ury),
+		Urx: math.Max(r.Llx, r.Urx),
+		Ury: math.Max(r.Lly, r.Ury),
+	}
+}
+
+// glyphStyle is the fill color and text rendering mode of a glyph.
+type glyphStyle struct {
+	color      string // Fill color as #rrggbb. Empty if it can't be converted to RGB.
+	renderMode int    // Text rendering mode (Tr).
+}
+
+// styleIndex is an index of glyph styles by glyph origin in device coordinates.
+// The extractor doesn't report the colors or rendering modes of the text marks it returns, so we
+// find them in a separate pass over the content stream and look them up by glyph origin.
+type styleIndex map[[2]int]glyphStyle
+
+// styleGrid is the resolution (in points) of styleIndex.
+const styleGrid = 0.5
+
+// add adds `style` for the glyph with origin (`x`, `y`) to `st`.
+func (st styleIndex) add(x, y float64, style glyphStyle) {
+	st[[2]int{int(math.Round(x / styleGrid)), int(math.Round(y / styleGrid))}] = style
+}
+
+// find returns the style of the glyph with origin nearest to (`x`, `y`) within one grid step.
+func (st styleIndex) find(x, y float64) (glyphStyle, bool) {
+	kx, ky := int(math.Round(x/styleGrid)), int(math.Round(y/styleGrid))
+	if style, ok := st[[2]int{kx, ky}]; ok {
+		return style, true
+	}
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			if style, ok := st[[2]int{kx + dx, ky + dy}]; ok {
+				return style, true
+			}
+		}
+	}
+	return glyphStyle{}, false
+}
+
+// pageStyles returns the styles of the glyphs on `page`.
+func pageStyles(page *pdf.PdfPage) (styleIndex, error) {
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return nil, err
+	}
+	sw := styleWalker{styles: styleIndex{}, fonts: map[core.PdfObject]*pdf.PdfFont{}}
+	err = sw.walk(contents, page.Resources, identityMatrix(), 0)
+	return sw.styles, err
+}
+
+// styleWalker finds the styles of glyphs in content streams.
+type styleWalker struct {
+	styles styleIndex
+	fonts  map[core.PdfObject]*pdf.PdfFont
+}
+
+// textState is the part of the text state that styleWalker tracks.
+type textState struct {
+	font       *pdf.PdfFont
+	tfs        float64 // Font size.
+	tc         float64 // Character spacing.
+	tw         float64 // Word spacing.
+	th         float64 // Horizontal scaling.
+	tl         float64 // Leading.
+	rise       float64 // Text rise.
+	renderMode int     // Text rendering mode.
+}
+
+// maxFormDepth is the maximum depth of form XObjects that styleWalker descends into.
+const maxFormDepth = 10
+
+// walk records the styles of the glyphs in content stream `contents` with resources `resources`.
+// `ctm` transforms the content stream's coordinates to device coordinates.
+// NOTE: Form XObjects are processed with the default initial fill color, not the fill color in
+// effect where they are drawn.
+func (sw *styleWalker) walk(contents string, resources *pdf.PdfPageResources, ctm matrix, level int) error {
+	ops, err := contentstream.NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return err
+	}
+
+	ts := textState{th: 1.0}
+	var stack []textState
+	var tm, tlm matrix
+
+	processor := contentstream.NewContentStreamProcessor(*ops)
+	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
+		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState,
+			resources *pdf.PdfPageResources) error {
+			floats, _ := core.GetNumbersAsFloat(op.Params)
+			switch op.Operand {
+			case "q":
+				stack = append(stack, ts)
+			case "Q":
+				if len(stack) > 0 {
+					ts = stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+				}
+			case "BT":
+				tm, tlm = identityMatrix(), identityMatrix()
+			case "Tf":
+				if len(op.Params) == 2 {
+					name, _ := core.GetNameVal(op.Params[0])
+					ts.font = sw.getFont(resources, name)
+					ts.tfs, _ = core.GetNumberAsFloat(op.Params[1])
+				}
+			case "Tc":
+				if len(floats) == 1 {
+					ts.tc = floats[0]
+				}
+			case "Tw":
+				if len(floats) == 1 {
+					ts.tw = floats[0]
+				}
+			case "Tz":
+				if len(floats) == 1 {
+					ts.th = floats[0] / 100.0
+				}
+			case "TL":
+				if len(floats) == 1 {
+					ts.tl = floats[0]
+				}
+			case "Ts":
+				if len(floats) == 1 {
+					ts.rise = floats[0]
+				}
+			case "Tr":
+				if len(floats) == 1 {
+					ts.renderMode = int(floats[0])
+				}
+			case "Td", "TD":
+				if len(floats) == 2 {
+					if op.Operand == "TD" {
+						ts.tl = -floats[1]
+					}
+					tlm = translation(floats[0], floats[1]).mult(tlm)
+					tm = tlm
+				}
+			case "Tm":
+				if len(floats) == 6 {
+					tlm = newMatrix(floats)
+					tm = tlm
+				}
+			case "T*":
+				tlm = translation(0, -ts.tl).mult(tlm)
+				tm = tlm
+			case "Tj", "TJ", "'", `"`:
+				var shown core.PdfObject
+				switch {
+				case op.Operand == `"` && len(op.Params) == 3:
+					ts.tw, _ = core.GetNumberAsFloat(op.Params[0])
+					ts.tc, _ = core.GetNumberAsFloat(op.Params[1])
+					shown = op.Params[2]
+				case op.Operand != `"` && len(op.Params) == 1:
+					shown = op.Params[0]
+				default:
+					common.Log.Debug("Invalid: %s with invalid set of parameters - skip", op.Operand)
+					return nil
+				}
+				if op.Operand == "'" || op.Operand == `"` {
+					tlm = translation(0, -ts.tl).mult(tlm)
+					tm = tlm
+				}
+				style := glyphStyle{color: colorHex(gs), renderMode: ts.renderMode}
+				sw.showText(shown, ts, &tm, gsMatrix(gs).mult(ctm), style)
+			case "Do":
+				if level >= maxFormDepth || len(op.Params) != 1 || resources == nil {
+					return nil
+				}
+				name, ok := core.GetName(op.Params[0])
+				if !ok {
+					return nil
+				}
+				if _, xtype := resources.GetXObjectByName(*name); xtype != pdf.XObjectTypeForm {
+					return nil
+				}
+				xform, err := resources.GetXObjectFormByName(*name)
+				if err != nil {
+					return err
+				}
+				content, err := xform.GetContentStream()
+				if err != nil {
+					return err
+				}
+				formCtm := gsMatrix(gs).mult(ctm)
+				if arr, ok := core.GetArray(xform.Matrix); ok {
+					if vals, err := arr.ToFloat64Array(); err == nil && len(vals) == 6 {
+						formCtm = newMatrix(vals).mult(formCtm)
+					}
+				}
+				formResources := xform.Resources
+				if formResources == nil {
+					formResources = resources
+				}
+				return sw.walk(string(content), formResources, formCtm, level+1)
+			}
+			return nil
+		})
+	return processor.Process(resources)
+}
+
+// showText records `style` for the glyphs in `shown`, the operand of a text showing operator, and
+// updates text matrix `tm` as the glyphs are shown. `ctm` is the current transformation matrix.
+func (sw *styleWalker) showText(shown core.PdfObject, ts textState, tm *matrix, ctm matrix, style glyphStyle) {
+	var elements []core.PdfObject
+	if arr, ok := core.GetArray(shown); ok {
+		elements = arr.Elements()
+	} else {
+		elements = []core.PdfObject{shown}
+	}
+	for _, el := range elements {
+		strobj, ok := core.GetString(el)
+		if !ok {
+			// Kerning adjustment.
+			if val, err := core.GetNumberAsFloat(el); err == nil {
+				*tm = translation(-val/1000.0*ts.tfs*ts.th, 0).mult(*tm)
+			}
+			continue
+		}
+		codes, widths := glyphMetrics(ts.font, strobj.Bytes())
+		for i, code := range codes {
+			x, y := tm.mult(ctm).transform(0, ts.rise)
+			sw.styles.add(x, y, style)
+
+			spacing := ts.tc
+			if code == 32 && (ts.font == nil || !ts.font.IsCID()) {
+				spacing += ts.tw
+			}
+			*tm = translation((widths[i]*ts.tfs+spacing)*ts.th, 0).mult(*tm)
+		}
+	}
+}
+
+// glyphMetrics returns the character codes of `data` in `font` and the widths of their glyphs in
+// text space units.
+func glyphMetrics(font *pdf.PdfFont, data []byte) ([]uint16, []float64) {
+	var codes []uint16
+	var widths []float64
+	if font == nil {
+		for _, b := range data {
+			codes = append(codes, uint16(b))
+			widths = append(widths, 0.5)
+		}
+		return codes, widths
+	}
+	for _, code := range font.BytesToCharcodes(data) {
+		w := 0.5
+		if m, ok := font.GetCharMetrics(code); ok {
+			w = m.Wx / 1000.0
+		}
+		codes = append(codes, uint16(code))
+		widths = append(widths, w)
+	}
+	return codes, widths
+}
+
+// getFont returns the font named `name` in `resources`, or nil if it can't be loaded.
+func (sw *styleWalker) getFont(resources *pdf.PdfPageResources, name string) *pdf.PdfFont {
+	if resources == nil {
+		return nil
+	}
+	fontObj, ok := resources.GetFontByName(core.PdfObjectName(name))
+	if !ok {
+		return nil
+	}
+	if font, ok := sw.fonts[fontObj]; ok {
+		return font
+	}
+	font, err := pdf.NewPdfFontFromPdfObject(fontObj)
+	if err != nil {
+		common.Log.Debug("ERROR: Could not load font %q. err=%v", name, err)
+		font = nil
+	}
+	sw.fonts[fontObj] = font
+	return font
+}
+
+// colorHex returns the fill color of `gs` as #rrggbb, or "" if it can't be converted to RGB.
+func colorHex(gs contentstream.GraphicsState) string {
+	if gs.ColorspaceNonStroking == nil || gs.ColorNonStroking == nil {
+		return ""
+	}
+	color, err := gs.ColorspaceNonStroking.ColorToRGB(gs.ColorNonStroking)
+	if err != nil {
+		return ""
+	}
+	rgb, ok := color.(*pdf.PdfColorDeviceRGB)
+	if !ok {
+		return ""
+	}
+	toByte := func(x float64) int { return int(math.Round(math.Max(0, math.Min(1, x)) * 255)) }
+	return fmt.Sprintf("#%02x%02x%02x", toByte(rgb.R()), toByte(rgb.G()), toByte(rgb.B()))
+}
+
+// gsMatrix returns the current transformation matrix of `gs`. gs.Transform isn't used because it
+// applies the transpose of the CTM's rotation and scaling, so the elements are read directly.
+func gsMatrix(gs contentstream.GraphicsState) matrix {
+	ctm := gs.CTM
+	return matrix{ctm[0], ctm[1], ctm[3], ctm[4], ctm[6], ctm[7]}
+}
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+// identityMatrix returns the identity matrix.
+func identityMatrix() matrix {
+	return matrix{1, 0, 0, 1, 0, 0}
+}
+
+// newMatrix returns the matrix with elements `vals`.
+func newMatrix(vals []float64) matrix {
+	var m matrix
+	copy(m[:], vals)
+	return m
+}
+
+// translation returns the matrix that translates by (`tx`, `ty`).
+func translation(tx, ty float64) matrix {
+	return matrix{1, 0, 0, 1, tx, ty}
+}
+
+// mult returns `m` × `o`, the transform that applies `m` then `o`.
+func (m matrix) mult(o matrix) matrix {
+	return matrix{
+		m[0]*o[0] + m[1]*o[2],
+		m[0]*o[1] + m[1]*o[3],
+		m[2]*o[0] + m[3]*o[2],
+		m[2]*o[1] + m[3]*o[3],
+		m[4]*o[0] + m[5]*o[2] + o[4],
+		m[4]*o[1] + m[5]*o[3] + o[5],
+	}
+}
+
+// transform returns point (`x`, `y`) transformed by `m`.
+func (m matrix) transform(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
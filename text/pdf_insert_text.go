@@ -3,109 +3,834 @@
  * If unsure about position, try getting the dimensions of a PDF with pdf/pages/pdf_page_info.go first or start with
  * 0,0 (upper left corner) and increase to move right, down.
  *
- * Run as: go run pdf_insert_text.go input.pdf <page> <xpos> <ypos> "text" output.pdf
+ * By default the text is drawn as a single line. With -w the text is wrapped to fit a box of that width
+ * whose upper left corner is at <xpos>,<ypos>, and with -h the box has that height. The text can be aligned
+ * within the box, drawn with a TrueType font, rotated about the upper left corner of the box and drawn
+ * partially transparent. Text that does not fit in the box is reported and handled according to -overflow.
+ *
+ * With -markup the text may contain <b>bold</b> and <i>italic</i> spans. The bold and italic faces are
+ * the matching standard 14 fonts when -font is a standard 14 font, and are set by -bold, -italic and
+ * -bolditalic when -font is a TrueType font.
+ *
+ * The text may contain the variables {page}, {pages}, {filename} and {date} (today as yyyy-mm-dd), which are
+ * replaced by their values on each page.
+ *
+ * With -jobs the text is stamped on many files, described by the rows of a JSON or CSV job file, by a pool of
+ * concurrent workers. Each row has an input and output path, a page selector like "1,3-5,last", an anchor
+ * (top-left, top-right, bottom-left, bottom-right, top or bottom) with x,y offsets from it, a text template and
+ * optionally font, size, color, width, height, align, rotate, opacity and overflow values that override the
+ * command line options. e.g.
+ *     input,output,pages,anchor,x,y,text
+ *     a.pdf,out/a.pdf,1,top-right,36,36,Approved by J. Smith on {date}
+ *     b.pdf,out/b.pdf,2-last,bottom,0,20,{filename} page {page} of {pages}
+ * A summary is printed and -report writes a CSV report with a row per job.
+ *
+ * Run as: go run pdf_insert_text.go [options] input.pdf <pages> <xpos> <ypos> "text" output.pdf
+ *     or: go run pdf_insert_text.go [options] -jobs jobs.csv [-workers N] [-report report.csv]
+ * e.g. go run pdf_insert_text.go -w 200 -h 40 -align center -font DejaVuSans.ttf -bold DejaVuSans-Bold.ttf \
+ *          -markup -opacity 0.5 input.pdf 1 350 700 "Approved by <b>J. Smith</b> on {date}" output.pdf
  */
 
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	//unicommon "github.com/unidoc/unipdf/v3/common"
+	unicommon "github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/core"
 	"github.com/unidoc/unipdf/v3/creator"
 	pdf "github.com/unidoc/unipdf/v3/model"
 )
 
+const usage = `Usage: go run pdf_insert_text.go [options] input.pdf <pages> <xpos> <ypos> "text" output.pdf
+   or: go run pdf_insert_text.go [options] -jobs jobs.csv [-workers N] [-report report.csv]
+
+Inserts "text" on pages <pages> of input.pdf (e.g. 1,3-5,last or -1 for all pages) with its upper left
+corner at <xpos>,<ypos> measured in points from the upper left corner of the page, and writes the result
+to output.pdf. With -jobs, stamps the files described in a JSON or CSV job file.
+`
+
+// textOptions describes how the text is drawn.
+type textOptions struct {
+	fontPath       string  // Regular font: a standard 14 font name or a TrueType font file.
+	boldPath       string  // Bold TrueType font file.
+	italicPath     string  // Italic TrueType font file.
+	boldItalicPath string  // Bold italic TrueType font file.
+	fontSize       float64 // Font size (points).
+	lineHeight     float64 // Line height relative to the font size.
+	color          string  // Text color as #rrggbb.
+	width          float64 // Box width. 0 means draw the text on a single line.
+	height         float64 // Box height. 0 means the box is as high as the text.
+	align          string  // left, center, right or justify.
+	angle          float64 // Rotation angle in degrees counterclockwise.
+	opacity        float64 // Opacity in the range 0 (transparent) to 1 (opaque).
+	overflow       string  // clip, visible, shrink or error.
+	markup         bool    // Text has <b> and <i> spans.
+}
+
+// minFontSize is the smallest font size that -overflow shrink will reduce the text to.
+const minFontSize = 4.0
+
 func main() {
-	if len(os.Args) < 7 {
-		fmt.Printf("Usage: go run pdf_insert_text.go input.pdf <page> <xpos> <ypos> \"text\" output.pdf\n")
-		os.Exit(1)
-	}
+	var opt textOptions
+	var (
+		jobsPath   string
+		numWorkers int
+		reportPath string
+		debug      bool
+	)
+	flag.StringVar(&opt.fontPath, "font", "Times-Bold", "Standard 14 font name or TrueType font file.")
+	flag.StringVar(&opt.boldPath, "bold", "", "Bold TrueType font file.")
+	flag.StringVar(&opt.italicPath, "italic", "", "Italic TrueType font file.")
+	flag.StringVar(&opt.boldItalicPath, "bolditalic", "", "Bold italic TrueType font file.")
+	flag.Float64Var(&opt.fontSize, "size", 10, "Font size (points).")
+	flag.Float64Var(&opt.lineHeight, "lh", 1.0, "Line height relative to the font size.")
+	flag.StringVar(&opt.color, "color", "#000000", "Text color (#rrggbb).")
+	flag.Float64Var(&opt.width, "w", 0, "Box width (points). Text is wrapped to this width.")
+	flag.Float64Var(&opt.height, "h", 0, "Box height (points). Default: the height of the text.")
+	flag.StringVar(&opt.align, "align", "left", "Alignment in the box: left/center/right/justify.")
+	flag.Float64Var(&opt.angle, "rotate", 0, "Rotation angle (degrees counterclockwise) about the upper left corner.")
+	flag.Float64Var(&opt.opacity, "opacity", 1.0, "Opacity (0-1).")
+	flag.StringVar(&opt.overflow, "overflow", "clip", "Text that doesn't fit the box: clip/visible/shrink/error.")
+	flag.BoolVar(&opt.markup, "markup", false, "Text contains <b>bold</b> and <i>italic</i> spans.")
+	flag.StringVar(&jobsPath, "jobs", "", "JSON or CSV job file.")
+	flag.IntVar(&numWorkers, "workers", runtime.NumCPU(), "Number of files to stamp concurrently.")
+	flag.StringVar(&reportPath, "report", "", "Write a CSV report of the jobs to this file.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
 
 	// When debugging, log to console:
-	//unicommon.SetLogger(unicommon.NewConsoleLogger(unicommon.LogLevelDebug))
-
-	inputPath := os.Args[1]
-	pageNumStr := os.Args[2]
-	textStr := os.Args[5]
-	outputPath := os.Args[6]
+	if debug {
+		unicommon.SetLogger(unicommon.NewConsoleLogger(unicommon.LogLevelDebug))
+	}
 
-	xPos, err := strconv.ParseFloat(os.Args[3], 64)
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+	if jobsPath != "" {
+		numFailed, err := runJobs(jobsPath, numWorkers, opt, reportPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if numFailed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) < 6 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	yPos, err := strconv.ParseFloat(os.Args[4], 64)
+
+	inputPath := args[0]
+	pages := args[1]
+	textStr := args[4]
+	outputPath := args[5]
+
+	xPos, err := strconv.ParseFloat(args[2], 64)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
-
-	fmt.Printf("xPos: %d, yPos: %d\n", xPos, yPos)
-	pageNum, err := strconv.Atoi(pageNumStr)
+	yPos, err := strconv.ParseFloat(args[3], 64)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	err = addTextToPdf(inputPath, outputPath, textStr, pageNum, xPos, yPos)
+	spec := stampSpec{pages: pages, x: xPos, y: yPos, text: textStr, opt: opt}
+	result, err := stampPdf(inputPath, outputPath, spec, time.Now().Format("2006-01-02"))
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
+	for _, note := range result.notes {
+		fmt.Println(note)
+	}
 
 	fmt.Printf("Complete, see output file: %s\n", outputPath)
 }
 
-func addTextToPdf(inputPath string, outputPath string, text string, pageNum int, xPos float64, yPos float64) error {
+// stampSpec describes the text to stamp on the pages of a PDF file.
+type stampSpec struct {
+	pages  string  // Page selector e.g. "1,3-5,last". "" or "all" selects all pages.
+	anchor string  // Page corner or edge that the box is positioned relative to.
+	x, y   float64 // Offset of the box from the anchor, measured towards the center of the page.
+	text   string  // Text template.
+	opt    textOptions
+}
+
+// stampResult describes the stamping of a PDF file.
+type stampResult struct {
+	numPages int      // Number of pages in the file.
+	stamped  int      // Number of pages stamped.
+	notes    []string // Notes about text that did not fit.
+}
+
+// stampPdf stamps the pages of PDF file `inputPath` as described by `spec` and writes the result to
+// `outputPath`. `date` is the value of the {date} template variable.
+func stampPdf(inputPath, outputPath string, spec stampSpec, date string) (stampResult, error) {
+	var result stampResult
+	opt := spec.opt
+	switch opt.align {
+	case "left", "center", "right", "justify":
+	default:
+		return result, fmt.Errorf("unknown alignment %q", opt.align)
+	}
+	switch opt.overflow {
+	case "clip", "visible", "shrink", "error":
+	default:
+		return result, fmt.Errorf("unknown overflow mode %q", opt.overflow)
+	}
+	if opt.opacity < 0 || opt.opacity > 1 {
+		return result, fmt.Errorf("opacity %g out of range", opt.opacity)
+	}
+
+	faces, err := loadFaces(opt)
+	if err != nil {
+		return result, err
+	}
+
 	// Read the input pdf file.
 	f, err := os.Open(inputPath)
 	if err != nil {
-		return err
+		return result, err
 	}
 	defer f.Close()
 
 	pdfReader, err := pdf.NewPdfReader(f)
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	numPages, err := pdfReader.GetNumPages()
 	if err != nil {
-		return err
+		return result, err
+	}
+	result.numPages = numPages
+	selected, err := parsePageSelector(spec.pages, numPages)
+	if err != nil {
+		return result, err
 	}
 
 	c := creator.New()
 
 	// Load the pages.
 	for i := 0; i < numPages; i++ {
-		page, err := pdfReader.GetPage(i + 1)
+		pageNum := i + 1
+		page, err := pdfReader.GetPage(pageNum)
 		if err != nil {
-			return err
+			return result, err
 		}
 
 		err = c.AddPage(page)
 		if err != nil {
-			return err
+			return result, err
+		}
+		if !selected[pageNum] {
+			continue
+		}
+
+		text := expandTemplate(spec.text, map[string]string{
+			"page":     strconv.Itoa(pageNum),
+			"pages":    strconv.Itoa(numPages),
+			"filename": filepath.Base(inputPath),
+			"date":     date,
+		})
+		spans := []textSpan{{text: text}}
+		if opt.markup {
+			spans = parseMarkup(text)
+		}
+		blk, notes, err := makeTextBlock(c, spans, faces, opt)
+		if err != nil {
+			return result, fmt.Errorf("page %d: %v", pageNum, err)
+		}
+		for _, note := range notes {
+			result.notes = append(result.notes, fmt.Sprintf("Page %d: %s", pageNum, note))
+		}
+		ctx := c.Context()
+		x, y, err := anchorPosition(spec.anchor, spec.x, spec.y, blk.Width(), blk.Height(),
+			ctx.PageWidth, ctx.PageHeight)
+		if err != nil {
+			return result, err
+		}
+		blk.SetPos(x, y)
+		if err := c.Draw(blk); err != nil {
+			return result, err
 		}
+		result.stamped++
+	}
+	if result.stamped == 0 {
+		result.notes = append(result.notes, fmt.Sprintf("No pages selected by %q.", spec.pages))
+	}
+
+	if dir := filepath.Dir(outputPath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return result, err
+		}
+	}
+	err = c.WriteToFile(outputPath)
+	return result, err
+}
+
+// anchorPosition returns the position of the upper left corner of a `w` x `h` box, measured from the
+// upper left corner of a `pageWidth` x `pageHeight` page, for a box that is offset by `x`,`y` from
+// `anchor`. The anchors are the page corners top-left, top-right, bottom-left and bottom-right, and
+// top and bottom which center the box horizontally. Offsets are measured from the anchor towards the
+// center of the page, except that `x` moves top and bottom boxes to the right.
+func anchorPosition(anchor string, x, y, w, h, pageWidth, pageHeight float64) (float64, float64, error) {
+	switch anchor {
+	case "", "top-left":
+		return x, y, nil
+	case "top-right":
+		return pageWidth - x - w, y, nil
+	case "bottom-left":
+		return x, pageHeight - y - h, nil
+	case "bottom-right":
+		return pageWidth - x - w, pageHeight - y - h, nil
+	case "top":
+		return (pageWidth-w)/2 + x, y, nil
+	case "bottom":
+		return (pageWidth-w)/2 + x, pageHeight - y - h, nil
+	}
+	return 0, 0, fmt.Errorf("unknown anchor %q", anchor)
+}
+
+// parsePageSelector parses page selector `spec` like "1,3-5,last" for a document with `numPages`
+// pages and returns the selected pages. "last" is the last page and may be used in ranges, e.g.
+// "2-last". A range with no end, e.g. "3-", extends to the last page. "", "all" and "-1" select all
+// pages.
+func parsePageSelector(spec string, numPages int) (map[int]bool, error) {
+	pages := map[int]bool{}
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "all" || spec == "-1" {
+		for p := 1; p <= numPages; p++ {
+			pages[p] = true
+		}
+		return pages, nil
+	}
+	pageNumber := func(s string) (int, error) {
+		s = strings.TrimSpace(s)
+		if s == "last" || s == "" {
+			return numPages, nil
+		}
+		return strconv.Atoi(s)
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+		lo, err := pageNumber(first)
+		if err != nil || first == "" {
+			return nil, fmt.Errorf("bad page selector %q", part)
+		}
+		hi, err := pageNumber(last)
+		if err != nil || lo < 1 || hi < lo {
+			return nil, fmt.Errorf("bad page selector %q", part)
+		}
+		for p := lo; p <= hi && p <= numPages; p++ {
+			pages[p] = true
+		}
+	}
+	return pages, nil
+}
+
+// expandTemplate returns `text` with the variables {name} replaced by vars[name]. Unknown variables
+// are left as they are.
+func expandTemplate(text string, vars map[string]string) string {
+	var oldnew []string
+	for name, value := range vars {
+		oldnew = append(oldnew, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(oldnew...).Replace(text)
+}
+
+// stampJob is a row of a job file. It describes the stamping of one PDF file. Zero style values
+// mean the value given on the command line.
+type stampJob struct {
+	Input    string  `json:"input"`
+	Output   string  `json:"output"`
+	Pages    string  `json:"pages"`
+	Anchor   string  `json:"anchor"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Text     string  `json:"text"`
+	Font     string  `json:"font"`
+	Size     float64 `json:"size"`
+	Color    string  `json:"color"`
+	Width    float64 `json:"width"`
+	Height   float64 `json:"height"`
+	Align    string  `json:"align"`
+	Rotate   float64 `json:"rotate"`
+	Opacity  float64 `json:"opacity"`
+	Overflow string  `json:"overflow"`
+}
+
+// spec returns the stampSpec for `job` with style values that aren't set in `job` taken from `opt`.
+func (job stampJob) spec(opt textOptions) stampSpec {
+	if job.Font != "" {
+		opt.fontPath = job.Font
+		opt.boldPath, opt.italicPath, opt.boldItalicPath = "", "", ""
+	}
+	if job.Size > 0 {
+		opt.fontSize = job.Size
+	}
+	if job.Color != "" {
+		opt.color = job.Color
+	}
+	if job.Width > 0 {
+		opt.width = job.Width
+	}
+	if job.Height > 0 {
+		opt.height = job.Height
+	}
+	if job.Align != "" {
+		opt.align = job.Align
+	}
+	if job.Rotate != 0 {
+		opt.angle = job.Rotate
+	}
+	if job.Opacity > 0 {
+		opt.opacity = job.Opacity
+	}
+	if job.Overflow != "" {
+		opt.overflow = job.Overflow
+	}
+	return stampSpec{pages: job.Pages, anchor: job.Anchor, x: job.X, y: job.Y, text: job.Text, opt: opt}
+}
+
+// readJobs reads the jobs in job file `path`. Files with a .csv extension are CSV files with a header
+// row of stampJob JSON field names. Other files are JSON arrays of stampJob objects.
+// Relative input and output paths are relative to the directory of the job file.
+func readJobs(path string) ([]stampJob, error) {
+	jobs, err := parseJobs(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	for i, job := range jobs {
+		if job.Input != "" && !filepath.IsAbs(job.Input) {
+			jobs[i].Input = filepath.Join(dir, job.Input)
+		}
+		if job.Output != "" && !filepath.IsAbs(job.Output) {
+			jobs[i].Output = filepath.Join(dir, job.Output)
+		}
+	}
+	return jobs, nil
+}
+
+// parseJobs returns the jobs in job file `path`.
+func parseJobs(path string) ([]stampJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-		if i == pageNum || pageNum == -1 {
-			p := c.NewParagraph(text)
-			// Change to times bold font (default is helvetica).
-			timesBold, err := pdf.NewStandard14Font("Times-Bold")
-			if err != nil {
-				panic(err)
+	var jobs []stampJob
+	if strings.ToLower(filepath.Ext(path)) != ".csv" {
+		if err := json.NewDecoder(f).Decode(&jobs); err != nil {
+			return nil, fmt.Errorf("could not parse job file %q. err=%v", path, err)
+		}
+		return jobs, nil
+	}
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse job file %q. err=%v", path, err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := records[0]
+	for i, record := range records[1:] {
+		fields := map[string]interface{}{}
+		for j, name := range header {
+			name = strings.ToLower(strings.TrimSpace(name))
+			value := strings.TrimSpace(record[j])
+			if value == "" {
+				continue
+			}
+			switch name {
+			case "x", "y", "size", "width", "height", "rotate", "opacity":
+				v, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s line %d: bad %s %q", path, i+2, name, value)
+				}
+				fields[name] = v
+			default:
+				fields[name] = value
+			}
+		}
+		// Round trip through JSON so that CSV and JSON job files share the stampJob field names.
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		var job stampJob
+		if err := json.Unmarshal(b, &job); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, i+2, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// jobResult is the outcome of a stampJob.
+type jobResult struct {
+	stampResult
+	err      error
+	duration time.Duration
+}
+
+// runJobs runs the jobs in job file `jobsPath` on `numWorkers` concurrent workers with default style
+// `opt`, prints a summary and writes a CSV report to `reportPath` if it isn't empty. It returns the
+// number of failed jobs.
+func runJobs(jobsPath string, numWorkers int, opt textOptions, reportPath string) (int, error) {
+	jobs, err := readJobs(jobsPath)
+	if err != nil {
+		return 0, err
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	date := time.Now().Format("2006-01-02")
+	start := time.Now()
+
+	results := make([]jobResult, len(jobs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				job := jobs[i]
+				t0 := time.Now()
+				var res jobResult
+				if job.Input == "" || job.Output == "" {
+					res.err = errors.New("input and output must be given")
+				} else {
+					res.stampResult, res.err = stampPdf(job.Input, job.Output, job.spec(opt), date)
+				}
+				res.duration = time.Since(t0)
+				results[i] = res
 			}
-			p.SetFont(timesBold)
-			p.SetPos(xPos, yPos)
+		}()
+	}
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	numFailed, numPages := 0, 0
+	for i, res := range results {
+		job := jobs[i]
+		if res.err != nil {
+			numFailed++
+			fmt.Printf("Job %d: %s FAILED. err=%v\n", i+1, job.Input, res.err)
+			continue
+		}
+		numPages += res.stamped
+		for _, note := range res.notes {
+			fmt.Printf("Job %d: %s %s\n", i+1, job.Input, note)
+		}
+	}
+	fmt.Printf("Stamped %d pages in %d of %d files in %.1f sec with %d workers. %d failed.\n",
+		numPages, len(jobs)-numFailed, len(jobs), time.Since(start).Seconds(), numWorkers, numFailed)
 
-			_ = c.Draw(p)
+	if reportPath != "" {
+		if err := writeJobReport(reportPath, jobs, results); err != nil {
+			return numFailed, err
 		}
+	}
+	return numFailed, nil
+}
 
+// writeJobReport writes a CSV report of `jobs` and their `results` to `path`.
+func writeJobReport(path string, jobs []stampJob, results []jobResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	err = c.WriteToFile(outputPath)
-	return err
+	w := csv.NewWriter(f)
+	w.Write([]string{"job", "input", "output", "status", "pages", "stamped", "seconds", "error", "notes"})
+	for i, res := range results {
+		status, errStr := "ok", ""
+		if res.err != nil {
+			status, errStr = "failed", res.err.Error()
+		}
+		w.Write([]string{
+			strconv.Itoa(i + 1),
+			jobs[i].Input,
+			jobs[i].Output,
+			status,
+			strconv.Itoa(res.numPages),
+			strconv.Itoa(res.stamped),
+			fmt.Sprintf("%.3f", res.duration.Seconds()),
+			errStr,
+			strings.Join(res.notes, "; "),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// textSpan is a run of text with the same style.
+type textSpan struct {
+	text   string
+	bold   bool
+	italic bool
+}
+
+// face returns the index of the font face for `s` in a fontFaces.
+func (s textSpan) face() int {
+	i := 0
+	if s.bold {
+		i |= 1
+	}
+	if s.italic {
+		i |= 2
+	}
+	return i
+}
+
+// fontFaces are the regular, bold, italic and bold italic faces of a font.
+type fontFaces [4]*pdf.PdfFont
+
+// standardFamilies are the standard 14 font families in fontFaces order.
+var standardFamilies = [][4]pdf.StdFontName{
+	{"Times-Roman", "Times-Bold", "Times-Italic", "Times-BoldItalic"},
+	{"Helvetica", "Helvetica-Bold", "Helvetica-Oblique", "Helvetica-BoldOblique"},
+	{"Courier", "Courier-Bold", "Courier-Oblique", "Courier-BoldOblique"},
+}
+
+// loadFaces returns the font faces described by `opt`.
+// If `opt.fontPath` is a standard 14 font name, the other faces are taken from the same family, with
+// bold and italic added to the style of the named font. e.g. Times-Bold italic is Times-BoldItalic.
+// Otherwise the faces are loaded from TrueType font files, and faces that aren't given are the
+// regular face.
+func loadFaces(opt textOptions) (fontFaces, error) {
+	var faces fontFaces
+	for _, family := range standardFamilies {
+		for i, name := range family {
+			if string(name) != opt.fontPath {
+				continue
+			}
+			for j := range faces {
+				font, err := pdf.NewStandard14Font(family[i|j])
+				if err != nil {
+					return faces, err
+				}
+				faces[j] = font
+			}
+			return faces, nil
+		}
+	}
+	if font, err := pdf.NewStandard14Font(pdf.StdFontName(opt.fontPath)); err == nil {
+		// Symbol and ZapfDingbats have no style variants.
+		for j := range faces {
+			faces[j] = font
+		}
+		return faces, nil
+	}
+
+	paths := []string{opt.fontPath, opt.boldPath, opt.italicPath, opt.boldItalicPath}
+	for j, path := range paths {
+		if path == "" {
+			faces[j] = faces[0]
+			continue
+		}
+		font, err := pdf.NewPdfFontFromTTFFile(path)
+		if err != nil {
+			return faces, fmt.Errorf("could not load font %q. err=%v", path, err)
+		}
+		faces[j] = font
+	}
+	return faces, nil
+}
+
+// parseMarkup splits `text` into spans at <b>, </b>, <i> and </i> tags. Tags may be nested.
+// The entities &lt; &gt; and &amp; are replaced by the characters they represent.
+func parseMarkup(text string) []textSpan {
+	var spans []textSpan
+	var sb strings.Builder
+	bold, italic := 0, 0
+	flush := func() {
+		if sb.Len() > 0 {
+			spans = append(spans, textSpan{text: sb.String(), bold: bold > 0, italic: italic > 0})
+			sb.Reset()
+		}
+	}
+	for len(text) > 0 {
+		tag := ""
+		for _, t := range []string{"<b>", "</b>", "<i>", "</i>"} {
+			if strings.HasPrefix(text, t) {
+				tag = t
+				break
+			}
+		}
+		if tag == "" {
+			sb.WriteByte(text[0])
+			text = text[1:]
+			continue
+		}
+		flush()
+		switch tag {
+		case "<b>":
+			bold++
+		case "</b>":
+			if bold > 0 {
+				bold--
+			}
+		case "<i>":
+			italic++
+		case "</i>":
+			if italic > 0 {
+				italic--
+			}
+		}
+		text = text[len(tag):]
+	}
+	flush()
+
+	r := strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+	for i := range spans {
+		spans[i].text = r.Replace(spans[i].text)
+	}
+	return spans
+}
+
+// makeTextBlock returns a block containing `spans` drawn with `faces` as described by `opt`, and
+// notes describing any text that does not fit in the box. It returns an error if the text doesn't fit
+// and `opt.overflow` is "error".
+func makeTextBlock(c *creator.Creator, spans []textSpan, faces fontFaces, opt textOptions) (*creator.Block,
+	[]string, error) {
+	var notes []string
+	p := c.NewStyledParagraph()
+	color := creator.ColorRGBFromHex(opt.color)
+	var chunks []*creator.TextChunk
+	for _, span := range spans {
+		chunk := p.Append(span.text)
+		chunk.Style.Font = faces[span.face()]
+		chunk.Style.FontSize = opt.fontSize
+		chunk.Style.Color = color
+		chunks = append(chunks, chunk)
+	}
+	p.SetLineHeight(opt.lineHeight)
+	switch opt.align {
+	case "center":
+		p.SetTextAlignment(creator.TextAlignmentCenter)
+	case "right":
+		p.SetTextAlignment(creator.TextAlignmentRight)
+	case "justify":
+		p.SetTextAlignment(creator.TextAlignmentJustify)
+	default:
+		p.SetTextAlignment(creator.TextAlignmentLeft)
+	}
+	p.SetPos(0, 0)
+
+	width := opt.width
+	if width > 0 {
+		p.SetEnableWrap(true)
+		p.SetWidth(width)
+	} else {
+		p.SetEnableWrap(false)
+		width = p.Width()
+	}
+
+	height := opt.height
+	if height <= 0 {
+		height = p.Height()
+	}
+	if opt.overflow == "shrink" {
+		for size := opt.fontSize; p.Height() > height && size > minFontSize; {
+			size = math.Max(size-0.5, minFontSize)
+			for _, chunk := range chunks {
+				chunk.Style.FontSize = size
+			}
+			if opt.width > 0 {
+				p.SetWidth(opt.width)
+			} else {
+				p.SetWidth(0)
+				width = p.Width()
+			}
+			if p.Height() <= height {
+				notes = append(notes, fmt.Sprintf("Reduced font size from %g to %g to fit the box.", opt.fontSize, size))
+			}
+		}
+	}
+	if textHeight := p.Height(); textHeight > height+1e-6 {
+		msg := fmt.Sprintf("Text overflows the %.1f x %.1f box: it needs a height of %.1f points.",
+			width, height, textHeight)
+		switch opt.overflow {
+		case "error":
+			return nil, nil, errors.New(msg)
+		case "clip", "shrink":
+			msg += " The text is clipped."
+		}
+		notes = append(notes, msg)
+	}
+
+	// The block is made from a template page so that it can start with the graphics state that sets
+	// opacity and clips to the box. The creator wraps block contents in q/Q so these don't leak.
+	var ops []string
+	resources := pdf.NewPdfPageResources()
+	if opt.opacity < 1 {
+		gs := core.MakeDict()
+		gs.Set("Type", core.MakeName("ExtGState"))
+		gs.Set("ca", core.MakeFloat(opt.opacity))
+		gs.Set("CA", core.MakeFloat(opt.opacity))
+		if err := resources.AddExtGState("GSInsert", gs); err != nil {
+			return nil, nil, err
+		}
+		ops = append(ops, "/GSInsert gs")
+	}
+	if opt.overflow != "visible" {
+		ops = append(ops, fmt.Sprintf("0 0 %.4f %.4f re W n", width, height))
+	}
+	template := pdf.NewPdfPage()
+	template.MediaBox = &pdf.PdfRectangle{Urx: width, Ury: height}
+	template.Resources = resources
+	if err := template.SetContentStreams([]string{strings.Join(ops, "\n")}, nil); err != nil {
+		return nil, nil, err
+	}
+	blk, err := creator.NewBlockFromPage(template)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := blk.Draw(p); err != nil {
+		return nil, nil, err
+	}
+	blk.SetAngle(opt.angle)
+	return blk, notes, nil
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
 }
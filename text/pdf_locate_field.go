@@ -0,0 +1,449 @@
+/*
+ * Locate form fields: Find the rectangles where fields such as signatures and dates should be
+ * placed on the pages of a PDF file, relative to anchor text labels.
+ *
+ * An anchor is a text label ("Signature:", "Date") or a regular expression that is searched for in
+ * the text extracted from each page. The field rectangle is placed relative to each instance of
+ * the label by a placement rule:
+ *  - on: The label's own bounding box, e.g. a "_______" signature line.
+ *  - right, left, below, above: A rectangle of the given width and height that is -gap points to
+ *    the right of, left of, below or above the label. Right and left rectangles share the label's
+ *    baseline. Below and above rectangles are left aligned with the label.
+ * With -within N, if there is a fill-in line (a run of 3 or more underscores) within N points of
+ * the label in the placement direction, the field rectangle is snapped to that line: it spans the
+ * line's width and is the given height above the line's baseline.
+ *
+ * The results are printed as text or as JSON, for use by tools that add signatures, QR codes etc.
+ * JSON rectangles are [llx, lly, urx, ury] in PDF user space (points, origin at lower left).
+ *
+ * Run as: go run pdf_locate_field.go [options] input.pdf
+ * e.g. go run pdf_locate_field.go -l "Signature:" -pos right -within 200 -json input.pdf
+ *      go run pdf_locate_field.go -l "Date\s*:" -r -pos below -w 100 -h 20 input.pdf
+ *      go run pdf_locate_field.go input.pdf   (Finds "_____" signature lines on all pages.)
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/extractor"
+	pdf "github.com/unidoc/unipdf/v3/model"
+)
+
+const usage = `Usage: go run pdf_locate_field.go [options] input.pdf
+
+Finds the field rectangles for the anchor labels in input.pdf. With no -l option, finds signature
+lines (runs of 5 or more underscores).
+`
+
+// signatureLinePattern matches the fill-in lines that are used for signatures.
+const signatureLinePattern = `_{5,}`
+
+// fillInLine matches the fill-in lines that fields are snapped to.
+var fillInLine = regexp.MustCompile(`_{3,}`)
+
+func main() {
+	// Make sure to enter a valid license key.
+	// Otherwise text is truncated and a watermark added to the text.
+	// License keys are available via: https://unidoc.io
+	/*
+			license.SetLicenseKey(`
+		-----BEGIN UNIDOC LICENSE KEY-----
+		...key contents...
+		-----END UNIDOC LICENSE KEY-----
+		`)
+	*/
+	var (
+		labels  stringList
+		rule    placementRule
+		isRegex bool
+		noCase  bool
+		pages   string
+		asJSON  bool
+		debug   bool
+	)
+	flag.Var(&labels, "l", "Anchor label. May be repeated.")
+	flag.BoolVar(&isRegex, "r", false, "Anchor labels are regular expressions.")
+	flag.BoolVar(&noCase, "i", false, "Case insensitive label matching.")
+	flag.StringVar(&rule.position, "pos", "on", "Field position relative to the label (on/right/left/below/above).")
+	flag.Float64Var(&rule.gap, "gap", 4, "Distance (points) from the label to the field.")
+	flag.Float64Var(&rule.width, "w", 150, "Field width (points).")
+	flag.Float64Var(&rule.height, "h", 0, "Field height (points). Default: twice the label height.")
+	flag.Float64Var(&rule.within, "within", 0, "Snap the field to a fill-in line within this many points of the label.")
+	flag.StringVar(&pages, "p", "", "Pages to search e.g. 1,3-5. Default: all pages.")
+	flag.BoolVar(&asJSON, "json", false, "Output the results as JSON.")
+	flag.BoolVar(&debug, "d", false, "Enable debug logging.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	} else {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelInfo))
+	}
+
+	switch rule.position {
+	case "on", "right", "left", "below", "above":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown position %q\n", rule.position)
+		os.Exit(1)
+	}
+
+	// Build the anchors.
+	if len(labels) == 0 {
+		labels = stringList{signatureLinePattern}
+		isRegex = true
+	}
+	var anchors []anchor
+	for _, label := range labels {
+		pattern := label
+		if !isRegex {
+			pattern = regexp.QuoteMeta(label)
+		}
+		if noCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid label %q. err=%v\n", label, err)
+			os.Exit(1)
+		}
+		anchors = append(anchors, anchor{label: label, re: re})
+	}
+
+	inputPath := args[0]
+	fields, err := locateFields(inputPath, anchors, rule, pages)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if asJSON {
+		b, err := json.MarshalIndent(fields, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	if len(fields) == 0 {
+		fmt.Println("No fields found.")
+		os.Exit(1)
+	}
+	for _, fld := range fields {
+		snapped := ""
+		if fld.Snapped {
+			snapped = " (snapped to fill-in line)"
+		}
+		fmt.Printf("Page %d: %q at %s -> field %s%s\n", fld.Page, fld.Text, fld.LabelRect, fld.Rect, snapped)
+	}
+}
+
+// anchor is a label to locate fields relative to.
+type anchor struct {
+	label string
+	re    *regexp.Regexp
+}
+
+// placementRule describes where a field is placed relative to its label.
+type placementRule struct {
+	position string  // on, right, left, below or above.
+	gap      float64 // Distance from the label to the field.
+	width    float64 // Field width.
+	height   float64 // Field height. 0 means twice the label height.
+	within   float64 // Maximum distance to a fill-in line to snap to. 0 means don't snap.
+}
+
+// field is a located field.
+type field struct {
+	Page      int    `json:"page"`
+	Label     string `json:"label"`      // The anchor label.
+	Text      string `json:"text"`       // The text that matched the label.
+	LabelRect rect   `json:"label_rect"` // The bounding box of the matched text.
+	Rect      rect   `json:"rect"`       // The field rectangle.
+	Snapped   bool   `json:"snapped"`    // True if the field was snapped to a fill-in line.
+}
+
+// rect is a rectangle [llx, lly, urx, ury] in PDF user space.
+type rect [4]float64
+
+// String returns a description of `r`.
+func (r rect) String() string {
+	return fmt.Sprintf("[%.2f %.2f %.2f %.2f]", r[0], r[1], r[2], r[3])
+}
+
+// makeRect returns `r` as a rect rounded to 0.01 points.
+func makeRect(r pdf.PdfRectangle) rect {
+	round := func(x float64) float64 { return math.Round(x*100) / 100 }
+	return rect{round(r.Llx), round(r.Lly), round(r.Urx), round(r.Ury)}
+}
+
+// locateFields returns the fields for `anchors` placed by `rule` on the pages of PDF file
+// `inputPath` selected by `pageSpec`.
+func locateFields(inputPath string, anchors []anchor, rule placementRule, pageSpec string) ([]field, error) {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pdfReader, err := pdf.NewPdfReader(f)
+	if err != nil {
+		return nil, err
+	}
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return nil, err
+	}
+	if isEncrypted {
+		auth, err := pdfReader.Decrypt([]byte(""))
+		if err != nil {
+			return nil, err
+		}
+		if !auth {
+			return nil, errors.New("encrypted")
+		}
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return nil, err
+	}
+	selected, err := parsePageRanges(pageSpec, numPages)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []field{}
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		if selected != nil && !selected[pageNum] {
+			continue
+		}
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		pageFields, err := locatePageFields(page, anchors, rule)
+		if err != nil {
+			return nil, fmt.Errorf("locatePageFields failed. pageNum=%d err=%v", pageNum, err)
+		}
+		for _, fld := range pageFields {
+			fld.Page = pageNum
+			fields = append(fields, fld)
+		}
+	}
+	return fields, nil
+}
+
+// locatePageFields returns the fields for `anchors` placed by `rule` on `page`.
+func locatePageFields(page *pdf.PdfPage, anchors []anchor, rule placementRule) ([]field, error) {
+	ex, err := extractor.New(page)
+	if err != nil {
+		return nil, err
+	}
+	pageText, _, _, err := ex.ExtractPageText()
+	if err != nil {
+		return nil, err
+	}
+	text := pageText.Text()
+	textMarks := pageText.Marks()
+
+	var lines []pdf.PdfRectangle
+	if rule.within > 0 {
+		lines, err = matchBBoxes(text, textMarks, fillInLine)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fields []field
+	for _, a := range anchors {
+		for _, loc := range a.re.FindAllStringIndex(text, -1) {
+			start, end := loc[0], loc[1]
+			if start == end {
+				continue
+			}
+			bbox, err := spanBBox(textMarks, start, end)
+			if err != nil {
+				return nil, err
+			}
+			fld := field{
+				Label:     a.label,
+				Text:      text[start:end],
+				LabelRect: makeRect(bbox),
+			}
+			r, snapped := placeField(bbox, rule, lines)
+			fld.Rect = makeRect(r)
+			fld.Snapped = snapped
+			fields = append(fields, fld)
+		}
+	}
+	return fields, nil
+}
+
+// placeField returns the field rectangle for a label with bounding box `label` placed by `rule`.
+// If `rule.within` > 0 and one of the fill-in lines `lines` is within that distance of the label
+// in the placement direction, the field is snapped to the nearest such line and true is returned.
+func placeField(label pdf.PdfRectangle, rule placementRule, lines []pdf.PdfRectangle) (pdf.PdfRectangle, bool) {
+	height := rule.height
+	if height <= 0 {
+		height = 2 * (label.Ury - label.Lly)
+	}
+
+	if rule.within > 0 && rule.position != "on" {
+		best, bestDist := -1, math.Inf(1)
+		for i, line := range lines {
+			if line == label {
+				continue
+			}
+			dist, ok := directedDistance(label, line, rule.position)
+			if ok && dist <= rule.within && dist < bestDist {
+				best, bestDist = i, dist
+			}
+		}
+		if best >= 0 {
+			line := lines[best]
+			return pdf.PdfRectangle{Llx: line.Llx, Lly: line.Lly, Urx: line.Urx, Ury: line.Lly + height}, true
+		}
+	}
+
+	switch rule.position {
+	case "right":
+		llx := label.Urx + rule.gap
+		return pdf.PdfRectangle{Llx: llx, Lly: label.Lly, Urx: llx + rule.width, Ury: label.Lly + height}, false
+	case "left":
+		urx := label.Llx - rule.gap
+		return pdf.PdfRectangle{Llx: urx - rule.width, Lly: label.Lly, Urx: urx, Ury: label.Lly + height}, false
+	case "below":
+		ury := label.Lly - rule.gap
+		return pdf.PdfRectangle{Llx: label.Llx, Lly: ury - height, Urx: label.Llx + rule.width, Ury: ury}, false
+	case "above":
+		lly := label.Ury + rule.gap
+		return pdf.PdfRectangle{Llx: label.Llx, Lly: lly, Urx: label.Llx + rule.width, Ury: lly + height}, false
+	}
+	return label, false
+}
+
+// directedDistance returns the distance from `label` to `line` in direction `position` and true
+// if `line` is in that direction from `label`. A line is to the right of or left of a label if it
+// overlaps the label vertically, and above or below a label if it overlaps it horizontally.
+func directedDistance(label, line pdf.PdfRectangle, position string) (float64, bool) {
+	const tol = 1.0
+	overlapsY := line.Lly < label.Ury && label.Lly < line.Ury
+	overlapsX := line.Llx < label.Urx && label.Llx < line.Urx
+	switch position {
+	case "right":
+		return line.Llx - label.Urx, overlapsY && line.Llx >= label.Urx-tol
+	case "left":
+		return label.Llx - line.Urx, overlapsY && line.Urx <= label.Llx+tol
+	case "below":
+		return label.Lly - line.Ury, overlapsX && line.Ury <= label.Lly+tol
+	case "above":
+		return line.Lly - label.Ury, overlapsX && line.Lly >= label.Ury-tol
+	}
+	return 0, false
+}
+
+// matchBBoxes returns the bounding boxes of the matches of `re` in `text`.
+func matchBBoxes(text string, textMarks *extractor.TextMarkArray, re *regexp.Regexp) ([]pdf.PdfRectangle, error) {
+	var bboxes []pdf.PdfRectangle
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		bbox, err := spanBBox(textMarks, loc[0], loc[1])
+		if err != nil {
+			return nil, err
+		}
+		bboxes = append(bboxes, bbox)
+	}
+	return bboxes, nil
+}
+
+// spanBBox returns the bounding box of the text marks for text[`start`:`end`].
+func spanBBox(textMarks *extractor.TextMarkArray, start, end int) (pdf.PdfRectangle, error) {
+	spanMarks, err := textMarks.RangeOffset(start, end)
+	if err != nil {
+		return pdf.PdfRectangle{}, err
+	}
+	bbox, ok := spanMarks.BBox()
+	if !ok {
+		return pdf.PdfRectangle{}, fmt.Errorf("spanMarks.BBox has no bounding box. spanMarks=%s", spanMarks)
+	}
+	return bbox, nil
+}
+
+// parsePageRanges parses page ranges `spec` like "1,3-5,8-" for a document with `numPages`
+// pages. It returns nil if `spec` is empty, meaning all pages. It is an error for a range to
+// include pages that are not in the document.
+func parsePageRanges(spec string, numPages int) (map[int]bool, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	pages := map[int]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			first, last = part[:i], part[i+1:]
+			if last == "" {
+				last = strconv.Itoa(numPages)
+			}
+		}
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("bad page range %q", part)
+		}
+		hi, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("bad page range %q", part)
+		}
+		if lo > numPages || hi > numPages {
+			return nil, fmt.Errorf("page range %q is outside the document's %d pages", part, numPages)
+		}
+		if lo < 1 || hi < lo {
+			return nil, fmt.Errorf("bad page range %q", part)
+		}
+		for p := lo; p <= hi; p++ {
+			pages[p] = true
+		}
+	}
+	return pages, nil
+}
+
+// stringList is a flag.Value for flags that may be repeated.
+type stringList []string
+
+// String returns a description of `l`.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set adds `s` to `l`.
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
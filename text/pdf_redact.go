@@ -0,0 +1,1396 @@
+/*
+ * Redact PDF: Remove the text, images and vector graphics under rectangular regions of PDF pages.
+ *
+ * Unlike drawing a rectangle over content (as in annotations/pdf_annotate_add_rectangle.go), the
+ * redacted content is removed from the output PDF so it can't be extracted.
+ *  - Glyphs whose centers are in a region are removed from the content streams. They are replaced
+ *    with TJ kerning adjustments so the remaining text doesn't move.
+ *  - Image pixels under a region are blanked and the image is saved as a new XObject.
+ *  - Vector subpaths that are entirely inside a region are removed. Paths that partly overlap a
+ *    region are clipped so that nothing is painted in the region.
+ *  - Annotations that overlap a region are deleted.
+ *  - An opaque box is painted over each region.
+ * Form XObjects that overlap a region are redacted in the same way and saved as new XObjects.
+ * XObjects that are replaced by redacted copies are removed from the page's resources, so the
+ * unredacted originals are not written to the output unless other pages use them.
+ *
+ * Regions are specified either as rectangles or as search terms. The regions for search terms are
+ * the bounding boxes of the lines of the matches of the terms in the extracted page text, as in
+ * pdf_text_locations.go. Spaces in terms match line breaks so terms that wrap across lines are
+ * redacted.
+ *
+ * Run as: go run pdf_redact.go [-r page:llx,lly,urx,ury]... [-t term]... input.pdf output.pdf
+ * e.g. go run pdf_redact.go -r 1:72,700,300,720 -t "Account number" in.pdf redacted.pdf
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/contentstream"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/extractor"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+const usage = `Usage: go run pdf_redact.go [options] input.pdf output.pdf
+
+Removes the content under the specified regions of input.pdf and saves the result to output.pdf.
+Rectangles are specified in PDF user space (points, origin at lower left of page).
+`
+
+// matchMargin is the margin (in points) added around the bounding boxes of search term matches.
+const matchMargin = 1.0
+
+func main() {
+	// Make sure to enter a valid license key.
+	// Otherwise text is truncated and a watermark added to the text.
+	// License keys are available via: https://unidoc.io
+	/*
+			license.SetLicenseKey(`
+		-----BEGIN UNIDOC LICENSE KEY-----
+		...key contents...
+		-----END UNIDOC LICENSE KEY-----
+		`)
+	*/
+	var debug bool
+	var rects, terms stringList
+	flag.BoolVar(&debug, "d", false, "Enable debug logging")
+	flag.Var(&rects, "r", "Region to redact page:llx,lly,urx,ury. May be repeated.")
+	flag.Var(&terms, "t", "Redact all instances of this text. May be repeated.")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 || (len(rects) == 0 && len(terms) == 0) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if debug {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+	} else {
+		common.SetLogger(common.NewConsoleLogger(common.LogLevelInfo))
+	}
+
+	inPath := args[0]
+	outPath := args[1]
+
+	pageRegions := map[int][]model.PdfRectangle{}
+	for _, s := range rects {
+		pageNum, r, err := parseRegion(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		pageRegions[pageNum] = append(pageRegions[pageNum], r)
+	}
+
+	err := redactPdf(inPath, outPath, pageRegions, terms)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Redaction failed. inPath=%q err=%v\n", inPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Redacted PDF saved to %q\n", outPath)
+}
+
+// redactPdf removes the content in `pageRegions` {pageNum: regions} and under the instances of
+// `terms` in PDF file `inPath` and saves the resulting PDF to `outPath`.
+func redactPdf(inPath, outPath string, pageRegions map[int][]model.PdfRectangle, terms []string) error {
+	f, err := os.Open(inPath)
+	if err != nil {
+		return fmt.Errorf("Could not open %q err=%v", inPath, err)
+	}
+	defer f.Close()
+
+	pdfReader, err := model.NewPdfReader(f)
+	if err != nil {
+		return fmt.Errorf("NewPdfReader failed. %q err=%v", inPath, err)
+	}
+	isEncrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return err
+	}
+	if isEncrypted {
+		auth, err := pdfReader.Decrypt([]byte(""))
+		if err != nil {
+			return err
+		}
+		if !auth {
+			return errors.New("Encrypted")
+		}
+	}
+	numPages, err := pdfReader.GetNumPages()
+	if err != nil {
+		return fmt.Errorf("GetNumPages failed. %q err=%v", inPath, err)
+	}
+
+	pdfWriter := model.NewPdfWriter()
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+		page, err := pdfReader.GetPage(pageNum)
+		if err != nil {
+			return fmt.Errorf("GetPage failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+		}
+
+		regions := pageRegions[pageNum]
+		if len(terms) > 0 {
+			termRegions, err := pageTermRegions(page, terms)
+			if err != nil {
+				return fmt.Errorf("pageTermRegions failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+			}
+			regions = append(regions, termRegions...)
+		}
+
+		if len(regions) > 0 {
+			stats, err := redactPage(page, regions)
+			if err != nil {
+				return fmt.Errorf("redactPage failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+			}
+			fmt.Printf("Page %d: %d regions. %s\n", pageNum, len(regions), stats)
+		}
+
+		if err := pdfWriter.AddPage(page); err != nil {
+			return fmt.Errorf("AddPage failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+		}
+	}
+
+	fw, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+	return pdfWriter.Write(fw)
+}
+
+// pageTermRegions returns the bounding boxes of all instances of `terms` in the text of `page`.
+// Whitespace in the terms matches any run of whitespace in the text, so terms that wrap across
+// lines are found. There is one box for each line of a match.
+func pageTermRegions(page *model.PdfPage, terms []string) ([]model.PdfRectangle, error) {
+	ex, err := extractor.New(page)
+	if err != nil {
+		return nil, err
+	}
+	pageText, _, _, err := ex.ExtractPageText()
+	if err != nil {
+		return nil, err
+	}
+	text, offsets := collapseSpaces(pageText.Text())
+	// The marks are in offset order. They are searched directly rather than with
+	// TextMarkArray.RangeOffset, which fails for matches that end at the last mark on the page.
+	marks := pageText.Marks().Elements()
+
+	var regions []model.PdfRectangle
+	for _, term := range terms {
+		term, _ = collapseSpaces(strings.TrimSpace(term))
+		for _, start := range indexAll(text, term) {
+			end := start + len(term)
+			i := sort.Search(len(marks), func(i int) bool { return marks[i].Offset >= offsets[start] })
+			var spanMarks []extractor.TextMark
+			for ; i < len(marks) && marks[i].Offset < offsets[end]; i++ {
+				spanMarks = append(spanMarks, marks[i])
+			}
+			for _, bbox := range lineBBoxes(spanMarks) {
+				bbox.Llx -= matchMargin
+				bbox.Lly -= matchMargin
+				bbox.Urx += matchMargin
+				bbox.Ury += matchMargin
+				regions = append(regions, bbox)
+			}
+		}
+	}
+	return regions, nil
+}
+
+// collapseSpaces returns `text` with each run of whitespace replaced by a single space, and the
+// offsets in `text` of the bytes of the returned text. There is an extra offset for the end of the
+// text.
+func collapseSpaces(text string) (string, []int) {
+	var b strings.Builder
+	var offsets []int
+	inSpace := false
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if !inSpace {
+				b.WriteByte(' ')
+				offsets = append(offsets, i)
+			}
+			inSpace = true
+			continue
+		}
+		inSpace = false
+		b.WriteRune(r)
+		for j := 0; j < utf8.RuneLen(r); j++ {
+			offsets = append(offsets, i)
+		}
+	}
+	offsets = append(offsets, len(text))
+	return b.String(), offsets
+}
+
+// indexAll returns the indices of all instances of `term` in `text`
+func indexAll(text, term string) []int {
+	if len(term) == 0 {
+		return nil
+	}
+	var indexes []int
+	for start := 0; start < len(text); {
+		i := strings.Index(text[start:], term)
+		if i < 0 {
+			return indexes
+		}
+		indexes = append(indexes, start+i)
+		start += i + len(term)
+	}
+	return indexes
+}
+
+// lineBBoxes returns the bounding boxes of the lines of text in `marks`. Consecutive marks that are
+// on the same line are merged into one box.
+func lineBBoxes(marks []extractor.TextMark) []model.PdfRectangle {
+	var lines []model.PdfRectangle
+	for _, mark := range marks {
+		if mark.Meta || strings.TrimSpace(mark.Text) == "" {
+			continue
+		}
+		r := mark.BBox
+		if len(lines) > 0 {
+			last := &lines[len(lines)-1]
+			tol := 0.5 * (r.Ury - r.Lly)
+			if math.Abs(r.Lly-last.Lly) <= tol && r.Llx >= last.Urx-tol {
+				last.Llx, last.Lly = math.Min(last.Llx, r.Llx), math.Min(last.Lly, r.Lly)
+				last.Urx, last.Ury = math.Max(last.Urx, r.Urx), math.Max(last.Ury, r.Ury)
+				continue
+			}
+		}
+		lines = append(lines, r)
+	}
+	return lines
+}
+
+// redactStats counts the content removed from a page.
+type redactStats struct {
+	glyphs      int // Glyphs removed.
+	images      int // Images with pixels blanked.
+	paths       int // Paths removed.
+	clipped     int // Paths clipped.
+	annotations int // Annotations deleted.
+}
+
+// String returns a description of `s`.
+func (s redactStats) String() string {
+	return fmt.Sprintf("Removed %d glyphs, %d paths, %d annotations. Clipped %d paths. Blanked %d images.",
+		s.glyphs, s.paths, s.annotations, s.clipped, s.images)
+}
+
+// redactPage removes the content of `page` in `regions` and paints opaque boxes over them.
+func redactPage(page *model.PdfPage, regions []model.PdfRectangle) (redactStats, error) {
+	var stats redactStats
+
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return stats, err
+	}
+	ops, err := contentstream.NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return stats, err
+	}
+	if page.Resources == nil {
+		page.Resources = model.NewPdfPageResources()
+	}
+
+	rd := newRedactor(regions)
+	redacted, err := rd.redactOps(*ops, identityMatrix(), page.Resources)
+	if err != nil {
+		return stats, err
+	}
+	rd.removeReplaced(page.Resources, redacted)
+	stats = rd.stats
+
+	annotations, err := page.GetAnnotations()
+	if err != nil {
+		return stats, err
+	}
+	var kept []*model.PdfAnnotation
+	for _, annot := range annotations {
+		if r, ok := annotRect(annot); ok && rd.overlaps(*r) {
+			stats.annotations++
+			continue
+		}
+		kept = append(kept, annot)
+	}
+	page.SetAnnotations(kept)
+
+	cc := contentstream.NewContentCreator()
+	cc.Add_q()
+	cc.Add_g(0.0)
+	for _, r := range regions {
+		cc.Add_re(r.Llx, r.Lly, r.Urx-r.Llx, r.Ury-r.Lly)
+	}
+	cc.Add_f()
+	cc.Add_Q()
+
+	wrapped := contentstream.ContentStreamOperations(redacted)
+	content := []string{wrapped.WrapIfNeeded().String(), cc.Operations().String()}
+	return stats, page.SetContentStreams(content, core.NewFlateEncoder())
+}
+
+// annotRect returns the rectangle of annotation `annot`.
+func annotRect(annot *model.PdfAnnotation) (*model.PdfRectangle, bool) {
+	arr, ok := core.GetArray(annot.Rect)
+	if !ok {
+		return nil, false
+	}
+	r, err := model.NewPdfRectangle(*arr)
+	if err != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+// redactor removes content in `regions` from content streams.
+type redactor struct {
+	regions []model.PdfRectangle
+	fonts   map[fontKey]*model.PdfFont
+	stats   redactStats
+	// copied is the set of resources whose XObject dictionaries have been replaced by copies that
+	// can be changed without changing other pages that share them.
+	copied map[*model.PdfPageResources]bool
+	// replaced {resources: names} is the names of the XObjects in each resources that have been
+	// replaced by redacted copies.
+	replaced map[*model.PdfPageResources][]core.PdfObjectName
+}
+
+// newRedactor returns a redactor that removes the content in `regions`.
+func newRedactor(regions []model.PdfRectangle) *redactor {
+	return &redactor{
+		regions:  regions,
+		fonts:    map[fontKey]*model.PdfFont{},
+		copied:   map[*model.PdfPageResources]bool{},
+		replaced: map[*model.PdfPageResources][]core.PdfObjectName{},
+	}
+}
+
+// fontKey identifies a font by its name and the resources it is in.
+type fontKey struct {
+	resources *model.PdfPageResources
+	name      string
+}
+
+// gstate is the part of the graphics state that the redactor tracks.
+type gstate struct {
+	ctm  matrix
+	font *model.PdfFont
+	tfs  float64 // Font size.
+	tc   float64 // Character spacing.
+	tw   float64 // Word spacing.
+	th   float64 // Horizontal scaling.
+	tl   float64 // Leading.
+	rise float64 // Text rise.
+}
+
+// redactOps returns content stream `ops`, with resources `resources` and initial transform `ctm`,
+// with the content in the redactor's regions removed.
+func (rd *redactor) redactOps(ops contentstream.ContentStreamOperations, ctm matrix,
+	resources *model.PdfPageResources) ([]*contentstream.ContentStreamOperation, error) {
+	gs := gstate{ctm: ctm, th: 1.0}
+	var stack []gstate
+	var tm, tlm matrix
+	var out []*contentstream.ContentStreamOperation
+
+	// Path construction operators are held in `path` until the path is painted so that subpaths
+	// inside redaction regions can be removed. `subpaths` holds the same operators split into
+	// subpaths.
+	var path []*contentstream.ContentStreamOperation
+	var subpaths []subpath
+	pathClips := false
+
+	// Marked content sequences are tracked so that the /ActualText of sequences that contain removed
+	// glyphs can be removed. `marked` holds the index in `out` of the BDC operator of each open
+	// sequence (-1 for BMC) and the number of glyphs removed before it.
+	type markedContent struct {
+		index  int
+		glyphs int
+	}
+	var marked []markedContent
+	endMarked := func(mc markedContent) {
+		if mc.index >= 0 && rd.stats.glyphs > mc.glyphs {
+			out[mc.index] = stripActualText(out[mc.index], resources)
+		}
+	}
+
+	for _, op := range ops {
+		if len(path) > 0 && !isPathOp(op.Operand) {
+			out = append(out, path...)
+			path, subpaths = nil, nil
+		}
+
+		floats, _ := core.GetNumbersAsFloat(op.Params)
+		switch op.Operand {
+		case "BDC":
+			marked = append(marked, markedContent{len(out), rd.stats.glyphs})
+		case "BMC":
+			marked = append(marked, markedContent{-1, rd.stats.glyphs})
+		case "EMC":
+			if len(marked) > 0 {
+				endMarked(marked[len(marked)-1])
+				marked = marked[:len(marked)-1]
+			}
+		case "q":
+			stack = append(stack, gs)
+		case "Q":
+			if len(stack) > 0 {
+				gs = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "cm":
+			if len(floats) == 6 {
+				gs.ctm = newMatrix(floats).mult(gs.ctm)
+			}
+		case "BT":
+			tm, tlm = identityMatrix(), identityMatrix()
+		case "Tf":
+			if len(op.Params) == 2 {
+				name, _ := core.GetNameVal(op.Params[0])
+				gs.font = rd.getFont(resources, name)
+				gs.tfs, _ = core.GetNumberAsFloat(op.Params[1])
+			}
+		case "Tc":
+			if len(floats) == 1 {
+				gs.tc = floats[0]
+			}
+		case "Tw":
+			if len(floats) == 1 {
+				gs.tw = floats[0]
+			}
+		case "Tz":
+			if len(floats) == 1 {
+				gs.th = floats[0] / 100.0
+			}
+		case "TL":
+			if len(floats) == 1 {
+				gs.tl = floats[0]
+			}
+		case "Ts":
+			if len(floats) == 1 {
+				gs.rise = floats[0]
+			}
+		case "Td", "TD":
+			if len(floats) == 2 {
+				if op.Operand == "TD" {
+					gs.tl = -floats[1]
+				}
+				tlm = translation(floats[0], floats[1]).mult(tlm)
+				tm = tlm
+			}
+		case "Tm":
+			if len(floats) == 6 {
+				tlm = newMatrix(floats)
+				tm = tlm
+			}
+		case "T*":
+			tlm = translation(0, -gs.tl).mult(tlm)
+			tm = tlm
+		case "Tj", "TJ", "'", `"`:
+			var shown core.PdfObject
+			var pre []*contentstream.ContentStreamOperation
+			switch op.Operand {
+			case "Tj", "TJ":
+				if len(op.Params) != 1 {
+					break
+				}
+				shown = op.Params[0]
+			case "'":
+				if len(op.Params) != 1 {
+					break
+				}
+				shown = op.Params[0]
+				pre = []*contentstream.ContentStreamOperation{makeOp("T*")}
+			case `"`:
+				if len(op.Params) != 3 {
+					break
+				}
+				gs.tw, _ = core.GetNumberAsFloat(op.Params[0])
+				gs.tc, _ = core.GetNumberAsFloat(op.Params[1])
+				shown = op.Params[2]
+				pre = []*contentstream.ContentStreamOperation{
+					makeOp("Tw", op.Params[0]), makeOp("Tc", op.Params[1]), makeOp("T*")}
+			}
+			if shown == nil {
+				common.Log.Debug("Invalid: %s with invalid set of parameters - skip", op.Operand)
+				break
+			}
+			if len(pre) > 0 {
+				tlm = translation(0, -gs.tl).mult(tlm)
+				tm = tlm
+			}
+			arr, removed := rd.showText(shown, gs, &tm)
+			if removed {
+				out = append(out, pre...)
+				out = append(out, makeOp("TJ", arr))
+				continue
+			}
+		case "Do":
+			if len(op.Params) != 1 {
+				break
+			}
+			name, ok := core.GetName(op.Params[0])
+			if !ok {
+				break
+			}
+			newOp, err := rd.redactXObject(*name, gs.ctm, resources)
+			if err != nil {
+				return nil, err
+			}
+			if newOp != op {
+				if newOp != nil {
+					out = append(out, newOp)
+				}
+				continue
+			}
+		case "BI":
+			if len(op.Params) != 1 {
+				break
+			}
+			iimg, ok := op.Params[0].(*contentstream.ContentStreamInlineImage)
+			if !ok {
+				break
+			}
+			newOp, err := rd.redactInlineImage(op, iimg, gs.ctm, resources)
+			if err != nil {
+				return nil, err
+			}
+			if newOp != op {
+				if newOp != nil {
+					out = append(out, newOp)
+				}
+				continue
+			}
+		case "m", "l", "c", "v", "y", "re", "h":
+			path = append(path, op)
+			if op.Operand == "m" || op.Operand == "re" || len(subpaths) == 0 {
+				subpaths = append(subpaths, subpath{box: emptyRect()})
+			}
+			sp := &subpaths[len(subpaths)-1]
+			sp.ops = append(sp.ops, op)
+			switch op.Operand {
+			case "re":
+				if len(floats) == 4 {
+					x, y, w, h := floats[0], floats[1], floats[2], floats[3]
+					for _, p := range [][2]float64{{x, y}, {x + w, y}, {x, y + h}, {x + w, y + h}} {
+						sp.box = sp.box.add(gs.ctm.transform(p[0], p[1]))
+					}
+				}
+			default:
+				for i := 0; i+1 < len(floats); i += 2 {
+					sp.box = sp.box.add(gs.ctm.transform(floats[i], floats[i+1]))
+				}
+			}
+			continue
+		case "W", "W*":
+			pathClips = true
+			path = append(path, op)
+			continue
+		case "S", "s", "f", "F", "f*", "B", "B*", "b", "b*", "n":
+			switch {
+			case pathClips && op.Operand == "n":
+				// Clipping paths that aren't painted are kept unchanged.
+				out = append(out, path...)
+				out = append(out, op)
+			case pathClips:
+				// The path is painted before the clipping path takes effect, so it is painted as a
+				// separate path followed by the unchanged clipping path.
+				out = append(out, rd.redactPath(subpaths, op, gs.ctm)...)
+				out = append(out, path...)
+				out = append(out, makeOp("n"))
+			default:
+				out = append(out, rd.redactPath(subpaths, op, gs.ctm)...)
+			}
+			path, subpaths = nil, nil
+			pathClips = false
+			continue
+		}
+		out = append(out, op)
+	}
+	out = append(out, path...)
+	for _, mc := range marked {
+		endMarked(mc)
+	}
+	return out, nil
+}
+
+// stripActualText returns BDC operator `op`, whose property list may be in `resources`, without
+// the /ActualText, /Alt and /E entries in its property list, which could contain removed text.
+func stripActualText(op *contentstream.ContentStreamOperation,
+	resources *model.PdfPageResources) *contentstream.ContentStreamOperation {
+	if len(op.Params) != 2 {
+		return op
+	}
+	props, ok := core.GetDict(op.Params[1])
+	if !ok && resources != nil {
+		if name, ok := core.GetName(op.Params[1]); ok {
+			if all, ok := core.GetDict(resources.Properties); ok {
+				props, _ = core.GetDict(all.Get(*name))
+			}
+		}
+	}
+	if props == nil {
+		return op
+	}
+	textKeys := map[core.PdfObjectName]bool{"ActualText": true, "Alt": true, "E": true}
+	stripped := core.MakeDict()
+	for _, key := range props.Keys() {
+		if !textKeys[key] {
+			stripped.Set(key, props.Get(key))
+		}
+	}
+	if len(stripped.Keys()) == len(props.Keys()) {
+		return op
+	}
+	return makeOp("BDC", op.Params[0], stripped)
+}
+
+// subpath is the operators of a subpath of a path and their bounding box in page coordinates.
+type subpath struct {
+	ops []*contentstream.ContentStreamOperation
+	box rect
+}
+
+// clipExtent is the half width in points of the area outside the redaction regions that
+// excludeRegions clips to.
+const clipExtent = 10000.0
+
+// redactPath returns the operators that paint the path made of `subpaths` with painting operator
+// `paint` and transform `ctm`, with the content in the redactor's regions removed. Subpaths that are
+// entirely in a region are removed. If the remaining subpaths overlap a region, they are painted with
+// a clipping path that excludes the regions.
+func (rd *redactor) redactPath(subpaths []subpath, paint *contentstream.ContentStreamOperation,
+	ctm matrix) []*contentstream.ContentStreamOperation {
+	if len(subpaths) == 0 {
+		return []*contentstream.ContentStreamOperation{paint}
+	}
+	var kept []*contentstream.ContentStreamOperation
+	var overlapped []model.PdfRectangle
+	removed := false
+	for _, sp := range subpaths {
+		box := model.PdfRectangle(sp.box)
+		if rd.contains(box) {
+			removed = true
+			continue
+		}
+		for _, r := range rd.regions {
+			if box.Llx < r.Urx && r.Llx < box.Urx && box.Lly < r.Ury && r.Lly < box.Ury {
+				overlapped = append(overlapped, r)
+			}
+		}
+		kept = append(kept, sp.ops...)
+	}
+	if len(kept) == 0 {
+		rd.stats.paths++
+		return nil
+	}
+	if removed {
+		rd.stats.paths++
+	}
+	if len(overlapped) == 0 {
+		return append(kept, paint)
+	}
+	clip, ok := excludeRegions(overlapped, ctm)
+	if !ok {
+		// A path drawn with a transform that can't be inverted has no area, so it can be removed.
+		if !removed {
+			rd.stats.paths++
+		}
+		return nil
+	}
+	rd.stats.clipped++
+	ops := []*contentstream.ContentStreamOperation{makeOp("q")}
+	ops = append(ops, clip...)
+	ops = append(ops, kept...)
+	return append(ops, paint, makeOp("Q"))
+}
+
+// excludeRegions returns the operators that clip to everything outside `regions` in a content
+// stream with transform `ctm`. Each region is excluded by a separate even-odd clipping path made of
+// a large rectangle and the region, so the clipping paths intersect to exclude all the regions.
+func excludeRegions(regions []model.PdfRectangle, ctm matrix) ([]*contentstream.ContentStreamOperation, bool) {
+	inv, ok := ctm.inverse()
+	if !ok {
+		return nil, false
+	}
+	var ops []*contentstream.ContentStreamOperation
+	addRect := func(llx, lly, urx, ury float64) {
+		for i, p := range [][2]float64{{llx, lly}, {urx, lly}, {urx, ury}, {llx, ury}} {
+			x, y := inv.transform(p[0], p[1])
+			operand := "l"
+			if i == 0 {
+				operand = "m"
+			}
+			ops = append(ops, makeOp(operand, core.MakeFloat(x), core.MakeFloat(y)))
+		}
+		ops = append(ops, makeOp("h"))
+	}
+	for _, r := range regions {
+		addRect(-clipExtent, -clipExtent, clipExtent, clipExtent)
+		addRect(r.Llx, r.Lly, r.Urx, r.Ury)
+		ops = append(ops, makeOp("W*"), makeOp("n"))
+	}
+	return ops, true
+}
+
+// isPathOp returns true if `operand` is a path construction, clipping or painting operator.
+func isPathOp(operand string) bool {
+	switch operand {
+	case "m", "l", "c", "v", "y", "re", "h", "W", "W*",
+		"S", "s", "f", "F", "f*", "B", "B*", "b", "b*", "n":
+		return true
+	}
+	return false
+}
+
+// getFont returns the font named `name` in `resources`, or nil if it can't be loaded.
+func (rd *redactor) getFont(resources *model.PdfPageResources, name string) *model.PdfFont {
+	key := fontKey{resources, name}
+	if font, ok := rd.fonts[key]; ok {
+		return font
+	}
+	var font *model.PdfFont
+	if fontObj, ok := resources.GetFontByName(core.PdfObjectName(name)); ok {
+		var err error
+		font, err = model.NewPdfFontFromPdfObject(fontObj)
+		if err != nil {
+			common.Log.Debug("ERROR: Could not load font %q. err=%v", name, err)
+			font = nil
+		}
+	}
+	if font == nil {
+		common.Log.Info("Font %q not available. Using a default glyph width.", name)
+	}
+	rd.fonts[key] = font
+	return font
+}
+
+// showText computes the positions of the glyphs in `shown`, the operand of a text showing
+// operator, and updates text matrix `tm` as the glyphs are shown. If any glyphs are in the
+// redactor's regions, it returns a TJ array with those glyphs replaced by kerning adjustments that
+// move the text position by the same amount, and true.
+func (rd *redactor) showText(shown core.PdfObject, gs gstate, tm *matrix) (*core.PdfObjectArray, bool) {
+	var elements []core.PdfObject
+	if arr, ok := core.GetArray(shown); ok {
+		elements = arr.Elements()
+	} else {
+		elements = []core.PdfObject{shown}
+	}
+
+	cid := gs.font != nil && gs.font.IsCID()
+	out := core.MakeArray()
+	removed := false
+	var kept []byte
+	adjust := 0.0
+
+	// flush moves kept glyphs and pending kerning adjustments to `out`.
+	flush := func() {
+		if len(kept) > 0 {
+			if cid {
+				out.Append(core.MakeHexString(string(kept)))
+			} else {
+				out.Append(core.MakeStringFromBytes(kept))
+			}
+			kept = nil
+		}
+		if adjust != 0 {
+			out.Append(core.MakeFloat(math.Round(adjust*1000) / 1000))
+			adjust = 0
+		}
+	}
+
+	for _, el := range elements {
+		strobj, ok := core.GetString(el)
+		if !ok {
+			// Kerning adjustment.
+			val, err := core.GetNumberAsFloat(el)
+			if err != nil {
+				continue
+			}
+			*tm = translation(-val/1000.0*gs.tfs*gs.th, 0).mult(*tm)
+			if len(kept) > 0 {
+				flush()
+			}
+			adjust += val
+			continue
+		}
+		data := strobj.Bytes()
+		width := 1
+		if cid {
+			width = 2
+		}
+		for i := 0; i < len(data); i += width {
+			j := i + width
+			if j > len(data) {
+				j = len(data)
+			}
+			code := data[i:j]
+			w0 := glyphWidth(gs.font, code)
+			spacing := gs.tc
+			if len(code) == 1 && code[0] == ' ' {
+				spacing += gs.tw
+			}
+			tx := (w0*gs.tfs + spacing) * gs.th
+
+			// The center of the glyph in text space.
+			trm := tm.mult(gs.ctm)
+			cx, cy := trm.transform(tx/2, gs.rise+0.3*gs.tfs)
+			if rd.inRegion(cx, cy) {
+				removed = true
+				rd.stats.glyphs++
+				if len(kept) > 0 {
+					flush()
+				}
+				if gs.tfs*gs.th != 0 {
+					adjust -= tx * 1000.0 / (gs.tfs * gs.th)
+				} else {
+					adjust -= w0 * 1000.0
+				}
+			} else {
+				if adjust != 0 {
+					flush()
+				}
+				kept = append(kept, code...)
+			}
+			*tm = translation(tx, 0).mult(*tm)
+		}
+	}
+	flush()
+	return out, removed
+}
+
+// glyphWidth returns the width of the glyph for character code `code` in `font` in text space
+// units.
+func glyphWidth(font *model.PdfFont, code []byte) float64 {
+	if font == nil {
+		return 0.5
+	}
+	charcodes := font.BytesToCharcodes(code)
+	if len(charcodes) == 0 {
+		return 0.5
+	}
+	m, ok := font.GetCharMetrics(charcodes[0])
+	if !ok {
+		return 0.5
+	}
+	return m.Wx / 1000.0
+}
+
+// redactXObject redacts the XObject named `name` in `resources` that is drawn with transform
+// `ctm`. It returns the Do operator that should replace the original one: the original if the
+// XObject is not changed, an operator for a redacted copy of the XObject if it is changed, or nil
+// if the XObject should not be drawn. The redacted copy is added to `resources` under a new name
+// because the original may be drawn elsewhere with a different transform.
+func (rd *redactor) redactXObject(name core.PdfObjectName, ctm matrix,
+	resources *model.PdfPageResources) (*contentstream.ContentStreamOperation, error) {
+	original := makeOp("Do", &name)
+	_, xtype := resources.GetXObjectByName(name)
+	switch xtype {
+	case model.XObjectTypeImage:
+		if !rd.overlaps(ctm.unitRect()) {
+			return original, nil
+		}
+		ximg, err := resources.GetXObjectImageByName(name)
+		if err != nil {
+			return nil, err
+		}
+		newImg, err := rd.redactImage(ximg, ctm)
+		if err != nil || newImg == nil {
+			common.Log.Info("Could not blank image %q. Removing it. err=%v", name, err)
+			rd.stats.images++
+			return nil, nil
+		}
+		rd.stats.images++
+		return rd.replaceXObject(resources, name, newImg.ToPdfObject())
+
+	case model.XObjectTypeForm:
+		xform, err := resources.GetXObjectFormByName(name)
+		if err != nil {
+			return nil, err
+		}
+		formCtm := ctm
+		if arr, ok := core.GetArray(xform.Matrix); ok {
+			if vals, err := arr.ToFloat64Array(); err == nil && len(vals) == 6 {
+				formCtm = newMatrix(vals).mult(ctm)
+			}
+		}
+		if arr, ok := core.GetArray(xform.BBox); ok {
+			if bbox, err := model.NewPdfRectangle(*arr); err == nil {
+				box := emptyRect()
+				for _, p := range [][2]float64{{bbox.Llx, bbox.Lly}, {bbox.Urx, bbox.Lly},
+					{bbox.Llx, bbox.Ury}, {bbox.Urx, bbox.Ury}} {
+					box = box.add(formCtm.transform(p[0], p[1]))
+				}
+				if !rd.overlaps(model.PdfRectangle(box)) {
+					return original, nil
+				}
+			}
+		}
+		content, err := xform.GetContentStream()
+		if err != nil {
+			return nil, err
+		}
+		ops, err := contentstream.NewContentStreamParser(string(content)).Parse()
+		if err != nil {
+			return nil, err
+		}
+		formResources := xform.Resources
+		if formResources == nil {
+			formResources = resources
+		}
+		before := rd.stats
+		redacted, err := rd.redactOps(*ops, formCtm, formResources)
+		if err != nil {
+			return nil, err
+		}
+		if rd.stats == before {
+			return original, nil
+		}
+		if xform.Resources != nil {
+			rd.removeReplaced(xform.Resources, redacted)
+		}
+
+		newForm := model.NewXObjectForm()
+		newForm.FormType = xform.FormType
+		newForm.BBox = xform.BBox
+		newForm.Matrix = xform.Matrix
+		newForm.Resources = xform.Resources
+		newForm.Group = xform.Group
+		newForm.OC = xform.OC
+		redactedOps := contentstream.ContentStreamOperations(redacted)
+		err = newForm.SetContentStream([]byte(redactedOps.String()), core.NewFlateEncoder())
+		if err != nil {
+			return nil, err
+		}
+		return rd.replaceXObject(resources, name, newForm.ToPdfObject())
+	}
+	return original, nil
+}
+
+// replaceXObject adds `obj`, a redacted copy of the XObject named `name` in `resources`, to
+// `resources` under a new name and returns a Do operator that draws it. `name` is recorded so that
+// removeReplaced can remove the original.
+func (rd *redactor) replaceXObject(resources *model.PdfPageResources, name core.PdfObjectName,
+	obj core.PdfObject) (*contentstream.ContentStreamOperation, error) {
+	stream, ok := obj.(*core.PdfObjectStream)
+	if !ok {
+		return nil, fmt.Errorf("XObject %q is not a stream", name)
+	}
+	// The XObject dictionary may be shared with other pages or forms, so it is copied before it is
+	// changed.
+	if !rd.copied[resources] {
+		xobjects := core.MakeDict()
+		if dict, ok := core.GetDict(resources.XObject); ok {
+			for _, key := range dict.Keys() {
+				xobjects.Set(key, dict.Get(key))
+			}
+		}
+		resources.XObject = xobjects
+		rd.copied[resources] = true
+	}
+	newName := resources.GenerateXObjectName()
+	if err := resources.SetXObjectByName(newName, stream); err != nil {
+		return nil, err
+	}
+	rd.replaced[resources] = append(rd.replaced[resources], name)
+	return makeOp("Do", core.MakeName(string(newName))), nil
+}
+
+// removeReplaced removes the XObjects in `resources` that have been replaced by redacted copies and
+// are no longer drawn by content stream `ops` or by the forms it draws that use `resources`.
+func (rd *redactor) removeReplaced(resources *model.PdfPageResources,
+	ops []*contentstream.ContentStreamOperation) {
+	names := rd.replaced[resources]
+	if len(names) == 0 {
+		return
+	}
+	delete(rd.replaced, resources)
+	used := map[core.PdfObjectName]bool{}
+	xobjectsUsed(ops, resources, used, 0)
+	dict, ok := core.GetDict(resources.XObject)
+	if !ok {
+		return
+	}
+	for _, name := range names {
+		if !used[name] {
+			dict.Remove(name)
+		}
+	}
+}
+
+// maxFormDepth is the maximum depth of form XObjects that xobjectsUsed descends into.
+const maxFormDepth = 10
+
+// xobjectsUsed adds the names of the XObjects in `resources` that are drawn by `ops` to `used`. Forms
+// without their own resources use `resources` so the XObjects they draw are added too.
+func xobjectsUsed(ops []*contentstream.ContentStreamOperation, resources *model.PdfPageResources,
+	used map[core.PdfObjectName]bool, level int) {
+	for _, op := range ops {
+		if op.Operand != "Do" || len(op.Params) != 1 {
+			continue
+		}
+		name, ok := core.GetName(op.Params[0])
+		if !ok || used[*name] {
+			continue
+		}
+		used[*name] = true
+		if level >= maxFormDepth {
+			continue
+		}
+		if _, xtype := resources.GetXObjectByName(*name); xtype != model.XObjectTypeForm {
+			continue
+		}
+		xform, err := resources.GetXObjectFormByName(*name)
+		if err != nil || xform.Resources != nil {
+			continue
+		}
+		content, err := xform.GetContentStream()
+		if err != nil {
+			continue
+		}
+		formOps, err := contentstream.NewContentStreamParser(string(content)).Parse()
+		if err != nil {
+			continue
+		}
+		xobjectsUsed(*formOps, resources, used, level+1)
+	}
+}
+
+// redactInlineImage redacts inline image `iimg`, drawn by operator `op` with transform `ctm`. It
+// returns the operator that should replace `op`, or nil if the image should not be drawn.
+// Inline images that can't be blanked, such as those in indexed color spaces, are removed.
+func (rd *redactor) redactInlineImage(op *contentstream.ContentStreamOperation,
+	iimg *contentstream.ContentStreamInlineImage, ctm matrix,
+	resources *model.PdfPageResources) (*contentstream.ContentStreamOperation, error) {
+	if !rd.overlaps(ctm.unitRect()) {
+		return op, nil
+	}
+	rd.stats.images++
+	if isMask, err := iimg.IsMask(); err != nil || isMask {
+		return nil, nil
+	}
+	cs, err := iimg.GetColorSpace(resources)
+	if err != nil {
+		return nil, nil
+	}
+	switch cs.(type) {
+	case *model.PdfColorspaceDeviceGray, *model.PdfColorspaceDeviceRGB, *model.PdfColorspaceDeviceCMYK:
+	default:
+		return nil, nil
+	}
+	img, err := iimg.ToImage(resources)
+	if err != nil {
+		return nil, nil
+	}
+	rd.blankImage(img, ctm)
+	newImg, err := contentstream.NewInlineImageFromImage(*img, core.NewFlateEncoder())
+	if err != nil {
+		return nil, nil
+	}
+	return makeOp("BI", newImg), nil
+}
+
+// redactImage returns a copy of image XObject `ximg`, drawn with transform `ctm`, with the pixels
+// in the redactor's regions blanked in the image and in its soft mask or stencil mask.
+func (rd *redactor) redactImage(ximg *model.XObjectImage, ctm matrix) (*model.XObjectImage, error) {
+	if ximg.ColorSpace == nil {
+		return nil, errors.New("no colorspace")
+	}
+	img, err := ximg.ToImage()
+	if err != nil {
+		return nil, err
+	}
+	rd.blankImage(img, ctm)
+	newImg, err := model.UpdateXObjectImageFromImage(ximg, img, ximg.ColorSpace, core.NewFlateEncoder())
+	if err != nil {
+		return nil, err
+	}
+	newImg.Decode = ximg.Decode
+	newImg.ImageMask = ximg.ImageMask
+	newImg.Intent = ximg.Intent
+	newImg.Interpolate = ximg.Interpolate
+	// The masks are the image's shape so they are redacted too. Color key mask arrays don't depend on
+	// the pixel positions and are kept.
+	if newImg.SMask, err = rd.redactMask(ximg.SMask, ctm); err != nil {
+		return nil, err
+	}
+	if newImg.Mask, err = rd.redactMask(ximg.Mask, ctm); err != nil {
+		return nil, err
+	}
+	return newImg, nil
+}
+
+// redactMask returns a copy of soft mask or stencil mask `obj` of an image drawn with transform
+// `ctm` with the pixels in the redactor's regions blanked. `obj` is returned unchanged if it isn't
+// a stream.
+func (rd *redactor) redactMask(obj core.PdfObject, ctm matrix) (core.PdfObject, error) {
+	stream, ok := core.GetStream(obj)
+	if !ok {
+		return obj, nil
+	}
+	data, err := core.DecodeStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	width, _ := core.GetNumberAsInt64(stream.Get("Width"))
+	height, _ := core.GetNumberAsInt64(stream.Get("Height"))
+	bpc, err := core.GetNumberAsInt64(stream.Get("BitsPerComponent"))
+	if err != nil {
+		bpc = 1 // Stencil masks may omit BitsPerComponent.
+	}
+	img := &model.Image{Width: width, Height: height, BitsPerComponent: bpc, ColorComponents: 1, Data: data}
+	rd.blankImage(img, ctm)
+
+	encoder := core.NewFlateEncoder()
+	encoded, err := encoder.EncodeBytes(img.Data)
+	if err != nil {
+		return nil, err
+	}
+	dict := encoder.MakeStreamDict()
+	for _, key := range stream.PdfObjectDictionary.Keys() {
+		switch key {
+		case "Filter", "DecodeParms", "Length":
+		default:
+			dict.Set(key, stream.Get(key))
+		}
+	}
+	dict.Set("Length", core.MakeInteger(int64(len(encoded))))
+	return &core.PdfObjectStream{PdfObjectDictionary: dict, Stream: encoded}, nil
+}
+
+// blankImage sets the samples of the pixels of `img`, drawn with transform `ctm`, that are in the
+// redactor's regions to zero.
+func (rd *redactor) blankImage(img *model.Image, ctm matrix) {
+	w, h := int(img.Width), int(img.Height)
+	cpts := img.ColorComponents
+	bpc := int(img.BitsPerComponent)
+	stride := (w*cpts*bpc + 7) / 8
+	inv, ok := ctm.inverse()
+	if !ok || w == 0 || h == 0 {
+		return
+	}
+	for _, r := range rd.regions {
+		// The region in image space, where the image is the unit square.
+		box := emptyRect()
+		for _, p := range [][2]float64{{r.Llx, r.Lly}, {r.Urx, r.Lly}, {r.Llx, r.Ury}, {r.Urx, r.Ury}} {
+			box = box.add(inv.transform(p[0], p[1]))
+		}
+		// Image row 0 is at the top of the unit square.
+		col0 := clampInt(int(math.Floor(box.Llx*float64(w))), 0, w)
+		col1 := clampInt(int(math.Ceil(box.Urx*float64(w))), 0, w)
+		row0 := clampInt(int(math.Floor((1-box.Ury)*float64(h))), 0, h)
+		row1 := clampInt(int(math.Ceil((1-box.Lly)*float64(h))), 0, h)
+		for row := row0; row < row1; row++ {
+			for col := col0; col < col1; col++ {
+				for c := 0; c < cpts; c++ {
+					clearSample(img.Data, row*stride, (col*cpts+c)*bpc, bpc)
+				}
+			}
+		}
+	}
+}
+
+// clearSample sets the `bpc` bit sample at bit offset `bit` in the row starting at byte `rowStart`
+// of `data` to zero.
+func clearSample(data []byte, rowStart, bit, bpc int) {
+	for b := bit; b < bit+bpc; b++ {
+		i := rowStart + b/8
+		if i >= len(data) {
+			return
+		}
+		data[i] &^= 0x80 >> uint(b%8)
+	}
+}
+
+// clampInt returns `x` clamped to the range [`lo`, `hi`].
+func clampInt(x, lo, hi int) int {
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
+
+// inRegion returns true if point (`x`, `y`) is in one of the redactor's regions.
+func (rd *redactor) inRegion(x, y float64) bool {
+	for _, r := range rd.regions {
+		if r.Llx <= x && x <= r.Urx && r.Lly <= y && y <= r.Ury {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps returns true if `box` overlaps one of the redactor's regions.
+func (rd *redactor) overlaps(box model.PdfRectangle) bool {
+	for _, r := range rd.regions {
+		if box.Llx < r.Urx && r.Llx < box.Urx && box.Lly < r.Ury && r.Lly < box.Ury {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if `box` is inside one of the redactor's regions.
+func (rd *redactor) contains(box model.PdfRectangle) bool {
+	for _, r := range rd.regions {
+		if r.Llx <= box.Llx && box.Urx <= r.Urx && r.Lly <= box.Lly && box.Ury <= r.Ury {
+			return true
+		}
+	}
+	return false
+}
+
+// makeOp returns a content stream operation for `operand` with parameters `params`.
+func makeOp(operand string, params ...core.PdfObject) *contentstream.ContentStreamOperation {
+	return &contentstream.ContentStreamOperation{Operand: operand, Params: params}
+}
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+// identityMatrix returns the identity matrix.
+func identityMatrix() matrix {
+	return matrix{1, 0, 0, 1, 0, 0}
+}
+
+// newMatrix returns the matrix with elements `vals`.
+func newMatrix(vals []float64) matrix {
+	var m matrix
+	copy(m[:], vals)
+	return m
+}
+
+// translation returns the matrix that translates by (`tx`, `ty`).
+func translation(tx, ty float64) matrix {
+	return matrix{1, 0, 0, 1, tx, ty}
+}
+
+// mult returns `m` × `o`, the transform that applies `m` then `o`.
+func (m matrix) mult(o matrix) matrix {
+	return matrix{
+		m[0]*o[0] + m[1]*o[2],
+		m[0]*o[1] + m[1]*o[3],
+		m[2]*o[0] + m[3]*o[2],
+		m[2]*o[1] + m[3]*o[3],
+		m[4]*o[0] + m[5]*o[2] + o[4],
+		m[4]*o[1] + m[5]*o[3] + o[5],
+	}
+}
+
+// transform returns point (`x`, `y`) transformed by `m`.
+func (m matrix) transform(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// inverse returns the inverse of `m` and true, or false if `m` is not invertible.
+func (m matrix) inverse() (matrix, bool) {
+	det := m[0]*m[3] - m[1]*m[2]
+	if math.Abs(det) < 1e-12 {
+		return matrix{}, false
+	}
+	return matrix{
+		m[3] / det,
+		-m[1] / det,
+		-m[2] / det,
+		m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det,
+		(m[1]*m[4] - m[0]*m[5]) / det,
+	}, true
+}
+
+// unitRect returns the bounding box of the unit square transformed by `m`. This is where images
+// drawn with transform `m` are placed.
+func (m matrix) unitRect() model.PdfRectangle {
+	box := emptyRect()
+	for _, p := range [][2]float64{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		box = box.add(m.transform(p[0], p[1]))
+	}
+	return model.PdfRectangle(box)
+}
+
+// rect is a model.PdfRectangle that can be grown to include points.
+type rect model.PdfRectangle
+
+// emptyRect returns a rectangle that contains no points.
+func emptyRect() rect {
+	return rect{Llx: math.Inf(1), Lly: math.Inf(1), Urx: math.Inf(-1), Ury: math.Inf(-1)}
+}
+
+// add returns `r` grown to include point (`x`, `y`).
+func (r rect) add(x, y float64) rect {
+	r.Llx = math.Min(r.Llx, x)
+	r.Lly = math.Min(r.Lly, y)
+	r.Urx = math.Max(r.Urx, x)
+	r.Ury = math.Max(r.Ury, y)
+	return r
+}
+
+// parseRegion parses a region specification page:llx,lly,urx,ury.
+func parseRegion(s string) (int, model.PdfRectangle, error) {
+	var r model.PdfRectangle
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, r, fmt.Errorf("bad region %q. Expected page:llx,lly,urx,ury", s)
+	}
+	pageNum, err := strconv.Atoi(parts[0])
+	if err != nil || pageNum < 1 {
+		return 0, r, fmt.Errorf("bad page number in region %q", s)
+	}
+	var vals []float64
+	for _, v := range strings.Split(parts[1], ",") {
+		x, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, r, fmt.Errorf("bad coordinate in region %q", s)
+		}
+		vals = append(vals, x)
+	}
+	if len(vals) != 4 {
+		return 0, r, fmt.Errorf("bad region %q. Expected page:llx,lly,urx,ury", s)
+	}
+	r = model.PdfRectangle{
+		Llx: math.Min(vals[0], vals[2]),
+		Lly: math.Min(vals[1], vals[3]),
+		Urx: math.Max(vals[0], vals[2]),
+		Ury: math.Max(vals[1], vals[3]),
+	}
+	return pageNum, r, nil
+}
+
+// stringList is a flag.Value for flags that may be repeated.
+type stringList []string
+
+// String returns a description of `l`.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set adds `s` to `l`.
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
+}
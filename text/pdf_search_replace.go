@@ -2,16 +2,33 @@
  * pdf_search_replace.go - Basic example of find and replace with UniDoc.
  * Replaces <text> with <replace text> in the output PDF.
  *
- * Syntax: go run pdf_search_replace.go <input.pdf> <output.pdf> <text> <replace text>
+ * The text shown in each BT/ET block is decoded with the fonts it is drawn in (via the fonts'
+ * ToUnicode maps and encodings), so <text> is found even when it is split over TJ array elements
+ * with kerning offsets, over successive Tj operators or drawn in CID fonts. Strings in CID fonts
+ * are split into character codes using the codespace ranges of the fonts' encoding CMaps.
+ * The replacement is encoded with the font of the text it replaces. It is an error if that font
+ * (typically a subset font) has no glyph for a character in the replacement.
+ * BT/ET blocks that show text in fonts that are missing or can't be loaded are left unchanged.
+ *
+ * With -r, <text> is a Go regular expression and <replace text> may refer to its capture groups
+ * as $1, ${1} or ${name}. Matches do not extend past the BT/ET block they start in.
+ *
+ * Syntax: go run pdf_search_replace.go [-r] [-p pages] <input.pdf> <output.pdf> <text> <replace text>
+ * e.g. go run pdf_search_replace.go -r -p 1,3-5 in.pdf out.pdf 'INV-(\d+)' 'Invoice #$1'
  */
 
 package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf16"
 
 	"github.com/unidoc/unipdf/v3/common"
 	"github.com/unidoc/unipdf/v3/contentstream"
@@ -20,25 +37,55 @@ import (
 	"github.com/unidoc/unipdf/v3/model/optimize"
 )
 
+// spaceKerning is the TJ kerning adjustment (in thousandths of text space units) at or below
+// which a gap between TJ array elements is treated as a space between words.
+const spaceKerning = -200.0
+
+// missingCodeRune is the rune that fonts decode character codes without a Unicode mapping to.
+const missingCodeRune = '\ufffd'
+
+const usage = `Usage: go run pdf_search_replace.go [options] <input.pdf> <output.pdf> <text> <replace text>
+`
+
 func main() {
-	if len(os.Args) < 5 {
-		fmt.Printf("Usage: go run pdf_search_replace.go <input.pdf> <output.pdf> <text> <replace text>\n")
+	var opts replaceOptions
+	flag.BoolVar(&opts.regex, "r", false, "<text> is a regular expression. <replace text> may use $1, ${name}.")
+	flag.StringVar(&opts.pages, "p", "", "Pages to replace text on. e.g. 1,3-5,8- (default: all pages)")
+	makeUsage(usage)
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 4 {
+		flag.Usage()
 		os.Exit(0)
 	}
 
-	inputPath := os.Args[1]
-	outputPath := os.Args[2]
-	searchText := os.Args[3]
-	replaceText := os.Args[4]
+	inputPath := args[0]
+	outputPath := args[1]
+	searchText := args[2]
+	replaceText := args[3]
 
-	err := searchReplace(inputPath, outputPath, searchText, replaceText)
+	err := searchReplace(inputPath, outputPath, searchText, replaceText, opts)
 	if err != nil {
 		panic(err)
 	}
 	fmt.Printf("Successfully created %s\n", outputPath)
 }
 
-func searchReplace(inputPath, outputPath, searchText, replaceText string) error {
+// replaceOptions control how searchReplace matches text and which pages it replaces text on.
+type replaceOptions struct {
+	regex bool   // The search text is a regular expression.
+	pages string // Page ranges to replace text on. All pages if empty.
+}
+
+// searchReplace replaces the instances of `searchText` in PDF file `inputPath` with `replaceText`
+// and writes the resulting PDF to `outputPath`. The number of replacements on each page is
+// printed.
+func searchReplace(inputPath, outputPath, searchText, replaceText string, opts replaceOptions) error {
+	r, err := newReplacer(searchText, replaceText, opts.regex)
+	if err != nil {
+		return err
+	}
+
 	f, err := os.Open(inputPath)
 	if err != nil {
 		return err
@@ -70,15 +117,25 @@ func searchReplace(inputPath, outputPath, searchText, replaceText string) error
 		return err
 	}
 
+	pageNums, err := parsePageRanges(opts.pages, numPages)
+	if err != nil {
+		return err
+	}
+
+	total := 0
 	for n := 1; n <= numPages; n++ {
 		page, err := pdfReader.GetPage(n)
 		if err != nil {
 			return err
 		}
 
-		err = searchReplacePageText(page, searchText, replaceText)
-		if err != nil {
-			return err
+		if pageNums[n] {
+			count, err := searchReplacePageText(page, r)
+			if err != nil {
+				return fmt.Errorf("page %d: %v", n, err)
+			}
+			fmt.Printf("Page %d: %d replacements\n", n, count)
+			total += count
 		}
 
 		err = pdfWriter.AddPage(page)
@@ -101,70 +158,807 @@ func searchReplace(inputPath, outputPath, searchText, replaceText string) error
 	}
 	pdfWriter.SetOptimizer(optimize.New(opt))
 
+	fmt.Printf("Total: %d replacements\n", total)
 	return pdfWriter.Write(fw)
 }
 
-func searchReplacePageText(page *model.PdfPage, searchText, replaceText string) error {
+// parsePageRanges returns the page numbers in page ranges `spec` (e.g. "1,3-5,8-") as a set.
+// All pages in a `numPages` page document are returned if `spec` is empty. It is an error for a
+// range to include pages that are not in the document.
+func parsePageRanges(spec string, numPages int) (map[int]bool, error) {
+	pageNums := map[int]bool{}
+	if strings.TrimSpace(spec) == "" {
+		for n := 1; n <= numPages; n++ {
+			pageNums[n] = true
+		}
+		return pageNums, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+			if to == "" {
+				to = strconv.Itoa(numPages)
+			}
+		}
+		lo, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("bad page range %q", part)
+		}
+		hi, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, fmt.Errorf("bad page range %q", part)
+		}
+		if lo > numPages || hi > numPages {
+			return nil, fmt.Errorf("page range %q is outside the document's %d pages", part, numPages)
+		}
+		if lo < 1 || hi < lo {
+			return nil, fmt.Errorf("bad page range %q", part)
+		}
+		for n := lo; n <= hi; n++ {
+			pageNums[n] = true
+		}
+	}
+	return pageNums, nil
+}
+
+// replacer finds the text to be replaced in the text of a textBlock and computes the replacements.
+type replacer struct {
+	searchText  string
+	replaceText string
+	re          *regexp.Regexp // Regular expression for `searchText` in regex mode, otherwise nil.
+}
+
+// textMatch is a match of a replacer in the text of a textBlock.
+type textMatch struct {
+	start, end  int    // Offsets of the matched text.
+	replacement string // Text to replace the matched text with.
+}
+
+// newReplacer returns a replacer that replaces `searchText` with `replaceText`. If `regex` is true
+// then `searchText` is a regular expression and `replaceText` is expanded as in
+// regexp.Regexp.Expand.
+func newReplacer(searchText, replaceText string, regex bool) (replacer, error) {
+	r := replacer{searchText: searchText, replaceText: replaceText}
+	if regex {
+		re, err := regexp.Compile(searchText)
+		if err != nil {
+			return r, fmt.Errorf("bad regular expression %q. err=%v", searchText, err)
+		}
+		r.re = re
+	}
+	return r, nil
+}
+
+// findAll returns the non-overlapping matches of `r` in `text`. Empty matches are skipped as
+// there is no text to replace.
+func (r replacer) findAll(text string) []textMatch {
+	var matches []textMatch
+	if r.re != nil {
+		for _, loc := range r.re.FindAllStringSubmatchIndex(text, -1) {
+			if loc[1] == loc[0] {
+				continue
+			}
+			replacement := r.re.ExpandString(nil, r.replaceText, text, loc)
+			matches = append(matches, textMatch{loc[0], loc[1], string(replacement)})
+		}
+		return matches
+	}
+	if r.searchText == "" {
+		return nil
+	}
+	for start := 0; start < len(text); {
+		i := strings.Index(text[start:], r.searchText)
+		if i < 0 {
+			break
+		}
+		start += i
+		end := start + len(r.searchText)
+		matches = append(matches, textMatch{start, end, r.replaceText})
+		start = end
+	}
+	return matches
+}
+
+// searchReplacePageText replaces all the matches of `r` in the text of `page` and returns the
+// number of replacements made.
+func searchReplacePageText(page *model.PdfPage, r replacer) (int, error) {
 	contents, err := page.GetAllContentStreams()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	csParser := contentstream.NewContentStreamParser(contents)
 	ops, err := csParser.Parse()
+	if err != nil {
+		return 0, err
+	}
+
+	blocks := pageTextBlocks(*ops, page.Resources)
+
+	numMatches := 0
+	for _, b := range blocks {
+		n, err := b.replaceAll(r)
+		if err != nil {
+			return 0, err
+		}
+		numMatches += n
+	}
+	if numMatches == 0 {
+		return 0, nil
+	}
+	common.Log.Debug("searchReplacePageText: %d replacements", numMatches)
+
+	for _, b := range blocks {
+		b.apply()
+	}
+
+	return numMatches, page.SetContentStreams([]string{ops.String()}, core.NewFlateEncoder())
+}
+
+// textBlock is the text shown by the text showing operators (Tj, TJ, ' and ") in a BT/ET block.
+// The strings in the operands are split into glyphs (character codes) so that text can be matched
+// and replaced across string boundaries.
+type textBlock struct {
+	items  []textItem  // The strings and TJ kerning adjustments in the block.
+	glyphs []textGlyph // The glyphs in the block's strings, in the order they are shown.
+	text   string      // The decoded text of `glyphs`.
+	skip   bool        // Some text in the block has no usable font, so the block isn't matched.
+}
+
+// textItem is a string operand or a TJ kerning adjustment in a textBlock.
+type textItem struct {
+	op    *contentstream.ContentStreamOperation // The text showing operator the item is in.
+	index int                                   // Index of the item in the TJ array, or of the operand.
+	font  *fontCodec                            // The font the item is drawn in.
+	obj   core.PdfObject                        // Kerning adjustment, or nil for strings.
+	drop  bool                                  // Kerning adjustment removed by a replacement.
+}
+
+// textGlyph is a character code in a textBlock and the text it decodes to.
+type textGlyph struct {
+	item    int    // Index in textBlock.items of the string or kerning adjustment the glyph is in.
+	code    []byte // Character code bytes. nil when the glyph has been removed.
+	text    string // Decoded text of `code`.
+	virtual bool   // Glyph is a space inferred from a TJ kerning adjustment.
+	start   int    // Offset of `text` in textBlock.text.
+}
+
+// pageTextBlocks returns the textBlocks in content stream `ops` whose fonts are in `resources`.
+// Blocks that show text in fonts that are missing or can't be loaded are left out.
+func pageTextBlocks(ops contentstream.ContentStreamOperations,
+	resources *model.PdfPageResources) []*textBlock {
+	fonts := map[string]*fontCodec{}
+	var font *fontCodec
+	var fontStack []*fontCodec
+	var blocks []*textBlock
+	var b *textBlock
+
+	for _, op := range ops {
+		switch op.Operand {
+		case "q":
+			fontStack = append(fontStack, font)
+		case "Q":
+			if len(fontStack) > 0 {
+				font = fontStack[len(fontStack)-1]
+				fontStack = fontStack[:len(fontStack)-1]
+			}
+		case "BT":
+			b = &textBlock{}
+		case "ET":
+			if b != nil && !b.skip {
+				b.finish()
+				blocks = append(blocks, b)
+			}
+			b = nil
+		case "Tf":
+			// Text shown in a font that can't be used makes its block be skipped.
+			font = nil
+			if len(op.Params) != 2 {
+				common.Log.Debug("Invalid: Tf with invalid set of parameters - skip")
+				continue
+			}
+			name, ok := core.GetNameVal(op.Params[0])
+			if !ok {
+				common.Log.Debug("Invalid: Tf with non-name font - skip")
+				continue
+			}
+			fc, err := getFontCodec(fonts, resources, name)
+			if err != nil {
+				common.Log.Debug("ERROR: %v - skip", err)
+				continue
+			}
+			font = fc
+		case "Tj", "'":
+			if len(op.Params) != 1 {
+				common.Log.Debug("Invalid: %s with invalid set of parameters - skip", op.Operand)
+				continue
+			}
+			b.addString(op, 0, font)
+		case `"`:
+			if len(op.Params) != 3 {
+				common.Log.Debug(`Invalid: " with invalid set of parameters - skip`)
+				continue
+			}
+			b.addString(op, 2, font)
+		case "TJ":
+			if len(op.Params) != 1 {
+				common.Log.Debug("Invalid: TJ with invalid set of parameters - skip")
+				continue
+			}
+			arr, ok := core.GetArray(op.Params[0])
+			if !ok {
+				common.Log.Debug("Invalid: TJ with non-array operand - skip")
+				continue
+			}
+			for i, obj := range arr.Elements() {
+				if _, ok := core.GetString(obj); ok {
+					b.addString(op, i, font)
+				} else {
+					b.addKerning(op, i, obj, font)
+				}
+			}
+		}
+	}
+	return blocks
+}
+
+// addString adds the string operand `index` of text showing operator `op` to `b`. `index` is the
+// index in the TJ array for TJ operators.
+func (b *textBlock) addString(op *contentstream.ContentStreamOperation, index int, font *fontCodec) {
+	if b == nil {
+		common.Log.Debug("Invalid: %s outside BT/ET - skip", op.Operand)
+		return
+	}
+	if font == nil {
+		common.Log.Debug("Invalid: %s without a usable font - skipping text block", op.Operand)
+		b.skip = true
+		return
+	}
+	item := textItem{op: op, index: index, font: font}
+	strobj, ok := core.GetString(item.operand())
+	if !ok {
+		common.Log.Debug("Invalid parameter, skipping")
+		return
+	}
+	b.items = append(b.items, item)
+	for _, g := range font.decode(strobj.Bytes()) {
+		g.item = len(b.items) - 1
+		b.glyphs = append(b.glyphs, g)
+	}
+}
+
+// addKerning adds kerning adjustment `obj`, element `index` of the array of TJ operator `op`, to
+// `b`. Large adjustments are recorded as virtual spaces so that words separated by them can be
+// matched.
+func (b *textBlock) addKerning(op *contentstream.ContentStreamOperation, index int, obj core.PdfObject,
+	font *fontCodec) {
+	if b == nil {
+		return
+	}
+	b.items = append(b.items, textItem{op: op, index: index, font: font, obj: obj})
+	if val, err := core.GetNumberAsFloat(obj); err == nil && val <= spaceKerning {
+		b.glyphs = append(b.glyphs, textGlyph{item: len(b.items) - 1, text: " ", virtual: true})
+	}
+}
+
+// finish computes the text of `b` after all its items have been added. Virtual spaces next to
+// real spaces are dropped so they don't double up word separators.
+func (b *textBlock) finish() {
+	var glyphs []textGlyph
+	for i, g := range b.glyphs {
+		if g.virtual {
+			if i == 0 || i == len(b.glyphs)-1 ||
+				strings.HasSuffix(b.glyphs[i-1].text, " ") ||
+				strings.HasPrefix(b.glyphs[i+1].text, " ") {
+				continue
+			}
+		}
+		glyphs = append(glyphs, g)
+	}
+	var sb strings.Builder
+	for i := range glyphs {
+		glyphs[i].start = sb.Len()
+		sb.WriteString(glyphs[i].text)
+	}
+	b.glyphs = glyphs
+	b.text = sb.String()
+}
+
+// replaceAll replaces all the matches of `r` in the text of `b` and returns the number of
+// replacements made.
+func (b *textBlock) replaceAll(r replacer) (int, error) {
+	matches := r.findAll(b.text)
+	for _, m := range matches {
+		if err := b.replace(m.start, m.end, m.replacement); err != nil {
+			return 0, err
+		}
+	}
+	return len(matches), nil
+}
+
+// replace replaces the glyphs that show b.text[start:end] with the glyphs for `replaceText`.
+// The replacement glyphs are encoded with the font of the first replaced glyph. Parts of glyphs
+// at either end of the range (e.g. ligatures) that are outside the range are preserved.
+func (b *textBlock) replace(start, end int, replaceText string) error {
+	first, last := -1, -1
+	for i, g := range b.glyphs {
+		if first < 0 && start < g.start+len(g.text) {
+			first = i
+		}
+		if g.start < end {
+			last = i
+		}
+	}
+	// The first glyph must be a real one as it receives the replacement text.
+	for first >= 0 && first <= last && b.glyphs[first].virtual {
+		first++
+	}
+	if first < 0 || first > last {
+		common.Log.Debug("replace: no glyphs for text[%d:%d]", start, end)
+		return nil
+	}
+
+	g0, g1 := b.glyphs[first], b.glyphs[last]
+	var lead, trail string
+	if start > g0.start {
+		lead = g0.text[:start-g0.start]
+	}
+	if end < g1.start+len(g1.text) {
+		trail = g1.text[end-g1.start:]
+	}
+	text := lead + replaceText + trail
+
+	font := b.items[g0.item].font
+	code, err := font.encode(text)
 	if err != nil {
 		return err
 	}
+	b.glyphs[first].code = code
+	b.glyphs[first].text = text
+
+	for i := first + 1; i <= last; i++ {
+		b.glyphs[i].code = nil
+		b.glyphs[i].text = ""
+	}
+	// Kerning between the replaced glyphs no longer separates anything.
+	for i := g0.item + 1; i < g1.item; i++ {
+		if b.items[i].obj != nil {
+			b.items[i].drop = true
+		}
+	}
+	return nil
+}
+
+// apply writes the glyphs in `b` back to the text showing operators they came from.
+func (b *textBlock) apply() {
+	data := make([][]byte, len(b.items))
+	for _, g := range b.glyphs {
+		if !g.virtual {
+			data[g.item] = append(data[g.item], g.code...)
+		}
+	}
+
+	arrays := map[*contentstream.ContentStreamOperation][]core.PdfObject{}
+	var tjOps []*contentstream.ContentStreamOperation
+	for i, item := range b.items {
+		if item.op.Operand != "TJ" {
+			item.op.Params[item.index] = item.font.makeString(data[i])
+			continue
+		}
+		if _, ok := arrays[item.op]; !ok {
+			tjOps = append(tjOps, item.op)
+			arrays[item.op] = []core.PdfObject{}
+		}
+		switch {
+		case item.obj == nil && len(data[i]) > 0:
+			arrays[item.op] = append(arrays[item.op], item.font.makeString(data[i]))
+		case item.obj != nil && !item.drop:
+			arrays[item.op] = append(arrays[item.op], item.obj)
+		}
+	}
+	for _, op := range tjOps {
+		op.Params[0] = core.MakeArray(arrays[op]...)
+	}
+}
+
+// operand returns the PDF object in the text showing operator for `item`.
+func (item textItem) operand() core.PdfObject {
+	if item.op.Operand == "TJ" {
+		arr, _ := core.GetArray(item.op.Params[0])
+		return arr.Get(item.index)
+	}
+	return item.op.Params[item.index]
+}
+
+// fontCodec decodes the character codes in strings drawn with a font to text and encodes text back
+// to character codes in the font.
+type fontCodec struct {
+	name         string
+	font         *model.PdfFont
+	subset       bool              // Font is a subset font, so it may be missing glyphs.
+	hasToUnicode bool              // Font has a ToUnicode CMap.
+	codes        map[string][]byte // {text: character code bytes}
+	maxCodeRunes int               // Maximum number of runes in a key of `codes`.
+	codespaces   []codespace       // Ranges of character codes in a CID font's encoding CMap.
+}
+
+// codespace is a codespace range in a CMap. Codes in the range have len(low) bytes and each byte
+// is between the corresponding bytes of `low` and `high`.
+type codespace struct {
+	low, high []byte
+}
+
+// identityCodespaces are the codespace ranges of the Identity-H and Identity-V CMaps. They are
+// used for CID fonts whose codespace ranges can't be found.
+var identityCodespaces = []codespace{{low: []byte{0x00, 0x00}, high: []byte{0xff, 0xff}}}
+
+// reSubset matches the tag at the start of subset font names.
+var reSubset = regexp.MustCompile(`^[A-Z]{6}\+`)
+
+// getFontCodec returns the fontCodec for the font called `name` in `resources`. `fonts` caches
+// fontCodecs so that the character codes seen in one text block can be reused in others.
+func getFontCodec(fonts map[string]*fontCodec, resources *model.PdfPageResources,
+	name string) (*fontCodec, error) {
+	if fc, ok := fonts[name]; ok {
+		return fc, nil
+	}
+	if resources == nil {
+		return nil, fmt.Errorf("no resources for font %q", name)
+	}
+	fontObj, ok := resources.GetFontByName(core.PdfObjectName(name))
+	if !ok {
+		return nil, fmt.Errorf("font %q not in page resources", name)
+	}
+	font, err := model.NewPdfFontFromPdfObject(fontObj)
+	if err != nil {
+		return nil, fmt.Errorf("could not load font %q. err=%v", name, err)
+	}
+	fc := &fontCodec{
+		name:         name,
+		font:         font,
+		subset:       reSubset.MatchString(font.BaseFont()),
+		hasToUnicode: font.ToUnicode() != "",
+		codes:        map[string][]byte{},
+	}
+	fc.learnToUnicode(fontObj)
+	if font.IsCID() {
+		fc.codespaces = cidCodespaces(fontObj)
+	} else {
+		fc.learnSimpleCodes()
+	}
+	fonts[name] = fc
+	return fc, nil
+}
 
-	replaceFunc := func(objptr *core.PdfObject) {
-		strobj, ok := core.GetString(*objptr)
+// decode splits `data` into character codes and returns the glyphs for them.
+func (fc *fontCodec) decode(data []byte) []textGlyph {
+	var glyphs []textGlyph
+	for i := 0; i < len(data); {
+		j := i + fc.codeLen(data[i:])
+		if j > len(data) {
+			j = len(data)
+		}
+		code := data[i:j]
+		i = j
+		text, _, _ := fc.font.CharcodeBytesToUnicode(code)
+		// Codes that are shown on the page are guaranteed to have glyphs in the font.
+		if text != string(missingCodeRune) {
+			fc.learn(code, text, true)
+		}
+		glyphs = append(glyphs, textGlyph{code: code, text: text})
+	}
+	return glyphs
+}
+
+// codeLen returns the number of bytes in the character code at the start of `data`. For CID fonts
+// this is the length of the codespace range the code is in. If there is no such range, it is the
+// length of the shortest range that contains the first byte, or of the shortest range if none do,
+// as PDF viewers do.
+func (fc *fontCodec) codeLen(data []byte) int {
+	if !fc.font.IsCID() {
+		return 1
+	}
+	for _, cs := range fc.codespaces {
+		if n := len(cs.low); n <= len(data) && cs.contains(data[:n]) {
+			return n
+		}
+	}
+	for _, cs := range fc.codespaces {
+		if data[0] >= cs.low[0] && data[0] <= cs.high[0] {
+			return len(cs.low)
+		}
+	}
+	return len(fc.codespaces[0].low)
+}
+
+// contains returns true if character code `code` is in `cs`.
+func (cs codespace) contains(code []byte) bool {
+	if len(code) != len(cs.low) {
+		return false
+	}
+	for i, b := range code {
+		if b < cs.low[i] || b > cs.high[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// encode returns the character code bytes for `text` in font `fc`. It returns an error if the font
+// has no glyph for some character in `text`.
+func (fc *fontCodec) encode(text string) ([]byte, error) {
+	runes := []rune(text)
+	var data []byte
+	for i := 0; i < len(runes); {
+		found := false
+		// Prefer the longest mapping so that ligatures are reused.
+		for n := fc.maxCodeRunes; n >= 1; n-- {
+			if i+n > len(runes) {
+				continue
+			}
+			if code, ok := fc.codes[string(runes[i:i+n])]; ok {
+				data = append(data, code...)
+				i += n
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		code, ok := fc.encodeRune(runes[i])
 		if !ok {
-			common.Log.Debug("Invalid parameter, skipping")
-			return
+			if fc.subset {
+				return nil, fmt.Errorf("subset font %q (%s) has no glyph for %q in %q",
+					fc.name, fc.font.BaseFont(), runes[i], text)
+			}
+			return nil, fmt.Errorf("font %q (%s) has no glyph for %q in %q",
+				fc.name, fc.font.BaseFont(), runes[i], text)
 		}
+		data = append(data, code...)
+		i++
+	}
+	return data, nil
+}
 
-		if strings.Contains(strobj.String(), searchText) {
-			s := strings.Replace(strobj.String(), searchText, replaceText, -1)
-			*strobj = *core.MakeString(s)
+// encodeRune returns the character code bytes for `r` from the font's encoding. This is only
+// used for fonts without ToUnicode CMaps as, for those with them, the encoding may not match the
+// text the codes represent.
+func (fc *fontCodec) encodeRune(r rune) ([]byte, bool) {
+	if fc.hasToUnicode {
+		return nil, false
+	}
+	encoder := fc.font.Encoder()
+	if encoder == nil {
+		return nil, false
+	}
+	code, ok := encoder.RuneToCharcode(r)
+	if !ok {
+		return nil, false
+	}
+	if fc.font.IsCID() {
+		// There is no way of telling which CIDs are present in a subset font without a ToUnicode
+		// map.
+		if fc.subset {
+			return nil, false
+		}
+		for _, cs := range fc.codespaces {
+			if data := valBytes(int(code), len(cs.low)); bytesVal(data) == int(code) && cs.contains(data) {
+				return data, true
+			}
 		}
+		return nil, false
 	}
+	if uint16(code) > 0xff {
+		return nil, false
+	}
+	if fc.subset {
+		if m, ok := fc.font.GetCharMetrics(code); !ok || m.Wx == 0 {
+			return nil, false
+		}
+	}
+	return []byte{byte(code)}, true
+}
 
-	processor := contentstream.NewContentStreamProcessor(*ops)
-	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
-		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState, resources *model.PdfPageResources) error {
-			switch op.Operand {
-			case `Tj`, `'`:
-				if len(op.Params) != 1 {
-					common.Log.Debug("Invalid: Tj/' with invalid set of parameters - skip")
-					return nil
-				}
-				replaceFunc(&op.Params[0])
-			case `''`:
-				if len(op.Params) != 3 {
-					common.Log.Debug("Invalid: '' with invalid set of parameters - skip")
-					return nil
+// makeString returns a PDF string object for the character codes `data`. Strings in CID fonts are
+// written in hex as they are typically not printable.
+func (fc *fontCodec) makeString(data []byte) *core.PdfObjectString {
+	if fc.font.IsCID() {
+		return core.MakeHexString(string(data))
+	}
+	return core.MakeStringFromBytes(data)
+}
+
+// learn records that character code `code` decodes to `text`. If `override` is true then this
+// mapping takes precedence over any existing mapping for `text`.
+func (fc *fontCodec) learn(code []byte, text string, override bool) {
+	if text == "" {
+		return
+	}
+	if _, ok := fc.codes[text]; ok && !override {
+		return
+	}
+	fc.codes[text] = append([]byte(nil), code...)
+	if n := len([]rune(text)); n > fc.maxCodeRunes {
+		fc.maxCodeRunes = n
+	}
+}
+
+// learnSimpleCodes records the text of all the single byte character codes in a simple font. For
+// subset fonts, only codes with glyphs are recorded.
+func (fc *fontCodec) learnSimpleCodes() {
+	for c := 0; c <= 0xff; c++ {
+		code := []byte{byte(c)}
+		text, _, numMisses := fc.font.CharcodeBytesToUnicode(code)
+		if numMisses > 0 || text == string(missingCodeRune) {
+			continue
+		}
+		if fc.subset {
+			charcodes := fc.font.BytesToCharcodes(code)
+			if m, ok := fc.font.GetCharMetrics(charcodes[0]); !ok || m.Wx == 0 {
+				continue
+			}
+		}
+		fc.learn(code, text, false)
+	}
+}
+
+var (
+	reCodespace = regexp.MustCompile(`(?s)begincodespacerange(.*?)endcodespacerange`)
+	reBfChar    = regexp.MustCompile(`(?s)beginbfchar(.*?)endbfchar`)
+	reBfRange   = regexp.MustCompile(`(?s)beginbfrange(.*?)endbfrange`)
+	reCMapTok   = regexp.MustCompile(`<[0-9A-Fa-f\s]*>|\[|\]`)
+)
+
+// learnToUnicode records the character code → text mappings in the ToUnicode CMap of the font
+// dictionary `fontObj`. The mappings in ToUnicode CMaps of subset fonts are for the glyphs in the
+// subset.
+func (fc *fontCodec) learnToUnicode(fontObj core.PdfObject) {
+	dict, ok := core.GetDict(core.TraceToDirectObject(fontObj))
+	if !ok {
+		return
+	}
+	stream, ok := core.GetStream(dict.Get("ToUnicode"))
+	if !ok {
+		return
+	}
+	data, err := core.DecodeStream(stream)
+	if err != nil {
+		common.Log.Debug("Could not decode ToUnicode of font %q. err=%v", fc.name, err)
+		return
+	}
+	cmap := string(data)
+
+	for _, m := range reBfChar.FindAllStringSubmatch(cmap, -1) {
+		toks := reCMapTok.FindAllString(m[1], -1)
+		for i := 0; i+1 < len(toks); i += 2 {
+			fc.learn(hexBytes(toks[i]), utf16Text(hexBytes(toks[i+1])), false)
+		}
+	}
+
+	for _, m := range reBfRange.FindAllStringSubmatch(cmap, -1) {
+		toks := reCMapTok.FindAllString(m[1], -1)
+		for i := 0; i+2 < len(toks); {
+			lo, hi := hexBytes(toks[i]), hexBytes(toks[i+1])
+			loVal, hiVal := bytesVal(lo), bytesVal(hi)
+			if toks[i+2] == "[" {
+				// <lo> <hi> [<dst0> <dst1> ...]
+				j := i + 3
+				for code := loVal; j < len(toks) && toks[j] != "]"; j++ {
+					fc.learn(valBytes(code, len(lo)), utf16Text(hexBytes(toks[j])), false)
+					code++
 				}
-				replaceFunc(&op.Params[3])
-			case `TJ`:
-				if len(op.Params) != 1 {
-					common.Log.Debug("Invalid: TJ with invalid set of parameters - skip")
-					return nil
+				i = j + 1
+				continue
+			}
+			// <lo> <hi> <dst>: The last byte of dst is incremented for each code.
+			dst := hexBytes(toks[i+2])
+			if len(dst) > 0 && hiVal >= loVal && hiVal-loVal <= 0xffff {
+				for code := loVal; code <= hiVal; code++ {
+					d := append([]byte(nil), dst...)
+					d[len(d)-1] += byte(code - loVal)
+					fc.learn(valBytes(code, len(lo)), utf16Text(d), false)
 				}
-				arr, _ := core.GetArray(op.Params[0])
-				for i := range arr.Elements() {
-					obj := arr.Get(i)
-					replaceFunc(&obj)
-					arr.Set(i, obj)
+			}
+			i += 3
+		}
+	}
+}
+
+// cidCodespaces returns the codespace ranges of the encoding CMap of the CID font dictionary
+// `fontObj`, sorted by code length. The predefined CMaps other than Identity-H and Identity-V are
+// not embedded, so for them the ranges in the font's ToUnicode CMap, which are normally the same,
+// are used.
+func cidCodespaces(fontObj core.PdfObject) []codespace {
+	dict, ok := core.GetDict(core.TraceToDirectObject(fontObj))
+	if !ok {
+		return identityCodespaces
+	}
+	var codespaces []codespace
+	for _, key := range []core.PdfObjectName{"Encoding", "ToUnicode"} {
+		stream, ok := core.GetStream(dict.Get(key))
+		if !ok {
+			if name, ok := core.GetNameVal(dict.Get(key)); ok && strings.HasPrefix(name, "Identity-") {
+				return identityCodespaces
+			}
+			continue
+		}
+		data, err := core.DecodeStream(stream)
+		if err != nil {
+			common.Log.Debug("Could not decode %s CMap. err=%v", key, err)
+			continue
+		}
+		for _, m := range reCodespace.FindAllStringSubmatch(string(data), -1) {
+			toks := reCMapTok.FindAllString(m[1], -1)
+			for i := 0; i+1 < len(toks); i += 2 {
+				low, high := hexBytes(toks[i]), hexBytes(toks[i+1])
+				if len(low) == 0 || len(low) != len(high) {
+					continue
 				}
+				codespaces = append(codespaces, codespace{low: low, high: high})
 			}
+		}
+		if len(codespaces) > 0 {
+			break
+		}
+	}
+	if len(codespaces) == 0 {
+		return identityCodespaces
+	}
+	sort.SliceStable(codespaces, func(i, j int) bool {
+		return len(codespaces[i].low) < len(codespaces[j].low)
+	})
+	return codespaces
+}
 
-			return nil
-		})
+// hexBytes returns the bytes in CMap hex string token `tok` (e.g. "<00 41>").
+func hexBytes(tok string) []byte {
+	tok = strings.Trim(tok, "<>")
+	tok = strings.Join(strings.Fields(tok), "")
+	var data []byte
+	for i := 0; i+1 < len(tok); i += 2 {
+		var b byte
+		fmt.Sscanf(tok[i:i+2], "%02x", &b)
+		data = append(data, b)
+	}
+	return data
+}
 
-	err = processor.Process(page.Resources)
-	if err != nil {
-		return err
+// utf16Text returns the text for UTF-16BE bytes `data`.
+func utf16Text(data []byte) string {
+	var units []uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// bytesVal returns the big-endian value of `data`.
+func bytesVal(data []byte) int {
+	v := 0
+	for _, b := range data {
+		v = v<<8 | int(b)
 	}
+	return v
+}
 
-	return page.SetContentStreams([]string{ops.String()}, core.NewFlateEncoder())
+// valBytes returns `v` as `n` big-endian bytes.
+func valBytes(v, n int) []byte {
+	data := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		data[i] = byte(v)
+		v >>= 8
+	}
+	return data
+}
+
+// makeUsage updates flag.Usage to include usage message `msg`.
+func makeUsage(msg string) {
+	usage := flag.Usage
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+	}
 }
@@ -1,26 +1,47 @@
 /*
  * Markup PDF text: Mark up locations of substrings of extracted text in a PDF file.
  *
- * Run as: go run pdf_text_locations.go file.pdf term
+ * By default the locations are marked by drawing boxes on the pages. With -a the locations are marked
+ * with text markup annotations (highlight, underline, squiggly or strikeout) that can be shown, hidden
+ * and deleted in PDF viewers. Matches that wrap across lines are marked on each line.
+ *
+ * Matching is exact by default. -i, -nodiacritics, -w, -lig and -hyph make it case-insensitive,
+ * diacritic-insensitive, whole-word only, expand ligatures and match words hyphenated across lines.
+ *
+ * Many terms can be searched for at once with -terms terms.txt. Each term is marked in its own color
+ * and -report writes every hit with its page, bounding box and surrounding text to a CSV or JSON file.
+ *
+ * Run as: go run pdf_text_locations.go [-i] [-w] [-a highlight] [-author name] [-comment text] file.pdf term
+ *     or: go run pdf_text_locations.go -terms terms.txt [-report hits.csv] file.pdf
  */
 
 package main
 
 import (
+	"bufio"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/unidoc/unipdf/v3/common"
+	"github.com/unidoc/unipdf/v3/core"
 	"github.com/unidoc/unipdf/v3/creator"
 	"github.com/unidoc/unipdf/v3/extractor"
 	pdf "github.com/unidoc/unipdf/v3/model"
+	"golang.org/x/text/unicode/norm"
 )
 
 const (
@@ -29,14 +50,49 @@ const (
 	markupDir = "marked.up"
 
 	usage = `
-	Usage: go run pdf_text_locations.go file.pdf term
+	Usage: go run pdf_text_locations.go [options] file.pdf term
+	   or: go run pdf_text_locations.go [options] -terms terms.txt file.pdf
 
-	Finds all instances of term in file.pdf
+	Finds all instances of term, or of the terms in terms.txt, in file.pdf
 	Saves marked-up PDF to marked.up/file.pdf
 	Saves bounding box coordinates to marked.up/file.json
+
+	terms.txt has one term per line, optionally followed by a tab and a #rrggbb color.
+	Terms starting with re: are regular expressions. Blank lines and lines starting with # are ignored.
 `
 )
 
+// termColors are the colors given to terms in a terms file that don't specify a color.
+var termColors = []string{
+	"#ffff00", "#00ffff", "#ff00ff", "#00ff00", "#ffa500", "#87cefa", "#ff69b4", "#adff2f",
+	"#ffd700", "#40e0d0", "#da70d6", "#f08080",
+}
+
+// searchTerm is a term to search for. If `re` is not nil the term is a regular expression.
+// `color` is the color the term's matches are marked with. "" for the default color.
+type searchTerm struct {
+	term  string
+	re    *regexp.Regexp
+	color string
+}
+
+// matchOptions describes how the search term is matched against the extracted text.
+type matchOptions struct {
+	ignoreCase       bool // Case-insensitive matching.
+	ignoreDiacritics bool // NFKD normalize and strip accents before matching.
+	wholeWord        bool // Only match whole words.
+	ligatures        bool // Expand ligatures such as ﬁ to fi before matching.
+	hyphenation      bool // Match words hyphenated across line breaks.
+}
+
+// annotOptions describes the text markup annotations that mark matches.
+type annotOptions struct {
+	kind    string // highlight, underline, squiggly or strikeout. "" to draw boxes instead.
+	author  string // Annotation author.
+	comment string // Annotation comment. "" for the matched term.
+	color   string // Annotation color #rrggbb. "" for the default color of `kind`.
+}
+
 func main() {
 	// Make sure to enter a valid license key.
 	// Otherwise text is truncated and a watermark added to the text.
@@ -49,12 +105,30 @@ func main() {
 		`)
 	*/
 	var debug bool
+	var opt annotOptions
+	var mopt matchOptions
+	var termsPath, reportPath string
+	var isRegex bool
+	var contextSize int
 	flag.BoolVar(&debug, "d", false, "Enable debug logging")
+	flag.StringVar(&termsPath, "terms", "", "File of terms to search for.")
+	flag.BoolVar(&isRegex, "r", false, "term is a regular expression.")
+	flag.StringVar(&reportPath, "report", "", "Write a report of all hits to this .csv or .json file.")
+	flag.IntVar(&contextSize, "context", 40, "Number of characters of context around hits in the report.")
+	flag.BoolVar(&mopt.ignoreCase, "i", false, "Case-insensitive matching.")
+	flag.BoolVar(&mopt.ignoreDiacritics, "nodiacritics", false, "Ignore diacritics (accents) when matching.")
+	flag.BoolVar(&mopt.wholeWord, "w", false, "Only match whole words.")
+	flag.BoolVar(&mopt.ligatures, "lig", false, "Expand ligatures (e.g. ﬁ to fi) when matching.")
+	flag.BoolVar(&mopt.hyphenation, "hyph", false, "Match words hyphenated across line breaks.")
+	flag.StringVar(&opt.kind, "a", "", "Mark matches with annotations: highlight/underline/squiggly/strikeout.")
+	flag.StringVar(&opt.author, "author", "", "Annotation author.")
+	flag.StringVar(&opt.comment, "comment", "", "Annotation comment. Default: the search term.")
+	flag.StringVar(&opt.color, "color", "", "Annotation color (#rrggbb). Default: yellow for highlights, red otherwise.")
 	makeUsage(usage)
 	flag.Parse()
 	args := flag.Args()
-	if len(args) < 2 {
-		fmt.Fprintln(os.Stderr, usage)
+	if len(args) < 2 && !(termsPath != "" && len(args) == 1) {
+		fmt.Fprint(os.Stderr, usage)
 		os.Exit(1)
 	}
 	if debug {
@@ -64,55 +138,162 @@ func main() {
 	}
 
 	inPath := args[0]
-	term := args[1]
+	var terms []searchTerm
+	if termsPath != "" {
+		var err error
+		terms, err = readTerms(termsPath, mopt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "readTerms failed. termsPath=%q err=%v\n", termsPath, err)
+			os.Exit(1)
+		}
+	}
+	if len(args) > 1 {
+		t, err := makeSearchTerm(args[1], isRegex, mopt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bad term %q. err=%v\n", args[1], err)
+			os.Exit(1)
+		}
+		terms = append(terms, t)
+	}
+	if len(terms) == 0 {
+		fmt.Fprintf(os.Stderr, "No terms to search for\n")
+		os.Exit(1)
+	}
 
-	err := markTextLocations(inPath, term)
+	switch opt.kind {
+	case "", "highlight", "underline", "squiggly", "strikeout":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown annotation type %q\n", opt.kind)
+		os.Exit(1)
+	}
+
+	l, err := markTextLocations(inPath, terms, mopt, opt, contextSize)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "TextLocations failed. inPath=%q term=%q err=%v\n",
-			inPath, term, err)
+		fmt.Fprintf(os.Stderr, "TextLocations failed. inPath=%q terms=%d err=%v\n",
+			inPath, len(terms), err)
+		os.Exit(1)
+	}
+	if reportPath != "" {
+		if err := l.writeReport(reportPath); err != nil {
+			fmt.Fprintf(os.Stderr, "writeReport failed. reportPath=%q err=%v\n", reportPath, err)
+			os.Exit(1)
+		}
 	}
 }
 
-// markTextLocations finds all instances of `term` in the text extracted from PDF file `inPath` and
-// saves a PDF file marked-up with boxes around the instances of `term` and a JSON file with the
-//  box coordinates.
-func markTextLocations(inPath, term string) error {
+// readTerms returns the search terms in terms file `termsPath`. Each line is a term optionally
+// followed by a tab and a color. Terms starting with "re:" are regular expressions. Blank lines and
+// lines starting with "#" are skipped. Terms without a color get one from `termColors`.
+func readTerms(termsPath string, mopt matchOptions) ([]searchTerm, error) {
+	f, err := os.Open(termsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var terms []searchTerm
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 2)
+		term := parts[0]
+		isRegex := strings.HasPrefix(term, "re:")
+		if isRegex {
+			term = term[len("re:"):]
+		}
+		t, err := makeSearchTerm(term, isRegex, mopt)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if len(parts) > 1 {
+			t.color = strings.TrimSpace(parts[1])
+			if _, _, _, err := parseColor(t.color); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+		} else {
+			t.color = termColors[len(terms)%len(termColors)]
+		}
+		terms = append(terms, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+// makeSearchTerm returns a searchTerm for `term`, which is a regular expression if `isRegex` is true.
+// Regular expressions are matched against the text after it has been transformed as described by
+// `mopt`, so they are made case-insensitive if `mopt.ignoreCase` is true.
+func makeSearchTerm(term string, isRegex bool, mopt matchOptions) (searchTerm, error) {
+	t := searchTerm{term: term}
+	if !isRegex {
+		if term == "" {
+			return t, fmt.Errorf("empty term")
+		}
+		return t, nil
+	}
+	expr := term
+	if mopt.ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return t, err
+	}
+	t.re = re
+	return t, nil
+}
+
+// markTextLocations finds all instances of `terms` in the text extracted from PDF file `inPath`,
+// matched as described by `mopt`, and saves a PDF file marked-up with boxes or annotations `opt`
+// around the instances of `terms` and a JSON file with the box coordinates. The matches include
+// `contextSize` characters of text on either side of them.
+func markTextLocations(inPath string, terms []searchTerm, mopt matchOptions, opt annotOptions,
+	contextSize int) (*markupList, error) {
 	f, err := os.Open(inPath)
 	if err != nil {
-		return fmt.Errorf("Could not open %q err=%v", inPath, err)
+		return nil, fmt.Errorf("Could not open %q err=%v", inPath, err)
 	}
 	defer f.Close()
-	common.Log.Info("Searching %q for %q", inPath, term)
+	if len(terms) == 1 {
+		common.Log.Info("Searching %q for %q", inPath, terms[0].term)
+	} else {
+		common.Log.Info("Searching %q for %d terms", inPath, len(terms))
+	}
 	pdfReader, err := pdf.NewPdfReaderLazy(f)
 	if err != nil {
-		return fmt.Errorf("NewPdfReaderLazy failed. %q err=%v", inPath, err)
+		return nil, fmt.Errorf("NewPdfReaderLazy failed. %q err=%v", inPath, err)
 	}
 	numPages, err := pdfReader.GetNumPages()
 	if err != nil {
-		return fmt.Errorf("GetNumPages failed. %q err=%v", inPath, err)
+		return nil, fmt.Errorf("GetNumPages failed. %q err=%v", inPath, err)
 	}
 	l := createMarkupList(inPath, pdfReader)
+	l.annot = opt
 
 	for pageNum := 1; pageNum <= numPages; pageNum++ {
 		page, err := pdfReader.GetPage(pageNum)
 		if err != nil {
-			return fmt.Errorf("GetNumPages failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+			return nil, fmt.Errorf("GetNumPages failed. %q pageNum=%d err=%v", inPath, pageNum, err)
 		}
 		ex, err := extractor.New(page)
 		if err != nil {
-			return fmt.Errorf("NewPdfReaderLazy failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+			return nil, fmt.Errorf("NewPdfReaderLazy failed. %q pageNum=%d err=%v", inPath, pageNum, err)
 		}
 		pageText, _, _, err := ex.ExtractPageText()
 		if err != nil {
-			return fmt.Errorf("ExtractPageText failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+			return nil, fmt.Errorf("ExtractPageText failed. %q pageNum=%d err=%v", inPath, pageNum, err)
 
 		}
 		text := pageText.Text()
 		textMarks := pageText.Marks()
 		common.Log.Debug("pageNum=%d text=%d textMarks=%d", pageNum, len(text), textMarks.Len())
-		matches, err := getMatches(text, textMarks, term)
+		matches, err := getMatches(text, textMarks, terms, mopt, contextSize)
 		if err != nil {
-			return fmt.Errorf("getMatches failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+			return nil, fmt.Errorf("getMatches failed. %q pageNum=%d err=%v", inPath, pageNum, err)
 		}
 		if matches != nil {
 			l.pageMatches[pageNum] = matches
@@ -120,39 +301,222 @@ func markTextLocations(inPath, term string) error {
 	}
 	err = l.saveOutputPdf()
 	if err != nil {
-		return fmt.Errorf("saveOutputPdf failed. %q  err=%v", inPath, err)
+		return nil, fmt.Errorf("saveOutputPdf failed. %q  err=%v", inPath, err)
 	}
-	return nil
+	return l, nil
 }
 
 // getMatches returns the matches (bounding box + offset) on the PDF page described by `textMarks`
-// that correspond to/ all the instances of `term` in `text`, where `text` and `textMarks` are the
+// that correspond to/ all the instances of `terms` in `text`, where `text` and `textMarks` are the
 // extracted text returned by text := pageText.Text and textMarks := pageText.Marks().
-func getMatches(text string, textMarks *extractor.TextMarkArray, term string) ([]match, error) {
-	indexes := indexAll(text, term)
-	if len(indexes) == 0 {
-		return nil, nil
-	}
-	matches := make([]match, len(indexes))
-	for i, start := range indexes {
-		end := start + len(term)
-		spanMarks, err := textMarks.RangeOffset(start, end)
-		if err != nil {
-			return nil, err
+// `opt` describes how `terms` are matched. The matches are sorted by offset and include
+// `contextSize` characters of `text` on either side of them.
+func getMatches(text string, textMarks *extractor.TextMarkArray, terms []searchTerm,
+	opt matchOptions, contextSize int) ([]match, error) {
+	normText, starts, ends := normalizeText(text, opt, true)
+	var matches []match
+	for _, t := range terms {
+		var spans [][2]int
+		if t.re != nil {
+			for _, loc := range t.re.FindAllStringIndex(normText, -1) {
+				if loc[1] > loc[0] {
+					spans = append(spans, [2]int{loc[0], loc[1]})
+				}
+			}
+		} else {
+			normTerm, _, _ := normalizeText(t.term, opt, false)
+			for _, i := range indexAll(normText, normTerm) {
+				spans = append(spans, [2]int{i, i + len(normTerm)})
+			}
 		}
-		bbox, ok := spanMarks.BBox()
-		if !ok {
-			return nil, fmt.Errorf("spanMarks.BBox has no bounding box. spanMarks=%s", spanMarks)
+		if opt.wholeWord {
+			spans = wholeWords(normText, spans)
 		}
-		matches[i] = match{
-			Term:        term,
-			OffsetRange: [2]int{start, end},
-			BBox:        bbox,
+		for _, span := range spans {
+			// Map the match in the normalized text back to the offsets in the extracted text.
+			start, end := starts[span[0]], ends[span[1]-1]
+			spanMarks, err := textMarks.RangeOffset(start, end)
+			if err != nil {
+				return nil, err
+			}
+			bbox, ok := spanMarks.BBox()
+			if !ok {
+				return nil, fmt.Errorf("spanMarks.BBox has no bounding box. spanMarks=%s", spanMarks)
+			}
+			matches = append(matches, match{
+				Term:        t.term,
+				Text:        text[start:end],
+				Context:     textContext(text, start, end, contextSize),
+				Color:       t.color,
+				OffsetRange: [2]int{start, end},
+				BBox:        bbox,
+				Lines:       lineBBoxes(spanMarks),
+			})
 		}
 	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].OffsetRange[0] < matches[j].OffsetRange[0]
+	})
 	return matches, nil
 }
 
+// textContext returns the text in `text` from `n` characters before offset `start` to `n` characters
+// after offset `end` with runs of whitespace replaced by single spaces.
+func textContext(text string, start, end, n int) string {
+	for i := 0; i < n && start > 0; i++ {
+		_, size := utf8.DecodeLastRuneInString(text[:start])
+		start -= size
+	}
+	for i := 0; i < n && end < len(text); i++ {
+		_, size := utf8.DecodeRuneInString(text[end:])
+		end += size
+	}
+	return strings.Join(strings.Fields(text[start:end]), " ")
+}
+
+// lineBBoxes returns the bounding boxes of the parts of `spanMarks` on each line of text they span.
+// A new line starts when a mark's baseline moves by more than half its height or it moves back to
+// the left.
+func lineBBoxes(spanMarks *extractor.TextMarkArray) []pdf.PdfRectangle {
+	var lines []pdf.PdfRectangle
+	for _, mark := range spanMarks.Elements() {
+		if mark.Meta || strings.TrimSpace(mark.Text) == "" {
+			continue
+		}
+		r := mark.BBox
+		if len(lines) > 0 {
+			last := &lines[len(lines)-1]
+			tol := 0.5 * (r.Ury - r.Lly)
+			if math.Abs(r.Lly-last.Lly) <= tol && r.Llx >= last.Urx-tol {
+				last.Llx, last.Lly = math.Min(last.Llx, r.Llx), math.Min(last.Lly, r.Lly)
+				last.Urx, last.Ury = math.Max(last.Urx, r.Urx), math.Max(last.Ury, r.Ury)
+				continue
+			}
+		}
+		lines = append(lines, r)
+	}
+	return lines
+}
+
+// ligatureExpansions are the expansions of the Unicode Latin ligatures.
+var ligatureExpansions = map[rune]string{
+	'ﬀ': "ff",
+	'ﬁ': "fi",
+	'ﬂ': "fl",
+	'ﬃ': "ffi",
+	'ﬄ': "ffl",
+	'ﬅ': "st",
+	'ﬆ': "st",
+	'Ĳ': "IJ",
+	'ĳ': "ij",
+	'Œ': "OE",
+	'œ': "oe",
+	'Æ': "AE",
+	'æ': "ae",
+}
+
+// normalizeText returns `text` transformed as described by `opt` so that it can be searched, along
+// with the byte offsets in `text` of the start and end of the rune that each byte of the returned
+// text came from. Hyphens at line ends are only removed if `isPage` is true, as search terms don't
+// contain line breaks.
+func normalizeText(text string, opt matchOptions, isPage bool) (string, []int, []int) {
+	var b strings.Builder
+	var starts, ends []int
+	emit := func(s string, start, end int) {
+		b.WriteString(s)
+		for i := 0; i < len(s); i++ {
+			starts = append(starts, start)
+			ends = append(ends, end)
+		}
+	}
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		start, end := i, i+size
+		i = end
+		if opt.hyphenation {
+			if r == '\u00ad' { // Soft hyphen.
+				continue
+			}
+			if isPage && isHyphen(r) {
+				if n := hyphenBreak(text, start, end); n > 0 {
+					// Skip the hyphen and the line break, joining the two parts of the word.
+					i = end + n
+					continue
+				}
+			}
+		}
+		s := string(r)
+		if opt.ligatures {
+			if exp, ok := ligatureExpansions[r]; ok {
+				s = exp
+			}
+		}
+		if opt.ignoreDiacritics {
+			var stripped []rune
+			for _, c := range norm.NFKD.String(s) {
+				if !unicode.Is(unicode.Mn, c) {
+					stripped = append(stripped, c)
+				}
+			}
+			s = string(stripped)
+		}
+		if opt.ignoreCase {
+			s = strings.ToLower(s)
+		}
+		emit(s, start, end)
+	}
+	return b.String(), starts, ends
+}
+
+// isHyphen returns true if `r` is a hyphen that can end a line in a hyphenated word.
+func isHyphen(r rune) bool {
+	return r == '-' || r == '\u2010' || r == '\u2011'
+}
+
+// hyphenBreak returns the number of bytes of whitespace containing a line break at offset `i` in
+// `text` if the hyphen at offset `h` follows a letter and the text after the line break starts with a
+// lowercase letter, which is how a word hyphenated across lines looks. Otherwise it returns 0.
+func hyphenBreak(text string, h, i int) int {
+	j := i
+	newline := false
+	for j < len(text) {
+		r, size := utf8.DecodeRuneInString(text[j:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		newline = newline || r == '\n'
+		j += size
+	}
+	if !newline || j == len(text) {
+		return 0
+	}
+	prev, _ := utf8.DecodeLastRuneInString(text[:h])
+	next, _ := utf8.DecodeRuneInString(text[j:])
+	if !unicode.IsLetter(prev) || !unicode.IsLower(next) {
+		return 0
+	}
+	return j - i
+}
+
+// wholeWords returns the elements of `spans`, the start and end offsets of matches in `text`, that
+// are whole words.
+func wholeWords(text string, spans [][2]int) [][2]int {
+	isWordRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+	}
+	var words [][2]int
+	for _, span := range spans {
+		start, end := span[0], span[1]
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if start > 0 && isWordRune(before) || end < len(text) && isWordRune(after) {
+			continue
+		}
+		words = append(words, span)
+	}
+	return words
+}
+
 // indexAll returns the indices of all instances of `term` in `text`
 func indexAll(text, term string) []int {
 	if len(term) == 0 {
@@ -179,19 +543,26 @@ type markupList struct {
 	pageMatches map[int][]match // {pageNum: matches on page}
 	pdfReader   *pdf.PdfReader  // Reader for input PDF
 	pageNum     int             // (1-offset) Page number being worked on.
+	annot       annotOptions    // Annotations to mark matches with.
 }
 
-// match is a match of search term `Term` on a page. `BBox` is the bounding box around the matched
-// term on the PDF page
+// match is a match of search term `Term` on a page. `Text` is the matched text, which may differ from
+// `Term` when matching is case-insensitive etc, and `Context` is the text around it. `Color` is the
+// color the match is marked with. `BBox` is the bounding box around the matched term on the PDF page
+// and `Lines` are the bounding boxes of the parts of the match on each line.
 type match struct {
 	Term        string
+	Text        string
+	Context     string
+	Color       string `json:",omitempty"`
 	BBox        pdf.PdfRectangle
+	Lines       []pdf.PdfRectangle
 	OffsetRange [2]int
 }
 
 // String returns a description of `l`.
 func (l markupList) String() string {
-	return fmt.Sprintf("Term found on %d pages with input page numbers %v",
+	return fmt.Sprintf("Terms found on %d pages with input page numbers %v",
 		len(l.pageMatches), l.pageNums())
 }
 
@@ -235,7 +606,20 @@ func (l *markupList) saveOutputPdf() error {
 	// Make a new PDF creator.
 	c := creator.New()
 
-	for _, pageNum := range l.pageNums() {
+	// Boxes are drawn on the pages with matches. Annotations are added to the whole document.
+	pageNums := l.pageNums()
+	if l.annot.kind != "" {
+		numPages, err := l.pdfReader.GetNumPages()
+		if err != nil {
+			return err
+		}
+		pageNums = nil
+		for pageNum := 1; pageNum <= numPages; pageNum++ {
+			pageNums = append(pageNums, pageNum)
+		}
+	}
+
+	for _, pageNum := range pageNums {
 		common.Log.Debug("saveOutputPdf: %q pageNum=%d", l.inPath, pageNum)
 		page, err := l.pdfReader.GetPage(pageNum)
 		if err != nil {
@@ -252,6 +636,21 @@ func (l *markupList) saveOutputPdf() error {
 		}
 		h := mediaBox.Ury
 
+		if l.annot.kind != "" {
+			for _, m := range l.pageMatches[pageNum] {
+				annotation, err := makeMarkupAnnotation(m, l.annot)
+				if err != nil {
+					return fmt.Errorf("makeMarkupAnnotation failed. pageNum=%d match=%v err=%v",
+						pageNum, m, err)
+				}
+				page.AddAnnotation(annotation)
+			}
+			if err := c.AddPage(page); err != nil {
+				return fmt.Errorf("AddPage failed %s:%d err=%v ", l.String(), pageNum, err)
+			}
+			continue
+		}
+
 		if err := c.AddPage(page); err != nil {
 			return fmt.Errorf("AddPage failed %s:%d err=%v ", l.String(), pageNum, err)
 		}
@@ -259,7 +658,11 @@ func (l *markupList) saveOutputPdf() error {
 		for _, m := range l.pageMatches[pageNum] {
 			r := m.BBox
 			rect := c.NewRectangle(r.Llx, h-r.Lly, r.Urx-r.Llx, -(r.Ury - r.Lly))
-			rect.SetBorderColor(creator.ColorRGBFromHex("#0000ff")) // Blue border.
+			color := "#0000ff" // Blue border.
+			if m.Color != "" {
+				color = m.Color
+			}
+			rect.SetBorderColor(creator.ColorRGBFromHex(color))
 			rect.SetBorderWidth(1.0)
 			if err := c.Draw(rect); err != nil {
 				return fmt.Errorf("Draw failed. pageNum=%d match=%v err=%v", pageNum, m, err)
@@ -284,6 +687,214 @@ func (l *markupList) saveOutputPdf() error {
 	return nil
 }
 
+// writeReport writes all the matches in `l` to `reportPath` as JSON if it has a .json extension and
+// as CSV otherwise.
+func (l *markupList) writeReport(reportPath string) error {
+	type hit struct {
+		File    string  `json:"file"`
+		Page    int     `json:"page"`
+		Term    string  `json:"term"`
+		Text    string  `json:"text"`
+		Llx     float64 `json:"llx"`
+		Lly     float64 `json:"lly"`
+		Urx     float64 `json:"urx"`
+		Ury     float64 `json:"ury"`
+		Context string  `json:"context"`
+	}
+	hits := []hit{}
+	for _, pageNum := range l.pageNums() {
+		for _, m := range l.pageMatches[pageNum] {
+			hits = append(hits, hit{
+				File:    l.inPath,
+				Page:    pageNum,
+				Term:    m.Term,
+				Text:    m.Text,
+				Llx:     m.BBox.Llx,
+				Lly:     m.BBox.Lly,
+				Urx:     m.BBox.Urx,
+				Ury:     m.BBox.Ury,
+				Context: m.Context,
+			})
+		}
+	}
+
+	if strings.ToLower(filepath.Ext(reportPath)) == ".json" {
+		b, err := json.MarshalIndent(hits, "", "\t")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(reportPath, b, 0666); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Create(reportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w := csv.NewWriter(f)
+		w.Write([]string{"file", "page", "term", "text", "llx", "lly", "urx", "ury", "context"})
+		for _, h := range hits {
+			w.Write([]string{
+				h.File,
+				strconv.Itoa(h.Page),
+				h.Term,
+				h.Text,
+				fmt.Sprintf("%.2f", h.Llx),
+				fmt.Sprintf("%.2f", h.Lly),
+				fmt.Sprintf("%.2f", h.Urx),
+				fmt.Sprintf("%.2f", h.Ury),
+				h.Context,
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+	common.Log.Info("Saved %d hits to %q", len(hits), reportPath)
+	return nil
+}
+
+// makeMarkupAnnotation returns a text markup annotation described by `opt` that covers the lines of
+// match `m`. The annotation has QuadPoints for each line and an appearance stream so that it is
+// shown the same way in all viewers.
+func makeMarkupAnnotation(m match, opt annotOptions) (*pdf.PdfAnnotation, error) {
+	lines := m.Lines
+	if len(lines) == 0 {
+		lines = []pdf.PdfRectangle{m.BBox}
+	}
+	color := m.Color
+	if color == "" {
+		color = opt.color
+	}
+	if color == "" {
+		color = "#ff0000"
+		if opt.kind == "highlight" {
+			color = "#ffff00"
+		}
+	}
+	r, g, b, err := parseColor(color)
+	if err != nil {
+		return nil, err
+	}
+	comment := opt.comment
+	if comment == "" {
+		comment = m.Term
+	}
+
+	// Quadrilaterals are given in the order upper left, upper right, lower left, lower right, which
+	// is the order that viewers use.
+	var quads []float64
+	rect := lines[0]
+	for _, q := range lines {
+		quads = append(quads, q.Llx, q.Ury, q.Urx, q.Ury, q.Llx, q.Lly, q.Urx, q.Lly)
+		rect.Llx, rect.Lly = math.Min(rect.Llx, q.Llx), math.Min(rect.Lly, q.Lly)
+		rect.Urx, rect.Ury = math.Max(rect.Urx, q.Urx), math.Max(rect.Ury, q.Ury)
+	}
+
+	// The appearance stream.
+	var ops []string
+	resources := pdf.NewPdfPageResources()
+	switch opt.kind {
+	case "highlight":
+		// Multiply blending keeps the text under the highlight readable.
+		gs := core.MakeDict()
+		gs.Set("Type", core.MakeName("ExtGState"))
+		gs.Set("BM", core.MakeName("Multiply"))
+		if err := resources.AddExtGState("GSHighlight", gs); err != nil {
+			return nil, err
+		}
+		ops = append(ops, "/GSHighlight gs", fmt.Sprintf("%.3f %.3f %.3f rg", r, g, b))
+		for _, q := range lines {
+			ops = append(ops, fmt.Sprintf("%.2f %.2f %.2f %.2f re f", q.Llx, q.Lly, q.Urx-q.Llx, q.Ury-q.Lly))
+		}
+	default:
+		ops = append(ops, fmt.Sprintf("%.3f %.3f %.3f RG", r, g, b))
+		for _, q := range lines {
+			h := q.Ury - q.Lly
+			width := math.Max(0.5, h/14)
+			ops = append(ops, fmt.Sprintf("%.2f w", width))
+			switch opt.kind {
+			case "underline":
+				y := q.Lly + width/2
+				ops = append(ops, fmt.Sprintf("%.2f %.2f m %.2f %.2f l S", q.Llx, y, q.Urx, y))
+			case "strikeout":
+				y := q.Lly + h*0.4
+				ops = append(ops, fmt.Sprintf("%.2f %.2f m %.2f %.2f l S", q.Llx, y, q.Urx, y))
+			case "squiggly":
+				step := math.Max(1.0, h/6)
+				path := []string{fmt.Sprintf("%.2f %.2f m", q.Llx, q.Lly+step)}
+				for i, x := 1, q.Llx+step; x <= q.Urx; i, x = i+1, x+step {
+					y := q.Lly + step
+					if i%2 == 1 {
+						y = q.Lly
+					}
+					path = append(path, fmt.Sprintf("%.2f %.2f l", x, y))
+				}
+				ops = append(ops, strings.Join(path, " ")+" S")
+			}
+		}
+	}
+	xform := pdf.NewXObjectForm()
+	xform.BBox = core.MakeArrayFromFloats([]float64{rect.Llx, rect.Lly, rect.Urx, rect.Ury})
+	xform.Resources = resources
+	if err := xform.SetContentStream([]byte(strings.Join(ops, "\n")), core.NewFlateEncoder()); err != nil {
+		return nil, err
+	}
+	ap := core.MakeDict()
+	ap.Set("N", xform.ToPdfObject())
+
+	var annotation *pdf.PdfAnnotation
+	var markup *pdf.PdfAnnotationMarkup
+	quadPoints := core.MakeArrayFromFloats(quads)
+	switch opt.kind {
+	case "highlight":
+		a := pdf.NewPdfAnnotationHighlight()
+		a.QuadPoints = quadPoints
+		annotation, markup = a.PdfAnnotation, a.PdfAnnotationMarkup
+	case "underline":
+		a := pdf.NewPdfAnnotationUnderline()
+		a.QuadPoints = quadPoints
+		annotation, markup = a.PdfAnnotation, a.PdfAnnotationMarkup
+	case "squiggly":
+		a := pdf.NewPdfAnnotationSquiggly()
+		a.QuadPoints = quadPoints
+		annotation, markup = a.PdfAnnotation, a.PdfAnnotationMarkup
+	case "strikeout":
+		a := pdf.NewPdfAnnotationStrikeOut()
+		a.QuadPoints = quadPoints
+		annotation, markup = a.PdfAnnotation, a.PdfAnnotationMarkup
+	default:
+		return nil, fmt.Errorf("unknown annotation type %q", opt.kind)
+	}
+	annotation.Rect = core.MakeArrayFromFloats([]float64{rect.Llx, rect.Lly, rect.Urx, rect.Ury})
+	annotation.C = core.MakeArrayFromFloats([]float64{r, g, b})
+	annotation.Contents = core.MakeString(comment)
+	annotation.F = core.MakeInteger(4) // Print.
+	annotation.AP = ap
+	now := time.Now().UTC().Format("D:20060102150405Z")
+	annotation.M = core.MakeString(now)
+	markup.CreationDate = core.MakeString(now)
+	if opt.author != "" {
+		markup.T = core.MakeString(opt.author)
+	}
+	return annotation, nil
+}
+
+// parseColor returns the red, green and blue components in the range 0-1 of color `hex` (#rrggbb).
+func parseColor(hex string) (float64, float64, float64, error) {
+	s := strings.TrimPrefix(hex, "#")
+	if len(s) != 6 {
+		return 0, 0, 0, fmt.Errorf("bad color %q", hex)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("bad color %q", hex)
+	}
+	return float64(v>>16&0xff) / 255, float64(v>>8&0xff) / 255, float64(v&0xff) / 255, nil
+}
+
 // makeUsage updates flag.Usage to include usage message `msg`.
 func makeUsage(msg string) {
 	usage := flag.Usage
@@ -5,23 +5,72 @@
  * Includes debugging capabilities such as outputing a marked up PDF showing bounding boxes of marks,
  * words, lines and columns.
  *
+ * There are two table detection modes.
+ * - stream: (default) Columns are inferred from the whitespace gaps between words. All the pages'
+ *   tables are written to a single CSV file.
+ * - lattice: Tables are found from the ruling lines (cell borders) drawn on the page. Each table's
+ *   cells are found from the grid of ruling lines, including cells that span several rows or
+ *   columns. Each table is written to its own CSV file, table_p<page>_t<n>.csv for output path
+ *   table.csv. The text of a spanned cell is written to its top left position.
+ *
+ * With the -s option, tables that continue across pages are stitched into one logical table with a
+ * single header row.
+ * - stream: Lines that are repeated at the same position on at least half the pages are page
+ *   headers and footers and are dropped. Digits are ignored when comparing single column lines, so
+ *   "Page 3 of 40" matches "Page 4 of 40".
+ *   The header row is the first multi-column line on the first page that is either repeated on
+ *   the later pages or set entirely in a bold font, and whose words line up with the columns of the
+ *   table body. Repeated lines that don't line up with the body, such as letterheads, are dropped
+ *   as page headers. Columns are found from all pages together so
+ *   that every page's rows have the same columns.
+ * - lattice: The first table on a page continues the last table on the previous page if they have
+ *   the same number of columns. The continuation's first row is dropped if it repeats the header.
+ *   Stitched tables are named after the page they start on.
+ *
  * Run as: go run pdf_to_csv.go -m all -mf markup.pdf table.pdf table.csv
  * - Outputs debug markup including: marks, words, lines, columns to markup.pdf
  * - The table data is outputed to table.csv with UTF-8 encoding.
+ *
+ * The tables can be written as CSV, XLSX or JSON. The format is set by the -f option or by the output
+ * file extension (.csv, .xlsx or .json).
+ * - csv: As described above.
+ * - xlsx: A workbook with one sheet per table. Numeric cells are stored as numbers and each cell
+ *   has a comment giving the bounding box of its text on the page.
+ * - json: An array of tables, each with its page number, number of columns, bounding box and rows
+ *   of cells with their text and bounding boxes.
+ * The cell bounding boxes are those of the cell's text in stream mode and those of the cells
+ * themselves in lattice mode.
+ *
+ * Run as: go run pdf_to_csv.go -s reconciliation.pdf reconciliation.csv
+ * - Outputs the table in all the pages of reconciliation.pdf to reconciliation.csv with one header.
+ *
+ * Run as: go run pdf_to_csv.go -t lattice -m cells -mf markup.pdf statement.pdf statement.csv
+ * - Outputs the table cells found from the ruling lines to markup.pdf
+ * - The tables are outputed to statement_p1_t1.csv, statement_p1_t2.csv, ...
+ *
+ * Run as: go run pdf_to_csv.go -t lattice -s statement.pdf statement.xlsx
+ * - The tables are outputed to statement.xlsx with one sheet per table.
  */
 
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/unidoc/unipdf/v3/common"
 	"github.com/unidoc/unipdf/v3/contentstream"
@@ -51,10 +100,15 @@ func main() {
 		loglevel   string
 		saveMarkup string
 		markupPath string
+		tableMode  string
+		opts       tableOptions
 	)
 	flag.StringVar(&loglevel, "l", "info", "Set log level (default: info)")
-	flag.StringVar(&saveMarkup, "m", "none", "Save markup (none/marks/words/lines/columns/all)")
+	flag.StringVar(&saveMarkup, "m", "none", "Save markup (none/marks/words/lines/columns/cells/all)")
 	flag.StringVar(&markupPath, "mf", "/tmp/markup.pdf", "Output markup path (default /tmp/markup.pdf)")
+	flag.StringVar(&tableMode, "t", "stream", "Table detection mode (stream/lattice)")
+	flag.BoolVar(&opts.stitch, "s", false, "Stitch tables that continue across pages into one table")
+	flag.StringVar(&opts.format, "f", "", "Output format (csv/xlsx/json). Default: from output file extension")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) < 2 {
@@ -81,6 +135,8 @@ func main() {
 		saveParams.markupType = "lines"
 	case "columns":
 		saveParams.markupType = "columns"
+	case "cells":
+		saveParams.markupType = "cells"
 	case "all":
 		saveParams.markupType = "all"
 	default:
@@ -88,18 +144,52 @@ func main() {
 	}
 	saveParams.markupOutputPath = markupPath
 
+	if tableMode != "stream" && tableMode != "lattice" {
+		fmt.Printf("Unknown table detection mode %q. Use stream or lattice.\n", tableMode)
+		os.Exit(1)
+	}
+
+	opts.lattice = tableMode == "lattice"
+
 	inPath := args[0]
 	outPath := args[1]
-	err := extractTableData(inPath, outPath)
+	if opts.format == "" {
+		opts.format = strings.TrimPrefix(strings.ToLower(filepath.Ext(outPath)), ".")
+	}
+	switch opts.format {
+	case "csv", "xlsx", "json":
+	default:
+		opts.format = "csv"
+	}
+
+	err := extractTableData(inPath, outPath, opts)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
+// tableOptions control how tables are detected.
+type tableOptions struct {
+	lattice bool   // Detect tables from ruling lines rather than whitespace gaps.
+	stitch  bool   // Stitch tables that continue across pages.
+	format  string // Output format: csv, xlsx or json.
+}
+
+// tableCell is a table cell. `bbox` is nil for positions that are covered by a spanned cell and
+// for empty cells in stream mode.
+type tableCell struct {
+	text    string
+	bbox    *model.PdfRectangle
+	pageNum int // The page the cell is on.
+}
+
 // extractTableData extracts tabular information from PDF file `inPath` and outputs
 // the data as CSV file to `outPath`.
-func extractTableData(inPath string, outPath string) error {
+// If `opts.lattice` is true, tables are detected from ruling lines and each table is written to
+// its own CSV file with a name derived from `outPath`.
+// If `opts.format` is xlsx or json, all the tables are written to `outPath` in that format.
+func extractTableData(inPath string, outPath string, opts tableOptions) error {
 	f, err := os.Open(inPath)
 	if err != nil {
 		return fmt.Errorf("Could not open %q err=%v", inPath, err)
@@ -118,11 +208,9 @@ func extractTableData(inPath string, outPath string) error {
 	saveParams.pdfReader = pdfReader
 	saveParams.markups = map[int][][]model.PdfRectangle{}
 
-	var csvData bytes.Buffer
+	var allLines []pageLines
+	var tables []pageTable
 	for pageNum := 1; pageNum <= numPages; pageNum++ {
-		if pageNum > 3 {
-			break
-		}
 		saveParams.curPage = pageNum
 
 		page, err := pdfReader.GetPage(pageNum)
@@ -176,12 +264,39 @@ func extractTableData(inPath string, outPath string) error {
 		}
 		saveParams.markups[pageNum] = append(saveParams.markups[pageNum], group)
 
-		pageCSV, err := pageMarksToCSV(textMarks)
-		if err != nil {
-			common.Log.Debug("Error grouping text: %v", err)
-			return err
+		if opts.lattice {
+			pageTables, err := pageLatticeTables(page, textMarks)
+			if err != nil {
+				return fmt.Errorf("pageLatticeTables failed. %q pageNum=%d err=%v", inPath, pageNum, err)
+			}
+			common.Log.Info("Page %d: %d tables", pageNum, len(pageTables))
+			for i, rows := range pageTables {
+				setCellPage(rows, pageNum)
+				tables = append(tables, pageTable{pageNum: pageNum, lastPage: pageNum, tableNum: i + 1, rows: rows})
+			}
+			continue
+		}
+
+		if opts.stitch {
+			words := identifyWords(textMarks)
+			lines := identifyLines(words)
+			allLines = append(allLines, pageLines{pageNum: pageNum, top: mbox.Ury, lines: lines})
+			continue
 		}
-		csvData.WriteString(pageCSV)
+
+		rows := pageMarksToTable(textMarks)
+		setCellPage(rows, pageNum)
+		tables = append(tables, pageTable{pageNum: pageNum, lastPage: pageNum, tableNum: 1, rows: rows})
+	}
+
+	if opts.stitch && !opts.lattice && len(allLines) > 0 {
+		rows := stitchPageLines(allLines)
+		tables = []pageTable{{pageNum: allLines[0].pageNum, lastPage: allLines[len(allLines)-1].pageNum,
+			tableNum: 1, rows: rows}}
+		common.Log.Info("Stitched %d rows from %d pages", len(rows), len(allLines))
+	}
+	if opts.lattice && opts.stitch {
+		tables = stitchTables(tables)
 	}
 
 	if saveParams.markupType != "none" {
@@ -191,7 +306,349 @@ func extractTableData(inPath string, outPath string) error {
 		}
 	}
 
-	return ioutil.WriteFile(outPath, csvData.Bytes(), 0666)
+	switch opts.format {
+	case "xlsx":
+		err = writeXLSXFile(outPath, tables)
+	case "json":
+		err = writeJSONFile(outPath, tables)
+	default:
+		if !opts.lattice {
+			// All the stream mode tables go in one CSV file.
+			var rows [][]tableCell
+			for _, table := range tables {
+				rows = append(rows, table.rows...)
+			}
+			return writeCSVFile(outPath, rows)
+		}
+		for _, table := range tables {
+			tablePath := latticeTablePath(outPath, table.pageNum, table.tableNum)
+			if err := writeCSVFile(tablePath, table.rows); err != nil {
+				return err
+			}
+			common.Log.Info("Saved table %d (%d rows) to %q", table.tableNum, len(table.rows), tablePath)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	common.Log.Info("Saved %d tables to %q", len(tables), outPath)
+	return nil
+}
+
+// latticeTablePath returns the path of the CSV file for table `tableNum` on page `pageNum` for
+// output path `outPath`. e.g. table.csv -> table_p1_t2.csv
+func latticeTablePath(outPath string, pageNum, tableNum int) string {
+	ext := filepath.Ext(outPath)
+	return fmt.Sprintf("%s_p%d_t%d%s", strings.TrimSuffix(outPath, ext), pageNum, tableNum, ext)
+}
+
+// writeCSVFile writes table `rows` to CSV file `outPath`.
+func writeCSVFile(outPath string, rows [][]tableCell) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, row := range rows {
+		if err := w.Write(rowText(row)); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outPath, buf.Bytes(), 0666)
+}
+
+// setCellPage sets the page number of the cells in `rows` to `pageNum`.
+func setCellPage(rows [][]tableCell, pageNum int) {
+	for _, row := range rows {
+		for i := range row {
+			row[i].pageNum = pageNum
+		}
+	}
+}
+
+// jsonTable is the JSON representation of a table.
+type jsonTable struct {
+	Page     int          `json:"page"`
+	LastPage int          `json:"last_page"`
+	Table    int          `json:"table"`
+	Columns  int          `json:"columns"`
+	BBox     *[4]float64  `json:"bbox,omitempty"` // Bounding box on the first page.
+	Rows     [][]jsonCell `json:"rows"`
+}
+
+// jsonCell is the JSON representation of a table cell.
+type jsonCell struct {
+	Text string      `json:"text"`
+	Page int         `json:"page,omitempty"`
+	BBox *[4]float64 `json:"bbox,omitempty"`
+}
+
+// writeJSONFile writes `tables` to JSON file `outPath`.
+func writeJSONFile(outPath string, tables []pageTable) error {
+	jsonTables := []jsonTable{}
+	for _, table := range tables {
+		jt := jsonTable{
+			Page:     table.pageNum,
+			LastPage: table.lastPage,
+			Table:    table.tableNum,
+			Rows:     [][]jsonCell{},
+		}
+		var tableBBox *model.PdfRectangle
+		for _, row := range table.rows {
+			if len(row) > jt.Columns {
+				jt.Columns = len(row)
+			}
+			jrow := make([]jsonCell, len(row))
+			for i, cell := range row {
+				jrow[i] = jsonCell{Text: cell.text}
+				if cell.bbox == nil {
+					continue
+				}
+				jrow[i].Page = cell.pageNum
+				jrow[i].BBox = bboxArray(*cell.bbox)
+				if cell.pageNum != table.pageNum {
+					continue
+				}
+				if tableBBox == nil {
+					r := *cell.bbox
+					tableBBox = &r
+				} else {
+					r := rectUnion(*tableBBox, *cell.bbox)
+					tableBBox = &r
+				}
+			}
+			jt.Rows = append(jt.Rows, jrow)
+		}
+		if tableBBox != nil {
+			jt.BBox = bboxArray(*tableBBox)
+		}
+		jsonTables = append(jsonTables, jt)
+	}
+	data, err := json.MarshalIndent(jsonTables, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outPath, data, 0666)
+}
+
+// bboxArray returns `r` as [llx, lly, urx, ury] rounded to 0.01 points.
+func bboxArray(r model.PdfRectangle) *[4]float64 {
+	round := func(x float64) float64 { return math.Round(x*100) / 100 }
+	return &[4]float64{round(r.Llx), round(r.Lly), round(r.Urx), round(r.Ury)}
+}
+
+// XLSX namespaces and content types.
+const (
+	xlsxMainNS   = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xlsxRelNS    = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	xlsxPkgRelNS = "http://schemas.openxmlformats.org/package/2006/relationships"
+	xlsxXMLHead  = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+)
+
+// writeXLSXFile writes `tables` to XLSX file `outPath` with one sheet per table. Numeric cells are
+// written as numbers and each cell with a bounding box has a comment giving the bounding box.
+// This is a minimal XLSX writer: inline strings, no styles and no shared strings.
+func writeXLSXFile(outPath string, tables []pageTable) error {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	addPart := func(name, content string) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(content))
+		return err
+	}
+
+	if len(tables) == 0 {
+		// A workbook must have at least one sheet.
+		tables = []pageTable{{}}
+	}
+
+	var contentTypes, sheets, workbookRels strings.Builder
+	contentTypes.WriteString(xlsxXMLHead)
+	contentTypes.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	contentTypes.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	contentTypes.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	contentTypes.WriteString(`<Default Extension="vml" ContentType="application/vnd.openxmlformats-officedocument.vmlDrawing"/>`)
+	contentTypes.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+
+	for i, table := range tables {
+		n := i + 1
+		sheet, comments, vml := xlsxSheet(table, n)
+		if err := addPart(fmt.Sprintf("xl/worksheets/sheet%d.xml", n), sheet); err != nil {
+			return err
+		}
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		if comments != "" {
+			if err := addPart(fmt.Sprintf("xl/comments%d.xml", n), comments); err != nil {
+				return err
+			}
+			if err := addPart(fmt.Sprintf("xl/drawings/vmlDrawing%d.vml", n), vml); err != nil {
+				return err
+			}
+			rels := xlsxXMLHead + `<Relationships xmlns="` + xlsxPkgRelNS + `">` +
+				fmt.Sprintf(`<Relationship Id="rId1" Type="%s/vmlDrawing" Target="../drawings/vmlDrawing%d.vml"/>`, xlsxRelNS, n) +
+				fmt.Sprintf(`<Relationship Id="rId2" Type="%s/comments" Target="../comments%d.xml"/>`, xlsxRelNS, n) +
+				`</Relationships>`
+			if err := addPart(fmt.Sprintf("xl/worksheets/_rels/sheet%d.xml.rels", n), rels); err != nil {
+				return err
+			}
+			fmt.Fprintf(&contentTypes, `<Override PartName="/xl/comments%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.comments+xml"/>`, n)
+		}
+		fmt.Fprintf(&sheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(sheetName(table)), n, n)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="%s/worksheet" Target="worksheets/sheet%d.xml"/>`, n, xlsxRelNS, n)
+	}
+	contentTypes.WriteString(`</Types>`)
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", xlsxXMLHead + `<Relationships xmlns="` + xlsxPkgRelNS + `">` +
+			`<Relationship Id="rId1" Type="` + xlsxRelNS + `/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", xlsxXMLHead + `<workbook xmlns="` + xlsxMainNS + `" xmlns:r="` + xlsxRelNS + `">` +
+			`<sheets>` + sheets.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", xlsxXMLHead + `<Relationships xmlns="` + xlsxPkgRelNS + `">` +
+			workbookRels.String() + `</Relationships>`},
+	}
+	for _, part := range parts {
+		if err := addPart(part.name, part.content); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outPath, buf.Bytes(), 0666)
+}
+
+// sheetName returns the XLSX sheet name for `table`. e.g. p3_t1 or p3-5_t1 for a stitched table.
+func sheetName(table pageTable) string {
+	if table.pageNum == 0 {
+		return "Sheet1"
+	}
+	if table.lastPage != table.pageNum {
+		return fmt.Sprintf("p%d-%d_t%d", table.pageNum, table.lastPage, table.tableNum)
+	}
+	return fmt.Sprintf("p%d_t%d", table.pageNum, table.tableNum)
+}
+
+// xlsxSheet returns the worksheet XML for `table`, which is sheet number `n`, and the comments and
+// VML drawing parts for its cell bounding box comments. The comments and drawing are empty if no
+// cells have bounding boxes.
+func xlsxSheet(table pageTable, n int) (sheet, comments, vml string) {
+	var data, commentList, shapes strings.Builder
+	numComments := 0
+	for r, row := range table.rows {
+		fmt.Fprintf(&data, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			ref := fmt.Sprintf("%s%d", columnName(c), r+1)
+			if x, ok := parseNumber(cell.text); ok {
+				fmt.Fprintf(&data, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(x, 'f', -1, 64))
+			} else if cell.text != "" {
+				fmt.Fprintf(&data, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`,
+					ref, xmlEscape(cell.text))
+			}
+			if cell.bbox == nil {
+				continue
+			}
+			b := cell.bbox
+			text := fmt.Sprintf("page %d bbox [%.2f %.2f %.2f %.2f]", cell.pageNum, b.Llx, b.Lly, b.Urx, b.Ury)
+			fmt.Fprintf(&commentList, `<comment ref="%s" authorId="0"><text><t>%s</t></text></comment>`,
+				ref, xmlEscape(text))
+			fmt.Fprintf(&shapes, `<v:shape id="_x0000_s%d" type="#_x0000_t202" `+
+				`style="position:absolute;margin-left:80pt;margin-top:2pt;width:140pt;height:40pt;z-index:%d;visibility:hidden" `+
+				`fillcolor="#ffffe1" o:insetmode="auto"><v:fill color2="#ffffe1"/>`+
+				`<v:shadow on="t" color="black" obscured="t"/><v:path o:connecttype="none"/>`+
+				`<v:textbox style="mso-direction-alt:auto"><div style="text-align:left"></div></v:textbox>`+
+				`<x:ClientData ObjectType="Note"><x:MoveWithCells/><x:SizeWithCells/>`+
+				`<x:Anchor>%d, 15, %d, 2, %d, 15, %d, 16</x:Anchor><x:AutoFill>False</x:AutoFill>`+
+				`<x:Row>%d</x:Row><x:Column>%d</x:Column></x:ClientData></v:shape>`,
+				1024*n+numComments+1, numComments+1, c+1, r, c+3, r+3, r, c)
+			numComments++
+		}
+		data.WriteString(`</row>`)
+	}
+
+	legacyDrawing := ""
+	if numComments > 0 {
+		legacyDrawing = `<legacyDrawing r:id="rId1"/>`
+		comments = xlsxXMLHead + `<comments xmlns="` + xlsxMainNS + `">` +
+			`<authors><author>pdf_to_csv</author></authors>` +
+			`<commentList>` + commentList.String() + `</commentList></comments>`
+		vml = `<xml xmlns:v="urn:schemas-microsoft-com:vml" xmlns:o="urn:schemas-microsoft-com:office:office" ` +
+			`xmlns:x="urn:schemas-microsoft-com:office:excel">` +
+			fmt.Sprintf(`<o:shapelayout v:ext="edit"><o:idmap v:ext="edit" data="%d"/></o:shapelayout>`, n) +
+			`<v:shapetype id="_x0000_t202" coordsize="21600,21600" o:spt="202" path="m,l,21600r21600,l21600,xe">` +
+			`<v:stroke joinstyle="miter"/><v:path gradientshapeok="t" o:connecttype="rect"/></v:shapetype>` +
+			shapes.String() + `</xml>`
+	}
+	sheet = xlsxXMLHead + `<worksheet xmlns="` + xlsxMainNS + `" xmlns:r="` + xlsxRelNS + `">` +
+		`<sheetData>` + data.String() + `</sheetData>` + legacyDrawing + `</worksheet>`
+	return sheet, comments, vml
+}
+
+// columnName returns the spreadsheet name of 0-offset column `col`. e.g. 0 -> A, 26 -> AA
+func columnName(col int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name
+}
+
+// parseNumber returns the numeric value of `text` and true if it is a number as written in
+// financial tables. e.g. 1,234.56 -1.5 (12.00) $5 12.00-
+// Numbers with leading zeros, such as account numbers, are not treated as numbers.
+func parseNumber(text string) (float64, bool) {
+	t := strings.TrimSpace(text)
+	neg := false
+	if strings.HasPrefix(t, "(") && strings.HasSuffix(t, ")") {
+		neg = true
+		t = strings.TrimSpace(t[1 : len(t)-1])
+	} else if strings.HasSuffix(t, "-") {
+		neg = true
+		t = strings.TrimSpace(t[:len(t)-1])
+	}
+	sign := ""
+	if strings.HasPrefix(t, "-") || strings.HasPrefix(t, "+") {
+		sign, t = t[:1], t[1:]
+	}
+	t = strings.TrimLeft(t, "$€£¥")
+	if !reNumber.MatchString(t) || reLeadingZero.MatchString(t) {
+		return 0, false
+	}
+	x, err := strconv.ParseFloat(sign+strings.Replace(t, ",", "", -1), 64)
+	if err != nil {
+		return 0, false
+	}
+	if neg {
+		x = -x
+	}
+	return x, true
+}
+
+var (
+	reNumber      = regexp.MustCompile(`^(\d{1,3}(,\d{3})+|\d+)(\.\d+)?$|^\.\d+$`)
+	reLeadingZero = regexp.MustCompile(`^0\d`)
+)
+
+// xmlEscape returns `s` escaped for use in XML text and attributes.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// rowText returns the text of the cells in `row`.
+func rowText(row []tableCell) []string {
+	text := make([]string, len(row))
+	for i, cell := range row {
+		text[i] = cell.text
+	}
+	return text
 }
 
 func rectUnion(b1, b2 model.PdfRectangle) model.PdfRectangle {
@@ -394,12 +851,12 @@ func identifyColumns(words []segmentationWord) []model.PdfRectangle {
 	return filtered
 }
 
-// getLineTableTextData converts the lines of words into table strings cells by accounting for
+// getLineTableTextData converts the lines of words into table cells by accounting for
 // distribution of lines into columns as specified by `columnBBoxes`.
-func getLineTableTextData(lines [][]segmentationWord, columnBBoxes []model.PdfRectangle) [][]string {
-	tabledata := [][]string{}
+func getLineTableTextData(lines [][]segmentationWord, columnBBoxes []model.PdfRectangle) [][]tableCell {
+	tabledata := [][]tableCell{}
 	for _, line := range lines {
-		linedata := make([]string, len(columnBBoxes))
+		linedata := make([]tableCell, len(columnBBoxes))
 		for _, word := range line {
 			wordBBox, ok := word.BBox()
 			if !ok {
@@ -415,7 +872,14 @@ func getLineTableTextData(lines [][]segmentationWord, columnBBoxes []model.PdfRe
 					bestColumn = icol
 				}
 			}
-			linedata[bestColumn] += word.String()
+			cell := &linedata[bestColumn]
+			cell.text += word.String()
+			if cell.bbox == nil {
+				cell.bbox = &wordBBox
+			} else {
+				union := rectUnion(*cell.bbox, wordBBox)
+				cell.bbox = &union
+			}
 		}
 		tabledata = append(tabledata, linedata)
 	}
@@ -424,22 +888,30 @@ func getLineTableTextData(lines [][]segmentationWord, columnBBoxes []model.PdfRe
 
 // segmentationWord represents a word that has been segmented in PDF text.
 type segmentationWord struct {
-	ma *extractor.TextMarkArray
+	marks []extractor.TextMark
 }
 
 func (w segmentationWord) Elements() []extractor.TextMark {
-	return w.ma.Elements()
+	return w.marks
 }
 
+// BBox returns the smallest axis-aligned rectangle that encloses the marks in `w`. Spaces after the
+// first mark are not included.
 func (w segmentationWord) BBox() (model.PdfRectangle, bool) {
-	return w.ma.BBox()
+	if len(w.marks) == 0 {
+		return model.PdfRectangle{}, false
+	}
+	bbox := w.marks[0].BBox
+	for _, m := range w.marks[1:] {
+		if strings.TrimSpace(m.Text) == "" {
+			continue
+		}
+		bbox = rectUnion(bbox, m.BBox)
+	}
+	return bbox, true
 }
 
 func (w segmentationWord) String() string {
-	if w.ma == nil {
-		return ""
-	}
-
 	var buf bytes.Buffer
 	for _, m := range w.Elements() {
 		buf.WriteString(m.Text)
@@ -447,13 +919,38 @@ func (w segmentationWord) String() string {
 	return buf.String()
 }
 
-// pageMarksToCSV converts textMarks from a single page into CSV by grouping the marks into
-// words, lines and columns and then writing the table cells data as CSV output.
-func pageMarksToCSV(textMarks *extractor.TextMarkArray) (string, error) {
-	// STEP - Form words.
+// pageMarksToTable converts textMarks from a single page into table cells by grouping the marks
+// into words, lines and columns.
+func pageMarksToTable(textMarks *extractor.TextMarkArray) [][]tableCell {
+	words := identifyWords(textMarks)
+	lines := identifyLines(words)
+
+	// Filter out words in lines with only 1 column.
+	tableLines := [][]segmentationWord{}
+	for _, line := range lines {
+		if len(line) <= 1 {
+			continue
+		}
+		tableLines = append(tableLines, line)
+	}
+
+	tableWords := []segmentationWord{}
+	for _, line := range tableLines {
+		for _, word := range line {
+			tableWords = append(tableWords, word)
+		}
+	}
+
+	columnBBoxes := identifyColumns(tableWords)
+
+	return getLineTableTextData(lines, columnBBoxes)
+}
+
+// identifyWords groups the closest text marks in `textMarks` that are overlapping into words.
+func identifyWords(textMarks *extractor.TextMarkArray) []segmentationWord {
 	// Group the closest text marks that are overlapping.
 	words := []segmentationWord{}
-	word := segmentationWord{ma: &extractor.TextMarkArray{}}
+	word := segmentationWord{}
 	var lastMark extractor.TextMark
 	isFirst := true
 	for i, mark := range textMarks.Elements() {
@@ -463,8 +960,7 @@ func pageMarksToCSV(textMarks *extractor.TextMarkArray) (string, error) {
 
 		common.Log.Debug("Mark %d - '%s' (% X)", i, mark.Text, mark.Text)
 		if isFirst {
-			word = segmentationWord{ma: &extractor.TextMarkArray{}}
-			word.ma.Append(mark)
+			word = segmentationWord{marks: []extractor.TextMark{mark}}
 			lastMark = mark
 			isFirst = false
 			continue
@@ -476,9 +972,9 @@ func pageMarksToCSV(textMarks *extractor.TextMarkArray) (string, error) {
 				common.Log.Debug("Appending word: '%s' (%d chars) (%d elements)", word.String(), len(word.String()), len(word.Elements()))
 				words = append(words, word)
 			}
-			word = segmentationWord{ma: &extractor.TextMarkArray{}}
+			word = segmentationWord{}
 		}
-		word.ma.Append(mark)
+		word.marks = append(word.marks, mark)
 		lastMark = mark
 	}
 	if len(strings.TrimSpace(word.String())) > 0 {
@@ -498,37 +994,295 @@ func pageMarksToCSV(textMarks *extractor.TextMarkArray) (string, error) {
 		}
 		saveParams.markups[saveParams.curPage] = append(saveParams.markups[saveParams.curPage], wbboxes)
 	}
+	return words
+}
 
-	lines := identifyLines(words)
+// pageLines are the lines of words on a page.
+type pageLines struct {
+	pageNum int
+	top     float64 // The top of the page.
+	lines   [][]segmentationWord
+}
 
-	// Filter out words in lines with only 1 column.
-	tableLines := [][]segmentationWord{}
+// pageTable is a table on a page.
+type pageTable struct {
+	pageNum  int
+	lastPage int // The last page of a table that has been stitched across pages.
+	tableNum int // The table's number on the page, starting at 1.
+	rows     [][]tableCell
+}
+
+// repeatTol is the maximum difference (in points) in the position of a line on different pages
+// for the line to be treated as repeated.
+const repeatTol = 4.0
+
+// stitchPageLines returns the table data in the lines of `pages` as a single table. Page headers
+// and footers are dropped and the table's header row is output once.
+func stitchPageLines(pages []pageLines) [][]tableCell {
+	if len(pages) == 0 {
+		return nil
+	}
+
+	// Find the lines that are repeated at the same position on other pages. A line's position is
+	// its distance from the top of its page.
+	type occurrence struct {
+		pageNum int
+		pos     float64
+	}
+	occurrences := map[string][]occurrence{}
+	for _, page := range pages {
+		for _, line := range page.lines {
+			key := lineKey(line)
+			occurrences[key] = append(occurrences[key], occurrence{page.pageNum, page.top - lineTop(line)})
+		}
+	}
+	minRepeats := (len(pages) + 1) / 2
+	if minRepeats < 2 {
+		minRepeats = 2
+	}
+	isRepeated := func(line []segmentationWord, pos float64) bool {
+		repeatPages := map[int]bool{}
+		for _, o := range occurrences[lineKey(line)] {
+			if math.Abs(o.pos-pos) <= repeatTol {
+				repeatPages[o.pageNum] = true
+			}
+		}
+		return len(repeatPages) >= minRepeats
+	}
+
+	// The table body is the multi-column lines that are not repeated.
+	var bodyLines [][]segmentationWord
+	for _, page := range pages {
+		for _, line := range page.lines {
+			if len(line) > 1 && !isRepeated(line, page.top-lineTop(line)) {
+				bodyLines = append(bodyLines, line)
+			}
+		}
+	}
+	bodyColumns := columnRanges(bodyLines)
+
+	// The header is the first multi-column line on the first page that is repeated or bold and whose
+	// words are in the body's columns. Repeated multi-column lines whose words are not in the body's
+	// columns, such as letterheads, are page furniture.
+	var header []segmentationWord
+	first := pages[0]
+	for _, line := range first.lines {
+		if len(line) < 2 || !inColumns(line, bodyColumns) {
+			continue
+		}
+		if isRepeated(line, first.top-lineTop(line)) || isBoldLine(line) {
+			header = line
+			break
+		}
+	}
+	headerKey := ""
+	if header != nil {
+		headerKey = lineKey(header)
+		common.Log.Info("Header row: %q", headerKey)
+	}
+
+	var lines [][]segmentationWord
+	var linePages []int
+	if header != nil {
+		lines = append(lines, header)
+		linePages = append(linePages, first.pageNum)
+	}
+	numDropped := 0
+	for _, page := range pages {
+		for _, line := range page.lines {
+			if headerKey != "" && lineKey(line) == headerKey {
+				continue
+			}
+			if isRepeated(line, page.top-lineTop(line)) {
+				common.Log.Debug("Dropping page header/footer: page %d %q", page.pageNum, lineKey(line))
+				numDropped++
+				continue
+			}
+			lines = append(lines, line)
+			linePages = append(linePages, page.pageNum)
+		}
+	}
+	common.Log.Info("Dropped %d page header and footer lines", numDropped)
+
+	// Find the columns from all the pages' multi-column lines.
+	tableWords := []segmentationWord{}
 	for _, line := range lines {
 		if len(line) <= 1 {
 			continue
 		}
-		tableLines = append(tableLines, line)
+		tableWords = append(tableWords, line...)
+	}
+	columnBBoxes := identifyColumns(tableWords)
+	for _, page := range pages {
+		pageMarkups := saveParams.markups[page.pageNum]
+		if len(pageMarkups) == 3 {
+			saveParams.markups[page.pageNum] = append(pageMarkups, columnBBoxes)
+		}
 	}
 
-	tableWords := []segmentationWord{}
-	for _, line := range tableLines {
+	rows := getLineTableTextData(lines, columnBBoxes)
+	for i, row := range rows {
+		setCellPage([][]tableCell{row}, linePages[i])
+	}
+	return rows
+}
+
+// columnRange is the horizontal extent of a column of words.
+type columnRange struct {
+	llx, urx float64
+}
+
+// columnRanges returns the horizontal extents of the columns of words in `lines`, found by merging
+// the overlapping horizontal extents of the words, sorted from left to right.
+func columnRanges(lines [][]segmentationWord) []columnRange {
+	var ranges []columnRange
+	for _, line := range lines {
 		for _, word := range line {
-			tableWords = append(tableWords, word)
+			if wbbox, ok := word.BBox(); ok {
+				ranges = append(ranges, columnRange{wbbox.Llx, wbbox.Urx})
+			}
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].llx < ranges[j].llx })
+	var merged []columnRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.llx <= merged[n-1].urx {
+			merged[n-1].urx = math.Max(merged[n-1].urx, r.urx)
+			continue
 		}
+		merged = append(merged, r)
 	}
+	return merged
+}
 
-	columnBBoxes := identifyColumns(tableWords)
+// inColumns returns true if every word in `line` overlaps one of `columns` and the words are in at
+// least two columns.
+func inColumns(line []segmentationWord, columns []columnRange) bool {
+	used := map[int]bool{}
+	for _, word := range line {
+		wbbox, ok := word.BBox()
+		if !ok {
+			continue
+		}
+		col := -1
+		for i, c := range columns {
+			if wbbox.Llx < c.urx && c.llx < wbbox.Urx {
+				col = i
+				break
+			}
+		}
+		if col < 0 {
+			return false
+		}
+		used[col] = true
+	}
+	return len(used) >= 2
+}
 
-	tabledata := getLineTableTextData(lines, columnBBoxes)
+// stitchTables returns `tables` with tables that continue on the next page merged. The first table
+// on a page continues the last table on the previous page if it has the same number of columns.
+// The continuation's first row is dropped if it is the same as the header (first row) of the
+// table it continues.
+func stitchTables(tables []pageTable) []pageTable {
+	var stitched []pageTable
+	for _, table := range tables {
+		if len(stitched) > 0 && table.tableNum == 1 && len(table.rows) > 0 {
+			last := &stitched[len(stitched)-1]
+			if table.pageNum == last.lastPage+1 && len(last.rows) > 0 &&
+				len(last.rows[0]) == len(table.rows[0]) {
+				rows := table.rows
+				if sameRow(rowText(rows[0]), rowText(last.rows[0])) {
+					rows = rows[1:]
+				}
+				last.rows = append(last.rows, rows...)
+				last.lastPage = table.pageNum
+				common.Log.Info("Page %d table 1 continues page %d table %d", table.pageNum,
+					last.pageNum, last.tableNum)
+				continue
+			}
+		}
+		stitched = append(stitched, table)
+	}
+	return stitched
+}
 
-	var buf bytes.Buffer
-	w := csv.NewWriter(&buf)
-	err := w.WriteAll(tabledata)
-	if err != nil {
-		return "", err
+// sameRow returns true if rows `a` and `b` have the same cell text, ignoring whitespace.
+func sameRow(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	w.Flush()
-	return buf.String(), nil
+	for i := range a {
+		if strings.Join(strings.Fields(a[i]), " ") != strings.Join(strings.Fields(b[i]), " ") {
+			return false
+		}
+	}
+	return true
+}
+
+// lineKey returns a key for comparing `line` with lines on other pages. Digits are ignored in
+// single column lines so that lines like "Page 3 of 40" have the same key on every page. They are
+// not ignored in multi-column lines, which may be table rows that differ only in their numbers.
+func lineKey(line []segmentationWord) string {
+	var parts []string
+	for _, word := range line {
+		parts = append(parts, strings.TrimSpace(word.String()))
+	}
+	key := strings.Join(parts, " ")
+	if len(line) > 1 {
+		return key
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return '#'
+		}
+		return r
+	}, key)
+}
+
+// lineTop returns the top of `line`.
+func lineTop(line []segmentationWord) float64 {
+	top := math.Inf(-1)
+	for _, word := range line {
+		if wbbox, ok := word.BBox(); ok {
+			top = math.Max(top, wbbox.Ury)
+		}
+	}
+	return top
+}
+
+// isBoldLine returns true if all the text in `line` is in bold fonts.
+func isBoldLine(line []segmentationWord) bool {
+	for _, word := range line {
+		for _, mark := range word.Elements() {
+			if strings.TrimSpace(mark.Text) != "" && !isBoldFont(mark.Font) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isBoldFont returns true if `font` is bold, judging by its name and font descriptor.
+func isBoldFont(font *model.PdfFont) bool {
+	if font == nil {
+		return false
+	}
+	name := strings.ToLower(font.BaseFont())
+	for _, weight := range []string{"bold", "black", "heavy", "demi", "semibold"} {
+		if strings.Contains(name, weight) {
+			return true
+		}
+	}
+	descriptor := font.FontDescriptor()
+	if descriptor == nil {
+		return false
+	}
+	if weight, err := core.GetNumberAsFloat(descriptor.FontWeight); err == nil && weight >= 600 {
+		return true
+	}
+	// Bit 19 of the font flags is ForceBold.
+	flags, ok := core.GetIntVal(descriptor.Flags)
+	return ok && flags&(1<<18) != 0
 }
 
 type saveMarkedupParams struct {
@@ -578,6 +1332,7 @@ func saveMarkedupPDF(params saveMarkedupParams) error {
 			1: "hide", // words
 			2: "hide", // lines
 			3: "hide", // columns
+			4: "hide", // cells
 		}
 
 		switch saveParams.markupType {
@@ -589,11 +1344,14 @@ func saveMarkedupPDF(params saveMarkedupParams) error {
 			colors[2] = "#ff0000"
 		case "columns":
 			colors[3] = "#f0f000"
+		case "cells":
+			colors[4] = "#ff00ff"
 		case "all":
 			colors[0] = "#0000ff"
 			colors[1] = "#00ff00"
 			colors[2] = "#ff0000"
 			colors[3] = "#f0f000"
+			colors[4] = "#ff00ff"
 		}
 
 		for gi, group := range params.markups[pageNum] {
@@ -622,3 +1380,500 @@ func saveMarkedupPDF(params saveMarkedupParams) error {
 	common.Log.Info("Saved marked-up PDF file: %v", saveParams.markupOutputPath)
 	return nil
 }
+
+// rulingTol is the tolerance (in points) used when matching ruling lines. Filled rectangles that
+// are thinner than this are treated as ruling lines.
+const rulingTol = 2.0
+
+// maxFormDepth is the maximum depth of form XObjects that are searched for ruling lines.
+const maxFormDepth = 10
+
+// ruling is a horizontal or vertical line segment that may be part of a table's cell borders.
+type ruling struct {
+	vertical bool
+	pos      float64 // x for vertical lines, y for horizontal lines.
+	lo, hi   float64 // Extent along the line.
+}
+
+// crosses returns true if horizontal ruling `h` and vertical ruling `v` intersect.
+func (h ruling) crosses(v ruling) bool {
+	return v.lo-rulingTol <= h.pos && h.pos <= v.hi+rulingTol &&
+		h.lo-rulingTol <= v.pos && v.pos <= h.hi+rulingTol
+}
+
+// covers returns true if `r` is at `pos` and extends over `x`.
+func (r ruling) covers(pos, x float64) bool {
+	return math.Abs(r.pos-pos) <= rulingTol && r.lo-rulingTol <= x && x <= r.hi+rulingTol
+}
+
+// pageLatticeTables returns the cells of the tables on `page` with ruled cell borders.
+// `textMarks` are the page's text marks. Each table is returned as rows of cells.
+func pageLatticeTables(page *model.PdfPage, textMarks *extractor.TextMarkArray) ([][][]tableCell, error) {
+	words := identifyWords(textMarks)
+
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		return nil, err
+	}
+	var rc rulingCollector
+	if err := rc.walk(contents, page.Resources, identityMatrix(), 0); err != nil {
+		return nil, err
+	}
+	rulings := mergeRulings(rc.rulings)
+	common.Log.Debug("%d rulings -> %d merged", len(rc.rulings), len(rulings))
+
+	var tables [][][]tableCell
+	var cellGroups []model.PdfRectangle
+	for _, grid := range findLatticeGrids(rulings) {
+		tables = append(tables, grid.cellText(words))
+		rects := grid.cellRects()
+		var keys []int
+		for i := range rects {
+			keys = append(keys, i)
+		}
+		sort.Ints(keys)
+		for _, i := range keys {
+			cellGroups = append(cellGroups, rects[i])
+		}
+	}
+
+	// The cells are markup group 4. Lines and columns are not used in lattice mode.
+	pageMarkups := saveParams.markups[saveParams.curPage]
+	for len(pageMarkups) < 4 {
+		pageMarkups = append(pageMarkups, nil)
+	}
+	saveParams.markups[saveParams.curPage] = append(pageMarkups, cellGroups)
+	return tables, nil
+}
+
+// rulingCollector finds the ruling lines in content streams.
+type rulingCollector struct {
+	rulings []ruling
+}
+
+// walk adds the horizontal and vertical lines that are stroked, and the thin rectangles that are
+// filled, in content stream `contents` with resources `resources` to the collector's rulings.
+// `ctm` transforms the content stream's coordinates to device coordinates.
+func (rc *rulingCollector) walk(contents string, resources *model.PdfPageResources, ctm matrix, level int) error {
+	ops, err := contentstream.NewContentStreamParser(contents).Parse()
+	if err != nil {
+		return err
+	}
+
+	// The current path. `segments` are line segments and `rects` are rectangles, both as pairs of
+	// points in device coordinates.
+	var segments, rects [][4]float64
+	var cx, cy, sx, sy float64 // Current point and start of subpath in device coordinates.
+
+	processor := contentstream.NewContentStreamProcessor(*ops)
+	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
+		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState,
+			resources *model.PdfPageResources) error {
+			m := gsMatrix(gs).mult(ctm)
+			floats, _ := core.GetNumbersAsFloat(op.Params)
+			switch op.Operand {
+			case "m":
+				if len(floats) == 2 {
+					cx, cy = m.transform(floats[0], floats[1])
+					sx, sy = cx, cy
+				}
+			case "l":
+				if len(floats) == 2 {
+					x, y := m.transform(floats[0], floats[1])
+					segments = append(segments, [4]float64{cx, cy, x, y})
+					cx, cy = x, y
+				}
+			case "c", "v", "y":
+				if len(floats) >= 2 {
+					cx, cy = m.transform(floats[len(floats)-2], floats[len(floats)-1])
+				}
+			case "h":
+				segments = append(segments, [4]float64{cx, cy, sx, sy})
+				cx, cy = sx, sy
+			case "re":
+				if len(floats) == 4 {
+					x0, y0 := m.transform(floats[0], floats[1])
+					x1, y1 := m.transform(floats[0]+floats[2], floats[1]+floats[3])
+					rects = append(rects, [4]float64{x0, y0, x1, y1})
+					cx, cy = x0, y0
+					sx, sy = x0, y0
+				}
+			case "S", "s", "B", "B*", "b", "b*":
+				for _, s := range segments {
+					rc.addLine(s[0], s[1], s[2], s[3])
+				}
+				for _, r := range rects {
+					rc.addRect(r, true)
+				}
+				segments, rects = nil, nil
+			case "f", "F", "f*":
+				for _, r := range rects {
+					rc.addRect(r, false)
+				}
+				segments, rects = nil, nil
+			case "n":
+				segments, rects = nil, nil
+			case "Do":
+				if level >= maxFormDepth || len(op.Params) != 1 || resources == nil {
+					return nil
+				}
+				name, ok := core.GetName(op.Params[0])
+				if !ok {
+					return nil
+				}
+				if _, xtype := resources.GetXObjectByName(*name); xtype != model.XObjectTypeForm {
+					return nil
+				}
+				xform, err := resources.GetXObjectFormByName(*name)
+				if err != nil {
+					return err
+				}
+				content, err := xform.GetContentStream()
+				if err != nil {
+					return err
+				}
+				formCtm := m
+				if arr, ok := core.GetArray(xform.Matrix); ok {
+					if vals, err := arr.ToFloat64Array(); err == nil && len(vals) == 6 {
+						formCtm = newMatrix(vals).mult(formCtm)
+					}
+				}
+				formResources := xform.Resources
+				if formResources == nil {
+					formResources = resources
+				}
+				return rc.walk(string(content), formResources, formCtm, level+1)
+			}
+			return nil
+		})
+	return processor.Process(resources)
+}
+
+// addLine adds the line from (`x0`, `y0`) to (`x1`, `y1`) to the collector's rulings if it is
+// horizontal or vertical.
+func (rc *rulingCollector) addLine(x0, y0, x1, y1 float64) {
+	const axisTol = 0.5
+	switch {
+	case math.Abs(y1-y0) <= axisTol && math.Abs(x1-x0) > rulingTol:
+		rc.rulings = append(rc.rulings, ruling{pos: (y0 + y1) / 2, lo: math.Min(x0, x1), hi: math.Max(x0, x1)})
+	case math.Abs(x1-x0) <= axisTol && math.Abs(y1-y0) > rulingTol:
+		rc.rulings = append(rc.rulings, ruling{vertical: true, pos: (x0 + x1) / 2, lo: math.Min(y0, y1), hi: math.Max(y0, y1)})
+	}
+}
+
+// addRect adds the rulings for rectangle `r` with corners (r[0], r[1]) and (r[2], r[3]).
+// Thin rectangles are treated as lines. The sides of other rectangles are added if `stroked` is
+// true. Large filled rectangles are cell backgrounds, not borders, so they are ignored.
+func (rc *rulingCollector) addRect(r [4]float64, stroked bool) {
+	llx, lly := math.Min(r[0], r[2]), math.Min(r[1], r[3])
+	urx, ury := math.Max(r[0], r[2]), math.Max(r[1], r[3])
+	switch {
+	case ury-lly <= rulingTol:
+		rc.addLine(llx, (lly+ury)/2, urx, (lly+ury)/2)
+	case urx-llx <= rulingTol:
+		rc.addLine((llx+urx)/2, lly, (llx+urx)/2, ury)
+	case stroked:
+		rc.addLine(llx, lly, urx, lly)
+		rc.addLine(llx, ury, urx, ury)
+		rc.addLine(llx, lly, llx, ury)
+		rc.addLine(urx, lly, urx, ury)
+	}
+}
+
+// mergeRulings returns `rulings` with the collinear rulings that overlap or touch merged.
+func mergeRulings(rulings []ruling) []ruling {
+	sort.Slice(rulings, func(i, j int) bool {
+		ri, rj := rulings[i], rulings[j]
+		if ri.vertical != rj.vertical {
+			return !ri.vertical
+		}
+		if ri.pos != rj.pos {
+			return ri.pos < rj.pos
+		}
+		return ri.lo < rj.lo
+	})
+	var merged []ruling
+	for _, r := range rulings {
+		found := false
+		for i := len(merged) - 1; i >= 0; i-- {
+			m := &merged[i]
+			if m.vertical != r.vertical || r.pos-m.pos > rulingTol {
+				break
+			}
+			if r.lo <= m.hi+rulingTol && m.lo <= r.hi+rulingTol {
+				m.lo = math.Min(m.lo, r.lo)
+				m.hi = math.Max(m.hi, r.hi)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// latticeGrid is a table whose cells are bounded by ruling lines.
+type latticeGrid struct {
+	xs      []float64 // Column boundaries, left to right.
+	ys      []float64 // Row boundaries, top to bottom.
+	hs, vs  []ruling  // The table's horizontal and vertical rulings.
+	parents []int     // Union-find parents of grid positions row*numCols+col.
+}
+
+// findLatticeGrids returns the tables formed by `rulings`. A table is a connected group of
+// rulings with at least 2 horizontal and 2 vertical rulings.
+func findLatticeGrids(rulings []ruling) []*latticeGrid {
+	parents := make([]int, len(rulings))
+	for i := range parents {
+		parents[i] = i
+	}
+	for i, h := range rulings {
+		if h.vertical {
+			continue
+		}
+		for j, v := range rulings {
+			if v.vertical && h.crosses(v) {
+				union(parents, i, j)
+			}
+		}
+	}
+	groups := map[int][]ruling{}
+	var roots []int
+	for i, r := range rulings {
+		root := find(parents, i)
+		if _, ok := groups[root]; !ok {
+			roots = append(roots, root)
+		}
+		groups[root] = append(groups[root], r)
+	}
+
+	var grids []*latticeGrid
+	for _, root := range roots {
+		grid := &latticeGrid{}
+		for _, r := range groups[root] {
+			if r.vertical {
+				grid.vs = append(grid.vs, r)
+				grid.xs = append(grid.xs, r.pos)
+			} else {
+				grid.hs = append(grid.hs, r)
+				grid.ys = append(grid.ys, r.pos)
+			}
+		}
+		grid.xs = clusterPositions(grid.xs)
+		grid.ys = clusterPositions(grid.ys)
+		if len(grid.xs) < 2 || len(grid.ys) < 2 {
+			continue
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(grid.ys)))
+		grid.findSpans()
+		grids = append(grids, grid)
+	}
+
+	// Order the tables top to bottom, then left to right.
+	sort.SliceStable(grids, func(i, j int) bool {
+		gi, gj := grids[i], grids[j]
+		if math.Abs(gi.ys[0]-gj.ys[0]) > rulingTol {
+			return gi.ys[0] > gj.ys[0]
+		}
+		return gi.xs[0] < gj.xs[0]
+	})
+	return grids
+}
+
+// clusterPositions returns the sorted distinct values of `positions`, treating values within
+// rulingTol of each other as the same.
+func clusterPositions(positions []float64) []float64 {
+	sort.Float64s(positions)
+	var clustered []float64
+	for _, x := range positions {
+		if len(clustered) > 0 && x-clustered[len(clustered)-1] <= rulingTol {
+			continue
+		}
+		clustered = append(clustered, x)
+	}
+	return clustered
+}
+
+// findSpans merges the grid positions of `grid` that are not separated by a ruling into spanned
+// cells.
+func (grid *latticeGrid) findSpans() {
+	numRows, numCols := len(grid.ys)-1, len(grid.xs)-1
+	grid.parents = make([]int, numRows*numCols)
+	for i := range grid.parents {
+		grid.parents[i] = i
+	}
+	for row := 0; row < numRows; row++ {
+		midY := (grid.ys[row] + grid.ys[row+1]) / 2
+		for col := 0; col < numCols; col++ {
+			midX := (grid.xs[col] + grid.xs[col+1]) / 2
+			if col+1 < numCols && !hasRuling(grid.vs, grid.xs[col+1], midY) {
+				union(grid.parents, row*numCols+col, row*numCols+col+1)
+			}
+			if row+1 < numRows && !hasRuling(grid.hs, grid.ys[row+1], midX) {
+				union(grid.parents, row*numCols+col, (row+1)*numCols+col)
+			}
+		}
+	}
+}
+
+// hasRuling returns true if one of `rulings` is at `pos` and extends over `x`.
+func hasRuling(rulings []ruling, pos, x float64) bool {
+	for _, r := range rulings {
+		if r.covers(pos, x) {
+			return true
+		}
+	}
+	return false
+}
+
+// cellText returns the text of `words` in the cells of `grid` as rows of cells. The text and
+// bounding box of a spanned cell are placed in its top left position. The other positions it covers
+// are empty.
+func (grid *latticeGrid) cellText(words []segmentationWord) [][]tableCell {
+	numRows, numCols := len(grid.ys)-1, len(grid.xs)-1
+	cellWords := map[int][]segmentationWord{}
+	for _, word := range words {
+		wbbox, ok := word.BBox()
+		if !ok {
+			continue
+		}
+		cx, cy := (wbbox.Llx+wbbox.Urx)/2, (wbbox.Lly+wbbox.Ury)/2
+		col := sort.Search(numCols, func(i int) bool { return cx < grid.xs[i+1] })
+		row := sort.Search(numRows, func(i int) bool { return cy > grid.ys[i+1] })
+		if cx < grid.xs[0] || col == numCols || cy > grid.ys[0] || row == numRows {
+			continue
+		}
+		cell := find(grid.parents, row*numCols+col)
+		cellWords[cell] = append(cellWords[cell], word)
+	}
+
+	rects := grid.cellRects()
+	rows := make([][]tableCell, numRows)
+	for row := range rows {
+		rows[row] = make([]tableCell, numCols)
+		for col := range rows[row] {
+			i := row*numCols + col
+			rows[row][col].text = wordsText(cellWords[i])
+			if r, ok := rects[i]; ok {
+				rows[row][col].bbox = &r
+			}
+		}
+	}
+	return rows
+}
+
+// cellRects returns the rectangles of the cells of `grid`, with spanned cells as single rectangles.
+// The rectangles are keyed by the grid position row*numCols+col of the cells' top left corners.
+func (grid *latticeGrid) cellRects() map[int]model.PdfRectangle {
+	numCols := len(grid.xs) - 1
+	cells := map[int]model.PdfRectangle{}
+	for i := range grid.parents {
+		row, col := i/numCols, i%numCols
+		r := model.PdfRectangle{Llx: grid.xs[col], Lly: grid.ys[row+1], Urx: grid.xs[col+1], Ury: grid.ys[row]}
+		cell := find(grid.parents, i)
+		if c, ok := cells[cell]; ok {
+			r = rectUnion(c, r)
+		}
+		cells[cell] = r
+	}
+	return cells
+}
+
+// wordsText returns the text of `words` in reading order: lines top to bottom and words left to
+// right within lines.
+func wordsText(words []segmentationWord) string {
+	var lines [][]segmentationWord
+	for _, word := range words {
+		wbbox, _ := word.BBox()
+		match := false
+		for i, line := range lines {
+			lbbox, _ := line[0].BBox()
+			if lineOverlap(wbbox, lbbox) < 0 {
+				lines[i] = append(lines[i], word)
+				match = true
+				break
+			}
+		}
+		if !match {
+			lines = append(lines, []segmentationWord{word})
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		bboxi, _ := lines[i][0].BBox()
+		bboxj, _ := lines[j][0].BBox()
+		return bboxi.Lly >= bboxj.Lly
+	})
+	var parts []string
+	for _, line := range lines {
+		sort.SliceStable(line, func(i, j int) bool {
+			bboxi, _ := line[i].BBox()
+			bboxj, _ := line[j].BBox()
+			return bboxi.Llx < bboxj.Llx
+		})
+		for _, word := range line {
+			parts = append(parts, strings.TrimSpace(word.String()))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// find returns the root of `i` in union-find forest `parents`.
+func find(parents []int, i int) int {
+	for parents[i] != i {
+		parents[i] = parents[parents[i]]
+		i = parents[i]
+	}
+	return i
+}
+
+// union merges the sets containing `i` and `j` in union-find forest `parents`. The root of the
+// merged set is the smaller of the two roots.
+func union(parents []int, i, j int) {
+	ri, rj := find(parents, i), find(parents, j)
+	if ri < rj {
+		parents[rj] = ri
+	} else if rj < ri {
+		parents[ri] = rj
+	}
+}
+
+// gsMatrix returns the current transformation matrix of `gs`, which maps ruling coordinates to
+// page coordinates.
+func gsMatrix(gs contentstream.GraphicsState) matrix {
+	ctm := gs.CTM
+	return matrix{ctm[0], ctm[1], ctm[3], ctm[4], ctm[6], ctm[7]}
+}
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+// identityMatrix returns the identity matrix.
+func identityMatrix() matrix {
+	return matrix{1, 0, 0, 1, 0, 0}
+}
+
+// newMatrix returns the matrix with elements `vals`.
+func newMatrix(vals []float64) matrix {
+	var m matrix
+	copy(m[:], vals)
+	return m
+}
+
+// mult returns `m` × `o`, the transform that applies `m` then `o`.
+func (m matrix) mult(o matrix) matrix {
+	return matrix{
+		m[0]*o[0] + m[1]*o[2],
+		m[0]*o[1] + m[1]*o[3],
+		m[2]*o[0] + m[3]*o[2],
+		m[2]*o[1] + m[3]*o[3],
+		m[4]*o[0] + m[5]*o[2] + o[4],
+		m[4]*o[1] + m[5]*o[3] + o[5],
+	}
+}
+
+// transform returns point (`x`, `y`) transformed by `m`.
+func (m matrix) transform(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}